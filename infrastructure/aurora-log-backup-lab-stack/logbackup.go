@@ -1,14 +1,20 @@
 package main
 
 import (
+	"fmt"
+	"regexp"
 	"strconv"
+	"strings"
 
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws"
 	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/cloudwatch"
 	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/dynamodb"
 	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/ec2"
 	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/iam"
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/kms"
 	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/lambda"
 	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/s3"
+	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/sns"
 	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/sqs"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
@@ -26,7 +32,20 @@ type LogBackupResources struct {
 	LogDetectorLambdaAlias   *lambda.Alias
 	LogDownloaderLambda      *lambda.Function
 	LogDownloaderLambdaAlias *lambda.Alias
+	ReconcilerLambda         *lambda.Function
+	ReconcilerLambdaAlias    *lambda.Alias
 	EventBridgeRule          *cloudwatch.EventRule
+	ReconcilerRule           *cloudwatch.EventRule
+	// The second log file table and its Log Downloader, nil unless secondaryTable is set
+	SecondaryDynamoDBTable            *dynamodb.Table
+	SecondaryLogDownloaderLambda      *lambda.Function
+	SecondaryLogDownloaderLambdaAlias *lambda.Alias
+	// The queue the Log Detector forwards poison messages to, nil unless poisonMessageDlq is set
+	PoisonMessageQueue *sqs.Queue
+	// The customer-managed key the backups are encrypted with, nil unless kmsEncryption is set
+	BackupKey *kms.Key
+	// The bucket in drRegion the backups are replicated to, nil unless s3Replication is set
+	ReplicaBucket *s3.Bucket
 }
 
 // createLogBackupResources creates all the resources for the log backup solution
@@ -62,15 +81,450 @@ func createLogBackupResources(ctx *pulumi.Context, networkResources *NetworkReso
 		return nil, err
 	}
 
+	// Cap the concurrent Log Downloader invocations so a burst of stream records can't throttle RDS
+	logDownloaderReservedConcurrencyStr := projectCfg.Get("logDownloaderReservedConcurrency")
+	if logDownloaderReservedConcurrencyStr == "" {
+		logDownloaderReservedConcurrencyStr = "5"
+	}
+	logDownloaderReservedConcurrency, err := strconv.Atoi(logDownloaderReservedConcurrencyStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The Reconciler settings are optional so existing stacks keep deploying without them
+	reconcilerMemoryStr := projectCfg.Get("reconcilerMemory")
+	if reconcilerMemoryStr == "" {
+		reconcilerMemoryStr = "256"
+	}
+	reconcilerMemory, err := strconv.Atoi(reconcilerMemoryStr)
+	if err != nil {
+		return nil, err
+	}
+	reconcilerTimeoutStr := projectCfg.Get("reconcilerTimeout")
+	if reconcilerTimeoutStr == "" {
+		reconcilerTimeoutStr = "300"
+	}
+	reconcilerTimeout, err := strconv.Atoi(reconcilerTimeoutStr)
+	if err != nil {
+		return nil, err
+	}
+	reconcilerSchedule := projectCfg.Get("reconcilerSchedule")
+	if reconcilerSchedule == "" {
+		reconcilerSchedule = "rate(1 day)"
+	}
+
 	// Other settings
 	eventBridgeSchedule := projectCfg.Require("eventBridgeSchedule")
 	s3LogPrefix := projectCfg.Require("s3LogPrefix")
+	s3KeyTemplate := projectCfg.Get("s3KeyTemplate") // Empty keeps the {prefix}/{instance}/{yyyy}/{MM}/{dd}/{file}.{lastWritten} layout
+
+	// Write objects under Hive-style dbinstance=/dt= prefixes for Athena (ignored when s3KeyTemplate is set)
+	partitionByDate := projectCfg.Get("partitionByDate")
+	if partitionByDate == "" {
+		partitionByDate = "false"
+	}
+	if _, err := strconv.ParseBool(partitionByDate); err != nil {
+		return nil, err
+	}
+
+	// Keep one object per log file, overwritten by every backup, instead of one per LastWritten time
+	// (ignored when s3KeyTemplate is set)
+	legacyKeys := projectCfg.Get("legacyKeys")
+	if legacyKeys == "" {
+		legacyKeys = "false"
+	}
+	if _, err := strconv.ParseBool(legacyKeys); err != nil {
+		return nil, fmt.Errorf("invalid legacyKeys %q", legacyKeys)
+	}
+
+	// Download only what was appended to a log file since its last backup, as an extra object
+	incrementalDownload := projectCfg.Get("incrementalDownload")
+	if incrementalDownload == "" {
+		incrementalDownload = "false"
+	}
+	if _, err := strconv.ParseBool(incrementalDownload); err != nil {
+		return nil, fmt.Errorf("invalid incrementalDownload %q", incrementalDownload)
+	}
+
+	// Upload every downloaded file even when its content is unchanged since the last backup
+	forceUpload := projectCfg.Get("forceUpload")
+	if forceUpload == "" {
+		forceUpload = "false"
+	}
+	if _, err := strconv.ParseBool(forceUpload); err != nil {
+		return nil, err
+	}
+
+	// Algorithm of the checksums recorded for new backups; sha256 also has S3 check the uploaded content
+	checksumAlgorithm := projectCfg.Get("checksumAlgorithm")
+	if checksumAlgorithm == "" {
+		checksumAlgorithm = "sha256"
+	}
+	if checksumAlgorithm != "md5" && checksumAlgorithm != "sha256" {
+		return nil, fmt.Errorf("invalid checksumAlgorithm %q", checksumAlgorithm)
+	}
+
+	// Seconds before the Log Downloader's deadline at which it stops requesting log file portions
+	deadlineSafetyMarginSeconds := projectCfg.Get("deadlineSafetyMarginSeconds")
+	if deadlineSafetyMarginSeconds == "" {
+		deadlineSafetyMarginSeconds = "20"
+	}
+	if _, err := strconv.Atoi(deadlineSafetyMarginSeconds); err != nil {
+		return nil, err
+	}
+
+	// Seconds a log file must go unwritten before the Log Downloader downloads it (0 downloads it right away)
+	stabilityWindowSeconds := projectCfg.Get("stabilityWindowSeconds")
+	if stabilityWindowSeconds == "" {
+		stabilityWindowSeconds = "0"
+	}
+	if seconds, err := strconv.Atoi(stabilityWindowSeconds); err != nil || seconds < 0 {
+		return nil, fmt.Errorf("invalid stabilityWindowSeconds %q", stabilityWindowSeconds)
+	}
+
+	// Fraction of its memory a log file may reach before the Log Downloader logs a warning (0 logs none)
+	memoryWarningFraction := projectCfg.Get("memoryWarningFraction")
+	if memoryWarningFraction == "" {
+		memoryWarningFraction = "0.5"
+	}
+	if fraction, err := strconv.ParseFloat(memoryWarningFraction, 64); err != nil || !(fraction >= 0 && fraction <= 1) {
+		return nil, fmt.Errorf("invalid memoryWarningFraction %q", memoryWarningFraction)
+	}
+
+	// Lines the Log Downloader requests per log file portion
+	portionLines := projectCfg.Get("portionLines")
+	if portionLines == "" {
+		portionLines = "10000"
+	}
+	if _, err := strconv.Atoi(portionLines); err != nil {
+		return nil, err
+	}
+
+	// Bytes of a log file the Log Downloader downloads per invocation before backing it up in parts (0 is no limit)
+	maxFileBytes := projectCfg.Get("maxFileBytes")
+	if maxFileBytes == "" {
+		maxFileBytes = "0"
+	}
+	if maxBytes, err := strconv.ParseInt(maxFileBytes, 10, 64); err != nil || maxBytes < 0 {
+		return nil, fmt.Errorf("invalid maxFileBytes %q", maxFileBytes)
+	}
+
+	// Attempts the Log Downloader makes per throttled log file portion
+	portionMaxAttempts := projectCfg.Get("portionMaxAttempts")
+	if portionMaxAttempts == "" {
+		portionMaxAttempts = "5"
+	}
+	if attempts, err := strconv.Atoi(portionMaxAttempts); err != nil || attempts <= 0 {
+		return nil, fmt.Errorf("invalid portionMaxAttempts %q", portionMaxAttempts)
+	}
+
+	// MiB of a log file the Log Downloader buffers per multipart upload part (5 to 5120)
+	multipartPartSizeMb := projectCfg.Get("multipartPartSizeMb")
+	if multipartPartSizeMb == "" {
+		multipartPartSizeMb = "5"
+	}
+	if size, err := strconv.Atoi(multipartPartSizeMb); err != nil || size < 5 || size > 5120 {
+		return nil, fmt.Errorf("invalid multipartPartSizeMb %q", multipartPartSizeMb)
+	}
+
+	// Download and checksum log files without writing to S3 or DynamoDB, to validate a new setup
+	dryRun := projectCfg.Get("dryRun")
+	if dryRun == "" {
+		dryRun = "false"
+	}
+	if _, err := strconv.ParseBool(dryRun); err != nil {
+		return nil, err
+	}
+
+	// RDS API calls per second of each Log Detector and Log Downloader execution environment (0 means unlimited)
+	rdsApiRps := projectCfg.Get("rdsApiRps")
+	if rdsApiRps == "" {
+		rdsApiRps = "0"
+	}
+	if _, err := strconv.ParseFloat(rdsApiRps, 64); err != nil {
+		return nil, err
+	}
+
+	// Attempts per DynamoDB call of the Log Detector and Log Downloader, retried with backoff and jitter
+	dynamodbMaxAttempts := projectCfg.Get("dynamodbMaxAttempts")
+	if dynamodbMaxAttempts == "" {
+		dynamodbMaxAttempts = "8"
+	}
+	if attempts, err := strconv.Atoi(dynamodbMaxAttempts); err != nil || attempts <= 0 {
+		return nil, fmt.Errorf("invalid dynamodbMaxAttempts %q", dynamodbMaxAttempts)
+	}
+
+	// Format audit logs are uploaded in: "raw" as downloaded, or "ndjson" or "jsonl" with one JSON object per record
+	outputFormat := projectCfg.Get("outputFormat")
+	if outputFormat == "" {
+		outputFormat = "raw"
+	}
+	if outputFormat != "raw" && outputFormat != "ndjson" && outputFormat != "jsonl" {
+		return nil, fmt.Errorf("invalid outputFormat %q", outputFormat)
+	}
+
+	// Compression of the uploaded log files: "none" or "gzip"
+	compression := projectCfg.Get("compression")
+	if compression == "" {
+		compression = "none"
+	}
+	if compression != "none" && compression != "gzip" {
+		return nil, fmt.Errorf("invalid compression %q", compression)
+	}
+
+	// Encrypt the uploaded objects with a customer-managed KMS key instead of the bucket's default encryption
+	kmsEncryptionStr := projectCfg.Get("kmsEncryption")
+	if kmsEncryptionStr == "" {
+		kmsEncryptionStr = "false"
+	}
+	kmsEncryption, err := strconv.ParseBool(kmsEncryptionStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kmsEncryption %q", kmsEncryptionStr)
+	}
 
 	lambdaBatchSize, err := strconv.Atoi(projectCfg.Require("lambdaBatchSize"))
 	if err != nil {
 		return nil, err
 	}
 
+	// Make the instance queue a FIFO queue grouped by instance ID, so no two Log Detectors process
+	// the same instance at once, at the cost of FIFO throughput limits
+	fifoQueueStr := projectCfg.Get("fifoQueue")
+	if fifoQueueStr == "" {
+		fifoQueueStr = "false"
+	}
+	fifoQueue, err := strconv.ParseBool(fifoQueueStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fifoQueue %q", fifoQueueStr)
+	}
+	if fifoQueue && lambdaBatchSize > 10 {
+		return nil, fmt.Errorf("lambdaBatchSize %d exceeds the 10 messages a FIFO queue allows", lambdaBatchSize)
+	}
+
+	// Maximum number of instances the DB Scanner enqueues per run (0 means unlimited)
+	maxEnqueuePerRun := projectCfg.Get("maxEnqueuePerRun")
+	if maxEnqueuePerRun == "" {
+		maxEnqueuePerRun = "0"
+	}
+	if _, err := strconv.Atoi(maxEnqueuePerRun); err != nil {
+		return nil, err
+	}
+
+	// Seconds over which the DB Scanner spreads the messages of a run with SQS delays (0 sends them at once)
+	scanSpreadSeconds := projectCfg.Get("scanSpreadSeconds")
+	if scanSpreadSeconds == "" {
+		scanSpreadSeconds = "0"
+	}
+	if seconds, err := strconv.Atoi(scanSpreadSeconds); err != nil || seconds < 0 {
+		return nil, fmt.Errorf("invalid scanSpreadSeconds %q", scanSpreadSeconds)
+	}
+
+	// Optional pattern of DB instance identifiers the DB Scanner never enqueues and the Reconciler skips
+	// (empty excludes none)
+	excludePattern := projectCfg.Get("excludePattern")
+	if _, err := regexp.Compile(excludePattern); err != nil {
+		return nil, fmt.Errorf("invalid excludePattern %q", excludePattern)
+	}
+
+	// Optional log file name patterns for the Log Detector (empty uses the built-in audit log patterns)
+	logNamePatterns := projectCfg.Get("logNamePatterns")
+
+	// Log file types detected and backed up: audit, error, slowquery and general
+	logTypes := projectCfg.Get("logTypes")
+	if logTypes == "" {
+		logTypes = "audit"
+	}
+	for _, logType := range strings.Split(logTypes, ",") {
+		switch strings.TrimSpace(logType) {
+		case "audit", "error", "slowquery", "general":
+		default:
+			return nil, fmt.Errorf("invalid logTypes entry %q", logType)
+		}
+	}
+
+	// Days a log file record is kept after the file was last written
+	retentionDays := projectCfg.Get("retentionDays")
+	if retentionDays == "" {
+		retentionDays = "14"
+	}
+	if _, err := strconv.Atoi(retentionDays); err != nil {
+		return nil, err
+	}
+
+	// List every log file on each Log Detector run instead of only the ones written since the watermark
+	fullRescan := projectCfg.Get("fullRescan")
+	if fullRescan == "" {
+		fullRescan = "false"
+	}
+	if _, err := strconv.ParseBool(fullRescan); err != nil {
+		return nil, err
+	}
+
+	// Minimum size and age a log file must reach before the Log Detector records it (0 records every file).
+	// The Reconciler applies them too, so it doesn't create the records the detector holds back.
+	minFileSizeBytes := projectCfg.Get("minFileSizeBytes")
+	if minFileSizeBytes == "" {
+		minFileSizeBytes = "0"
+	}
+	if _, err := strconv.ParseInt(minFileSizeBytes, 10, 64); err != nil {
+		return nil, err
+	}
+
+	minFileAgeSeconds := projectCfg.Get("minFileAgeSeconds")
+	if minFileAgeSeconds == "" {
+		minFileAgeSeconds = "0"
+	}
+	if _, err := strconv.Atoi(minFileAgeSeconds); err != nil {
+		return nil, err
+	}
+
+	// DescribeDBLogFiles page size (0 uses the RDS default) and pages the Log Detector lists per invocation
+	describeLogsMaxRecords := projectCfg.Get("describeLogsMaxRecords")
+	if describeLogsMaxRecords == "" {
+		describeLogsMaxRecords = "0"
+	}
+	if _, err := strconv.Atoi(describeLogsMaxRecords); err != nil {
+		return nil, err
+	}
+
+	maxPages := projectCfg.Get("maxPages")
+	if maxPages == "" {
+		maxPages = "100"
+	}
+	if _, err := strconv.Atoi(maxPages); err != nil {
+		return nil, err
+	}
+
+	// Number of DB instances the Log Detector processes at the same time
+	detectorConcurrency := projectCfg.Get("detectorConcurrency")
+	if detectorConcurrency == "" {
+		detectorConcurrency = "4"
+	}
+	if _, err := strconv.Atoi(detectorConcurrency); err != nil {
+		return nil, err
+	}
+
+	// Seconds during which the Log Detector skips further messages for an instance it processed (0 disables it)
+	detectionCooldownSeconds := projectCfg.Get("detectionCooldownSeconds")
+	if detectionCooldownSeconds == "" {
+		detectionCooldownSeconds = "60"
+	}
+	if _, err := strconv.Atoi(detectionCooldownSeconds); err != nil {
+		return nil, err
+	}
+
+	// Seconds before its deadline at which the Log Detector returns the unprocessed messages to the queue
+	detectorDeadlineSafetyMarginSeconds := projectCfg.Get("detectorDeadlineSafetyMarginSeconds")
+	if detectorDeadlineSafetyMarginSeconds == "" {
+		detectorDeadlineSafetyMarginSeconds = "10"
+	}
+	if _, err := strconv.Atoi(detectorDeadlineSafetyMarginSeconds); err != nil {
+		return nil, err
+	}
+
+	// Dimension the Log Detector metrics by DB instance; false only dimensions them by function,
+	// which bounds the number of CloudWatch metrics in accounts with many instances
+	metricsByInstance := projectCfg.Get("metricsByInstance")
+	if metricsByInstance == "" {
+		metricsByInstance = "true"
+	}
+	if _, err := strconv.ParseBool(metricsByInstance); err != nil {
+		return nil, err
+	}
+
+	// Create a second log file table, e.g. for staging, with its own Log Downloader. The Log Detector writes
+	// the records of SQS messages with a TableName attribute naming it there instead of the main table.
+	secondaryTableStr := projectCfg.Get("secondaryTable")
+	if secondaryTableStr == "" {
+		secondaryTableStr = "false"
+	}
+	secondaryTable, err := strconv.ParseBool(secondaryTableStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Forward SQS messages the Log Detector can never process to a dead-letter queue instead of dropping them
+	poisonMessageDlqStr := projectCfg.Get("poisonMessageDlq")
+	if poisonMessageDlqStr == "" {
+		poisonMessageDlqStr = "false"
+	}
+	poisonMessageDlq, err := strconv.ParseBool(poisonMessageDlqStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Optional role in the workload account the Lambdas assume for RDS calls (empty uses the local account)
+	assumeRoleArn := projectCfg.Get("assumeRoleArn")
+
+	// Regions scanned for Aurora instances, comma-separated (empty scans the stack's region only)
+	regions := projectCfg.Get("regions")
+	regionPattern := regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+	for _, region := range strings.Split(regions, ",") {
+		if region = strings.TrimSpace(region); region != "" && !regionPattern.MatchString(region) {
+			return nil, fmt.Errorf("invalid regions entry %q", region)
+		}
+	}
+
+	// Existing bucket in another region the Log Downloader copies every backup to (empty doesn't copy them).
+	// With drRequired, a backup that isn't copied fails and is retried.
+	drBucketName := projectCfg.Get("drBucketName")
+	drRegion := projectCfg.Get("drRegion")
+	if drBucketName != "" && !regionPattern.MatchString(drRegion) {
+		return nil, fmt.Errorf("invalid drRegion %q for drBucketName %s", drRegion, drBucketName)
+	}
+
+	// Replicate the backups with S3 replication to a bucket the stack creates in drRegion
+	s3ReplicationStr := projectCfg.Get("s3Replication")
+	if s3ReplicationStr == "" {
+		s3ReplicationStr = "false"
+	}
+	s3Replication, err := strconv.ParseBool(s3ReplicationStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3Replication %q", s3ReplicationStr)
+	}
+	if s3Replication && !regionPattern.MatchString(drRegion) {
+		return nil, fmt.Errorf("invalid drRegion %q for s3Replication", drRegion)
+	}
+	if s3Replication && kmsEncryption {
+		// Objects encrypted with a KMS key are only replicated with a key of the destination region
+		return nil, fmt.Errorf("s3Replication doesn't support kmsEncryption")
+	}
+	drRequired := projectCfg.Get("drRequired")
+	if drRequired == "" {
+		drRequired = "false"
+	}
+	if _, err := strconv.ParseBool(drRequired); err != nil {
+		return nil, fmt.Errorf("invalid drRequired %q", drRequired)
+	}
+
+	// Download the log file of a removed record that wasn't backed up one last time
+	removeFinalBackup := projectCfg.Get("removeFinalBackup")
+	if removeFinalBackup == "" {
+		removeFinalBackup = "false"
+	}
+	if _, err := strconv.ParseBool(removeFinalBackup); err != nil {
+		return nil, fmt.Errorf("invalid removeFinalBackup %q", removeFinalBackup)
+	}
+
+	// Create an SNS topic the Log Downloader notifies of failed backups, checksum mismatches and partial backups
+	snsNotificationsStr := projectCfg.Get("snsNotifications")
+	if snsNotificationsStr == "" {
+		snsNotificationsStr = "false"
+	}
+	snsNotifications, err := strconv.ParseBool(snsNotificationsStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snsNotifications %q", snsNotificationsStr)
+	}
+
+	// Also dimension the Log Downloader's metrics of every log file by DB instance, e.g. for debugging
+	downloaderMetricsByInstance := projectCfg.Get("downloaderMetricsByInstance")
+	if downloaderMetricsByInstance == "" {
+		downloaderMetricsByInstance = "false"
+	}
+	if _, err := strconv.ParseBool(downloaderMetricsByInstance); err != nil {
+		return nil, fmt.Errorf("invalid downloaderMetricsByInstance %q", downloaderMetricsByInstance)
+	}
+
 	// Get image versions from config
 	dbScannerImageVersion := projectCfg.Get("dbScannerImageVersion")
 	if dbScannerImageVersion == "" {
@@ -87,6 +541,11 @@ func createLogBackupResources(ctx *pulumi.Context, networkResources *NetworkReso
 		logDownloaderImageVersion = "latest"
 	}
 
+	reconcilerImageVersion := projectCfg.Get("reconcilerImageVersion")
+	if reconcilerImageVersion == "" {
+		reconcilerImageVersion = "latest"
+	}
+
 	// Check if we should publish Lambda versions
 	publishVersions := false
 	if publishVersionsStr := projectCfg.Get("publishLambdaVersions"); publishVersionsStr == "true" {
@@ -97,73 +556,294 @@ func createLogBackupResources(ctx *pulumi.Context, networkResources *NetworkReso
 	dbScannerRepoUrl := ecrStack.GetOutput(pulumi.String("dbScannerRepositoryUrl"))
 	logDetectorRepoUrl := ecrStack.GetOutput(pulumi.String("logDetectorRepositoryUrl"))
 	logDownloaderRepoUrl := ecrStack.GetOutput(pulumi.String("logDownloaderRepositoryUrl"))
+	reconcilerRepoUrl := ecrStack.GetOutput(pulumi.String("reconcilerRepositoryUrl"))
+
+	// Configure server-side encryption
+	bucketEncryption := &s3.BucketServerSideEncryptionConfigurationArgs{
+		Rule: &s3.BucketServerSideEncryptionConfigurationRuleArgs{
+			ApplyServerSideEncryptionByDefault: &s3.BucketServerSideEncryptionConfigurationRuleApplyServerSideEncryptionByDefaultArgs{
+				SseAlgorithm: pulumi.String("AES256"),
+			},
+		},
+	}
+
+	// Configure lifecycle rules for log retention
+	bucketLifecycleRules := s3.BucketLifecycleRuleArray{
+		&s3.BucketLifecycleRuleArgs{
+			Id:      pulumi.String("expire-old-logs"),
+			Enabled: pulumi.Bool(true),
+			Expiration: &s3.BucketLifecycleRuleExpirationArgs{
+				Days: pulumi.Int(90), // Keep logs for 90 days
+			},
+			// Expire the versions a versioned bucket keeps of overwritten backups as well
+			NoncurrentVersionExpiration: &s3.BucketLifecycleRuleNoncurrentVersionExpirationArgs{
+				Days: pulumi.Int(90),
+			},
+		},
+		&s3.BucketLifecycleRuleArgs{
+			Id:                                 pulumi.String("abort-stale-multipart-uploads"),
+			Enabled:                            pulumi.Bool(true),
+			AbortIncompleteMultipartUploadDays: pulumi.Int(7), // Clean up downloads that were never resumed
+		},
+	}
 
 	// Create S3 bucket for log backups
-	logBucket, err := s3.NewBucket(ctx, "aurora-log-backup-bucket", &s3.BucketArgs{
+	logBucketArgs := &s3.BucketArgs{
 		Acl: pulumi.String("private"),
 		Tags: pulumi.StringMap{
 			"Name": pulumi.String("aurora-log-backup"),
 		},
-		// Configure server-side encryption
-		ServerSideEncryptionConfiguration: &s3.BucketServerSideEncryptionConfigurationArgs{
-			Rule: &s3.BucketServerSideEncryptionConfigurationRuleArgs{
-				ApplyServerSideEncryptionByDefault: &s3.BucketServerSideEncryptionConfigurationRuleApplyServerSideEncryptionByDefaultArgs{
-					SseAlgorithm: pulumi.String("AES256"),
-				},
-			},
-		},
-		// Configure lifecycle rules for log retention
-		LifecycleRules: s3.BucketLifecycleRuleArray{
-			&s3.BucketLifecycleRuleArgs{
-				Id:      pulumi.String("expire-old-logs"),
-				Enabled: pulumi.Bool(true),
-				Expiration: &s3.BucketLifecycleRuleExpirationArgs{
-					Days: pulumi.Int(90), // Keep logs for 90 days
-				},
-			},
+		ServerSideEncryptionConfiguration: bucketEncryption,
+		LifecycleRules:                    bucketLifecycleRules,
+	}
+	if s3Replication {
+		// Replication requires versioning on both buckets
+		logBucketArgs.Versioning = &s3.BucketVersioningArgs{
+			Enabled: pulumi.Bool(true),
+		}
+	}
+	logBucket, err := s3.NewBucket(ctx, "aurora-log-backup-bucket", logBucketArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Disable ACLs so every object belongs to the bucket owner, whoever uploads it
+	_, err = s3.NewBucketOwnershipControls(ctx, "aurora-log-backup-bucket-ownership", &s3.BucketOwnershipControlsArgs{
+		Bucket: logBucket.ID(),
+		Rule: &s3.BucketOwnershipControlsRuleArgs{
+			ObjectOwnership: pulumi.String("BucketOwnerEnforced"),
 		},
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	// Create DynamoDB table for tracking log files
-	dynamoTable, err := dynamodb.NewTable(ctx, "aurora-log-files", &dynamodb.TableArgs{
-		Attributes: dynamodb.TableAttributeArray{
-			&dynamodb.TableAttributeArgs{
-				Name: pulumi.String("DBInstanceIdentifier"),
-				Type: pulumi.String("S"),
+	// Replicate the log prefix of the bucket to a bucket in drRegion
+	var replicaBucket *s3.Bucket
+	if s3Replication {
+		drProvider, err := aws.NewProvider(ctx, "aurora-log-backup-dr-provider", &aws.ProviderArgs{
+			Region: pulumi.String(drRegion),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		replicaBucket, err = s3.NewBucket(ctx, "aurora-log-backup-replica-bucket", &s3.BucketArgs{
+			Acl: pulumi.String("private"),
+			Tags: pulumi.StringMap{
+				"Name": pulumi.String("aurora-log-backup-replica"),
 			},
-			&dynamodb.TableAttributeArgs{
-				Name: pulumi.String("LogFileName"),
-				Type: pulumi.String("S"),
+			ServerSideEncryptionConfiguration: bucketEncryption,
+			LifecycleRules:                    bucketLifecycleRules,
+			Versioning: &s3.BucketVersioningArgs{
+				Enabled: pulumi.Bool(true),
 			},
-		},
-		HashKey:        pulumi.String("DBInstanceIdentifier"),
-		RangeKey:       pulumi.String("LogFileName"),
-		BillingMode:    pulumi.String("PAY_PER_REQUEST"),
-		StreamEnabled:  pulumi.Bool(true),
-		StreamViewType: pulumi.String("NEW_AND_OLD_IMAGES"),
-		Tags: pulumi.StringMap{
-			"Name": pulumi.String("aurora-log-files"),
-		},
-	})
+		}, pulumi.Provider(drProvider))
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = s3.NewBucketOwnershipControls(ctx, "aurora-log-backup-replica-bucket-ownership", &s3.BucketOwnershipControlsArgs{
+			Bucket: replicaBucket.ID(),
+			Rule: &s3.BucketOwnershipControlsRuleArgs{
+				ObjectOwnership: pulumi.String("BucketOwnerEnforced"),
+			},
+		}, pulumi.Provider(drProvider))
+		if err != nil {
+			return nil, err
+		}
+
+		replicationRole, err := iam.NewRole(ctx, "aurora-log-backup-replication-role", &iam.RoleArgs{
+			AssumeRolePolicy: pulumi.String(`{
+				"Version": "2012-10-17",
+				"Statement": [{
+					"Action": "sts:AssumeRole",
+					"Principal": {
+						"Service": "s3.amazonaws.com"
+					},
+					"Effect": "Allow",
+					"Sid": ""
+				}]
+			}`),
+			Tags: pulumi.StringMap{
+				"Name": pulumi.String("aurora-log-backup-replication-role"),
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		replicationPolicy, err := iam.NewPolicy(ctx, "aurora-log-backup-replication-policy", &iam.PolicyArgs{
+			Description: pulumi.String("Policy for S3 to replicate the Aurora log backups to the replica bucket"),
+			Policy: pulumi.All(logBucket.Arn, replicaBucket.Arn).ApplyT(func(args []interface{}) string {
+				bucketArn := args[0].(string)
+				replicaArn := args[1].(string)
+				return `{
+				"Version": "2012-10-17",
+				"Statement": [
+					{
+						"Effect": "Allow",
+						"Action": [
+							"s3:GetReplicationConfiguration",
+							"s3:ListBucket"
+						],
+						"Resource": "` + bucketArn + `"
+					},
+					{
+						"Effect": "Allow",
+						"Action": [
+							"s3:GetObjectVersionForReplication",
+							"s3:GetObjectVersionAcl",
+							"s3:GetObjectVersionTagging"
+						],
+						"Resource": "` + bucketArn + `/*"
+					},
+					{
+						"Effect": "Allow",
+						"Action": [
+							"s3:ReplicateObject",
+							"s3:ReplicateDelete",
+							"s3:ReplicateTags"
+						],
+						"Resource": "` + replicaArn + `/*"
+					}
+				]
+			}`
+			}).(pulumi.StringOutput),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		replicationPolicyAttachment, err := iam.NewRolePolicyAttachment(ctx, "replication-policy", &iam.RolePolicyAttachmentArgs{
+			Role:      replicationRole.Name,
+			PolicyArn: replicationPolicy.Arn,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// Deletes, including the delete markers of lifecycle expiration, aren't replicated, so the replica
+		// expires its copies by its own lifecycle rules
+		_, err = s3.NewBucketReplicationConfig(ctx, "aurora-log-backup-replication", &s3.BucketReplicationConfigArgs{
+			Bucket: logBucket.ID(),
+			Role:   replicationRole.Arn,
+			Rules: s3.BucketReplicationConfigRuleArray{
+				&s3.BucketReplicationConfigRuleArgs{
+					Id:     pulumi.String("replicate-logs"),
+					Status: pulumi.String("Enabled"),
+					Filter: &s3.BucketReplicationConfigRuleFilterArgs{
+						Prefix: pulumi.String(s3LogPrefix + "/"),
+					},
+					DeleteMarkerReplication: &s3.BucketReplicationConfigRuleDeleteMarkerReplicationArgs{
+						Status: pulumi.String("Disabled"),
+					},
+					Destination: &s3.BucketReplicationConfigRuleDestinationArgs{
+						Bucket: replicaBucket.Arn,
+					},
+				},
+			},
+		}, pulumi.DependsOn([]pulumi.Resource{replicationPolicyAttachment}))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// newLogFilesTable creates a DynamoDB table for tracking log files
+	newLogFilesTable := func(name string) (*dynamodb.Table, error) {
+		return dynamodb.NewTable(ctx, name, &dynamodb.TableArgs{
+			Attributes: dynamodb.TableAttributeArray{
+				&dynamodb.TableAttributeArgs{
+					Name: pulumi.String("DBInstanceIdentifier"),
+					Type: pulumi.String("S"),
+				},
+				&dynamodb.TableAttributeArgs{
+					Name: pulumi.String("LogFileName"),
+					Type: pulumi.String("S"),
+				},
+				&dynamodb.TableAttributeArgs{
+					Name: pulumi.String("Status"),
+					Type: pulumi.String("S"),
+				},
+				&dynamodb.TableAttributeArgs{
+					Name: pulumi.String("LastWritten"),
+					Type: pulumi.String("N"),
+				},
+			},
+			HashKey:  pulumi.String("DBInstanceIdentifier"),
+			RangeKey: pulumi.String("LogFileName"),
+			// Index the records by download status to query the backlog without scanning the table
+			GlobalSecondaryIndexes: dynamodb.TableGlobalSecondaryIndexArray{
+				&dynamodb.TableGlobalSecondaryIndexArgs{
+					Name:             pulumi.String("StatusIndex"),
+					HashKey:          pulumi.String("Status"),
+					RangeKey:         pulumi.String("LastWritten"),
+					ProjectionType:   pulumi.String("INCLUDE"),
+					NonKeyAttributes: pulumi.StringArray{pulumi.String("Size")},
+				},
+			},
+			BillingMode:    pulumi.String("PAY_PER_REQUEST"),
+			StreamEnabled:  pulumi.Bool(true),
+			StreamViewType: pulumi.String("NEW_AND_OLD_IMAGES"),
+			// Records expire RETENTION_DAYS after their log file was last written
+			Ttl: &dynamodb.TableTtlArgs{
+				AttributeName: pulumi.String("ExpiresAt"),
+				Enabled:       pulumi.Bool(true),
+			},
+			Tags: pulumi.StringMap{
+				"Name": pulumi.String(name),
+			},
+		})
+	}
+
+	// Create DynamoDB table for tracking log files
+	dynamoTable, err := newLogFilesTable("aurora-log-files")
 	if err != nil {
 		return nil, err
 	}
 
+	var secondaryDynamoTable *dynamodb.Table
+	if secondaryTable {
+		secondaryDynamoTable, err = newLogFilesTable("aurora-log-files-secondary")
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Create SQS queue for DB instance IDs
-	queue, err := sqs.NewQueue(ctx, "aurora-db-instances", &sqs.QueueArgs{
+	queueArgs := &sqs.QueueArgs{
 		VisibilityTimeoutSeconds: pulumi.Int(300),   // 5 minutes
 		MessageRetentionSeconds:  pulumi.Int(86400), // 24 hours
 		Tags: pulumi.StringMap{
 			"Name": pulumi.String("aurora-db-instances"),
 		},
-	})
+	}
+	if fifoQueue {
+		// A FIFO queue's name must end in .fifo, which is how the DB Scanner recognizes it
+		queueArgs.Name = pulumi.String("aurora-db-instances.fifo")
+		queueArgs.FifoQueue = pulumi.Bool(true)
+		// Drops the same instance queued again within 5 minutes
+		queueArgs.ContentBasedDeduplication = pulumi.Bool(true)
+	}
+	queue, err := sqs.NewQueue(ctx, "aurora-db-instances", queueArgs)
 	if err != nil {
 		return nil, err
 	}
 
+	// Create the dead-letter queue for poison messages, kept for the 14 days SQS allows at most
+	var poisonQueue *sqs.Queue
+	if poisonMessageDlq {
+		poisonQueue, err = sqs.NewQueue(ctx, "aurora-db-instances-poison", &sqs.QueueArgs{
+			MessageRetentionSeconds: pulumi.Int(1209600), // 14 days
+			Tags: pulumi.StringMap{
+				"Name": pulumi.String("aurora-db-instances-poison"),
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Create IAM role for Lambda functions
 	lambdaRole, err := iam.NewRole(ctx, "aurora-log-backup-lambda-role", &iam.RoleArgs{
 		AssumeRolePolicy: pulumi.String(`{
@@ -194,16 +874,23 @@ func createLogBackupResources(ctx *pulumi.Context, networkResources *NetworkReso
 		return nil, err
 	}
 
-	// Create custom policy for Lambda functions
+	// Create custom policy for Lambda functions, scoped to the resources of this stack.
+	// RDS and the VPC network interfaces are not scoped because the instances and ENIs aren't known in advance.
 	lambdaPolicy, err := iam.NewPolicy(ctx, "aurora-log-backup-lambda-policy", &iam.PolicyArgs{
 		Description: pulumi.String("Policy for Aurora log backup Lambda functions"),
-		Policy: pulumi.String(`{
+		Policy: pulumi.All(dynamoTable.Arn, dynamoTable.StreamArn, queue.Arn, logBucket.Arn).ApplyT(func(args []interface{}) string {
+			tableArn := args[0].(string)
+			streamArn := args[1].(string)
+			queueArn := args[2].(string)
+			bucketArn := args[3].(string)
+			return `{
 			"Version": "2012-10-17",
 			"Statement": [
 				{
 					"Effect": "Allow",
 					"Action": [
 						"rds:DescribeDBInstances",
+						"rds:DescribeDBClusters",
 						"rds:DescribeDBLogFiles",
 						"rds:DownloadDBLogFilePortion"
 					],
@@ -213,16 +900,30 @@ func createLogBackupResources(ctx *pulumi.Context, networkResources *NetworkReso
 					"Effect": "Allow",
 					"Action": [
 						"dynamodb:GetItem",
+						"dynamodb:BatchGetItem",
 						"dynamodb:PutItem",
 						"dynamodb:UpdateItem",
+						"dynamodb:DeleteItem",
 						"dynamodb:Query",
-						"dynamodb:Scan",
+						"dynamodb:Scan"
+					],
+					"Resource": [
+						"` + tableArn + `",
+						"` + tableArn + `/index/*"
+					]
+				},
+				{
+					"Effect": "Allow",
+					"Action": [
 						"dynamodb:GetRecords",
 						"dynamodb:GetShardIterator",
 						"dynamodb:DescribeStream",
 						"dynamodb:ListStreams"
 					],
-					"Resource": "*"
+					"Resource": [
+						"` + streamArn + `",
+						"` + tableArn + `/stream/*"
+					]
 				},
 				{
 					"Effect": "Allow",
@@ -232,18 +933,22 @@ func createLogBackupResources(ctx *pulumi.Context, networkResources *NetworkReso
 						"sqs:DeleteMessage",
 						"sqs:GetQueueAttributes"
 					],
-					"Resource": "*"
+					"Resource": "` + queueArn + `"
+				},
+				{
+					"Effect": "Allow",
+					"Action": "s3:ListBucket",
+					"Resource": "` + bucketArn + `"
 				},
 				{
 					"Effect": "Allow",
 					"Action": [
 						"s3:PutObject",
 						"s3:GetObject",
-						"s3:ListBucket"
+						"s3:ListMultipartUploadParts",
+						"s3:AbortMultipartUpload"
 					],
-					"Resource": [
-						"*"
-					]
+					"Resource": "` + bucketArn + `/*"
 				},
 				{
 					"Effect": "Allow",
@@ -260,7 +965,8 @@ func createLogBackupResources(ctx *pulumi.Context, networkResources *NetworkReso
 					"Resource": "*"
 				}
 			]
-		}`),
+		}`
+		}).(pulumi.StringOutput),
 	})
 	if err != nil {
 		return nil, err
@@ -275,6 +981,253 @@ func createLogBackupResources(ctx *pulumi.Context, networkResources *NetworkReso
 		return nil, err
 	}
 
+	// Grant access to the second table and its stream
+	if secondaryDynamoTable != nil {
+		secondaryTablePolicy, err := iam.NewPolicy(ctx, "aurora-log-backup-secondary-table-policy", &iam.PolicyArgs{
+			Description: pulumi.String("Policy for Aurora log backup Lambda functions to use the second log file table"),
+			Policy: pulumi.All(secondaryDynamoTable.Arn, secondaryDynamoTable.StreamArn).ApplyT(func(args []interface{}) string {
+				tableArn := args[0].(string)
+				streamArn := args[1].(string)
+				return `{
+				"Version": "2012-10-17",
+				"Statement": [
+					{
+						"Effect": "Allow",
+						"Action": [
+							"dynamodb:GetItem",
+							"dynamodb:BatchGetItem",
+							"dynamodb:PutItem",
+							"dynamodb:UpdateItem",
+							"dynamodb:DeleteItem",
+							"dynamodb:Query",
+							"dynamodb:Scan"
+						],
+						"Resource": [
+							"` + tableArn + `",
+							"` + tableArn + `/index/*"
+						]
+					},
+					{
+						"Effect": "Allow",
+						"Action": [
+							"dynamodb:GetRecords",
+							"dynamodb:GetShardIterator",
+							"dynamodb:DescribeStream",
+							"dynamodb:ListStreams"
+						],
+						"Resource": [
+							"` + streamArn + `",
+							"` + tableArn + `/stream/*"
+						]
+					}
+				]
+			}`
+			}).(pulumi.StringOutput),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = iam.NewRolePolicyAttachment(ctx, "lambda-secondary-table-policy", &iam.RolePolicyAttachmentArgs{
+			Role:      lambdaRole.Name,
+			PolicyArn: secondaryTablePolicy.Arn,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Allow the Log Downloader to copy backups, including a given version of them, to the DR bucket
+	if drBucketName != "" {
+		drBucketPolicy, err := iam.NewPolicy(ctx, "aurora-log-backup-dr-bucket-policy", &iam.PolicyArgs{
+			Description: pulumi.String("Policy for the Aurora Log Downloader to copy backups to the DR bucket"),
+			Policy: logBucket.Arn.ApplyT(func(bucketArn string) string {
+				return `{
+				"Version": "2012-10-17",
+				"Statement": [
+					{
+						"Effect": "Allow",
+						"Action": "s3:GetObjectVersion",
+						"Resource": "` + bucketArn + `/*"
+					},
+					{
+						"Effect": "Allow",
+						"Action": "s3:PutObject",
+						"Resource": "arn:aws:s3:::` + drBucketName + `/*"
+					}
+				]
+			}`
+			}).(pulumi.StringOutput),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = iam.NewRolePolicyAttachment(ctx, "lambda-dr-bucket-policy", &iam.RolePolicyAttachmentArgs{
+			Role:      lambdaRole.Name,
+			PolicyArn: drBucketPolicy.Arn,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Allow the Log Detector to forward poison messages
+	if poisonQueue != nil {
+		poisonQueuePolicy, err := iam.NewPolicy(ctx, "aurora-log-backup-poison-queue-policy", &iam.PolicyArgs{
+			Description: pulumi.String("Policy for the Aurora Log Detector to forward poison messages"),
+			Policy: poisonQueue.Arn.ApplyT(func(queueArn string) string {
+				return `{
+				"Version": "2012-10-17",
+				"Statement": [
+					{
+						"Effect": "Allow",
+						"Action": "sqs:SendMessage",
+						"Resource": "` + queueArn + `"
+					}
+				]
+			}`
+			}).(pulumi.StringOutput),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = iam.NewRolePolicyAttachment(ctx, "lambda-poison-queue-policy", &iam.RolePolicyAttachmentArgs{
+			Role:      lambdaRole.Name,
+			PolicyArn: poisonQueuePolicy.Arn,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Create the KMS key the Log Downloader encrypts the backups with. The key policy leaves the key's
+	// administration to IAM in this account and lets the Lambda role encrypt and decrypt with it.
+	var backupKey *kms.Key
+	s3Sse := ""
+	var kmsKeyArn pulumi.StringInput = pulumi.String("")
+	if kmsEncryption {
+		callerIdentity, err := aws.GetCallerIdentity(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		backupKey, err = kms.NewKey(ctx, "aurora-log-backup-key", &kms.KeyArgs{
+			Description:       pulumi.String("Encrypts the Aurora log backups"),
+			EnableKeyRotation: pulumi.Bool(true),
+			Policy: lambdaRole.Arn.ApplyT(func(roleArn string) string {
+				return `{
+				"Version": "2012-10-17",
+				"Statement": [
+					{
+						"Sid": "EnableIAMPolicies",
+						"Effect": "Allow",
+						"Principal": {"AWS": "arn:aws:iam::` + callerIdentity.AccountId + `:root"},
+						"Action": "kms:*",
+						"Resource": "*"
+					},
+					{
+						"Sid": "AllowLambdaBackups",
+						"Effect": "Allow",
+						"Principal": {"AWS": "` + roleArn + `"},
+						"Action": [
+							"kms:GenerateDataKey",
+							"kms:Decrypt"
+						],
+						"Resource": "*"
+					}
+				]
+			}`
+			}).(pulumi.StringOutput),
+			Tags: pulumi.StringMap{
+				"Name": pulumi.String("aurora-log-backup"),
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = kms.NewAlias(ctx, "aurora-log-backup-key-alias", &kms.AliasArgs{
+			Name:        pulumi.String("alias/aurora-log-backup"),
+			TargetKeyId: backupKey.KeyId,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// Uploads need GenerateDataKey; multipart uploads also Decrypt the data key of every part
+		_, err = iam.NewRolePolicy(ctx, "aurora-log-backup-kms-policy", &iam.RolePolicyArgs{
+			Role: lambdaRole.Name,
+			Policy: pulumi.Sprintf(`{
+				"Version": "2012-10-17",
+				"Statement": [{
+					"Effect": "Allow",
+					"Action": [
+						"kms:GenerateDataKey",
+						"kms:Decrypt"
+					],
+					"Resource": "%s"
+				}]
+			}`, backupKey.Arn),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		s3Sse = "aws:kms"
+		kmsKeyArn = backupKey.Arn
+	}
+
+	// Allow the Lambda functions to assume the cross-account RDS role
+	if assumeRoleArn != "" {
+		_, err = iam.NewRolePolicy(ctx, "aurora-log-backup-assume-role-policy", &iam.RolePolicyArgs{
+			Role: lambdaRole.Name,
+			Policy: pulumi.Sprintf(`{
+				"Version": "2012-10-17",
+				"Statement": [{
+					"Effect": "Allow",
+					"Action": "sts:AssumeRole",
+					"Resource": "%s"
+				}]
+			}`, assumeRoleArn),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Create the notification topic and allow the Lambda functions to publish to it
+	var notificationTopic *sns.Topic
+	var snsTopicArn pulumi.StringInput = pulumi.String("")
+	if snsNotifications {
+		notificationTopic, err = sns.NewTopic(ctx, "aurora-log-backup-notifications", &sns.TopicArgs{
+			Tags: pulumi.StringMap{
+				"Name": pulumi.String("aurora-log-backup-notifications"),
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = iam.NewRolePolicy(ctx, "aurora-log-backup-sns-policy", &iam.RolePolicyArgs{
+			Role: lambdaRole.Name,
+			Policy: pulumi.Sprintf(`{
+				"Version": "2012-10-17",
+				"Statement": [{
+					"Effect": "Allow",
+					"Action": "sns:Publish",
+					"Resource": "%s"
+				}]
+			}`, notificationTopic.Arn),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		snsTopicArn = notificationTopic.Arn
+	}
+
 	// Create security group for Lambda functions
 	lambdaSecurityGroup, err := ec2.NewSecurityGroup(ctx, "lambda-sg", &ec2.SecurityGroupArgs{
 		VpcId:       networkResources.Vpc.ID(),
@@ -319,7 +1272,13 @@ func createLogBackupResources(ctx *pulumi.Context, networkResources *NetworkReso
 		},
 		Environment: &lambda.FunctionEnvironmentArgs{
 			Variables: pulumi.StringMap{
-				"SQS_QUEUE_URL": queue.Url,
+				"SQS_QUEUE_URL":       queue.Url,
+				"DYNAMODB_TABLE_NAME": dynamoTable.Name,
+				"MAX_ENQUEUE_PER_RUN": pulumi.String(maxEnqueuePerRun),
+				"SCAN_SPREAD_SECONDS": pulumi.String(scanSpreadSeconds),
+				"EXCLUDE_PATTERN":     pulumi.String(excludePattern),
+				"ASSUME_ROLE_ARN":     pulumi.String(assumeRoleArn),
+				"REGIONS":             pulumi.String(regions),
 			},
 		},
 		Tags: pulumi.StringMap{
@@ -341,6 +1300,18 @@ func createLogBackupResources(ctx *pulumi.Context, networkResources *NetworkReso
 		return nil, err
 	}
 
+	// Queue the Log Detector forwards poison messages to (empty acknowledges them)
+	var dlqURL pulumi.StringInput = pulumi.String("")
+	if poisonQueue != nil {
+		dlqURL = poisonQueue.Url
+	}
+
+	// Tables SQS messages may route the Log Detector's records to
+	var allowedTables pulumi.StringInput = pulumi.String("")
+	if secondaryDynamoTable != nil {
+		allowedTables = secondaryDynamoTable.Name
+	}
+
 	// Create Log Detector Lambda function with container image
 	logDetectorLambda, err := lambda.NewFunction(ctx, "aurora-log-detector", &lambda.FunctionArgs{
 		PackageType: pulumi.String("Image"),
@@ -364,7 +1335,25 @@ func createLogBackupResources(ctx *pulumi.Context, networkResources *NetworkReso
 		},
 		Environment: &lambda.FunctionEnvironmentArgs{
 			Variables: pulumi.StringMap{
-				"DYNAMODB_TABLE_NAME": dynamoTable.Name,
+				"DYNAMODB_TABLE_NAME":            dynamoTable.Name,
+				"LOG_NAME_PATTERNS":              pulumi.String(logNamePatterns),
+				"LOG_TYPES":                      pulumi.String(logTypes),
+				"RETENTION_DAYS":                 pulumi.String(retentionDays),
+				"FULL_RESCAN":                    pulumi.String(fullRescan),
+				"MIN_FILE_SIZE_BYTES":            pulumi.String(minFileSizeBytes),
+				"MIN_FILE_AGE_SECONDS":           pulumi.String(minFileAgeSeconds),
+				"DESCRIBE_LOGS_MAX_RECORDS":      pulumi.String(describeLogsMaxRecords),
+				"MAX_PAGES":                      pulumi.String(maxPages),
+				"DETECTOR_CONCURRENCY":           pulumi.String(detectorConcurrency),
+				"DETECTION_COOLDOWN_SECONDS":     pulumi.String(detectionCooldownSeconds),
+				"DEADLINE_SAFETY_MARGIN_SECONDS": pulumi.String(detectorDeadlineSafetyMarginSeconds),
+				"METRICS_BY_INSTANCE":            pulumi.String(metricsByInstance),
+				"ALLOWED_TABLES":                 allowedTables,
+				"DLQ_URL":                        dlqURL,
+				"RDS_API_RPS":                    pulumi.String(rdsApiRps),
+				"DYNAMODB_MAX_ATTEMPTS":          pulumi.String(dynamodbMaxAttempts),
+				"ASSUME_ROLE_ARN":                pulumi.String(assumeRoleArn),
+				"REGIONS":                        pulumi.String(regions),
 			},
 		},
 		Tags: pulumi.StringMap{
@@ -386,15 +1375,111 @@ func createLogBackupResources(ctx *pulumi.Context, networkResources *NetworkReso
 		return nil, err
 	}
 
-	// Create Log Downloader Lambda function with container image
-	logDownloaderLambda, err := lambda.NewFunction(ctx, "aurora-log-downloader", &lambda.FunctionArgs{
+	// newLogDownloader creates a Log Downloader Lambda function with container image, and its alias,
+	// backing up the log files recorded in the table
+	newLogDownloader := func(name string, table *dynamodb.Table) (*lambda.Function, *lambda.Alias, error) {
+		function, err := lambda.NewFunction(ctx, name, &lambda.FunctionArgs{
+			PackageType: pulumi.String("Image"),
+			ImageUri:    pulumi.Sprintf("%s:%s", logDownloaderRepoUrl, logDownloaderImageVersion),
+			Role:        lambdaRole.Arn,
+			MemorySize:  pulumi.Int(logDownloaderMemory),
+			Timeout:     pulumi.Int(logDownloaderTimeout),
+			Publish:     pulumi.Bool(publishVersions),
+			// Limits the parallel DownloadDBLogFilePortion load on the account
+			ReservedConcurrentExecutions: pulumi.Int(logDownloaderReservedConcurrency),
+			Description:                  pulumi.Sprintf("Aurora Log Downloader Lambda - Version %s", logDownloaderImageVersion),
+			Architectures: pulumi.StringArray{
+				pulumi.String("arm64"),
+			},
+			VpcConfig: &lambda.FunctionVpcConfigArgs{
+				SubnetIds: pulumi.StringArray{
+					networkResources.PrivateSubnet1.ID(),
+					networkResources.PrivateSubnet2.ID(),
+				},
+				SecurityGroupIds: pulumi.StringArray{
+					lambdaSecurityGroup.ID(),
+				},
+			},
+			Environment: &lambda.FunctionEnvironmentArgs{
+				Variables: pulumi.StringMap{
+					"DYNAMODB_TABLE_NAME":            table.Name,
+					"S3_BUCKET_NAME":                 logBucket.ID(),
+					"S3_PREFIX":                      pulumi.String(s3LogPrefix),
+					"LOG_TYPES":                      pulumi.String(logTypes),
+					"S3_KEY_TEMPLATE":                pulumi.String(s3KeyTemplate),
+					"PARTITION_BY_DATE":              pulumi.String(partitionByDate),
+					"LEGACY_KEYS":                    pulumi.String(legacyKeys),
+					"INCREMENTAL_DOWNLOAD":           pulumi.String(incrementalDownload),
+					"FORCE_UPLOAD":                   pulumi.String(forceUpload),
+					"CHECKSUM_ALGO":                  pulumi.String(checksumAlgorithm),
+					"DEADLINE_SAFETY_MARGIN_SECONDS": pulumi.String(deadlineSafetyMarginSeconds),
+					"STABILITY_WINDOW_SECONDS":       pulumi.String(stabilityWindowSeconds),
+					"MEMORY_WARNING_FRACTION":        pulumi.String(memoryWarningFraction),
+					"PORTION_LINES":                  pulumi.String(portionLines),
+					"MAX_FILE_BYTES":                 pulumi.String(maxFileBytes),
+					"PORTION_MAX_ATTEMPTS":           pulumi.String(portionMaxAttempts),
+					"MULTIPART_PART_SIZE_MB":         pulumi.String(multipartPartSizeMb),
+					"DRY_RUN":                        pulumi.String(dryRun),
+					"OUTPUT_FORMAT":                  pulumi.String(outputFormat),
+					"COMPRESSION":                    pulumi.String(compression),
+					"S3_SSE":                         pulumi.String(s3Sse),
+					"KMS_KEY_ARN":                    kmsKeyArn,
+					"RDS_API_RPS":                    pulumi.String(rdsApiRps),
+					"DYNAMODB_MAX_ATTEMPTS":          pulumi.String(dynamodbMaxAttempts),
+					"ASSUME_ROLE_ARN":                pulumi.String(assumeRoleArn),
+					"REGIONS":                        pulumi.String(regions),
+					"DR_BUCKET_NAME":                 pulumi.String(drBucketName),
+					"DR_REGION":                      pulumi.String(drRegion),
+					"DR_REQUIRED":                    pulumi.String(drRequired),
+					"REMOVE_FINAL_BACKUP":            pulumi.String(removeFinalBackup),
+					"SNS_TOPIC_ARN":                  snsTopicArn,
+					"METRICS_BY_INSTANCE":            pulumi.String(downloaderMetricsByInstance),
+				},
+			},
+			Tags: pulumi.StringMap{
+				"Name": pulumi.String(name),
+			},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Create an alias for the Log Downloader Lambda
+		alias, err := lambda.NewAlias(ctx, name+"-alias", &lambda.AliasArgs{
+			FunctionName:    function.Name,
+			FunctionVersion: pulumi.String("$LATEST"), // Use $LATEST or a specific version
+			Name:            pulumi.String("live"),
+			Description:     pulumi.String("Production alias for Aurora Log Downloader Lambda"),
+		}, pulumi.DependsOn([]pulumi.Resource{function}))
+		if err != nil {
+			return nil, nil, err
+		}
+		return function, alias, nil
+	}
+
+	logDownloaderLambda, logDownloaderAlias, err := newLogDownloader("aurora-log-downloader", dynamoTable)
+	if err != nil {
+		return nil, err
+	}
+
+	var secondaryLogDownloaderLambda *lambda.Function
+	var secondaryLogDownloaderAlias *lambda.Alias
+	if secondaryDynamoTable != nil {
+		secondaryLogDownloaderLambda, secondaryLogDownloaderAlias, err = newLogDownloader("aurora-log-downloader-secondary", secondaryDynamoTable)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Create Reconciler Lambda function with container image
+	reconcilerLambda, err := lambda.NewFunction(ctx, "aurora-log-reconciler", &lambda.FunctionArgs{
 		PackageType: pulumi.String("Image"),
-		ImageUri:    pulumi.Sprintf("%s:%s", logDownloaderRepoUrl, logDownloaderImageVersion),
+		ImageUri:    pulumi.Sprintf("%s:%s", reconcilerRepoUrl, reconcilerImageVersion),
 		Role:        lambdaRole.Arn,
-		MemorySize:  pulumi.Int(logDownloaderMemory),
-		Timeout:     pulumi.Int(logDownloaderTimeout),
+		MemorySize:  pulumi.Int(reconcilerMemory),
+		Timeout:     pulumi.Int(reconcilerTimeout),
 		Publish:     pulumi.Bool(publishVersions),
-		Description: pulumi.Sprintf("Aurora Log Downloader Lambda - Version %s", logDownloaderImageVersion),
+		Description: pulumi.Sprintf("Aurora Log Reconciler Lambda - Version %s", reconcilerImageVersion),
 		Architectures: pulumi.StringArray{
 			pulumi.String("arm64"),
 		},
@@ -409,26 +1494,31 @@ func createLogBackupResources(ctx *pulumi.Context, networkResources *NetworkReso
 		},
 		Environment: &lambda.FunctionEnvironmentArgs{
 			Variables: pulumi.StringMap{
-				"DYNAMODB_TABLE_NAME": dynamoTable.Name,
-				"S3_BUCKET_NAME":      logBucket.ID(),
-				"S3_PREFIX":           pulumi.String(s3LogPrefix),
+				"DYNAMODB_TABLE_NAME":  dynamoTable.Name,
+				"LOG_NAME_PATTERNS":    pulumi.String(logNamePatterns),
+				"LOG_TYPES":            pulumi.String(logTypes),
+				"RETENTION_DAYS":       pulumi.String(retentionDays),
+				"MIN_FILE_SIZE_BYTES":  pulumi.String(minFileSizeBytes),
+				"MIN_FILE_AGE_SECONDS": pulumi.String(minFileAgeSeconds),
+				"EXCLUDE_PATTERN":      pulumi.String(excludePattern),
+				"ASSUME_ROLE_ARN":      pulumi.String(assumeRoleArn),
 			},
 		},
 		Tags: pulumi.StringMap{
-			"Name": pulumi.String("aurora-log-downloader"),
+			"Name": pulumi.String("aurora-log-reconciler"),
 		},
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	// Create an alias for the Log Downloader Lambda
-	logDownloaderAlias, err := lambda.NewAlias(ctx, "aurora-log-downloader-alias", &lambda.AliasArgs{
-		FunctionName:    logDownloaderLambda.Name,
+	// Create an alias for the Reconciler Lambda
+	reconcilerAlias, err := lambda.NewAlias(ctx, "aurora-log-reconciler-alias", &lambda.AliasArgs{
+		FunctionName:    reconcilerLambda.Name,
 		FunctionVersion: pulumi.String("$LATEST"), // Use $LATEST or a specific version
 		Name:            pulumi.String("live"),
-		Description:     pulumi.String("Production alias for Aurora Log Downloader Lambda"),
-	}, pulumi.DependsOn([]pulumi.Resource{logDownloaderLambda}))
+		Description:     pulumi.String("Production alias for Aurora Log Reconciler Lambda"),
+	}, pulumi.DependsOn([]pulumi.Resource{reconcilerLambda}))
 	if err != nil {
 		return nil, err
 	}
@@ -466,11 +1556,46 @@ func createLogBackupResources(ctx *pulumi.Context, networkResources *NetworkReso
 		return nil, err
 	}
 
+	// Create EventBridge rule to trigger Reconciler Lambda
+	reconcilerRule, err := cloudwatch.NewEventRule(ctx, "aurora-log-reconciler-schedule", &cloudwatch.EventRuleArgs{
+		ScheduleExpression: pulumi.String(reconcilerSchedule),
+		Description:        pulumi.String("Trigger Aurora Log Reconciler Lambda to find untracked log files"),
+		Tags: pulumi.StringMap{
+			"Name": pulumi.String("aurora-log-reconciler-schedule"),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Add EventBridge target for Reconciler Lambda (using alias)
+	_, err = cloudwatch.NewEventTarget(ctx, "aurora-log-reconciler-target", &cloudwatch.EventTargetArgs{
+		Rule: reconcilerRule.Name,
+		Arn:  reconcilerAlias.Arn,
+	}, pulumi.DependsOn([]pulumi.Resource{reconcilerAlias}))
+	if err != nil {
+		return nil, err
+	}
+
+	// Allow EventBridge to invoke Reconciler Lambda (using alias)
+	_, err = lambda.NewPermission(ctx, "aurora-log-reconciler-permission", &lambda.PermissionArgs{
+		Action:    pulumi.String("lambda:InvokeFunction"),
+		Function:  reconcilerLambda.Name,
+		Qualifier: reconcilerAlias.Name,
+		Principal: pulumi.String("events.amazonaws.com"),
+		SourceArn: reconcilerRule.Arn,
+	}, pulumi.DependsOn([]pulumi.Resource{reconcilerAlias}))
+	if err != nil {
+		return nil, err
+	}
+
 	// Create SQS event source mapping for Log Detector Lambda (using alias)
 	_, err = lambda.NewEventSourceMapping(ctx, "aurora-log-detector-sqs-mapping", &lambda.EventSourceMappingArgs{
 		EventSourceArn: queue.Arn,
 		FunctionName:   logDetectorAlias.Arn, // Use alias ARN instead of function ARN
 		BatchSize:      pulumi.Int(lambdaBatchSize),
+		// Retry only the messages reported as failed instead of the whole batch
+		FunctionResponseTypes: pulumi.StringArray{pulumi.String("ReportBatchItemFailures")},
 	}, pulumi.DependsOn([]pulumi.Resource{logDetectorAlias}))
 	if err != nil {
 		return nil, err
@@ -482,11 +1607,32 @@ func createLogBackupResources(ctx *pulumi.Context, networkResources *NetworkReso
 		FunctionName:     logDownloaderAlias.Arn, // Use alias ARN instead of function ARN
 		StartingPosition: pulumi.String("LATEST"),
 		BatchSize:        pulumi.Int(lambdaBatchSize),
+		// Retry from the first stream record reported as failed, splitting the batch when the function errors.
+		// A log file still failing after the retries stays FAILED and is counted by the backlog report.
+		FunctionResponseTypes:      pulumi.StringArray{pulumi.String("ReportBatchItemFailures")},
+		BisectBatchOnFunctionError: pulumi.Bool(true),
+		MaximumRetryAttempts:       pulumi.Int(5),
 	}, pulumi.DependsOn([]pulumi.Resource{logDownloaderAlias}))
 	if err != nil {
 		return nil, err
 	}
 
+	// The Log Downloader of the second table consumes its stream
+	if secondaryDynamoTable != nil {
+		_, err = lambda.NewEventSourceMapping(ctx, "aurora-log-downloader-secondary-dynamodb-mapping", &lambda.EventSourceMappingArgs{
+			EventSourceArn:             secondaryDynamoTable.StreamArn,
+			FunctionName:               secondaryLogDownloaderAlias.Arn,
+			StartingPosition:           pulumi.String("LATEST"),
+			BatchSize:                  pulumi.Int(lambdaBatchSize),
+			FunctionResponseTypes:      pulumi.StringArray{pulumi.String("ReportBatchItemFailures")},
+			BisectBatchOnFunctionError: pulumi.Bool(true),
+			MaximumRetryAttempts:       pulumi.Int(5),
+		}, pulumi.DependsOn([]pulumi.Resource{secondaryLogDownloaderAlias}))
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Export resource ARNs and names
 	ctx.Export("logBucketName", logBucket.ID())
 	ctx.Export("dynamoTableName", dynamoTable.Name)
@@ -494,23 +1640,64 @@ func createLogBackupResources(ctx *pulumi.Context, networkResources *NetworkReso
 	ctx.Export("dbScannerLambdaArn", dbScannerLambda.Arn)
 	ctx.Export("logDetectorLambdaArn", logDetectorLambda.Arn)
 	ctx.Export("logDownloaderLambdaArn", logDownloaderLambda.Arn)
+	ctx.Export("reconcilerLambdaArn", reconcilerLambda.Arn)
 
 	// Export Lambda aliases
 	ctx.Export("dbScannerLambdaAliasArn", dbScannerAlias.Arn)
 	ctx.Export("logDetectorLambdaAliasArn", logDetectorAlias.Arn)
 	ctx.Export("logDownloaderLambdaAliasArn", logDownloaderAlias.Arn)
+	ctx.Export("reconcilerLambdaAliasArn", reconcilerAlias.Arn)
+
+	// Export the Log Downloader concurrency cap
+	ctx.Export("logDownloaderReservedConcurrency", pulumi.Int(logDownloaderReservedConcurrency))
+
+	// Export the second table and the Log Downloader backing it up
+	if secondaryDynamoTable != nil {
+		ctx.Export("secondaryDynamoTableName", secondaryDynamoTable.Name)
+		ctx.Export("secondaryDynamoTableStreamArn", secondaryDynamoTable.StreamArn)
+		ctx.Export("secondaryLogDownloaderLambdaAliasArn", secondaryLogDownloaderAlias.Arn)
+	}
+
+	// Export the poison message queue
+	if poisonQueue != nil {
+		ctx.Export("poisonMessageQueueUrl", poisonQueue.Url)
+	}
+
+	// Export the key the backups are encrypted with
+	if backupKey != nil {
+		ctx.Export("backupKmsKeyArn", backupKey.Arn)
+	}
+
+	// Export the bucket the backups are replicated to
+	if replicaBucket != nil {
+		ctx.Export("replicaBucketName", replicaBucket.ID())
+	}
+
+	// Export the topic the Log Downloader notifies
+	if notificationTopic != nil {
+		ctx.Export("notificationTopicArn", notificationTopic.Arn)
+	}
 
 	return &LogBackupResources{
-		LogBucket:                logBucket,
-		DynamoDBTable:            dynamoTable,
-		SQSQueue:                 queue,
-		LambdaRole:               lambdaRole,
-		DBScannerLambda:          dbScannerLambda,
-		DBScannerLambdaAlias:     dbScannerAlias,
-		LogDetectorLambda:        logDetectorLambda,
-		LogDetectorLambdaAlias:   logDetectorAlias,
-		LogDownloaderLambda:      logDownloaderLambda,
-		LogDownloaderLambdaAlias: logDownloaderAlias,
-		EventBridgeRule:          eventRule,
+		LogBucket:                         logBucket,
+		DynamoDBTable:                     dynamoTable,
+		SQSQueue:                          queue,
+		LambdaRole:                        lambdaRole,
+		DBScannerLambda:                   dbScannerLambda,
+		DBScannerLambdaAlias:              dbScannerAlias,
+		LogDetectorLambda:                 logDetectorLambda,
+		LogDetectorLambdaAlias:            logDetectorAlias,
+		LogDownloaderLambda:               logDownloaderLambda,
+		LogDownloaderLambdaAlias:          logDownloaderAlias,
+		ReconcilerLambda:                  reconcilerLambda,
+		ReconcilerLambdaAlias:             reconcilerAlias,
+		EventBridgeRule:                   eventRule,
+		ReconcilerRule:                    reconcilerRule,
+		SecondaryDynamoDBTable:            secondaryDynamoTable,
+		SecondaryLogDownloaderLambda:      secondaryLogDownloaderLambda,
+		SecondaryLogDownloaderLambdaAlias: secondaryLogDownloaderAlias,
+		PoisonMessageQueue:                poisonQueue,
+		BackupKey:                         backupKey,
+		ReplicaBucket:                     replicaBucket,
 	}, nil
 }
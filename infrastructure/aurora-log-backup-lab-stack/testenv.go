@@ -1,6 +1,10 @@
 package main
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+
 	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/ec2"
 	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/iam"
 	"github.com/pulumi/pulumi-aws/sdk/v5/go/aws/rds"
@@ -36,6 +40,40 @@ func createTestEnvironmentResources(ctx *pulumi.Context, networkResources *Netwo
 	ec2KeyPairName := projectCfg.Require("ec2KeyPairName")
 	ec2InstanceType := projectCfg.Require("ec2InstanceType")
 	auroraInstanceType := projectCfg.Require("auroraInstanceType")
+
+	// Audit events the cluster logs; fewer events reduce the log volume
+	auditEvents, err := parseAuditEvents(projectCfg.Get("auditEvents"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Whether the cluster writes audit logs at all
+	auditLoggingStr := projectCfg.Get("auditLogging")
+	if auditLoggingStr == "" {
+		auditLoggingStr = "true"
+	}
+	auditLogging, err := strconv.ParseBool(auditLoggingStr)
+	if err != nil {
+		return nil, err
+	}
+	serverAuditLogging := "0"
+	if auditLogging {
+		serverAuditLogging = "1"
+	}
+
+	// Users whose activity is left out of, or the only activity in, the audit logs, e.g. monitoring users.
+	// Aurora ignores auditExcludedUsers when auditIncludedUsers is set.
+	auditExcludedUsers := strings.TrimSpace(projectCfg.Get("auditExcludedUsers"))
+	auditIncludedUsers := strings.TrimSpace(projectCfg.Get("auditIncludedUsers"))
+
+	// The slow query log is off by default, so the cluster only writes one when it is backed up
+	slowQueryLog := false
+	for _, logType := range strings.Split(projectCfg.Get("logTypes"), ",") {
+		if strings.TrimSpace(logType) == "slowquery" {
+			slowQueryLog = true
+		}
+	}
+
 	// Create EC2 security group
 	ec2SecurityGroup, err := ec2.NewSecurityGroup(ctx, "ec2-sg", &ec2.SecurityGroupArgs{
 		VpcId:       networkResources.Vpc.ID(),
@@ -369,18 +407,39 @@ func createTestEnvironmentResources(ctx *pulumi.Context, networkResources *Netwo
 	}
 
 	// Create parameter group for Aurora cluster
-	parameterGroup, err := rds.NewClusterParameterGroup(ctx, "aurora-param-group", &rds.ClusterParameterGroupArgs{
-		Family: pulumi.String("aurora-mysql8.0"),
-		Parameters: rds.ClusterParameterGroupParameterArray{
-			&rds.ClusterParameterGroupParameterArgs{
-				Name:  pulumi.String("server_audit_events"),
-				Value: pulumi.String("CONNECT,QUERY,TABLE,QUERY_DDL,QUERY_DML,QUERY_DCL"),
-			},
-			&rds.ClusterParameterGroupParameterArgs{
-				Name:  pulumi.String("server_audit_logging"),
-				Value: pulumi.String("1"),
-			},
+	parameters := rds.ClusterParameterGroupParameterArray{
+		&rds.ClusterParameterGroupParameterArgs{
+			Name:  pulumi.String("server_audit_events"),
+			Value: pulumi.String(auditEvents),
+		},
+		&rds.ClusterParameterGroupParameterArgs{
+			Name:  pulumi.String("server_audit_logging"),
+			Value: pulumi.String(serverAuditLogging),
 		},
+	}
+	if auditExcludedUsers != "" {
+		parameters = append(parameters, &rds.ClusterParameterGroupParameterArgs{
+			Name:  pulumi.String("server_audit_excl_users"),
+			Value: pulumi.String(auditExcludedUsers),
+		})
+	}
+	if auditIncludedUsers != "" {
+		parameters = append(parameters, &rds.ClusterParameterGroupParameterArgs{
+			Name:  pulumi.String("server_audit_incl_users"),
+			Value: pulumi.String(auditIncludedUsers),
+		})
+	}
+
+	if slowQueryLog {
+		parameters = append(parameters, &rds.ClusterParameterGroupParameterArgs{
+			Name:  pulumi.String("slow_query_log"),
+			Value: pulumi.String("1"),
+		})
+	}
+
+	parameterGroup, err := rds.NewClusterParameterGroup(ctx, "aurora-param-group", &rds.ClusterParameterGroupArgs{
+		Family:     pulumi.String("aurora-mysql8.0"),
+		Parameters: parameters,
 		Tags: pulumi.StringMap{
 			"Name": pulumi.String("aurora-param-group"),
 		},
@@ -700,3 +759,38 @@ chown -R ec2-user:ec2-user /home/ec2-user/scripts
 		AuroraS3PolicyAttachment:     auroraS3PolicyAttachment,
 	}, nil
 }
+
+// defaultAuditEvents are the audit events logged when auditEvents is not set
+const defaultAuditEvents = "CONNECT,QUERY,TABLE,QUERY_DDL,QUERY_DML,QUERY_DCL"
+
+// allowedAuditEvents are the values Aurora MySQL accepts in server_audit_events
+var allowedAuditEvents = map[string]bool{
+	"CONNECT":             true,
+	"QUERY":               true,
+	"QUERY_DCL":           true,
+	"QUERY_DDL":           true,
+	"QUERY_DML":           true,
+	"QUERY_DML_NO_SELECT": true,
+	"TABLE":               true,
+}
+
+// parseAuditEvents validates a comma-separated server_audit_events list and returns it normalized.
+// An empty value returns defaultAuditEvents.
+func parseAuditEvents(value string) (string, error) {
+	if strings.TrimSpace(value) == "" {
+		return defaultAuditEvents, nil
+	}
+
+	var events []string
+	for _, event := range strings.Split(value, ",") {
+		event = strings.ToUpper(strings.TrimSpace(event))
+		if event == "" {
+			continue
+		}
+		if !allowedAuditEvents[event] {
+			return "", fmt.Errorf("invalid audit event %q in auditEvents", event)
+		}
+		events = append(events, event)
+	}
+	return strings.Join(events, ","), nil
+}
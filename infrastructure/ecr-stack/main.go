@@ -52,10 +52,26 @@ func main() {
 			return err
 		}
 
+		// Create ECR repository for Reconciler Lambda
+		reconcilerRepo, err := ecr.NewRepository(ctx, "aurora-log-reconciler-repo", &ecr.RepositoryArgs{
+			Name: pulumi.String("aurora-log-reconciler"),
+			ImageScanningConfiguration: &ecr.RepositoryImageScanningConfigurationArgs{
+				ScanOnPush: pulumi.Bool(true),
+			},
+			ImageTagMutability: pulumi.String("MUTABLE"),
+			Tags: pulumi.StringMap{
+				"Name": pulumi.String("aurora-log-reconciler-repo"),
+			},
+		})
+		if err != nil {
+			return err
+		}
+
 		// Export ECR repository URLs
 		ctx.Export("dbScannerRepositoryUrl", dbScannerRepo.RepositoryUrl)
 		ctx.Export("logDetectorRepositoryUrl", logDetectorRepo.RepositoryUrl)
 		ctx.Export("logDownloaderRepositoryUrl", logDownloaderRepo.RepositoryUrl)
+		ctx.Export("reconcilerRepositoryUrl", reconcilerRepo.RepositoryUrl)
 
 		return nil
 	})
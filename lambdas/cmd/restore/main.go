@@ -0,0 +1,349 @@
+// Command restore downloads a backed-up log file from S3 to a local file. It finds the object with the S3 key
+// layout the Log Downloader writes, joins the parts appended by incremental downloads, decompresses gzip
+// objects, and checks the content against the checksum in the log file's record.
+//
+// Usage:
+//
+//	restore -instance db-1 -file audit/server_audit.log [-date 2024-05-01] [-o server_audit.log]
+//
+// The table, bucket, prefix and key template default to the DYNAMODB_TABLE_NAME, S3_BUCKET_NAME, S3_PREFIX and
+// S3_KEY_TEMPLATE settings of the Log Downloader.
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/checksum"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/s3key"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/s3object"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/timeutil"
+)
+
+// objectSuffixes are the suffixes the Log Downloader appends to the rendered key, for OUTPUT_FORMAT=ndjson
+// or jsonl and COMPRESSION=gzip
+var objectSuffixes = []string{"", ".gz", ".ndjson", ".ndjson.gz", ".jsonl", ".jsonl.gz"}
+
+// timestampedObject matches what follows the {lastWritten} placeholder in a backup's key
+var timestampedObject = regexp.MustCompile(`^(\d+)(\.ndjson|\.jsonl)?(\.gz)?$`)
+
+// LogFileRecord is the part of a log file record that locates and checks its last backup
+type LogFileRecord struct {
+	LastWritten           int64  `dynamodbav:"LastWritten"`
+	LastBackup            int64  `dynamodbav:"LastBackup,omitempty"`
+	LastChecksum          string `dynamodbav:"LastChecksum,omitempty"`          // Hex checksum of the raw content, across all parts
+	LastChecksumAlgorithm string `dynamodbav:"LastChecksumAlgorithm,omitempty"` // Algorithm of LastChecksum; empty is MD5
+	LastS3Key             string `dynamodbav:"LastS3Key,omitempty"`             // Key of the last backup
+	LastPartCount         int64  `dynamodbav:"LastPartCount,omitempty"`         // Parts appended to LastS3Key
+}
+
+// RecordGetter is the subset of the DynamoDB client used to read the log file record
+type RecordGetter interface {
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+}
+
+// ObjectReader is the subset of the S3 client used to find and download the backup
+type ObjectReader interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+}
+
+// options are the command line settings
+type options struct {
+	Table       string
+	Bucket      string
+	Prefix      string
+	KeyTemplate string
+	Instance    string
+	LogFile     string
+	Date        time.Time // Restore the last backup of a log file written that day (UTC); zero restores the last backup
+	Output      string
+}
+
+// backup is the object a log file was backed up to
+type backup struct {
+	Key               string
+	Parts             int64  // Parts appended by incremental downloads, at the key's .partN keys
+	Checksum          string // Checksum recorded for the backup; empty when the record is of a later backup
+	ChecksumAlgorithm string // Algorithm of Checksum, as recorded in LastChecksumAlgorithm
+}
+
+// getRecord reads the log file record, nil when there is none
+func getRecord(ctx context.Context, client RecordGetter, tableName, dbInstanceID, logFileName string) (*LogFileRecord, error) {
+	resp, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"DBInstanceIdentifier": &types.AttributeValueMemberS{Value: dbInstanceID},
+			"LogFileName":          &types.AttributeValueMemberS{Value: logFileName},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Item) == 0 {
+		return nil, nil
+	}
+
+	var record LogFileRecord
+	if err := attributevalue.UnmarshalMap(resp.Item, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// lastBackup returns the last backup recorded for the log file. Its key is rendered from the record's LastWritten
+// time and checked against LastS3Key, which tells a key template or prefix that differs from the Log Downloader's.
+// Incremental downloads append to the key of the first backup, which LastS3Key keeps.
+func lastBackup(opts options, record *LogFileRecord) (backup, error) {
+	if record == nil || record.LastBackup == 0 {
+		return backup{}, fmt.Errorf("log file %s of instance %s has no recorded backup", opts.LogFile, opts.Instance)
+	}
+	if record.LastPartCount > 0 {
+		return backup{Key: record.LastS3Key, Parts: record.LastPartCount, Checksum: record.LastChecksum, ChecksumAlgorithm: record.LastChecksumAlgorithm}, nil
+	}
+
+	key := s3key.Build(opts.KeyTemplate, opts.Prefix, opts.Instance, opts.LogFile, record.LastWritten)
+	for _, suffix := range objectSuffixes {
+		if key+suffix == record.LastS3Key {
+			return backup{Key: record.LastS3Key, Checksum: record.LastChecksum, ChecksumAlgorithm: record.LastChecksumAlgorithm}, nil
+		}
+	}
+	return backup{}, fmt.Errorf("key %s doesn't match the recorded backup %s, check the prefix and key template", key, record.LastS3Key)
+}
+
+// backupOn finds the last backup of the log file written on a day, by listing the keys the template renders up
+// to its {lastWritten} placeholder, which must end the template. A template without {lastWritten} keeps a single
+// object per log file.
+func backupOn(ctx context.Context, client ObjectReader, opts options, record *LogFileRecord) (backup, error) {
+	template, cut := opts.KeyTemplate, -1
+	for _, placeholder := range []string{"{lastWritten}", "{ts}"} {
+		if i := strings.Index(template, placeholder); i >= 0 && (cut < 0 || i < cut) {
+			cut = i
+		}
+	}
+	timestamped := cut >= 0
+	if timestamped {
+		template = template[:cut]
+	}
+	prefix := s3key.Build(template, opts.Prefix, opts.Instance, opts.LogFile, timeutil.EpochMillis(opts.Date))
+
+	keys, err := listKeys(ctx, client, opts.Bucket, prefix)
+	if err != nil {
+		return backup{}, err
+	}
+
+	var found backup
+	var foundWritten int64 = -1
+	for key := range keys {
+		rest := strings.TrimPrefix(key, prefix)
+		if !timestamped {
+			if slices.Contains(objectSuffixes, rest) {
+				found = backup{Key: key}
+			}
+			continue
+		}
+		match := timestampedObject.FindStringSubmatch(rest)
+		if match == nil {
+			continue
+		}
+		written, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil || timeutil.FromEpochMillis(written).UTC().Format(time.DateOnly) != opts.Date.Format(time.DateOnly) {
+			continue
+		}
+		if written > foundWritten {
+			found, foundWritten = backup{Key: key}, written
+		}
+	}
+	if found.Key == "" {
+		return backup{}, fmt.Errorf("no backup of log file %s of instance %s written on %s under s3://%s/%s", opts.LogFile, opts.Instance, opts.Date.Format(time.DateOnly), opts.Bucket, prefix)
+	}
+
+	for keys[s3key.PartKey(found.Key, found.Parts+1)] {
+		found.Parts++
+	}
+	// Only the record's own backup has a checksum to check against
+	if record != nil && record.LastS3Key == found.Key {
+		found.Checksum, found.ChecksumAlgorithm = record.LastChecksum, record.LastChecksumAlgorithm
+	}
+	return found, nil
+}
+
+// listKeys returns the keys under a prefix
+func listKeys(ctx context.Context, client ObjectReader, bucketName, prefix string) (map[string]bool, error) {
+	keys := make(map[string]bool)
+	var token *string
+	for {
+		resp, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:            aws.String(bucketName),
+			Prefix:            aws.String(prefix),
+			ContinuationToken: token,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range resp.Contents {
+			keys[aws.ToString(object.Key)] = true
+		}
+		if !aws.ToBool(resp.IsTruncated) {
+			return keys, nil
+		}
+		token = resp.NextContinuationToken
+	}
+}
+
+// restore writes the content of a backup and its parts to w and returns the hex checksum of the content, of the
+// backup's checksum algorithm
+func restore(ctx context.Context, client ObjectReader, bucketName string, b backup, w io.Writer) (string, error) {
+	contentHash, err := checksum.New(b.ChecksumAlgorithm)
+	if err != nil {
+		return "", err
+	}
+	out := io.MultiWriter(w, contentHash)
+
+	keys := []string{b.Key}
+	for n := int64(1); n <= b.Parts; n++ {
+		keys = append(keys, s3key.PartKey(b.Key, n))
+	}
+	for _, key := range keys {
+		if err := s3object.Copy(ctx, client, bucketName, key, out); err != nil {
+			return "", fmt.Errorf("failed to download s3://%s/%s: %w", bucketName, key, err)
+		}
+	}
+	return hex.EncodeToString(contentHash.Sum(nil)), nil
+}
+
+// run restores the log file to opts.Output. The file is removed when its content doesn't match the recorded checksum.
+func run(ctx context.Context, dynamoClient RecordGetter, s3Client ObjectReader, opts options, logger *log.Logger) error {
+	record, err := getRecord(ctx, dynamoClient, opts.Table, opts.Instance, opts.LogFile)
+	if err != nil {
+		return fmt.Errorf("failed to read the log file record: %w", err)
+	}
+
+	var b backup
+	if opts.Date.IsZero() {
+		b, err = lastBackup(opts, record)
+	} else {
+		b, err = backupOn(ctx, s3Client, opts, record)
+	}
+	if err != nil {
+		return err
+	}
+	logger.Printf("Restoring s3://%s/%s with %d appended parts to %s\n", opts.Bucket, b.Key, b.Parts, opts.Output)
+
+	file, err := os.Create(opts.Output)
+	if err != nil {
+		return err
+	}
+	sum, err := restore(ctx, s3Client, opts.Bucket, b, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	algorithm := checksum.Normalize(b.ChecksumAlgorithm)
+	switch {
+	case s3key.Converted(b.Key):
+		// The checksum is of the raw log file, before it was converted
+		logger.Printf("Restored JSON content can't be checked against the checksum of the raw log file (%s %s)\n", algorithm, sum)
+	case b.Checksum == "":
+		logger.Printf("No checksum is recorded for this backup, restored content is not verified (%s %s)\n", algorithm, sum)
+	case sum != b.Checksum:
+		os.Remove(opts.Output)
+		return fmt.Errorf("restored content has %s %s, but the backup recorded %s", algorithm, sum, b.Checksum)
+	default:
+		logger.Printf("Restored content matches the recorded %s %s\n", algorithm, sum)
+	}
+	return nil
+}
+
+// envDefault returns the value of an environment variable, or fallback when it is not set
+func envDefault(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// parseFlags parses the command line into options
+func parseFlags(args []string) (options, error) {
+	var opts options
+	var date string
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	fs.StringVar(&opts.Table, "table", os.Getenv("DYNAMODB_TABLE_NAME"), "DynamoDB table of the log file records")
+	fs.StringVar(&opts.Bucket, "bucket", os.Getenv("S3_BUCKET_NAME"), "S3 bucket of the backups")
+	fs.StringVar(&opts.Prefix, "prefix", envDefault("S3_PREFIX", "logs"), "S3 prefix of the backups, including the log type prefix when more than audit logs are backed up")
+	fs.StringVar(&opts.KeyTemplate, "key-template", envDefault("S3_KEY_TEMPLATE", s3key.DefaultTemplate), "S3 key template of the backups")
+	fs.StringVar(&opts.Instance, "instance", "", "DB instance identifier")
+	fs.StringVar(&opts.LogFile, "file", "", "log file name, such as audit/server_audit.log")
+	fs.StringVar(&date, "date", "", "restore the last backup of the log file written on this day (YYYY-MM-DD, UTC) instead of its last backup")
+	fs.StringVar(&opts.Output, "o", "", "local file to write (default: the log file's base name)")
+	if err := fs.Parse(args); err != nil {
+		return options{}, err
+	}
+
+	var missing []string
+	for _, required := range []struct{ flag, value string }{
+		{"table", opts.Table}, {"bucket", opts.Bucket}, {"instance", opts.Instance}, {"file", opts.LogFile},
+	} {
+		if required.value == "" {
+			missing = append(missing, "-"+required.flag)
+		}
+	}
+	if len(missing) > 0 {
+		return options{}, fmt.Errorf("required flags not set: %s", strings.Join(missing, ", "))
+	}
+
+	if date != "" {
+		parsed, err := time.Parse(time.DateOnly, date)
+		if err != nil {
+			return options{}, fmt.Errorf("invalid -date %q, want YYYY-MM-DD", date)
+		}
+		opts.Date = parsed
+	}
+	if opts.Output == "" {
+		opts.Output = path.Base(opts.LogFile)
+	}
+	return opts, nil
+}
+
+func main() {
+	logger := log.New(os.Stderr, "", 0)
+
+	opts, err := parseFlags(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		logger.Fatalf("Error: %v\n", err)
+	}
+
+	ctx := context.Background()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		logger.Fatalf("Error loading AWS config: %v\n", err)
+	}
+
+	if err := run(ctx, dynamodb.NewFromConfig(cfg), s3.NewFromConfig(cfg), opts, logger); err != nil {
+		logger.Fatalf("Error: %v\n", err)
+	}
+}
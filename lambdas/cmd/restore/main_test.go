@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/s3key"
+)
+
+var discardLogger = log.New(io.Discard, "", 0)
+
+// fakeRecords returns record from GetItem, or no item when it is nil
+type fakeRecords struct {
+	record *LogFileRecord
+}
+
+func (f *fakeRecords) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	if f.record == nil {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+	item, err := attributevalue.MarshalMap(f.record)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.GetItemOutput{Item: item}, nil
+}
+
+// fakeS3 serves objects by key and lists them two keys per page
+type fakeS3 struct {
+	objects map[string][]byte
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	body, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, &s3types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(body))}, nil
+}
+
+func (f *fakeS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, aws.ToString(params.Prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	start := 0
+	if params.ContinuationToken != nil {
+		start, _ = strconv.Atoi(aws.ToString(params.ContinuationToken))
+	}
+	end := min(start+2, len(keys))
+	resp := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(end < len(keys))}
+	for _, key := range keys[start:end] {
+		resp.Contents = append(resp.Contents, s3types.Object{Key: aws.String(key)})
+	}
+	if end < len(keys) {
+		resp.NextContinuationToken = aws.String(strconv.Itoa(end))
+	}
+	return resp, nil
+}
+
+// gzipped compresses data as one gzip member
+func gzipped(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	io.WriteString(zw, data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func md5Hex(data string) string {
+	sum := md5.Sum([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func testOptions() options {
+	return options{Table: "table", Bucket: "bucket", Prefix: "logs", KeyTemplate: s3key.DefaultTemplate, Instance: "db-1", LogFile: "audit/server_audit.log"}
+}
+
+func TestLastBackup(t *testing.T) {
+	const key = "logs/db-1/2023/11/14/audit/server_audit.log.1700000000000"
+
+	tests := []struct {
+		name     string
+		template string
+		record   *LogFileRecord
+		want     backup
+		wantErr  bool
+	}{
+		{
+			name:   "whole file",
+			record: &LogFileRecord{LastWritten: 1700000000000, LastBackup: 1, LastChecksum: "abc", LastS3Key: key},
+			want:   backup{Key: key, Checksum: "abc"},
+		},
+		{
+			name:   "compressed",
+			record: &LogFileRecord{LastWritten: 1700000000000, LastBackup: 1, LastChecksum: "abc", LastS3Key: key + ".ndjson.gz"},
+			want:   backup{Key: key + ".ndjson.gz", Checksum: "abc"},
+		},
+		{
+			name:   "incremental",
+			record: &LogFileRecord{LastWritten: 1700000500000, LastBackup: 1, LastChecksum: "abc", LastS3Key: key, LastPartCount: 2},
+			want:   backup{Key: key, Parts: 2, Checksum: "abc"},
+		},
+		{
+			name:     "other key template",
+			template: s3key.PartitionedTemplate,
+			record:   &LogFileRecord{LastWritten: 1700000000000, LastBackup: 1, LastChecksum: "abc", LastS3Key: key},
+			wantErr:  true,
+		},
+		{name: "never backed up", record: &LogFileRecord{LastWritten: 1700000000000}, wantErr: true},
+		{name: "no record", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		opts := testOptions()
+		if tt.template != "" {
+			opts.KeyTemplate = tt.template
+		}
+		got, err := lastBackup(opts, tt.record)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: lastBackup() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: lastBackup() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBackupOn(t *testing.T) {
+	const dayPrefix = "logs/db-1/2023/11/14/audit/server_audit.log."
+	client := &fakeS3{objects: map[string][]byte{
+		dayPrefix + "1699920000000":        nil,
+		dayPrefix + "1699999000000":        nil,
+		dayPrefix + "1699999000000.part1":  nil,
+		dayPrefix + "1699999000000.part2":  nil,
+		dayPrefix + "1.1700000000000":      nil, // The rotated audit/server_audit.log.1
+		"logs/db-1/audit/server_audit.log": nil,
+	}}
+	date := time.Date(2023, 11, 14, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		template string
+		record   *LogFileRecord
+		date     time.Time
+		want     backup
+		wantErr  bool
+	}{
+		{
+			name: "latest of the day",
+			date: date,
+			want: backup{Key: dayPrefix + "1699999000000", Parts: 2},
+		},
+		{
+			name:   "recorded backup",
+			date:   date,
+			record: &LogFileRecord{LastS3Key: dayPrefix + "1699999000000", LastChecksum: "abc"},
+			want:   backup{Key: dayPrefix + "1699999000000", Parts: 2, Checksum: "abc"},
+		},
+		{
+			name:   "recorded backup of a later day",
+			date:   date,
+			record: &LogFileRecord{LastS3Key: "logs/db-1/2023/11/15/audit/server_audit.log.1700006400000", LastChecksum: "abc"},
+			want:   backup{Key: dayPrefix + "1699999000000", Parts: 2},
+		},
+		{name: "no backup that day", date: date.AddDate(0, 0, 1), wantErr: true},
+		{
+			name:     "legacy key",
+			template: s3key.LegacyTemplate,
+			date:     date,
+			want:     backup{Key: "logs/db-1/audit/server_audit.log"},
+		},
+	}
+
+	for _, tt := range tests {
+		opts := testOptions()
+		opts.Date = tt.date
+		if tt.template != "" {
+			opts.KeyTemplate = tt.template
+		}
+		got, err := backupOn(context.Background(), client, opts, tt.record)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: backupOn() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: backupOn() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	const key = "logs/db-1/2023/11/14/audit/server_audit.log.1700000000000"
+	content := "line 1\nline 2\nline 3\n"
+
+	tests := []struct {
+		name      string
+		objects   map[string][]byte
+		s3Key     string
+		checksum  string
+		algorithm string
+		parts     int64
+		want      string // Restored content, empty when the restore fails
+	}{
+		{
+			name:     "whole file",
+			objects:  map[string][]byte{key: []byte(content)},
+			s3Key:    key,
+			checksum: md5Hex(content),
+			want:     content,
+		},
+		{
+			name:      "SHA-256",
+			objects:   map[string][]byte{key: []byte(content)},
+			s3Key:     key,
+			checksum:  sha256Hex(content),
+			algorithm: "sha256",
+			want:      content,
+		},
+		{
+			name:      "checksum of another algorithm",
+			objects:   map[string][]byte{key: []byte(content)},
+			s3Key:     key,
+			checksum:  md5Hex(content),
+			algorithm: "sha256",
+		},
+		{
+			name: "compressed parts",
+			objects: map[string][]byte{
+				key + ".gz":       append(gzipped(t, "line 1\n"), gzipped(t, "line 2\n")...), // Compressed one part at a time
+				key + ".part1.gz": gzipped(t, "line 3\n"),
+			},
+			s3Key:    key + ".gz",
+			checksum: md5Hex(content),
+			parts:    1,
+			want:     content,
+		},
+		{
+			name:     "tampered",
+			objects:  map[string][]byte{key: []byte("line 1\n")},
+			s3Key:    key,
+			checksum: md5Hex(content),
+		},
+		{
+			name:     "NDJSON isn't checked",
+			objects:  map[string][]byte{key + ".ndjson": []byte(`{"line":1}` + "\n")},
+			s3Key:    key + ".ndjson",
+			checksum: md5Hex(content),
+			want:     `{"line":1}` + "\n",
+		},
+		{
+			name:     "JSON Lines isn't checked",
+			objects:  map[string][]byte{key + ".jsonl": []byte(`{"raw":"line 1"}` + "\n")},
+			s3Key:    key + ".jsonl",
+			checksum: md5Hex(content),
+			want:     `{"raw":"line 1"}` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions()
+			opts.Output = filepath.Join(t.TempDir(), "server_audit.log")
+			record := &LogFileRecord{LastWritten: 1700000000000, LastBackup: 1, LastChecksum: tt.checksum, LastChecksumAlgorithm: tt.algorithm, LastS3Key: tt.s3Key, LastPartCount: tt.parts}
+
+			err := run(context.Background(), &fakeRecords{record: record}, &fakeS3{objects: tt.objects}, opts, discardLogger)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatal("run() error = nil, want a checksum mismatch")
+				}
+				if _, statErr := os.Stat(opts.Output); !errors.Is(statErr, os.ErrNotExist) {
+					t.Errorf("output left behind after a mismatch: %v", statErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+			got, err := os.ReadFile(opts.Output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("restored %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+	t.Setenv("S3_PREFIX", "")
+	t.Setenv("S3_KEY_TEMPLATE", "")
+
+	opts, err := parseFlags([]string{"-instance", "db-1", "-file", "audit/server_audit.log", "-date", "2023-11-14"})
+	if err != nil {
+		t.Fatalf("parseFlags() error = %v", err)
+	}
+	want := testOptions()
+	want.Date = time.Date(2023, 11, 14, 0, 0, 0, 0, time.UTC)
+	want.Output = "server_audit.log"
+	if opts != want {
+		t.Errorf("parseFlags() = %+v, want %+v", opts, want)
+	}
+
+	for _, args := range [][]string{
+		{"-file", "audit/server_audit.log"},
+		{"-instance", "db-1", "-file", "audit/server_audit.log", "-date", "14/11/2023"},
+	} {
+		if _, err := parseFlags(args); err == nil {
+			t.Errorf("parseFlags(%q) error = nil, want an error", args)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+// Command verify checks the backups recorded in the log file table against the objects in S3, for attesting that
+// backed-up log files haven't been tampered with. Every object of a backup, including the parts appended by
+// incremental downloads, must exist. The last object uploaded must still be the recorded version and, for a whole
+// file, have the recorded size. Its content-md5 or content-sha256 metadata, the checksum of the content the Log
+// Downloader uploaded, must match the record's LastChecksum. With -download, every backup is downloaded and its
+// checksum, of the record's LastChecksumAlgorithm, compared with the record's LastChecksum.
+//
+// Usage:
+//
+//	verify [-instance db-1] [-download]
+//
+// The command prints each failed backup and a summary, and exits non-zero when any backup failed. The table and
+// bucket default to the DYNAMODB_TABLE_NAME and S3_BUCKET_NAME settings of the Log Downloader; records carry the
+// bucket they were uploaded to, which takes precedence.
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/checksum"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/s3key"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/s3object"
+)
+
+// LogFileRecord is the part of a log file record that describes its last backup
+type LogFileRecord struct {
+	DBInstanceIdentifier  string `dynamodbav:"DBInstanceIdentifier"`
+	LogFileName           string `dynamodbav:"LogFileName"`
+	LastBackup            int64  `dynamodbav:"LastBackup,omitempty"`
+	LastChecksum          string `dynamodbav:"LastChecksum,omitempty"`          // Hex checksum of the raw content, across all parts
+	LastChecksumAlgorithm string `dynamodbav:"LastChecksumAlgorithm,omitempty"` // Algorithm of LastChecksum; empty is MD5
+	LastS3Key             string `dynamodbav:"LastS3Key,omitempty"`             // Key of the last backup
+	LastS3Bucket          string `dynamodbav:"LastS3Bucket,omitempty"`          // Bucket LastS3Key is in; empty in records of earlier versions
+	LastS3VersionId       string `dynamodbav:"LastS3VersionId,omitempty"`       // Version of the last object uploaded, in a versioned bucket
+	LastObjectSize        int64  `dynamodbav:"LastObjectSize,omitempty"`        // Bytes of the last object uploaded
+	LastPartCount         int64  `dynamodbav:"LastPartCount,omitempty"`         // Parts appended to LastS3Key
+}
+
+// RecordScanner is the subset of the DynamoDB client used to read the log file records
+type RecordScanner interface {
+	Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
+}
+
+// ObjectReader is the subset of the S3 client used to check the backups
+type ObjectReader interface {
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// options are the command line settings
+type options struct {
+	Table    string
+	Bucket   string // Bucket of records without LastS3Bucket
+	Instance string // Only verify the backups of this DB instance; empty verifies all
+	Download bool   // Download the backups and compare their checksum with LastChecksum
+}
+
+// Outcomes of verifying a backup
+const (
+	outcomeVerified   = "verified"
+	outcomeUnchecked  = "unchecked" // Exists, but the content can't be compared with the checksum
+	outcomeMissing    = "missing"
+	outcomeMismatched = "mismatched"
+	outcomeFailed     = "failed" // The backup couldn't be read
+)
+
+// summary counts the backups by outcome
+type summary struct {
+	Records  int // Log file records read, including those never backed up
+	Outcomes map[string]int
+}
+
+// failures returns the number of backups that are missing, don't match their record, or couldn't be read
+func (s summary) failures() int {
+	return s.Outcomes[outcomeMissing] + s.Outcomes[outcomeMismatched] + s.Outcomes[outcomeFailed]
+}
+
+// String formats the summary on one line
+func (s summary) String() string {
+	backups := 0
+	for _, n := range s.Outcomes {
+		backups += n
+	}
+	return fmt.Sprintf("Checked %d backups of %d log file records: %d verified, %d unchecked, %d missing, %d mismatched, %d failed",
+		backups, s.Records, s.Outcomes[outcomeVerified], s.Outcomes[outcomeUnchecked], s.Outcomes[outcomeMissing], s.Outcomes[outcomeMismatched], s.Outcomes[outcomeFailed])
+}
+
+// scanRecords calls fn with every log file record in the table, skipping bookkeeping items such as the
+// scanner's enqueue checkpoint and the detector's instance summaries
+func scanRecords(ctx context.Context, client RecordScanner, tableName string, fn func(LogFileRecord)) error {
+	var startKey map[string]types.AttributeValue
+	for {
+		resp, err := client.Scan(ctx, &dynamodb.ScanInput{
+			TableName:         aws.String(tableName),
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return err
+		}
+		for _, item := range resp.Items {
+			var record LogFileRecord
+			if err := attributevalue.UnmarshalMap(item, &record); err != nil {
+				return err
+			}
+			if strings.HasPrefix(record.LogFileName, "#") {
+				continue
+			}
+			fn(record)
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		startKey = resp.LastEvaluatedKey
+	}
+}
+
+// backupKeys returns the keys of a backup: LastS3Key followed by its appended parts
+func backupKeys(record LogFileRecord) []string {
+	keys := []string{record.LastS3Key}
+	for n := int64(1); n <= record.LastPartCount; n++ {
+		keys = append(keys, s3key.PartKey(record.LastS3Key, n))
+	}
+	return keys
+}
+
+// verifyBackup checks the backup of a record, returning its outcome and, unless it was verified, why
+func verifyBackup(ctx context.Context, client ObjectReader, bucketName string, record LogFileRecord, download bool) (string, string) {
+	keys := backupKeys(record)
+	for i, key := range keys {
+		resp, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			var notFound *s3types.NotFound
+			if errors.As(err, &notFound) {
+				return outcomeMissing, fmt.Sprintf("s3://%s/%s not found", bucketName, key)
+			}
+			return outcomeFailed, fmt.Sprintf("failed to read s3://%s/%s: %v", bucketName, key, err)
+		}
+		// The recorded version and size are of the last object uploaded
+		if i < len(keys)-1 {
+			continue
+		}
+		if version := aws.ToString(resp.VersionId); record.LastS3VersionId != "" && version != record.LastS3VersionId {
+			return outcomeMismatched, fmt.Sprintf("s3://%s/%s is version %s, the backup recorded %s", bucketName, key, version, record.LastS3VersionId)
+		}
+		// A delta that appended nothing records a size of 0
+		if size := aws.ToInt64(resp.ContentLength); record.LastPartCount == 0 && record.LastObjectSize > 0 && size != record.LastObjectSize {
+			return outcomeMismatched, fmt.Sprintf("s3://%s/%s is %d bytes, the backup recorded %d", bucketName, key, size, record.LastObjectSize)
+		}
+		// The metadata holds the checksum of the whole file, across all parts. Objects uploaded by earlier
+		// versions have none, and are only compared with -download.
+		metadataKey := checksum.MetadataKey(record.LastChecksumAlgorithm)
+		if sum, ok := resp.Metadata[metadataKey]; ok && record.LastChecksum != "" && sum != record.LastChecksum {
+			return outcomeMismatched, fmt.Sprintf("s3://%s/%s has %s %s, the backup recorded %s", bucketName, key, metadataKey, sum, record.LastChecksum)
+		}
+	}
+
+	if !download {
+		return outcomeVerified, ""
+	}
+	// The checksum is of the raw log file, before it was converted
+	if s3key.Converted(record.LastS3Key) || record.LastChecksum == "" {
+		return outcomeUnchecked, fmt.Sprintf("s3://%s/%s has no checksum of its content to compare with", bucketName, record.LastS3Key)
+	}
+
+	contentHash, err := checksum.New(record.LastChecksumAlgorithm)
+	if err != nil {
+		return outcomeFailed, fmt.Sprintf("s3://%s/%s: %v", bucketName, record.LastS3Key, err)
+	}
+	for _, key := range keys {
+		if err := s3object.Copy(ctx, client, bucketName, key, contentHash); err != nil {
+			return outcomeFailed, fmt.Sprintf("failed to download s3://%s/%s: %v", bucketName, key, err)
+		}
+	}
+	if sum := hex.EncodeToString(contentHash.Sum(nil)); sum != record.LastChecksum {
+		return outcomeMismatched, fmt.Sprintf("s3://%s/%s has %s %s, the backup recorded %s", bucketName, record.LastS3Key, checksum.Normalize(record.LastChecksumAlgorithm), sum, record.LastChecksum)
+	}
+	return outcomeVerified, ""
+}
+
+// run verifies the backups of the records in the table, writing each backup that isn't verified to out
+func run(ctx context.Context, dynamoClient RecordScanner, s3Client ObjectReader, opts options, out io.Writer) (summary, error) {
+	result := summary{Outcomes: make(map[string]int)}
+	err := scanRecords(ctx, dynamoClient, opts.Table, func(record LogFileRecord) {
+		if opts.Instance != "" && record.DBInstanceIdentifier != opts.Instance {
+			return
+		}
+		result.Records++
+		if record.LastBackup == 0 || record.LastS3Key == "" {
+			return
+		}
+
+		bucketName := record.LastS3Bucket
+		if bucketName == "" {
+			bucketName = opts.Bucket
+		}
+		var outcome, reason string
+		if bucketName == "" {
+			outcome, reason = outcomeFailed, "no bucket recorded, set -bucket"
+		} else {
+			outcome, reason = verifyBackup(ctx, s3Client, bucketName, record, opts.Download)
+		}
+		result.Outcomes[outcome]++
+		if outcome != outcomeVerified {
+			fmt.Fprintf(out, "%s %s %s: %s\n", strings.ToUpper(outcome), record.DBInstanceIdentifier, record.LogFileName, reason)
+		}
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to scan table %s: %w", opts.Table, err)
+	}
+	return result, nil
+}
+
+// parseFlags parses the command line into options
+func parseFlags(args []string) (options, error) {
+	var opts options
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	fs.StringVar(&opts.Table, "table", os.Getenv("DYNAMODB_TABLE_NAME"), "DynamoDB table of the log file records")
+	fs.StringVar(&opts.Bucket, "bucket", os.Getenv("S3_BUCKET_NAME"), "S3 bucket of backups whose record doesn't name one")
+	fs.StringVar(&opts.Instance, "instance", "", "only verify the backups of this DB instance")
+	fs.BoolVar(&opts.Download, "download", false, "download every backup and compare its checksum with the recorded one")
+	if err := fs.Parse(args); err != nil {
+		return options{}, err
+	}
+
+	if opts.Table == "" {
+		return options{}, errors.New("required flag not set: -table")
+	}
+	return opts, nil
+}
+
+func main() {
+	logger := log.New(os.Stderr, "", 0)
+
+	opts, err := parseFlags(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		logger.Fatalf("Error: %v\n", err)
+	}
+
+	ctx := context.Background()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		logger.Fatalf("Error loading AWS config: %v\n", err)
+	}
+
+	result, err := run(ctx, dynamodb.NewFromConfig(cfg), s3.NewFromConfig(cfg), opts, os.Stdout)
+	fmt.Println(result)
+	if err != nil {
+		logger.Fatalf("Error: %v\n", err)
+	}
+	if result.failures() > 0 {
+		os.Exit(1)
+	}
+}
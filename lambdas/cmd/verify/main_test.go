@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const key = "logs/db-1/2023/11/14/audit/server_audit.log.1700000000000"
+
+// fakeRecords returns one record per Scan page
+type fakeRecords struct {
+	records []LogFileRecord
+}
+
+func (f *fakeRecords) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	start := 0
+	if params.ExclusiveStartKey != nil {
+		start, _ = strconv.Atoi(params.ExclusiveStartKey["page"].(*types.AttributeValueMemberN).Value)
+	}
+	resp := &dynamodb.ScanOutput{}
+	if start < len(f.records) {
+		item, err := attributevalue.MarshalMap(f.records[start])
+		if err != nil {
+			return nil, err
+		}
+		resp.Items = append(resp.Items, item)
+	}
+	if start+1 < len(f.records) {
+		resp.LastEvaluatedKey = map[string]types.AttributeValue{"page": &types.AttributeValueMemberN{Value: strconv.Itoa(start + 1)}}
+	}
+	return resp, nil
+}
+
+// object is an object in fakeS3
+type object struct {
+	body     []byte
+	version  string
+	metadata map[string]string
+}
+
+// fakeS3 serves objects by bucket and key
+type fakeS3 struct {
+	objects map[string]object
+	gets    int
+}
+
+func (f *fakeS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	o, ok := f.objects[aws.ToString(params.Bucket)+"/"+aws.ToString(params.Key)]
+	if !ok {
+		return nil, &s3types.NotFound{}
+	}
+	resp := &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(o.body))), Metadata: o.metadata}
+	if o.version != "" {
+		resp.VersionId = aws.String(o.version)
+	}
+	return resp, nil
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.gets++
+	o, ok := f.objects[aws.ToString(params.Bucket)+"/"+aws.ToString(params.Key)]
+	if !ok {
+		return nil, &s3types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(o.body))}, nil
+}
+
+// gzipped compresses data as one gzip member
+func gzipped(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	io.WriteString(zw, data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func md5Hex(data string) string {
+	sum := md5.Sum([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestVerifyBackup(t *testing.T) {
+	content := "line 1\nline 2\n"
+	whole := LogFileRecord{LastBackup: 1, LastChecksum: md5Hex(content), LastS3Key: key, LastObjectSize: int64(len(content))}
+
+	tests := []struct {
+		name     string
+		objects  map[string]object
+		record   LogFileRecord
+		download bool
+		want     string
+		wantGets bool
+	}{
+		{
+			name:    "whole file",
+			objects: map[string]object{"bucket/" + key: {body: []byte(content)}},
+			record:  whole,
+			want:    outcomeVerified,
+		},
+		{name: "missing", record: whole, want: outcomeMissing},
+		{
+			name:    "size changed",
+			objects: map[string]object{"bucket/" + key: {body: []byte("line 1\n")}},
+			record:  whole,
+			want:    outcomeMismatched,
+		},
+		{
+			name:    "overwritten",
+			objects: map[string]object{"bucket/" + key: {body: []byte(content), version: "v2"}},
+			record:  LogFileRecord{LastBackup: 1, LastChecksum: md5Hex(content), LastS3Key: key, LastS3VersionId: "v1"},
+			want:    outcomeMismatched,
+		},
+		{
+			name:    "checksum metadata",
+			objects: map[string]object{"bucket/" + key: {body: []byte(content), metadata: map[string]string{"content-md5": md5Hex(content)}}},
+			record:  whole,
+			want:    outcomeVerified,
+		},
+		{
+			name:    "checksum metadata changed",
+			objects: map[string]object{"bucket/" + key: {body: []byte(content), metadata: map[string]string{"content-md5": md5Hex("line 1\nline 3\n")}}},
+			record:  whole,
+			want:    outcomeMismatched,
+		},
+		{
+			name:    "checksum metadata of another algorithm",
+			objects: map[string]object{"bucket/" + key: {body: []byte(content), metadata: map[string]string{"content-sha256": sha256Hex(content)}}},
+			record:  whole,
+			want:    outcomeVerified,
+		},
+		{
+			name:    "SHA-256 checksum metadata changed",
+			objects: map[string]object{"bucket/" + key: {body: []byte(content), metadata: map[string]string{"content-sha256": sha256Hex("line 1\n")}}},
+			record:  LogFileRecord{LastBackup: 1, LastChecksum: sha256Hex(content), LastChecksumAlgorithm: "sha256", LastS3Key: key},
+			want:    outcomeMismatched,
+		},
+		{
+			name: "checksum metadata of the last part",
+			objects: map[string]object{
+				"bucket/" + key:            {body: []byte("line 1\n"), metadata: map[string]string{"content-md5": md5Hex("line 1\n")}},
+				"bucket/" + key + ".part1": {body: []byte("line 2\n"), metadata: map[string]string{"content-md5": md5Hex(content)}},
+			},
+			record: LogFileRecord{LastBackup: 1, LastChecksum: md5Hex(content), LastS3Key: key, LastPartCount: 1},
+			want:   outcomeVerified,
+		},
+		{
+			name:     "tampered with the same size",
+			objects:  map[string]object{"bucket/" + key: {body: []byte("line 1\nline 3\n")}},
+			record:   whole,
+			download: true,
+			want:     outcomeMismatched,
+			wantGets: true,
+		},
+		{
+			name:     "downloaded",
+			objects:  map[string]object{"bucket/" + key: {body: []byte(content)}},
+			record:   whole,
+			download: true,
+			want:     outcomeVerified,
+			wantGets: true,
+		},
+		{
+			name:     "downloaded with SHA-256",
+			objects:  map[string]object{"bucket/" + key: {body: []byte(content)}},
+			record:   LogFileRecord{LastBackup: 1, LastChecksum: sha256Hex(content), LastChecksumAlgorithm: "sha256", LastS3Key: key},
+			download: true,
+			want:     outcomeVerified,
+			wantGets: true,
+		},
+		{
+			name:     "tampered with SHA-256",
+			objects:  map[string]object{"bucket/" + key: {body: []byte("line 1\nline 3\n")}},
+			record:   LogFileRecord{LastBackup: 1, LastChecksum: sha256Hex(content), LastChecksumAlgorithm: "sha256", LastS3Key: key},
+			download: true,
+			want:     outcomeMismatched,
+			wantGets: true,
+		},
+		{
+			name: "compressed parts",
+			objects: map[string]object{
+				"bucket/" + key + ".gz":       {body: gzipped(t, "line 1\n")},
+				"bucket/" + key + ".part1.gz": {body: gzipped(t, "line 2\n"), version: "v1"},
+			},
+			record:   LogFileRecord{LastBackup: 1, LastChecksum: md5Hex(content), LastS3Key: key + ".gz", LastS3VersionId: "v1", LastPartCount: 1},
+			download: true,
+			want:     outcomeVerified,
+			wantGets: true,
+		},
+		{
+			name:    "missing part",
+			objects: map[string]object{"bucket/" + key: {body: []byte("line 1\n")}},
+			record:  LogFileRecord{LastBackup: 1, LastChecksum: md5Hex(content), LastS3Key: key, LastPartCount: 1},
+			want:    outcomeMissing,
+		},
+		{
+			name:     "NDJSON",
+			objects:  map[string]object{"bucket/" + key + ".ndjson": {body: []byte(`{"line":1}` + "\n")}},
+			record:   LogFileRecord{LastBackup: 1, LastChecksum: md5Hex(content), LastS3Key: key + ".ndjson"},
+			download: true,
+			want:     outcomeUnchecked,
+		},
+		{
+			name:     "JSON Lines",
+			objects:  map[string]object{"bucket/" + key + ".jsonl": {body: []byte(`{"raw":"line 1"}` + "\n")}},
+			record:   LogFileRecord{LastBackup: 1, LastChecksum: md5Hex(content), LastS3Key: key + ".jsonl"},
+			download: true,
+			want:     outcomeUnchecked,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeS3{objects: tt.objects}
+			got, reason := verifyBackup(context.Background(), client, "bucket", tt.record, tt.download)
+			if got != tt.want {
+				t.Errorf("verifyBackup() = %s (%s), want %s", got, reason, tt.want)
+			}
+			if (client.gets > 0) != tt.wantGets {
+				t.Errorf("downloaded %d objects, want downloads %v", client.gets, tt.wantGets)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	content := "line 1\n"
+	records := &fakeRecords{records: []LogFileRecord{
+		{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log", LastBackup: 1, LastChecksum: md5Hex(content), LastS3Key: key, LastS3Bucket: "bucket"},
+		{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log.1", LastBackup: 1, LastChecksum: md5Hex(content), LastS3Key: key + "1"}, // Recorded before LastS3Bucket
+		{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log.2"},                                                                     // Never backed up
+		{DBInstanceIdentifier: "db-1", LogFileName: "#SUMMARY"},
+		{DBInstanceIdentifier: "db-2", LogFileName: "audit/server_audit.log", LastBackup: 1, LastChecksum: md5Hex(content), LastS3Key: "logs/db-2/server_audit.log", LastS3Bucket: "bucket"},
+	}}
+	client := &fakeS3{objects: map[string]object{
+		"bucket/" + key:        {body: []byte(content)},
+		"default/" + key + "1": {body: []byte(content)},
+	}}
+
+	var out bytes.Buffer
+	got, err := run(context.Background(), records, client, options{Table: "table", Bucket: "default"}, &out)
+	if err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if got.Records != 4 || got.Outcomes[outcomeVerified] != 2 || got.Outcomes[outcomeMissing] != 1 || got.failures() != 1 {
+		t.Errorf("run() = %v, want 2 of 4 records verified and 1 missing", got)
+	}
+	if want := "MISSING db-2 audit/server_audit.log: s3://bucket/logs/db-2/server_audit.log not found\n"; out.String() != want {
+		t.Errorf("reported %q, want %q", out.String(), want)
+	}
+
+	out.Reset()
+	got, err = run(context.Background(), records, client, options{Table: "table", Instance: "db-1"}, &out)
+	if err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if got.Records != 3 || got.Outcomes[outcomeFailed] != 1 || !strings.Contains(out.String(), "set -bucket") {
+		t.Errorf("run() = %v, reported %q, want the record without a bucket failed", got, out.String())
+	}
+}
+
+func TestSummaryString(t *testing.T) {
+	s := summary{Records: 5, Outcomes: map[string]int{outcomeVerified: 2, outcomeMismatched: 1}}
+	want := "Checked 3 backups of 5 log file records: 2 verified, 0 unchecked, 0 missing, 1 mismatched, 0 failed"
+	if got := s.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+
+	opts, err := parseFlags([]string{"-instance", "db-1", "-download"})
+	if err != nil {
+		t.Fatalf("parseFlags() error = %v", err)
+	}
+	if want := (options{Table: "table", Bucket: "bucket", Instance: "db-1", Download: true}); opts != want {
+		t.Errorf("parseFlags() = %+v, want %+v", opts, want)
+	}
+
+	t.Setenv("DYNAMODB_TABLE_NAME", "")
+	if _, err := parseFlags(nil); err == nil {
+		t.Error("parseFlags() error = nil, want the missing -table")
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/aws/smithy-go"
+)
+
+// rdsCheckTimeout bounds the connectivity check, well below the time the SDK would otherwise spend retrying
+// an unreachable endpoint
+const rdsCheckTimeout = 5 * time.Second
+
+// rdsCheckMaxRecords is the smallest page DescribeDBInstances accepts, which keeps the check cheap
+const rdsCheckMaxRecords = 20
+
+// checkRDSConnectivity makes a lightweight DescribeDBInstances call with a short timeout before the scan.
+// The Lambdas run in private subnets without a NAT gateway and reach RDS only through its interface VPC
+// endpoint, so an endpoint that is missing or unreachable would otherwise leave the scan hanging until the
+// Lambda times out with a generic dial error.
+func checkRDSConnectivity(ctx context.Context, client DescribeDBInstancesAPI, region string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	_, err := client.DescribeDBInstances(ctx, &rds.DescribeDBInstancesInput{MaxRecords: aws.Int32(rdsCheckMaxRecords)})
+	if err == nil {
+		return nil
+	}
+
+	// An error response, such as AccessDenied, means the RDS API was reached
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return fmt.Errorf("checking RDS API in region %s: %w", region, err)
+	}
+	return fmt.Errorf("can't reach the RDS API in region %s within %s; the Lambda has no NAT gateway, so check that "+
+		"the com.amazonaws.%s.rds interface VPC endpoint is in the Lambda's subnets, has private DNS enabled and "+
+		"a security group allowing HTTPS from the Lambda: %w", region, timeout, region, err)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/aws/smithy-go"
+)
+
+// hangingRDS blocks every call until its context is done, like an unreachable endpoint
+type hangingRDS struct{}
+
+func (hangingRDS) DescribeDBInstances(ctx context.Context, params *rds.DescribeDBInstancesInput, optFns ...func(*rds.Options)) (*rds.DescribeDBInstancesOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestCheckRDSConnectivity(t *testing.T) {
+	tests := []struct {
+		name        string
+		client      DescribeDBInstancesAPI
+		wantErr     bool
+		wantVPCHint bool
+	}{
+		{name: "reachable", client: &fakeRDS{}},
+		{name: "denied", client: &fakeRDS{err: &smithy.GenericAPIError{Code: "AccessDenied"}}, wantErr: true},
+		{name: "dial error", client: &fakeRDS{err: errors.New("dial tcp 10.0.1.5:443: i/o timeout")}, wantErr: true, wantVPCHint: true},
+		{name: "hanging", client: hangingRDS{}, wantErr: true, wantVPCHint: true},
+	}
+
+	for _, tt := range tests {
+		err := checkRDSConnectivity(context.Background(), tt.client, "ap-southeast-1", 10*time.Millisecond)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkRDSConnectivity() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil {
+			continue
+		}
+		if got := strings.Contains(err.Error(), "com.amazonaws.ap-southeast-1.rds interface VPC endpoint"); got != tt.wantVPCHint {
+			t.Errorf("%s: checkRDSConnectivity() error = %v, want VPC endpoint hint %v", tt.name, err, tt.wantVPCHint)
+		}
+	}
+
+	// The check's own timeout is reported, not the scan's
+	err := checkRDSConnectivity(context.Background(), hangingRDS{}, "ap-southeast-1", 10*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("checkRDSConnectivity() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestHandleChecksRDSConnectivity(t *testing.T) {
+	t.Setenv("SQS_QUEUE_URL", "queue")
+	t.Setenv("MAX_ENQUEUE_PER_RUN", "")
+	t.Setenv("REGIONS", "")
+
+	rdsClient := &fakeRDS{err: errors.New("dial tcp 10.0.1.5:443: i/o timeout")}
+	sqsClient := &fakeSQS{}
+	deps := HandlerDeps{RDS: rdsClient, SQS: sqsClient, DynamoDB: &fakeCheckpoints{}, Region: "ap-southeast-1"}
+	_, err := NewHandler(deps)(context.Background(), Event{})
+	if err == nil || !strings.Contains(err.Error(), "VPC endpoint") {
+		t.Errorf("handler error = %v, want the VPC endpoint hint", err)
+	}
+	if rdsClient.checks != 1 || len(rdsClient.markers) != 0 {
+		t.Errorf("made %d checks and scanned %v, want one check and no scan", rdsClient.checks, rdsClient.markers)
+	}
+	if len(sqsClient.sent) != 0 {
+		t.Errorf("sent = %v, want nothing", sqsClient.sent)
+	}
+}
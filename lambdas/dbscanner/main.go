@@ -2,15 +2,30 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go-v2/service/rds"
 	"github.com/aws/aws-sdk-go-v2/service/rds/types"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/aurora"
 )
 
 // Event represents the input event for the Lambda function
@@ -20,67 +35,302 @@ type Event struct {
 
 // Response represents the output of the Lambda function
 type Response struct {
-	InstancesFound int    `json:"instancesFound"`
-	QueueURL       string `json:"queueUrl"`
-	Message        string `json:"message"`
+	InstancesFound    int      `json:"instancesFound"`
+	InstancesEnqueued int      `json:"instancesEnqueued"`
+	DeferredInstances []string `json:"deferredInstances,omitempty"`
+	QueueURL          string   `json:"queueUrl"`
+	Message           string   `json:"message"`
 }
 
-// Handler is the Lambda function handler
+// checkpointSortKey is the LogFileName used for the per-instance enqueue checkpoint item.
+// Sort keys starting with "#" are reserved for bookkeeping items and are ignored by the downloader.
+const checkpointSortKey = "#CHECKPOINT"
+
+// maxDelaySeconds is the longest DelaySeconds SQS accepts for a message
+const maxDelaySeconds = 900
+
+// DescribeDBInstancesAPI is the subset of the RDS client used by the scanner
+type DescribeDBInstancesAPI interface {
+	DescribeDBInstances(ctx context.Context, params *rds.DescribeDBInstancesInput, optFns ...func(*rds.Options)) (*rds.DescribeDBInstancesOutput, error)
+}
+
+// SendMessageAPI is the subset of the SQS client used by the scanner
+type SendMessageAPI interface {
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+}
+
+// CheckpointAPI is the subset of the DynamoDB client used for the enqueue checkpoints
+type CheckpointAPI interface {
+	BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error)
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+}
+
+// HandlerDeps holds the AWS clients used by the handler
+type HandlerDeps struct {
+	RDS      DescribeDBInstancesAPI // RDS client of the Lambda's region
+	SQS      SendMessageAPI
+	DynamoDB CheckpointAPI
+	// Region is the Lambda's region, which is scanned when REGIONS is not set
+	Region string
+	// RegionalRDS holds the RDS clients of the other regions listed in REGIONS
+	RegionalRDS map[string]DescribeDBInstancesAPI
+}
+
+// instanceMessage is the SQS message body naming an instance, its cluster and its region.
+// The Log File Detector still accepts a plain instance ID, which it looks up in its own region.
+type instanceMessage struct {
+	InstanceID string `json:"instanceId"`
+	// ClusterID is the instance's DB cluster, which the detector stores on its log file records
+	ClusterID string `json:"clusterId,omitempty"`
+	Region    string `json:"region,omitempty"`
+}
+
+// regionPattern matches AWS region names such as us-east-1 and ap-southeast-1
+var regionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+
+// requiredEnvVars are the environment variables the scanner can't run without
+var requiredEnvVars = []string{"SQS_QUEUE_URL"}
+
+// validateConfig returns an error naming every required environment variable that is not set
+func validateConfig() error {
+	var missing []string
+	for _, name := range requiredEnvVars {
+		if os.Getenv(name) == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("required environment variables not set: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// NewHandlerDeps creates the AWS clients from the given configuration, with an RDS client
+// for every other region listed in REGIONS
+func NewHandlerDeps(cfg aws.Config) HandlerDeps {
+	rdsCfg := rdsConfig(cfg)
+	regionalRDS := make(map[string]DescribeDBInstancesAPI)
+
+	// An invalid REGIONS is reported by the handler, which then fails every invocation
+	regions, _ := parseRegions(os.Getenv("REGIONS"), cfg.Region)
+	for _, region := range regions {
+		if region == cfg.Region {
+			continue
+		}
+		regionalCfg := rdsCfg.Copy()
+		regionalCfg.Region = region
+		regionalRDS[region] = rds.NewFromConfig(regionalCfg)
+	}
+
+	return HandlerDeps{
+		RDS:         rds.NewFromConfig(rdsCfg),
+		SQS:         sqs.NewFromConfig(cfg),
+		DynamoDB:    dynamodb.NewFromConfig(cfg),
+		Region:      cfg.Region,
+		RegionalRDS: regionalRDS,
+	}
+}
+
+// parseRegions parses the comma-separated REGIONS value, defaulting to the Lambda's region.
+// Duplicates are dropped, keeping the first occurrence.
+func parseRegions(value, defaultRegion string) ([]string, error) {
+	var regions []string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || slices.Contains(regions, entry) {
+			continue
+		}
+		if !regionPattern.MatchString(entry) {
+			return nil, fmt.Errorf("invalid region %q", entry)
+		}
+		regions = append(regions, entry)
+	}
+	if len(regions) == 0 {
+		return []string{defaultRegion}, nil
+	}
+	return regions, nil
+}
+
+// rdsClient returns the RDS client of a region, or nil if there is none
+func (deps HandlerDeps) rdsClient(region string) DescribeDBInstancesAPI {
+	if region == deps.Region {
+		return deps.RDS
+	}
+	return deps.RegionalRDS[region]
+}
+
+// rdsConfig returns the configuration for the RDS client. When ASSUME_ROLE_ARN is set, the RDS client
+// assumes that role to reach instances in another account; the other clients stay in the local account.
+func rdsConfig(cfg aws.Config) aws.Config {
+	roleARN := os.Getenv("ASSUME_ROLE_ARN")
+	if roleARN == "" {
+		return cfg
+	}
+
+	rdsCfg := cfg.Copy()
+	rdsCfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), roleARN))
+	return rdsCfg
+}
+
+// NewHandler returns a Lambda function handler using the given clients
+func NewHandler(deps HandlerDeps) func(ctx context.Context, event Event) (Response, error) {
+	return deps.handle
+}
+
+// Handler is the Lambda function handler.
+// It creates the AWS clients on every invocation; main uses NewHandler to create them once per cold start.
 func Handler(ctx context.Context, event Event) (Response, error) {
+	// Load AWS configuration
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		log.Printf("Error loading AWS config: %v\n", err)
+		return Response{}, err
+	}
+
+	return NewHandler(NewHandlerDeps(cfg))(ctx, event)
+}
+
+// handle scans for Aurora MySQL instances and sends their IDs to SQS
+func (deps HandlerDeps) handle(ctx context.Context, event Event) (Response, error) {
 	// Initialize logger
 	logger := log.New(os.Stdout, "", log.LstdFlags)
 	logger.Println("Starting DB Instance Scanner Lambda")
 
+	// Fail the invocation when required settings are missing, so it is retried and alarmed on
+	if err := validateConfig(); err != nil {
+		logger.Printf("Error: %v\n", err)
+		return Response{}, err
+	}
+
 	// Get SQS queue URL from environment variable
 	queueURL := os.Getenv("SQS_QUEUE_URL")
-	if queueURL == "" {
-		logger.Println("Error: SQS_QUEUE_URL environment variable not set")
-		return Response{}, nil
+
+	// Get the optional per-run enqueue limit (0 means unlimited)
+	maxEnqueue := 0
+	if maxEnqueueStr := os.Getenv("MAX_ENQUEUE_PER_RUN"); maxEnqueueStr != "" {
+		val, err := strconv.Atoi(maxEnqueueStr)
+		if err != nil || val < 0 {
+			err = fmt.Errorf("invalid MAX_ENQUEUE_PER_RUN value %q", maxEnqueueStr)
+			logger.Printf("Error: %v\n", err)
+			return Response{}, err
+		}
+		maxEnqueue = val
 	}
 
-	// Load AWS configuration
-	cfg, err := config.LoadDefaultConfig(ctx)
+	// Seconds over which the messages of a run are spread with DelaySeconds (0 sends them all at once)
+	scanSpread := 0
+	if value := os.Getenv("SCAN_SPREAD_SECONDS"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			err = fmt.Errorf("invalid SCAN_SPREAD_SECONDS value %q", value)
+			logger.Printf("Error: %v\n", err)
+			return Response{}, err
+		}
+		scanSpread = seconds
+	}
+	if scanSpread > 0 && isFIFOQueue(queueURL) {
+		// FIFO queues only support a delay for the whole queue
+		logger.Printf("Warning: SCAN_SPREAD_SECONDS is ignored for FIFO queue %s\n", queueURL)
+		scanSpread = 0
+	}
+
+	// Instances whose identifier matches EXCLUDE_PATTERN, e.g. ephemeral clones, are never enqueued
+	excludePattern, err := aurora.ParseExcludePattern(os.Getenv("EXCLUDE_PATTERN"))
 	if err != nil {
-		logger.Printf("Error loading AWS config: %v\n", err)
+		logger.Printf("Error: %v\n", err)
 		return Response{}, err
 	}
 
-	// Create RDS client
-	rdsClient := rds.NewFromConfig(cfg)
-
-	// Create SQS client
-	sqsClient := sqs.NewFromConfig(cfg)
+	// The enqueue checkpoints live in the DynamoDB table, which is required to limit the enqueue rate
+	tableName := os.Getenv("DYNAMODB_TABLE_NAME")
+	if maxEnqueue > 0 && tableName == "" {
+		err := errors.New("DYNAMODB_TABLE_NAME environment variable must be set when MAX_ENQUEUE_PER_RUN is used")
+		logger.Printf("Error: %v\n", err)
+		return Response{}, err
+	}
 
-	// Get all DB instances
-	instances, err := getDBInstances(ctx, rdsClient, logger)
+	// Regions scanned for DB instances
+	regions, err := parseRegions(os.Getenv("REGIONS"), deps.Region)
 	if err != nil {
-		logger.Printf("Error getting DB instances: %v\n", err)
+		err = fmt.Errorf("invalid REGIONS value %q: %w", os.Getenv("REGIONS"), err)
+		logger.Printf("Error: %v\n", err)
 		return Response{}, err
 	}
 
+	// Get all DB instances of every region
+	var instances []types.DBInstance
+	for _, region := range regions {
+		client := deps.rdsClient(region)
+		if client == nil {
+			err := fmt.Errorf("no RDS client for region %s", region)
+			logger.Printf("Error: %v\n", err)
+			return Response{}, err
+		}
+
+		// Fail fast with a clear error when the RDS API can't be reached from the Lambda's subnets
+		if err := checkRDSConnectivity(ctx, client, region, rdsCheckTimeout); err != nil {
+			logger.Printf("Error: %v\n", err)
+			return Response{}, err
+		}
+
+		regionInstances, err := getDBInstances(ctx, client, logger)
+		if err != nil {
+			logger.Printf("Error getting DB instances in region %s: %v\n", region, err)
+			return Response{}, err
+		}
+		instances = append(instances, regionInstances...)
+	}
+
 	// Filter for Aurora MySQL instances
-	auroraInstances := filterAuroraInstances(instances, logger)
+	auroraInstances := filterAuroraInstances(instances, excludePattern, logger)
 	logger.Printf("Found %d Aurora MySQL instances\n", len(auroraInstances))
 
-	// Send each instance ID to SQS
-	for _, instance := range auroraInstances {
-		err := sendToSQS(ctx, sqsClient, queueURL, *instance.DBInstanceIdentifier, logger)
+	// Limit the number of instances enqueued in this run, favouring the ones waiting the longest
+	toEnqueue := auroraInstances
+	var deferred []string
+	if maxEnqueue > 0 && len(auroraInstances) > maxEnqueue {
+		lastEnqueued, err := getLastEnqueued(ctx, deps.DynamoDB, tableName, auroraInstances, logger)
+		if err != nil {
+			logger.Printf("Error getting enqueue checkpoints: %v\n", err)
+			return Response{}, err
+		}
+
+		toEnqueue, deferred = selectInstancesToEnqueue(auroraInstances, lastEnqueued, maxEnqueue)
+		logger.Printf("Deferring %d instances to the next run (MAX_ENQUEUE_PER_RUN=%d): %v\n", len(deferred), maxEnqueue, deferred)
+	}
+
+	// Send each instance ID to SQS, delayed by its share of the spread so detection staggers over the interval
+	enqueued := 0
+	for i, instance := range toEnqueue {
+		delay := spreadDelay(i, len(toEnqueue), scanSpread)
+		err := sendToSQS(ctx, deps.SQS, queueURL, deps.message(instance), delay, logger)
 		if err != nil {
 			logger.Printf("Error sending instance ID to SQS: %v\n", err)
 			// Continue with other instances even if one fails
 			continue
 		}
+		enqueued++
+
+		// Record the enqueue time so the next limited run can pick the oldest instances first
+		if tableName != "" {
+			err = updateLastEnqueued(ctx, deps.DynamoDB, tableName, *instance.DBInstanceIdentifier, logger)
+			if err != nil {
+				logger.Printf("Error updating enqueue checkpoint: %v\n", err)
+			}
+		}
 	}
 
 	return Response{
-		InstancesFound: len(auroraInstances),
-		QueueURL:       queueURL,
-		Message:        "Successfully sent Aurora MySQL instance IDs to SQS",
+		InstancesFound:    len(auroraInstances),
+		InstancesEnqueued: enqueued,
+		DeferredInstances: deferred,
+		QueueURL:          queueURL,
+		Message:           "Successfully sent Aurora MySQL instance IDs to SQS",
 	}, nil
 }
 
-// getDBInstances gets all DB instances in the current region
-func getDBInstances(ctx context.Context, client *rds.Client, logger *log.Logger) ([]types.DBInstance, error) {
+// getDBInstances gets all DB instances in the region of the client
+func getDBInstances(ctx context.Context, client DescribeDBInstancesAPI, logger *log.Logger) ([]types.DBInstance, error) {
 	logger.Println("Getting all DB instances")
 
 	var instances []types.DBInstance
@@ -108,33 +358,193 @@ func getDBInstances(ctx context.Context, client *rds.Client, logger *log.Logger)
 	return instances, nil
 }
 
-// filterAuroraInstances filters for Aurora MySQL instances
-func filterAuroraInstances(instances []types.DBInstance, logger *log.Logger) []types.DBInstance {
+// filterAuroraInstances filters for Aurora MySQL instances, without those whose identifier matches exclude
+// (nil excludes none)
+func filterAuroraInstances(instances []types.DBInstance, exclude *regexp.Regexp, logger *log.Logger) []types.DBInstance {
 	logger.Println("Filtering for Aurora MySQL instances")
 
-	var auroraInstances []types.DBInstance
-	for _, instance := range instances {
-		// Check if it's an Aurora MySQL instance
-		if instance.Engine != nil && (*instance.Engine == "aurora-mysql" || *instance.Engine == "aurora") {
-			auroraInstances = append(auroraInstances, instance)
-		}
+	auroraInstances, excluded := aurora.MySQLInstances(instances, exclude)
+	if exclude != nil {
+		logger.Printf("Excluded %d Aurora MySQL instances matching EXCLUDE_PATTERN %q\n", excluded, exclude)
 	}
-
 	return auroraInstances
 }
 
-// sendToSQS sends a DB instance ID to the SQS queue
-func sendToSQS(ctx context.Context, client *sqs.Client, queueURL string, instanceID string, logger *log.Logger) error {
-	logger.Printf("Sending instance ID %s to SQS\n", instanceID)
+// message returns the SQS message of an instance. Its region is taken from its ARN, or is the Lambda's region
+// when it has none.
+func (deps HandlerDeps) message(instance types.DBInstance) instanceMessage {
+	region := deps.Region
+	if parsed, err := arn.Parse(aws.ToString(instance.DBInstanceArn)); err == nil && parsed.Region != "" {
+		region = parsed.Region
+	}
+	return instanceMessage{
+		InstanceID: aws.ToString(instance.DBInstanceIdentifier),
+		ClusterID:  aws.ToString(instance.DBClusterIdentifier),
+		Region:     region,
+	}
+}
+
+// spreadDelay returns the DelaySeconds of the index-th of count messages spread evenly over spread seconds,
+// capped at the 15 minutes SQS allows
+func spreadDelay(index, count, spread int) int32 {
+	if spread <= 0 || count <= 0 {
+		return 0
+	}
+	return int32(min(index*spread/count, maxDelaySeconds))
+}
+
+// sendToSQS sends the message of a DB instance to the SQS queue as a JSON object, delivered after delaySeconds.
+// On a FIFO queue, the messages of an instance share a message group, so the Log Detector processes them one at
+// a time, and the queue's content-based deduplication drops an instance enqueued again within 5 minutes.
+func sendToSQS(ctx context.Context, client SendMessageAPI, queueURL string, message instanceMessage, delaySeconds int32, logger *log.Logger) error {
+	logger.Printf("Sending instance ID %s (%s) to SQS with a delay of %ds\n", message.InstanceID, message.Region, delaySeconds)
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
 
-	_, err := client.SendMessage(ctx, &sqs.SendMessageInput{
+	input := &sqs.SendMessageInput{
 		QueueUrl:    aws.String(queueURL),
-		MessageBody: aws.String(instanceID),
+		MessageBody: aws.String(string(body)),
+	}
+	if isFIFOQueue(queueURL) {
+		input.MessageGroupId = aws.String(message.InstanceID)
+	}
+	if delaySeconds > 0 {
+		input.DelaySeconds = delaySeconds
+	}
+	_, err = client.SendMessage(ctx, input)
+
+	return err
+}
+
+// isFIFOQueue reports whether a queue URL names a FIFO queue, whose names end in .fifo
+func isFIFOQueue(queueURL string) bool {
+	return strings.HasSuffix(queueURL, ".fifo")
+}
+
+// getLastEnqueued gets the LastEnqueued checkpoint for each instance from DynamoDB.
+// Instances without a checkpoint are omitted from the result.
+func getLastEnqueued(ctx context.Context, client CheckpointAPI, tableName string, instances []types.DBInstance, logger *log.Logger) (map[string]int64, error) {
+	logger.Printf("Getting enqueue checkpoints for %d instances\n", len(instances))
+
+	lastEnqueued := make(map[string]int64)
+
+	// BatchGetItem accepts at most 100 keys per request
+	const batchSize = 100
+	for start := 0; start < len(instances); start += batchSize {
+		end := start + batchSize
+		if end > len(instances) {
+			end = len(instances)
+		}
+
+		keys := make([]map[string]dynamodbtypes.AttributeValue, 0, end-start)
+		for _, instance := range instances[start:end] {
+			keys = append(keys, map[string]dynamodbtypes.AttributeValue{
+				"DBInstanceIdentifier": &dynamodbtypes.AttributeValueMemberS{Value: *instance.DBInstanceIdentifier},
+				"LogFileName":          &dynamodbtypes.AttributeValueMemberS{Value: checkpointSortKey},
+			})
+		}
+
+		requestItems := map[string]dynamodbtypes.KeysAndAttributes{
+			tableName: {
+				Keys:                 keys,
+				ProjectionExpression: aws.String("DBInstanceIdentifier, LastEnqueued"),
+			},
+		}
+
+		// Keep requesting until DynamoDB has returned every key
+		for len(requestItems) > 0 {
+			resp, err := client.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+				RequestItems: requestItems,
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			for _, item := range resp.Responses[tableName] {
+				id, ok := item["DBInstanceIdentifier"].(*dynamodbtypes.AttributeValueMemberS)
+				if !ok {
+					continue
+				}
+				value, ok := item["LastEnqueued"].(*dynamodbtypes.AttributeValueMemberN)
+				if !ok {
+					continue
+				}
+				val, err := strconv.ParseInt(value.Value, 10, 64)
+				if err != nil {
+					logger.Printf("Error parsing LastEnqueued for instance %s: %v\n", id.Value, err)
+					continue
+				}
+				lastEnqueued[id.Value] = val
+			}
+
+			requestItems = resp.UnprocessedKeys
+		}
+	}
+
+	return lastEnqueued, nil
+}
+
+// selectInstancesToEnqueue picks up to limit instances with the oldest LastEnqueued checkpoint.
+// Instances that have never been enqueued go first. The remaining instance IDs are returned as deferred.
+func selectInstancesToEnqueue(instances []types.DBInstance, lastEnqueued map[string]int64, limit int) ([]types.DBInstance, []string) {
+	sorted := make([]types.DBInstance, len(instances))
+	copy(sorted, instances)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		idI, idJ := *sorted[i].DBInstanceIdentifier, *sorted[j].DBInstanceIdentifier
+		if lastEnqueued[idI] != lastEnqueued[idJ] {
+			return lastEnqueued[idI] < lastEnqueued[idJ]
+		}
+		return idI < idJ
+	})
+
+	if len(sorted) <= limit {
+		return sorted, nil
+	}
+
+	var deferred []string
+	for _, instance := range sorted[limit:] {
+		deferred = append(deferred, *instance.DBInstanceIdentifier)
+	}
+
+	return sorted[:limit], deferred
+}
+
+// updateLastEnqueued records the time an instance was last sent to SQS
+func updateLastEnqueued(ctx context.Context, client CheckpointAPI, tableName string, instanceID string, logger *log.Logger) error {
+	logger.Printf("Updating enqueue checkpoint for instance %s\n", instanceID)
+
+	now := time.Now().Unix()
+
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"DBInstanceIdentifier": &dynamodbtypes.AttributeValueMemberS{Value: instanceID},
+			"LogFileName":          &dynamodbtypes.AttributeValueMemberS{Value: checkpointSortKey},
+		},
+		UpdateExpression: aws.String("SET LastEnqueued = :lastEnqueued"),
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":lastEnqueued": &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(now, 10)},
+		},
 	})
 
 	return err
 }
 
 func main() {
-	lambda.Start(Handler)
+	// Fail the cold start instead of every invocation when the configuration is incomplete
+	if err := validateConfig(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+
+	// Load AWS configuration once per cold start
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Error loading AWS config: %v\n", err)
+	}
+
+	lambda.Start(NewHandler(NewHandlerDeps(cfg)))
 }
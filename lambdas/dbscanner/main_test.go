@@ -0,0 +1,674 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/aws/aws-sdk-go-v2/service/rds/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// fakeRDS returns one page of DB instances per DescribeDBInstances call.
+// Connectivity checks, which set MaxRecords, are counted and return no instances.
+type fakeRDS struct {
+	pages   []*rds.DescribeDBInstancesOutput
+	err     error
+	markers []string
+	checks  int
+}
+
+func (f *fakeRDS) DescribeDBInstances(ctx context.Context, params *rds.DescribeDBInstancesInput, optFns ...func(*rds.Options)) (*rds.DescribeDBInstancesOutput, error) {
+	if params.MaxRecords != nil {
+		f.checks++
+		if f.err != nil {
+			return nil, f.err
+		}
+		return &rds.DescribeDBInstancesOutput{}, nil
+	}
+	f.markers = append(f.markers, aws.ToString(params.Marker))
+	if f.err != nil {
+		return nil, f.err
+	}
+	page := f.pages[0]
+	f.pages = f.pages[1:]
+	return page, nil
+}
+
+// fakeSQS records sent message bodies, groups and delays and fails for the configured bodies
+type fakeSQS struct {
+	fail   map[string]bool
+	sent   []string
+	groups []string
+	delays []int32
+}
+
+func (f *fakeSQS) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	body := aws.ToString(params.MessageBody)
+	if f.fail[body] {
+		return nil, errors.New("send failed")
+	}
+	f.sent = append(f.sent, body)
+	f.groups = append(f.groups, aws.ToString(params.MessageGroupId))
+	f.delays = append(f.delays, params.DelaySeconds)
+	return &sqs.SendMessageOutput{}, nil
+}
+
+// fakeCheckpoints serves LastEnqueued checkpoints and records updates.
+// The first BatchGetItem call returns the first unprocessedKeys keys as unprocessed.
+type fakeCheckpoints struct {
+	lastEnqueued    map[string]int64
+	unprocessedKeys int
+	batchGetCalls   int
+	updated         []string
+}
+
+func (f *fakeCheckpoints) BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	f.batchGetCalls++
+	resp := &dynamodb.BatchGetItemOutput{Responses: map[string][]map[string]dynamodbtypes.AttributeValue{}}
+	for tableName, keysAndAttributes := range params.RequestItems {
+		keys := keysAndAttributes.Keys
+		if f.batchGetCalls == 1 && f.unprocessedKeys > 0 {
+			resp.UnprocessedKeys = map[string]dynamodbtypes.KeysAndAttributes{
+				tableName: {Keys: keys[:f.unprocessedKeys]},
+			}
+			keys = keys[f.unprocessedKeys:]
+		}
+		for _, key := range keys {
+			id := key["DBInstanceIdentifier"].(*dynamodbtypes.AttributeValueMemberS).Value
+			value, ok := f.lastEnqueued[id]
+			if !ok {
+				continue
+			}
+			resp.Responses[tableName] = append(resp.Responses[tableName], map[string]dynamodbtypes.AttributeValue{
+				"DBInstanceIdentifier": &dynamodbtypes.AttributeValueMemberS{Value: id},
+				"LastEnqueued":         &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(value, 10)},
+			})
+		}
+	}
+	return resp, nil
+}
+
+func (f *fakeCheckpoints) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	f.updated = append(f.updated, params.Key["DBInstanceIdentifier"].(*dynamodbtypes.AttributeValueMemberS).Value)
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+var discardLogger = log.New(io.Discard, "", 0)
+
+func dbInstance(id, engine string) types.DBInstance {
+	instance := types.DBInstance{DBInstanceIdentifier: aws.String(id)}
+	if engine != "" {
+		instance.Engine = aws.String(engine)
+	}
+	return instance
+}
+
+func instanceIDs(instances []types.DBInstance) []string {
+	var ids []string
+	for _, instance := range instances {
+		ids = append(ids, *instance.DBInstanceIdentifier)
+	}
+	return ids
+}
+
+func TestFilterAuroraInstances(t *testing.T) {
+	tests := []struct {
+		name      string
+		instances []types.DBInstance
+		exclude   *regexp.Regexp
+		want      []string
+	}{
+		{
+			name: "aurora engines only",
+			instances: []types.DBInstance{
+				dbInstance("mysql-1", "aurora-mysql"),
+				dbInstance("legacy-1", "aurora"),
+				dbInstance("pg-1", "aurora-postgresql"),
+				dbInstance("rds-1", "mysql"),
+			},
+			want: []string{"mysql-1", "legacy-1"},
+		},
+		{
+			name:      "missing engine",
+			instances: []types.DBInstance{dbInstance("unknown-1", "")},
+			want:      nil,
+		},
+		{
+			name:      "no instances",
+			instances: nil,
+			want:      nil,
+		},
+		{
+			name: "excluded by pattern",
+			instances: []types.DBInstance{
+				dbInstance("prod-1", "aurora-mysql"),
+				dbInstance("prod-1-clone-7", "aurora-mysql"),
+				dbInstance("test-clone", "aurora"),
+			},
+			exclude: regexp.MustCompile(`-clone`),
+			want:    []string{"prod-1"},
+		},
+		{
+			name:      "pattern excluding none",
+			instances: []types.DBInstance{dbInstance("prod-1", "aurora-mysql")},
+			exclude:   regexp.MustCompile(`^tmp-`),
+			want:      []string{"prod-1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := instanceIDs(filterAuroraInstances(tt.instances, tt.exclude, discardLogger))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("filterAuroraInstances() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetDBInstances(t *testing.T) {
+	tests := []struct {
+		name        string
+		client      *fakeRDS
+		want        []string
+		wantMarkers []string
+		wantErr     bool
+	}{
+		{
+			name: "single page",
+			client: &fakeRDS{pages: []*rds.DescribeDBInstancesOutput{
+				{DBInstances: []types.DBInstance{dbInstance("db-1", "aurora-mysql")}},
+			}},
+			want:        []string{"db-1"},
+			wantMarkers: []string{""},
+		},
+		{
+			name: "follows markers across pages",
+			client: &fakeRDS{pages: []*rds.DescribeDBInstancesOutput{
+				{DBInstances: []types.DBInstance{dbInstance("db-1", "aurora-mysql")}, Marker: aws.String("page-2")},
+				{DBInstances: []types.DBInstance{dbInstance("db-2", "mysql")}, Marker: aws.String("page-3")},
+				{DBInstances: []types.DBInstance{dbInstance("db-3", "aurora")}},
+			}},
+			want:        []string{"db-1", "db-2", "db-3"},
+			wantMarkers: []string{"", "page-2", "page-3"},
+		},
+		{
+			name:        "describe error",
+			client:      &fakeRDS{err: errors.New("throttled")},
+			wantMarkers: []string{""},
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instances, err := getDBInstances(context.Background(), tt.client, discardLogger)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getDBInstances() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := instanceIDs(instances); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getDBInstances() = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(tt.client.markers, tt.wantMarkers) {
+				t.Errorf("markers = %v, want %v", tt.client.markers, tt.wantMarkers)
+			}
+		})
+	}
+}
+
+func TestSelectInstancesToEnqueue(t *testing.T) {
+	instances := []types.DBInstance{
+		dbInstance("db-c", "aurora-mysql"),
+		dbInstance("db-a", "aurora-mysql"),
+		dbInstance("db-b", "aurora-mysql"),
+		dbInstance("db-d", "aurora-mysql"),
+	}
+
+	tests := []struct {
+		name         string
+		lastEnqueued map[string]int64
+		limit        int
+		want         []string
+		wantDeferred []string
+	}{
+		{
+			name:         "never enqueued instances go first in ID order",
+			lastEnqueued: map[string]int64{"db-a": 300, "db-b": 100},
+			limit:        3,
+			want:         []string{"db-c", "db-d", "db-b"},
+			wantDeferred: []string{"db-a"},
+		},
+		{
+			name:         "oldest checkpoints first",
+			lastEnqueued: map[string]int64{"db-a": 400, "db-b": 100, "db-c": 300, "db-d": 200},
+			limit:        2,
+			want:         []string{"db-b", "db-d"},
+			wantDeferred: []string{"db-c", "db-a"},
+		},
+		{
+			name:         "limit covers every instance",
+			lastEnqueued: map[string]int64{},
+			limit:        10,
+			want:         []string{"db-a", "db-b", "db-c", "db-d"},
+			wantDeferred: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selected, deferred := selectInstancesToEnqueue(instances, tt.lastEnqueued, tt.limit)
+			if got := instanceIDs(selected); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selected = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(deferred, tt.wantDeferred) {
+				t.Errorf("deferred = %v, want %v", deferred, tt.wantDeferred)
+			}
+		})
+	}
+
+	// The input order must not change
+	if got := instanceIDs(instances); !reflect.DeepEqual(got, []string{"db-c", "db-a", "db-b", "db-d"}) {
+		t.Errorf("input reordered to %v", got)
+	}
+}
+
+func TestGetLastEnqueuedRetriesUnprocessedKeys(t *testing.T) {
+	client := &fakeCheckpoints{
+		lastEnqueued:    map[string]int64{"db-1": 100, "db-2": 200},
+		unprocessedKeys: 1,
+	}
+	instances := []types.DBInstance{
+		dbInstance("db-1", "aurora-mysql"),
+		dbInstance("db-2", "aurora-mysql"),
+		dbInstance("db-3", "aurora-mysql"),
+	}
+
+	got, err := getLastEnqueued(context.Background(), client, "table", instances, discardLogger)
+	if err != nil {
+		t.Fatalf("getLastEnqueued() error = %v", err)
+	}
+	if want := map[string]int64{"db-1": 100, "db-2": 200}; !reflect.DeepEqual(got, want) {
+		t.Errorf("getLastEnqueued() = %v, want %v", got, want)
+	}
+	if client.batchGetCalls != 2 {
+		t.Errorf("BatchGetItem calls = %d, want 2", client.batchGetCalls)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	page := &rds.DescribeDBInstancesOutput{DBInstances: []types.DBInstance{
+		dbInstance("db-1", "aurora-mysql"),
+		dbInstance("db-2", "aurora-mysql"),
+		dbInstance("db-3", "aurora-mysql"),
+		dbInstance("rds-1", "mysql"),
+	}}
+
+	tests := []struct {
+		name         string
+		env          map[string]string
+		rds          *fakeRDS
+		sqs          *fakeSQS
+		checkpoints  *fakeCheckpoints
+		want         Response
+		wantSent     []string
+		wantDelays   []int32
+		wantUpdated  []string
+		wantErr      bool
+		wantNoClient bool
+	}{
+		{
+			name:     "SQS failure is skipped",
+			env:      map[string]string{"SQS_QUEUE_URL": "queue"},
+			rds:      &fakeRDS{pages: []*rds.DescribeDBInstancesOutput{page}},
+			sqs:      &fakeSQS{fail: map[string]bool{`{"instanceId":"db-2"}`: true}},
+			want:     Response{InstancesFound: 3, InstancesEnqueued: 2, QueueURL: "queue", Message: "Successfully sent Aurora MySQL instance IDs to SQS"},
+			wantSent: []string{`{"instanceId":"db-1"}`, `{"instanceId":"db-3"}`},
+		},
+		{
+			name: "enqueue limit defers recently enqueued instances",
+			env:  map[string]string{"SQS_QUEUE_URL": "queue", "MAX_ENQUEUE_PER_RUN": "2", "DYNAMODB_TABLE_NAME": "table"},
+			rds:  &fakeRDS{pages: []*rds.DescribeDBInstancesOutput{page}},
+			sqs:  &fakeSQS{},
+			checkpoints: &fakeCheckpoints{
+				lastEnqueued: map[string]int64{"db-1": 300, "db-2": 100},
+			},
+			want:        Response{InstancesFound: 3, InstancesEnqueued: 2, DeferredInstances: []string{"db-1"}, QueueURL: "queue", Message: "Successfully sent Aurora MySQL instance IDs to SQS"},
+			wantSent:    []string{`{"instanceId":"db-3"}`, `{"instanceId":"db-2"}`},
+			wantUpdated: []string{"db-3", "db-2"},
+		},
+		{
+			name:       "scan spread delays the messages",
+			env:        map[string]string{"SQS_QUEUE_URL": "queue", "SCAN_SPREAD_SECONDS": "300"},
+			rds:        &fakeRDS{pages: []*rds.DescribeDBInstancesOutput{page}},
+			sqs:        &fakeSQS{},
+			want:       Response{InstancesFound: 3, InstancesEnqueued: 3, QueueURL: "queue", Message: "Successfully sent Aurora MySQL instance IDs to SQS"},
+			wantSent:   []string{`{"instanceId":"db-1"}`, `{"instanceId":"db-2"}`, `{"instanceId":"db-3"}`},
+			wantDelays: []int32{0, 100, 200},
+		},
+		{
+			name:       "scan spread is ignored for FIFO queues",
+			env:        map[string]string{"SQS_QUEUE_URL": "queue.fifo", "SCAN_SPREAD_SECONDS": "300"},
+			rds:        &fakeRDS{pages: []*rds.DescribeDBInstancesOutput{page}},
+			sqs:        &fakeSQS{},
+			want:       Response{InstancesFound: 3, InstancesEnqueued: 3, QueueURL: "queue.fifo", Message: "Successfully sent Aurora MySQL instance IDs to SQS"},
+			wantSent:   []string{`{"instanceId":"db-1"}`, `{"instanceId":"db-2"}`, `{"instanceId":"db-3"}`},
+			wantDelays: []int32{0, 0, 0},
+		},
+		{
+			name:         "invalid scan spread fails the invocation",
+			env:          map[string]string{"SQS_QUEUE_URL": "queue", "SCAN_SPREAD_SECONDS": "soon"},
+			rds:          &fakeRDS{},
+			sqs:          &fakeSQS{},
+			wantErr:      true,
+			wantNoClient: true,
+		},
+		{
+			name:     "excluded instances are not enqueued",
+			env:      map[string]string{"SQS_QUEUE_URL": "queue", "EXCLUDE_PATTERN": "^db-[12]$"},
+			rds:      &fakeRDS{pages: []*rds.DescribeDBInstancesOutput{page}},
+			sqs:      &fakeSQS{},
+			want:     Response{InstancesFound: 1, InstancesEnqueued: 1, QueueURL: "queue", Message: "Successfully sent Aurora MySQL instance IDs to SQS"},
+			wantSent: []string{`{"instanceId":"db-3"}`},
+		},
+		{
+			name:         "invalid exclude pattern fails the invocation",
+			env:          map[string]string{"SQS_QUEUE_URL": "queue", "EXCLUDE_PATTERN": "db-("},
+			rds:          &fakeRDS{},
+			sqs:          &fakeSQS{},
+			wantErr:      true,
+			wantNoClient: true,
+		},
+		{
+			name:         "invalid regions fails the invocation",
+			env:          map[string]string{"SQS_QUEUE_URL": "queue", "REGIONS": "us-east-1,Europe"},
+			rds:          &fakeRDS{},
+			sqs:          &fakeSQS{},
+			wantErr:      true,
+			wantNoClient: true,
+		},
+		{
+			name:    "describe error fails the invocation",
+			env:     map[string]string{"SQS_QUEUE_URL": "queue"},
+			rds:     &fakeRDS{err: errors.New("throttled")},
+			sqs:     &fakeSQS{},
+			wantErr: true,
+		},
+		{
+			name:         "missing queue URL fails the invocation",
+			env:          map[string]string{},
+			rds:          &fakeRDS{},
+			sqs:          &fakeSQS{},
+			wantErr:      true,
+			wantNoClient: true,
+		},
+		{
+			name:         "invalid enqueue limit fails the invocation",
+			env:          map[string]string{"SQS_QUEUE_URL": "queue", "MAX_ENQUEUE_PER_RUN": "-1"},
+			rds:          &fakeRDS{},
+			sqs:          &fakeSQS{},
+			wantErr:      true,
+			wantNoClient: true,
+		},
+		{
+			name:         "enqueue limit without table fails the invocation",
+			env:          map[string]string{"SQS_QUEUE_URL": "queue", "MAX_ENQUEUE_PER_RUN": "2"},
+			rds:          &fakeRDS{},
+			sqs:          &fakeSQS{},
+			wantErr:      true,
+			wantNoClient: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"SQS_QUEUE_URL", "MAX_ENQUEUE_PER_RUN", "SCAN_SPREAD_SECONDS", "DYNAMODB_TABLE_NAME", "REGIONS", "EXCLUDE_PATTERN"} {
+				t.Setenv(name, tt.env[name])
+			}
+			checkpoints := tt.checkpoints
+			if checkpoints == nil {
+				checkpoints = &fakeCheckpoints{}
+			}
+
+			handler := NewHandler(HandlerDeps{RDS: tt.rds, SQS: tt.sqs, DynamoDB: checkpoints})
+			got, err := handler(context.Background(), Event{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handler error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("handler() = %+v, want %+v", got, tt.want)
+			}
+			if !reflect.DeepEqual(tt.sqs.sent, tt.wantSent) {
+				t.Errorf("sent = %v, want %v", tt.sqs.sent, tt.wantSent)
+			}
+			if tt.wantDelays != nil && !reflect.DeepEqual(tt.sqs.delays, tt.wantDelays) {
+				t.Errorf("DelaySeconds = %v, want %v", tt.sqs.delays, tt.wantDelays)
+			}
+			if !reflect.DeepEqual(checkpoints.updated, tt.wantUpdated) {
+				t.Errorf("updated checkpoints = %v, want %v", checkpoints.updated, tt.wantUpdated)
+			}
+			if tt.wantNoClient && len(tt.rds.markers) > 0 {
+				t.Errorf("RDS called %d times, want none", len(tt.rds.markers))
+			}
+		})
+	}
+}
+
+func TestSendToSQS(t *testing.T) {
+	tests := []struct {
+		name      string
+		queueURL  string
+		message   instanceMessage
+		wantBody  string
+		wantGroup string
+	}{
+		{
+			name:     "standard queue",
+			queueURL: "https://sqs.us-east-1.amazonaws.com/123456789012/aurora-db-instances",
+			message:  instanceMessage{InstanceID: "db-1", Region: "us-east-1"},
+			wantBody: `{"instanceId":"db-1","region":"us-east-1"}`,
+		},
+		{
+			name:      "FIFO queue",
+			queueURL:  "https://sqs.us-east-1.amazonaws.com/123456789012/aurora-db-instances.fifo",
+			message:   instanceMessage{InstanceID: "db-1", Region: "us-east-1"},
+			wantBody:  `{"instanceId":"db-1","region":"us-east-1"}`,
+			wantGroup: "db-1",
+		},
+		{
+			name:     "clustered instance",
+			queueURL: "https://sqs.us-east-1.amazonaws.com/123456789012/aurora-db-instances",
+			message:  instanceMessage{InstanceID: "db-1", ClusterID: "cluster-1", Region: "us-east-1"},
+			wantBody: `{"instanceId":"db-1","clusterId":"cluster-1","region":"us-east-1"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeSQS{}
+			if err := sendToSQS(context.Background(), client, tt.queueURL, tt.message, 30, discardLogger); err != nil {
+				t.Fatalf("sendToSQS() error = %v", err)
+			}
+			if want := []string{tt.wantBody}; !reflect.DeepEqual(client.sent, want) {
+				t.Errorf("sent = %v, want %v", client.sent, want)
+			}
+			if want := []string{tt.wantGroup}; !reflect.DeepEqual(client.groups, want) {
+				t.Errorf("MessageGroupId = %q, want %q", client.groups, want)
+			}
+			if want := []int32{30}; !reflect.DeepEqual(client.delays, want) {
+				t.Errorf("DelaySeconds = %v, want %v", client.delays, want)
+			}
+		})
+	}
+}
+
+func TestSpreadDelay(t *testing.T) {
+	tests := []struct {
+		name               string
+		index, count, span int
+		want               int32
+	}{
+		{name: "no spread", index: 3, count: 10, want: 0},
+		{name: "first message", index: 0, count: 10, span: 600, want: 0},
+		{name: "evenly spread", index: 5, count: 10, span: 600, want: 300},
+		{name: "last message", index: 9, count: 10, span: 600, want: 540},
+		{name: "capped at 15 minutes", index: 9, count: 10, span: 3600, want: maxDelaySeconds},
+		{name: "more messages than seconds", index: 3, count: 100, span: 10, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := spreadDelay(tt.index, tt.count, tt.span); got != tt.want {
+				t.Errorf("spreadDelay(%d, %d, %d) = %d, want %d", tt.index, tt.count, tt.span, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRegions(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{value: "", want: []string{"ap-southeast-1"}},
+		{value: " , ", want: []string{"ap-southeast-1"}},
+		{value: "us-east-1", want: []string{"us-east-1"}},
+		{value: "ap-southeast-1, us-east-1,ap-southeast-1", want: []string{"ap-southeast-1", "us-east-1"}},
+		{value: "us-gov-west-1", want: []string{"us-gov-west-1"}},
+		{value: "us-east-1,mars", wantErr: true},
+		{value: "US-EAST-1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseRegions(tt.value, "ap-southeast-1")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRegions(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRegions(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+// regionalInstance returns an Aurora MySQL instance with the ARN of the region
+func regionalInstance(id, region string) types.DBInstance {
+	instance := dbInstance(id, "aurora-mysql")
+	instance.DBInstanceArn = aws.String("arn:aws:rds:" + region + ":123456789012:db:" + id)
+	return instance
+}
+
+func TestMessage(t *testing.T) {
+	clustered := regionalInstance("db-2", "ap-southeast-1")
+	clustered.DBClusterIdentifier = aws.String("cluster-1")
+
+	tests := []struct {
+		name     string
+		instance types.DBInstance
+		want     instanceMessage
+	}{
+		{name: "without ARN", instance: dbInstance("db-1", "aurora-mysql"), want: instanceMessage{InstanceID: "db-1", Region: "us-east-1"}},
+		{name: "clustered instance", instance: clustered, want: instanceMessage{InstanceID: "db-2", ClusterID: "cluster-1", Region: "ap-southeast-1"}},
+	}
+
+	deps := HandlerDeps{Region: "us-east-1"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := deps.message(tt.instance); got != tt.want {
+				t.Errorf("message() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleScansRegions(t *testing.T) {
+	t.Setenv("SQS_QUEUE_URL", "queue")
+	t.Setenv("MAX_ENQUEUE_PER_RUN", "")
+	t.Setenv("REGIONS", "ap-southeast-1,us-east-1")
+
+	local := &fakeRDS{pages: []*rds.DescribeDBInstancesOutput{{DBInstances: []types.DBInstance{
+		regionalInstance("db-1", "ap-southeast-1"),
+	}}}}
+	remote := &fakeRDS{pages: []*rds.DescribeDBInstancesOutput{{DBInstances: []types.DBInstance{
+		regionalInstance("db-2", "us-east-1"),
+		dbInstance("rds-1", "mysql"),
+	}}}}
+	sqsClient := &fakeSQS{}
+	deps := HandlerDeps{
+		RDS:         local,
+		SQS:         sqsClient,
+		DynamoDB:    &fakeCheckpoints{},
+		Region:      "ap-southeast-1",
+		RegionalRDS: map[string]DescribeDBInstancesAPI{"us-east-1": remote},
+	}
+
+	got, err := NewHandler(deps)(context.Background(), Event{})
+	if err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+	if got.InstancesFound != 2 || got.InstancesEnqueued != 2 {
+		t.Errorf("handler() = %+v, want 2 instances found and enqueued", got)
+	}
+
+	want := []string{`{"instanceId":"db-1","region":"ap-southeast-1"}`, `{"instanceId":"db-2","region":"us-east-1"}`}
+	if !reflect.DeepEqual(sqsClient.sent, want) {
+		t.Errorf("sent = %v, want %v", sqsClient.sent, want)
+	}
+}
+
+func TestHandleFailsWithoutRegionalClient(t *testing.T) {
+	t.Setenv("SQS_QUEUE_URL", "queue")
+	t.Setenv("MAX_ENQUEUE_PER_RUN", "")
+	t.Setenv("REGIONS", "ap-southeast-1,eu-west-1")
+
+	sqsClient := &fakeSQS{}
+	deps := HandlerDeps{RDS: &fakeRDS{pages: []*rds.DescribeDBInstancesOutput{{}}}, SQS: sqsClient, DynamoDB: &fakeCheckpoints{}, Region: "ap-southeast-1"}
+	if _, err := NewHandler(deps)(context.Background(), Event{}); err == nil {
+		t.Error("handler error = nil, want an error")
+	}
+	if len(sqsClient.sent) != 0 {
+		t.Errorf("sent = %v, want nothing before every region is scanned", sqsClient.sent)
+	}
+}
+
+func TestNewHandlerDeps(t *testing.T) {
+	t.Setenv("REGIONS", "us-east-1,ap-southeast-1")
+
+	deps := NewHandlerDeps(aws.Config{Region: "us-east-1"})
+	if deps.RDS == nil || deps.SQS == nil || deps.DynamoDB == nil {
+		t.Errorf("NewHandlerDeps() = %+v, want every client set", deps)
+	}
+	if len(deps.RegionalRDS) != 1 || deps.RegionalRDS["ap-southeast-1"] == nil {
+		t.Errorf("RegionalRDS = %v, want a client for ap-southeast-1 only", deps.RegionalRDS)
+	}
+}
+
+func TestRDSConfigAssumesRole(t *testing.T) {
+	cfg := aws.Config{Region: "us-east-1", Credentials: aws.AnonymousCredentials{}}
+
+	t.Setenv("ASSUME_ROLE_ARN", "")
+	if got := rdsConfig(cfg); got.Credentials != cfg.Credentials {
+		t.Errorf("rdsConfig() credentials = %T, want the local credentials", got.Credentials)
+	}
+
+	t.Setenv("ASSUME_ROLE_ARN", "arn:aws:iam::123456789012:role/audit-log-backup")
+	got := rdsConfig(cfg)
+	cache, ok := got.Credentials.(*aws.CredentialsCache)
+	if !ok || !cache.IsCredentialsProvider(&stscreds.AssumeRoleProvider{}) {
+		t.Errorf("rdsConfig() credentials = %T, want an assume role provider", got.Credentials)
+	}
+	if cfg.Credentials != (aws.AnonymousCredentials{}) {
+		t.Errorf("rdsConfig() changed the local credentials to %T", cfg.Credentials)
+	}
+}
@@ -0,0 +1,234 @@
+// Package auditlog parses the server_audit log of Aurora MySQL and converts it to JSON Lines.
+package auditlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// RawField is the field of the JSON Lines objects that holds a line which isn't a server_audit record
+const RawField = "raw"
+
+// MaxRecordBytes bounds a record whose quoted query continues over several lines. Lines that reach it
+// without closing the quote aren't a record, and are written as they are.
+const MaxRecordBytes = 1 << 20
+
+// ErrUnterminatedObject is returned by Parse for a line whose quoted object doesn't end on that line
+var ErrUnterminatedObject = errors.New("unterminated object")
+
+// Record is a line of the server_audit log
+type Record struct {
+	Timestamp    string `json:"timestamp"`
+	ServerHost   string `json:"serverhost"`
+	Username     string `json:"username"`
+	Host         string `json:"host"`
+	ConnectionID int64  `json:"connectionid"`
+	QueryID      int64  `json:"queryid"`
+	Operation    string `json:"operation"`
+	Database     string `json:"database"`
+	Object       string `json:"object"`
+	RetCode      int64  `json:"retcode"`
+	// ConnectionType is the field Aurora MySQL version 3 appends to every line
+	ConnectionType string `json:"connectiontype,omitempty"`
+}
+
+// Parse parses a server_audit log line:
+// timestamp,serverhost,username,host,connectionid,queryid,operation,database,object,retcode[,connection_type].
+// The object is quoted with single quotes when it is a query, which may contain commas, escaped quotes and
+// newlines. ErrUnterminatedObject is returned when the quoted object doesn't end within line.
+func Parse(line string) (Record, error) {
+	fields := strings.SplitN(line, ",", 9)
+	if len(fields) != 9 {
+		return Record{}, errors.New("too few fields")
+	}
+
+	var record Record
+	var err error
+	record.Timestamp, record.ServerHost, record.Username, record.Host = fields[0], fields[1], fields[2], fields[3]
+	if record.ConnectionID, err = strconv.ParseInt(fields[4], 10, 64); err != nil {
+		return Record{}, errors.New("invalid connection ID")
+	}
+	if record.QueryID, err = strconv.ParseInt(fields[5], 10, 64); err != nil {
+		return Record{}, errors.New("invalid query ID")
+	}
+	record.Operation, record.Database = fields[6], fields[7]
+
+	// The object runs up to its closing quote, or up to the next comma when it isn't quoted
+	rest := fields[8]
+	if strings.HasPrefix(rest, "'") {
+		object, n, ok := unquoteObject(rest)
+		if !ok {
+			return Record{}, ErrUnterminatedObject
+		}
+		record.Object, rest = object, rest[n:]
+		if !strings.HasPrefix(rest, ",") {
+			return Record{}, errors.New("no return code")
+		}
+		rest = rest[1:]
+	} else {
+		object, remainder, ok := strings.Cut(rest, ",")
+		if !ok {
+			return Record{}, errors.New("no return code")
+		}
+		record.Object, rest = object, remainder
+	}
+
+	retCode, connectionType, _ := strings.Cut(rest, ",")
+	if record.RetCode, err = strconv.ParseInt(retCode, 10, 64); err != nil {
+		return Record{}, errors.New("invalid return code")
+	}
+	if strings.Contains(connectionType, ",") {
+		return Record{}, errors.New("too many fields")
+	}
+	record.ConnectionType = connectionType
+
+	return record, nil
+}
+
+// unquoteObject returns the single-quoted object at the start of s without its quotes and escapes,
+// and the length of the quoted object in s
+func unquoteObject(s string) (string, int, bool) {
+	var object strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+			}
+			object.WriteByte(s[i])
+		case '\'':
+			return object.String(), i + 1, true
+		default:
+			object.WriteByte(s[i])
+		}
+	}
+	return "", 0, false
+}
+
+// Writer converts the audit log written to it into JSON Lines, one JSON object per record.
+// A record whose quoted query spans several lines becomes a single object. Lines that can't be parsed are
+// written verbatim under the raw field instead of being dropped. A line split across writes is held back
+// until it is complete, or until Close when the log file doesn't end with a newline.
+type Writer struct {
+	w        io.Writer
+	rawField string
+	partial  []byte
+	// Lines of a record whose quoted object hasn't ended yet, and their size
+	record     []string
+	recordSize int
+}
+
+// NewWriter returns a Writer converting audit log lines into JSON Lines written to w, with the lines that
+// aren't records under rawField, e.g. RawField
+func NewWriter(w io.Writer, rawField string) *Writer {
+	return &Writer{w: w, rawField: rawField}
+}
+
+// Write converts the complete lines in p, keeping a trailing incomplete line for the next write
+func (c *Writer) Write(p []byte) (int, error) {
+	data := append(c.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		if err := c.writeLine(string(data[:i])); err != nil {
+			return 0, err
+		}
+		data = data[i+1:]
+	}
+	c.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+// Pending reports whether an incomplete line or record is held back, so the output doesn't end at a record
+// boundary yet
+func (c *Writer) Pending() bool {
+	return len(c.partial) > 0 || len(c.record) > 0
+}
+
+// Close converts the final line when the log file doesn't end with a newline. The lines of a record whose
+// quoted object never ended are written verbatim.
+func (c *Writer) Close() error {
+	if len(c.partial) > 0 {
+		line := string(c.partial)
+		c.partial = nil
+		if err := c.writeLine(line); err != nil {
+			return err
+		}
+	}
+	lines := c.record
+	c.record, c.recordSize = nil, 0
+	return c.writeRaw(lines)
+}
+
+// writeLine converts one line, which may continue the record held back; empty lines between records are skipped
+func (c *Writer) writeLine(line string) error {
+	line = strings.TrimSuffix(line, "\r")
+	if line == "" && len(c.record) == 0 {
+		return nil
+	}
+
+	// A line that is a record of its own ends the lines held back, which weren't a record
+	if len(c.record) > 0 {
+		if record, err := Parse(line); err == nil {
+			lines := c.record
+			c.record, c.recordSize = nil, 0
+			if err := c.writeRaw(lines); err != nil {
+				return err
+			}
+			return c.encode(record)
+		}
+	}
+
+	c.record = append(c.record, line)
+	c.recordSize += len(line) + 1
+	record, err := Parse(strings.Join(c.record, "\n"))
+	if errors.Is(err, ErrUnterminatedObject) && c.recordSize < MaxRecordBytes {
+		// The query continues on the next line
+		return nil
+	}
+	lines := c.record
+	c.record, c.recordSize = nil, 0
+	if err == nil {
+		return c.encode(record)
+	}
+	if len(lines) == 1 {
+		return c.writeRaw(lines)
+	}
+
+	// The first line wasn't the start of a record; the ones after it may be
+	if err := c.writeRaw(lines[:1]); err != nil {
+		return err
+	}
+	for _, line := range lines[1:] {
+		if err := c.writeLine(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRaw writes every line under the raw field
+func (c *Writer) writeRaw(lines []string) error {
+	for _, line := range lines {
+		if err := c.encode(map[string]string{c.rawField: line}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encode writes a value as a JSON object on a line of its own
+func (c *Writer) encode(value any) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = c.w.Write(append(encoded, '\n'))
+	return err
+}
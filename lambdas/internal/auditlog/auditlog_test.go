@@ -0,0 +1,195 @@
+package auditlog
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    Record
+		wantErr error
+	}{
+		{
+			line: "1700000000123456,ip-10-0-0-1,admin,10.0.0.5,26,102,QUERY,shop,'SELECT 1',0",
+			want: Record{Timestamp: "1700000000123456", ServerHost: "ip-10-0-0-1", Username: "admin", Host: "10.0.0.5", ConnectionID: 26, QueryID: 102, Operation: "QUERY", Database: "shop", Object: "SELECT 1"},
+		},
+		{
+			// Quoted objects may contain commas and escaped quotes
+			line: `20231115 10:00:00,db-host,app,10.0.0.6,7,8,QUERY,shop,'INSERT INTO t VALUES (1, \'a,b\')',1064`,
+			want: Record{Timestamp: "20231115 10:00:00", ServerHost: "db-host", Username: "app", Host: "10.0.0.6", ConnectionID: 7, QueryID: 8, Operation: "QUERY", Database: "shop", Object: "INSERT INTO t VALUES (1, 'a,b')", RetCode: 1064},
+		},
+		{
+			// An escaped backslash doesn't escape the closing quote
+			line: `1700000000123456,db-host,app,10.0.0.6,7,8,QUERY,shop,'SELECT \'C:\\\\\'',0`,
+			want: Record{Timestamp: "1700000000123456", ServerHost: "db-host", Username: "app", Host: "10.0.0.6", ConnectionID: 7, QueryID: 8, Operation: "QUERY", Database: "shop", Object: `SELECT 'C:\\'`},
+		},
+		{
+			// A query may span several lines
+			line: "1700000000123456,db-host,app,10.0.0.6,7,8,QUERY,shop,'SELECT a,\n  b\nFROM t',0",
+			want: Record{Timestamp: "1700000000123456", ServerHost: "db-host", Username: "app", Host: "10.0.0.6", ConnectionID: 7, QueryID: 8, Operation: "QUERY", Database: "shop", Object: "SELECT a,\n  b\nFROM t"},
+		},
+		{
+			line: "1700000000123456,ip-10-0-0-1,rdsadmin,localhost,6,0,CONNECT,,,0",
+			want: Record{Timestamp: "1700000000123456", ServerHost: "ip-10-0-0-1", Username: "rdsadmin", Host: "localhost", ConnectionID: 6, Operation: "CONNECT"},
+		},
+		{
+			// Aurora MySQL version 3 appends the connection type
+			line: "1700000000123456,ip-10-0-0-1,rdsadmin,localhost,6,0,CONNECT,,,0,SOCKET",
+			want: Record{Timestamp: "1700000000123456", ServerHost: "ip-10-0-0-1", Username: "rdsadmin", Host: "localhost", ConnectionID: 6, Operation: "CONNECT", ConnectionType: "SOCKET"},
+		},
+		{line: "not an audit line", wantErr: errors.New("too few fields")},
+		{line: "1700000000123456,host,user,localhost,x,0,CONNECT,,,0", wantErr: errors.New("invalid connection ID")},
+		{line: "1700000000123456,host,user,localhost,6,0,QUERY,db,'SELECT 1,0", wantErr: ErrUnterminatedObject},
+		{line: "1700000000123456,host,user,localhost,6,0,QUERY,db,'SELECT 1',", wantErr: errors.New("invalid return code")},
+		{line: "1700000000123456,host,user,localhost,6,0,CONNECT,,,0,SOCKET,extra", wantErr: errors.New("too many fields")},
+	}
+
+	for _, tt := range tests {
+		got, err := Parse(tt.line)
+		if tt.wantErr != nil {
+			if err == nil || err.Error() != tt.wantErr.Error() {
+				t.Errorf("Parse(%q) error = %v, want %v", tt.line, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q) error = %v", tt.line, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+
+	if _, err := Parse("1700000000123456,host,user,localhost,6,0,QUERY,db,'SELECT"); !errors.Is(err, ErrUnterminatedObject) {
+		t.Errorf("Parse() of an unterminated query error = %v, want ErrUnterminatedObject", err)
+	}
+}
+
+func TestWriterJoinsSplitLines(t *testing.T) {
+	var output bytes.Buffer
+	converter := NewWriter(&output, "_raw")
+
+	// The second line is split across writes, and the last one has no newline
+	writes := []string{
+		"1700000000000001,host,app,10.0.0.5,1,2,QUERY,shop,'SELECT 1',0\n1700000000000002,host,app,10.0.0.5,1,3,QUE",
+		"RY,shop,'SELECT 2',0\r\n\n",
+		"garbage",
+	}
+	for _, data := range writes {
+		if _, err := converter.Write([]byte(data)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	if !converter.Pending() {
+		t.Error("Pending() = false, want the line without newline held back")
+	}
+	if err := converter.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	want := strings.Join([]string{
+		`{"timestamp":"1700000000000001","serverhost":"host","username":"app","host":"10.0.0.5","connectionid":1,"queryid":2,"operation":"QUERY","database":"shop","object":"SELECT 1","retcode":0}`,
+		`{"timestamp":"1700000000000002","serverhost":"host","username":"app","host":"10.0.0.5","connectionid":1,"queryid":3,"operation":"QUERY","database":"shop","object":"SELECT 2","retcode":0}`,
+		`{"_raw":"garbage"}`,
+	}, "\n") + "\n"
+	if output.String() != want {
+		t.Errorf("output = %q, want %q", output.String(), want)
+	}
+}
+
+func TestWriterMultiLineRecords(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{
+			name:  "multi-line query",
+			input: "1,host,app,10.0.0.5,1,2,QUERY,shop,'SELECT a,\n\n  \\'x,y\\'\nFROM t',0\n1,host,app,10.0.0.5,1,3,QUERY,shop,'SELECT 2',0\n",
+			want: []string{
+				`{"timestamp":"1","serverhost":"host","username":"app","host":"10.0.0.5","connectionid":1,"queryid":2,"operation":"QUERY","database":"shop","object":"SELECT a,\n\n  'x,y'\nFROM t","retcode":0}`,
+				`{"timestamp":"1","serverhost":"host","username":"app","host":"10.0.0.5","connectionid":1,"queryid":3,"operation":"QUERY","database":"shop","object":"SELECT 2","retcode":0}`,
+			},
+		},
+		{
+			// A stray quote holds the lines back until the next record, and they are kept verbatim
+			name:  "unterminated quote before a record",
+			input: "1,host,app,10.0.0.5,1,2,QUERY,shop,'SELECT 1,0\ncontinued\n1,host,app,10.0.0.5,1,3,CONNECT,,,0\n",
+			want: []string{
+				`{"raw":"1,host,app,10.0.0.5,1,2,QUERY,shop,'SELECT 1,0"}`,
+				`{"raw":"continued"}`,
+				`{"timestamp":"1","serverhost":"host","username":"app","host":"10.0.0.5","connectionid":1,"queryid":3,"operation":"CONNECT","database":"","object":"","retcode":0}`,
+			},
+		},
+		{
+			// The quote closes, but what follows isn't a return code
+			name:  "closed quote without return code",
+			input: "1,host,app,10.0.0.5,1,2,QUERY,shop,'SELECT\nx',oops\nnot a record\n",
+			want: []string{
+				`{"raw":"1,host,app,10.0.0.5,1,2,QUERY,shop,'SELECT"}`,
+				`{"raw":"x',oops"}`,
+				`{"raw":"not a record"}`,
+			},
+		},
+		{
+			name:  "unterminated quote at the end",
+			input: "1,host,app,10.0.0.5,1,2,QUERY,shop,'SELECT 1,0\nline \"two\"",
+			want: []string{
+				`{"raw":"1,host,app,10.0.0.5,1,2,QUERY,shop,'SELECT 1,0"}`,
+				`{"raw":"line \"two\""}`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output bytes.Buffer
+			converter := NewWriter(&output, RawField)
+			// Every byte is written on its own, so lines and records are split across writes
+			for i := range len(tt.input) {
+				if _, err := converter.Write([]byte{tt.input[i]}); err != nil {
+					t.Fatalf("Write() error = %v", err)
+				}
+			}
+			if err := converter.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			want := strings.Join(tt.want, "\n") + "\n"
+			if output.String() != want {
+				t.Errorf("output = %s, want %s", output.String(), want)
+			}
+		})
+	}
+}
+
+func TestWriterPendingRecord(t *testing.T) {
+	var output bytes.Buffer
+	converter := NewWriter(&output, RawField)
+
+	if _, err := converter.Write([]byte("1,host,app,10.0.0.5,1,2,QUERY,shop,'SELECT\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if !converter.Pending() || output.Len() != 0 {
+		t.Errorf("Pending() = %t with output %q, want the unfinished query held back", converter.Pending(), output.String())
+	}
+	if _, err := converter.Write([]byte("1',0\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if converter.Pending() || !strings.Contains(output.String(), `"object":"SELECT\n1"`) {
+		t.Errorf("Pending() = %t with output %q, want the query written", converter.Pending(), output.String())
+	}
+
+	// Lines that never close the quote are only held back up to MaxRecordBytes
+	output.Reset()
+	converter.Write([]byte("1,host,app,10.0.0.5,1,2,QUERY,shop,'SELECT\n"))
+	converter.Write([]byte(strings.Repeat("x", MaxRecordBytes) + "\n"))
+	if converter.Pending() || !strings.HasPrefix(output.String(), `{"raw":"1,host`) {
+		t.Errorf("Pending() = %t, want the lines written verbatim past MaxRecordBytes", converter.Pending())
+	}
+}
@@ -0,0 +1,220 @@
+// Package aurora classifies Aurora MySQL DB instances and their log files, so the Log Detector and the
+// Reconciler agree on which instances are scanned and which log files get a record.
+package aurora
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	rdstypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/timeutil"
+)
+
+// LogFileType classifies a log file by the name pattern it matched
+type LogFileType string
+
+// Supported log file types
+const (
+	LogFileTypeAudit     LogFileType = "audit"
+	LogFileTypeError     LogFileType = "error"
+	LogFileTypeSlowQuery LogFileType = "slowquery"
+	LogFileTypeGeneral   LogFileType = "general"
+)
+
+// LogFileTypes lists the supported log file types
+var LogFileTypes = []LogFileType{LogFileTypeAudit, LogFileTypeError, LogFileTypeSlowQuery, LogFileTypeGeneral}
+
+// DefaultLogNamePatterns reproduces the built-in audit log naming conventions, followed by the
+// Aurora MySQL error and slow query logs (error/mysql-error-running.log, slowquery/mysql-slowquery.log
+// and their hourly rotations). The audit patterns come first so error/mysql-audit.log stays an audit log.
+// Each comma-separated entry is a regular expression, optionally prefixed with "<type>:".
+// Rotations of server_audit.log (server_audit.log.1, .2, ...) match too, each getting its own record.
+const DefaultLogNamePatterns = `audit:^audit\.log$,audit:^(audit/)?server_audit\.log(\.[0-9]+)?$,audit:^error/mysql-audit\.log$,audit:^audit,` +
+	`error:^error/mysql-error(-running)?\.log(\.[0-9.-]+)?$,slowquery:^slowquery/mysql-slowquery\.log(\.[0-9.-]+)?$`
+
+// DefaultLogTypes is the default for LOG_TYPES
+const DefaultLogTypes = "audit"
+
+// LogNamePattern is a compiled LOG_NAME_PATTERNS entry
+type LogNamePattern struct {
+	fileType LogFileType
+	regex    *regexp.Regexp
+}
+
+// ParseLogNamePatterns compiles the comma-separated LOG_NAME_PATTERNS value, defaulting to DefaultLogNamePatterns.
+// Entries may be prefixed with a log file type ("slowquery:^slowquery/"); unprefixed entries are audit logs.
+func ParseLogNamePatterns(value string) ([]LogNamePattern, error) {
+	if strings.TrimSpace(value) == "" {
+		value = DefaultLogNamePatterns
+	}
+
+	var patterns []LogNamePattern
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		fileType := LogFileTypeAudit
+		for _, t := range LogFileTypes {
+			if strings.HasPrefix(entry, string(t)+":") {
+				fileType = t
+				entry = strings.TrimPrefix(entry, string(t)+":")
+				break
+			}
+		}
+
+		regex, err := regexp.Compile(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log name pattern %q: %w", entry, err)
+		}
+		patterns = append(patterns, LogNamePattern{fileType: fileType, regex: regex})
+	}
+
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("no log name patterns configured")
+	}
+
+	return patterns, nil
+}
+
+// ParseLogTypes parses the comma-separated LOG_TYPES value, defaulting to audit logs only
+func ParseLogTypes(value string) (map[LogFileType]bool, error) {
+	if strings.TrimSpace(value) == "" {
+		value = DefaultLogTypes
+	}
+
+	logTypes := make(map[LogFileType]bool)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !slices.Contains(LogFileTypes, LogFileType(entry)) {
+			return nil, fmt.Errorf("unknown log file type %q", entry)
+		}
+		logTypes[LogFileType(entry)] = true
+	}
+
+	return logTypes, nil
+}
+
+// ClassifyLogFile returns the type of the first pattern matching the log file name
+func ClassifyLogFile(patterns []LogNamePattern, logFileName string) (LogFileType, bool) {
+	for _, pattern := range patterns {
+		if pattern.regex.MatchString(logFileName) {
+			return pattern.fileType, true
+		}
+	}
+
+	return "", false
+}
+
+// Thresholds holds the MIN_FILE_SIZE_BYTES and MIN_FILE_AGE_SECONDS settings. Log files below them aren't
+// recorded yet, so small or recently created files can grow and settle first.
+type Thresholds struct {
+	MinFileSize int64
+	MinFileAge  time.Duration
+}
+
+// ParseThresholds parses the MIN_FILE_SIZE_BYTES and MIN_FILE_AGE_SECONDS values; an empty value is no threshold
+func ParseThresholds(minFileSize, minFileAge string) (Thresholds, error) {
+	var thresholds Thresholds
+	if minFileSize != "" {
+		val, err := strconv.ParseInt(minFileSize, 10, 64)
+		if err != nil || val < 0 {
+			return Thresholds{}, fmt.Errorf("invalid MIN_FILE_SIZE_BYTES value %q", minFileSize)
+		}
+		thresholds.MinFileSize = val
+	}
+
+	if minFileAge != "" {
+		val, err := strconv.Atoi(minFileAge)
+		if err != nil || val < 0 {
+			return Thresholds{}, fmt.Errorf("invalid MIN_FILE_AGE_SECONDS value %q", minFileAge)
+		}
+		thresholds.MinFileAge = time.Duration(val) * time.Second
+	}
+
+	return thresholds, nil
+}
+
+// Below reports whether a log file of size bytes is smaller than MinFileSize or was written less than
+// MinFileAge before now. lastWritten is in milliseconds since the epoch.
+func (t Thresholds) Below(size, lastWritten int64, now time.Time) bool {
+	if size < t.MinFileSize {
+		return true
+	}
+	return t.MinFileAge > 0 && now.Sub(timeutil.FromEpochMillis(lastWritten)) < t.MinFileAge
+}
+
+// ParseExcludePattern compiles the EXCLUDE_PATTERN value; an empty value excludes no instance and returns nil
+func ParseExcludePattern(value string) (*regexp.Regexp, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	pattern, err := regexp.Compile(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EXCLUDE_PATTERN value %q: %w", value, err)
+	}
+	return pattern, nil
+}
+
+// MySQLInstances returns the Aurora MySQL instances, without those whose identifier matches exclude
+// (nil excludes none), and how many were excluded
+func MySQLInstances(instances []rdstypes.DBInstance, exclude *regexp.Regexp) ([]rdstypes.DBInstance, int) {
+	var auroraInstances []rdstypes.DBInstance
+	excluded := 0
+	for _, instance := range instances {
+		engine := aws.ToString(instance.Engine)
+		if engine != "aurora-mysql" && engine != "aurora" {
+			continue
+		}
+		if exclude != nil && exclude.MatchString(aws.ToString(instance.DBInstanceIdentifier)) {
+			excluded++
+			continue
+		}
+		auroraInstances = append(auroraInstances, instance)
+	}
+
+	return auroraInstances, excluded
+}
+
+// DescribeDBClustersAPI is the subset of the RDS client used to resolve the member instances of a DB cluster
+type DescribeDBClustersAPI interface {
+	DescribeDBClusters(ctx context.Context, params *rds.DescribeDBClustersInput, optFns ...func(*rds.Options)) (*rds.DescribeDBClustersOutput, error)
+}
+
+// ClusterMembers returns the identifiers of the member instances of a DB cluster, the writer first
+func ClusterMembers(ctx context.Context, client DescribeDBClustersAPI, clusterID string) ([]string, error) {
+	output, err := client.DescribeDBClusters(ctx, &rds.DescribeDBClustersInput{
+		DBClusterIdentifier: aws.String(clusterID),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var members []string
+	for _, cluster := range output.DBClusters {
+		for _, member := range cluster.DBClusterMembers {
+			dbInstanceID := aws.ToString(member.DBInstanceIdentifier)
+			if dbInstanceID == "" || slices.Contains(members, dbInstanceID) {
+				continue
+			}
+			if aws.ToBool(member.IsClusterWriter) {
+				members = slices.Insert(members, 0, dbInstanceID)
+			} else {
+				members = append(members, dbInstanceID)
+			}
+		}
+	}
+	return members, nil
+}
@@ -0,0 +1,267 @@
+package aurora
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	rdstypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
+)
+
+func TestClassifyLogFileDefaultPatterns(t *testing.T) {
+	patterns, err := ParseLogNamePatterns("")
+	if err != nil {
+		t.Fatalf("ParseLogNamePatterns() error = %v", err)
+	}
+
+	tests := []struct {
+		logFileName string
+		want        LogFileType // Empty when no pattern matches
+	}{
+		{logFileName: "server_audit.log", want: LogFileTypeAudit},
+		{logFileName: "server_audit.log.1", want: LogFileTypeAudit},
+		{logFileName: "audit/server_audit.log", want: LogFileTypeAudit},
+		{logFileName: "audit/server_audit.log.10", want: LogFileTypeAudit},
+		{logFileName: "error/mysql-audit.log", want: LogFileTypeAudit},
+		{logFileName: "server_audit.log.bak"},
+		{logFileName: "error/mysql-error.log", want: LogFileTypeError},
+		{logFileName: "error/mysql-error-running.log", want: LogFileTypeError},
+		{logFileName: "error/mysql-error-running.log.2026-10-15.06", want: LogFileTypeError},
+		{logFileName: "slowquery/mysql-slowquery.log", want: LogFileTypeSlowQuery},
+		{logFileName: "slowquery/mysql-slowquery.log.2026-10-15.06", want: LogFileTypeSlowQuery},
+		{logFileName: "general/mysql-general.log"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.logFileName, func(t *testing.T) {
+			fileType, ok := ClassifyLogFile(patterns, tt.logFileName)
+			if ok != (tt.want != "") {
+				t.Fatalf("ClassifyLogFile(%q) matched = %v, want %v", tt.logFileName, ok, tt.want != "")
+			}
+			if fileType != tt.want {
+				t.Errorf("ClassifyLogFile(%q) type = %q, want %q", tt.logFileName, fileType, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLogNamePatterns(t *testing.T) {
+	tests := []struct {
+		value   string
+		name    string
+		want    LogFileType // Empty when no pattern matches
+		wantErr bool
+	}{
+		{value: `^custom\.log$`, name: "custom.log", want: LogFileTypeAudit},
+		{value: ` slowquery:^slow/ , error:^err/`, name: "slow/mysql.log", want: LogFileTypeSlowQuery},
+		{value: ` slowquery:^slow/ , error:^err/`, name: "err/mysql.log", want: LogFileTypeError},
+		{value: `^custom\.log$`, name: "server_audit.log"},
+		{value: `audit:(`, wantErr: true},
+		{value: ` , `, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		patterns, err := ParseLogNamePatterns(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("ParseLogNamePatterns(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+		}
+		if tt.wantErr {
+			continue
+		}
+		if got, _ := ClassifyLogFile(patterns, tt.name); got != tt.want {
+			t.Errorf("ParseLogNamePatterns(%q) classifies %q as %q, want %q", tt.value, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseLogTypes(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[LogFileType]bool
+		wantErr bool
+	}{
+		{value: "", want: map[LogFileType]bool{LogFileTypeAudit: true}},
+		{value: "audit, error,slowquery", want: map[LogFileType]bool{LogFileTypeAudit: true, LogFileTypeError: true, LogFileTypeSlowQuery: true}},
+		{value: "error", want: map[LogFileType]bool{LogFileTypeError: true}},
+		{value: "audit,binlog", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseLogTypes(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("ParseLogTypes(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseLogTypes(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseThresholds(t *testing.T) {
+	tests := []struct {
+		minFileSize string
+		minFileAge  string
+		want        Thresholds
+		wantErr     bool
+	}{
+		{},
+		{minFileSize: "1024", minFileAge: "300", want: Thresholds{MinFileSize: 1024, MinFileAge: 5 * time.Minute}},
+		{minFileSize: "1KB", wantErr: true},
+		{minFileSize: "-1", wantErr: true},
+		{minFileAge: "5m", wantErr: true},
+		{minFileAge: "-1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseThresholds(tt.minFileSize, tt.minFileAge)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("ParseThresholds(%q, %q) error = %v, wantErr %v", tt.minFileSize, tt.minFileAge, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("ParseThresholds(%q, %q) = %+v, want %+v", tt.minFileSize, tt.minFileAge, got, tt.want)
+		}
+	}
+}
+
+func TestThresholdsBelow(t *testing.T) {
+	now := time.UnixMilli(100_000)
+
+	tests := []struct {
+		name        string
+		thresholds  Thresholds
+		size        int64
+		lastWritten int64
+		want        bool
+	}{
+		{name: "no thresholds", size: 0, lastWritten: 100_000},
+		{name: "no thresholds with a clock skew", size: 0, lastWritten: 200_000},
+		{name: "one byte below the minimum size", thresholds: Thresholds{MinFileSize: 100}, size: 99, want: true},
+		{name: "exactly the minimum size", thresholds: Thresholds{MinFileSize: 100}, size: 100},
+		{name: "one millisecond below the minimum age", thresholds: Thresholds{MinFileAge: 60 * time.Second}, lastWritten: 40_001, want: true},
+		{name: "exactly the minimum age", thresholds: Thresholds{MinFileAge: 60 * time.Second}, lastWritten: 40_000},
+		{name: "old enough but too small", thresholds: Thresholds{MinFileSize: 100, MinFileAge: 60 * time.Second}, size: 99, lastWritten: 0, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.thresholds.Below(tt.size, tt.lastWritten, now); got != tt.want {
+				t.Errorf("Below() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseExcludePattern(t *testing.T) {
+	pattern, err := ParseExcludePattern("")
+	if pattern != nil || err != nil {
+		t.Errorf("ParseExcludePattern(\"\") = %v, %v, want nil, nil", pattern, err)
+	}
+
+	pattern, err = ParseExcludePattern("-clone-|^test-")
+	if err != nil || !pattern.MatchString("prod-clone-1") || pattern.MatchString("prod-1") {
+		t.Errorf("ParseExcludePattern(\"-clone-|^test-\") = %v, %v", pattern, err)
+	}
+
+	if _, err := ParseExcludePattern("(clone"); err == nil || !strings.Contains(err.Error(), "EXCLUDE_PATTERN") {
+		t.Errorf("ParseExcludePattern(\"(clone\") error = %v, want an error naming EXCLUDE_PATTERN", err)
+	}
+}
+
+func dbInstance(id, engine string) rdstypes.DBInstance {
+	instance := rdstypes.DBInstance{DBInstanceIdentifier: aws.String(id)}
+	if engine != "" {
+		instance.Engine = aws.String(engine)
+	}
+	return instance
+}
+
+func TestMySQLInstances(t *testing.T) {
+	tests := []struct {
+		name         string
+		instances    []rdstypes.DBInstance
+		exclude      *regexp.Regexp
+		want         []string
+		wantExcluded int
+	}{
+		{
+			name: "aurora engines only",
+			instances: []rdstypes.DBInstance{
+				dbInstance("mysql-1", "aurora-mysql"),
+				dbInstance("legacy-1", "aurora"),
+				dbInstance("pg-1", "aurora-postgresql"),
+				dbInstance("rds-1", "mysql"),
+			},
+			want: []string{"mysql-1", "legacy-1"},
+		},
+		{
+			name:      "missing engine",
+			instances: []rdstypes.DBInstance{dbInstance("unknown-1", "")},
+		},
+		{
+			name: "excluded by pattern",
+			instances: []rdstypes.DBInstance{
+				dbInstance("prod-1", "aurora-mysql"),
+				dbInstance("prod-1-clone-7", "aurora-mysql"),
+				dbInstance("test-clone", "aurora"),
+				dbInstance("pg-clone", "aurora-postgresql"),
+			},
+			exclude:      regexp.MustCompile(`-clone`),
+			want:         []string{"prod-1"},
+			wantExcluded: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instances, excluded := MySQLInstances(tt.instances, tt.exclude)
+			var got []string
+			for _, instance := range instances {
+				got = append(got, aws.ToString(instance.DBInstanceIdentifier))
+			}
+			if !reflect.DeepEqual(got, tt.want) || excluded != tt.wantExcluded {
+				t.Errorf("MySQLInstances() = %v, %d excluded, want %v, %d excluded", got, excluded, tt.want, tt.wantExcluded)
+			}
+		})
+	}
+}
+
+// fakeClusters serves the members of the configured DB clusters
+type fakeClusters map[string][]rdstypes.DBClusterMember
+
+func (f fakeClusters) DescribeDBClusters(ctx context.Context, params *rds.DescribeDBClustersInput, optFns ...func(*rds.Options)) (*rds.DescribeDBClustersOutput, error) {
+	members, ok := f[aws.ToString(params.DBClusterIdentifier)]
+	if !ok {
+		return nil, &rdstypes.DBClusterNotFoundFault{}
+	}
+	return &rds.DescribeDBClustersOutput{DBClusters: []rdstypes.DBCluster{{DBClusterMembers: members}}}, nil
+}
+
+// clusterMember returns a member instance of a DB cluster
+func clusterMember(dbInstanceID string, writer bool) rdstypes.DBClusterMember {
+	return rdstypes.DBClusterMember{DBInstanceIdentifier: aws.String(dbInstanceID), IsClusterWriter: aws.Bool(writer)}
+}
+
+func TestClusterMembers(t *testing.T) {
+	client := fakeClusters{
+		"cluster-1": {clusterMember("db-2", false), clusterMember("db-1", true), clusterMember("db-3", false), clusterMember("db-2", false)},
+	}
+
+	members, err := ClusterMembers(context.Background(), client, "cluster-1")
+	if err != nil {
+		t.Fatalf("ClusterMembers() error = %v", err)
+	}
+	if want := []string{"db-1", "db-2", "db-3"}; !reflect.DeepEqual(members, want) {
+		t.Errorf("ClusterMembers() = %v, want %v", members, want)
+	}
+
+	var notFound *rdstypes.DBClusterNotFoundFault
+	if _, err := ClusterMembers(context.Background(), client, "cluster-2"); !errors.As(err, &notFound) {
+		t.Errorf("ClusterMembers() of a missing cluster error = %v, want DBClusterNotFoundFault", err)
+	}
+}
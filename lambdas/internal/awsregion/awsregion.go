@@ -0,0 +1,38 @@
+// Package awsregion parses the REGIONS setting shared by the Lambda functions that reach
+// Aurora instances outside their own region.
+package awsregion
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// pattern matches AWS region names such as us-east-1 and ap-southeast-1
+var pattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+
+// Valid reports whether name looks like an AWS region name
+func Valid(name string) bool {
+	return pattern.MatchString(name)
+}
+
+// ParseList parses a comma-separated list of regions, defaulting to defaultRegion when it is empty.
+// Duplicates are dropped, keeping the first occurrence.
+func ParseList(value, defaultRegion string) ([]string, error) {
+	var regions []string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || slices.Contains(regions, entry) {
+			continue
+		}
+		if !Valid(entry) {
+			return nil, fmt.Errorf("invalid region %q", entry)
+		}
+		regions = append(regions, entry)
+	}
+	if len(regions) == 0 {
+		return []string{defaultRegion}, nil
+	}
+	return regions, nil
+}
@@ -0,0 +1,33 @@
+package awsregion
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseList(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{value: "", want: []string{"ap-southeast-1"}},
+		{value: " , ", want: []string{"ap-southeast-1"}},
+		{value: "us-east-1", want: []string{"us-east-1"}},
+		{value: "ap-southeast-1, us-east-1,ap-southeast-1", want: []string{"ap-southeast-1", "us-east-1"}},
+		{value: "us-gov-west-1", want: []string{"us-gov-west-1"}},
+		{value: "us-east-1,mars", wantErr: true},
+		{value: "US-EAST-1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseList(tt.value, "ap-southeast-1")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseList(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseList(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
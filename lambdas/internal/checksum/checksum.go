@@ -0,0 +1,45 @@
+// Package checksum creates the checksums of the downloaded log file content recorded in LastChecksum.
+// Records written before the algorithm was configurable have no LastChecksumAlgorithm and are MD5.
+package checksum
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+)
+
+// Checksum algorithms, as recorded in LastChecksumAlgorithm and set in CHECKSUM_ALGO
+const (
+	MD5    = "md5"
+	SHA256 = "sha256"
+)
+
+// Default is the algorithm of new backups when CHECKSUM_ALGO isn't set
+const Default = SHA256
+
+// Normalize returns the algorithm of a record's LastChecksumAlgorithm, MD5 when it is empty
+func Normalize(algorithm string) string {
+	if algorithm == "" {
+		return MD5
+	}
+	return algorithm
+}
+
+// MetadataKey returns the object metadata the Log Downloader stores the checksum of an algorithm in,
+// content-md5 or content-sha256
+func MetadataKey(algorithm string) string {
+	return "content-" + Normalize(algorithm)
+}
+
+// New returns a hash of the algorithm; an empty algorithm is MD5
+func New(algorithm string) (hash.Hash, error) {
+	switch Normalize(algorithm) {
+	case MD5:
+		return md5.New(), nil
+	case SHA256:
+		return sha256.New(), nil
+	default:
+		return nil, fmt.Errorf("unknown checksum algorithm %q", algorithm)
+	}
+}
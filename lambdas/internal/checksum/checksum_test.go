@@ -0,0 +1,51 @@
+package checksum
+
+import (
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm string
+		want      string
+		wantErr   bool
+	}{
+		{name: "md5", algorithm: MD5, want: "b1946ac92492d2347c6235b4d2611184"},
+		{name: "unset", want: "b1946ac92492d2347c6235b4d2611184"},
+		{name: "sha256", algorithm: SHA256, want: "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"},
+		{name: "unknown", algorithm: "crc32", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := New(tt.algorithm)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New(%q) error = %v, wantErr %v", tt.algorithm, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			io.WriteString(h, "hello\n")
+			if got := hex.EncodeToString(h.Sum(nil)); got != tt.want {
+				t.Errorf("checksum = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetadataKey(t *testing.T) {
+	tests := map[string]string{
+		MD5:    "content-md5",
+		"":     "content-md5",
+		SHA256: "content-sha256",
+	}
+
+	for algorithm, want := range tests {
+		if got := MetadataKey(algorithm); got != want {
+			t.Errorf("MetadataKey(%q) = %q, want %q", algorithm, got, want)
+		}
+	}
+}
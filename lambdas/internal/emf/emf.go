@@ -0,0 +1,84 @@
+// Package emf writes metrics in the CloudWatch Embedded Metric Format.
+// Lambda sends the records to CloudWatch Logs, which extracts the metrics from them.
+package emf
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+)
+
+// Namespace is the CloudWatch namespace of the log backup metrics
+const Namespace = "AuroraLogBackup"
+
+// Metric units
+const (
+	Count        = "Count"
+	Seconds      = "Seconds"
+	Milliseconds = "Milliseconds"
+	Bytes        = "Bytes"
+)
+
+// Metric is a named metric value
+type Metric struct {
+	Name  string
+	Value float64
+	Unit  string
+}
+
+// Logger writes EMF records, one JSON object per line
+type Logger struct {
+	w         io.Writer
+	namespace string
+}
+
+// New returns a Logger writing the metrics of namespace to w
+func New(w io.Writer, namespace string) *Logger {
+	return &Logger{w: w, namespace: namespace}
+}
+
+// metricDirective tells CloudWatch which properties of a record are metrics
+type metricDirective struct {
+	Namespace  string             `json:"Namespace"`
+	Dimensions [][]string         `json:"Dimensions"`
+	Metrics    []metricDefinition `json:"Metrics"`
+}
+
+type metricDefinition struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+// Emit writes one record with the given metrics, dimensioned by all the given dimensions
+func (l *Logger) Emit(dimensions map[string]string, metrics []Metric) error {
+	dimensionNames := make([]string, 0, len(dimensions))
+	for name := range dimensions {
+		dimensionNames = append(dimensionNames, name)
+	}
+	sort.Strings(dimensionNames)
+
+	directive := metricDirective{
+		Namespace:  l.namespace,
+		Dimensions: [][]string{dimensionNames},
+	}
+	record := map[string]any{}
+	for _, metric := range metrics {
+		directive.Metrics = append(directive.Metrics, metricDefinition{Name: metric.Name, Unit: metric.Unit})
+		record[metric.Name] = metric.Value
+	}
+	for name, value := range dimensions {
+		record[name] = value
+	}
+	record["_aws"] = map[string]any{
+		"Timestamp":         time.Now().UnixMilli(),
+		"CloudWatchMetrics": []metricDirective{directive},
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = l.w.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,52 @@
+package emf
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestEmit(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, "Test")
+
+	err := logger.Emit(map[string]string{"DBInstanceIdentifier": "db-1"}, []Metric{
+		{Name: "RecordsCreated", Value: 2, Unit: Count},
+		{Name: "DiscoveryLagSeconds", Value: 30, Unit: Seconds},
+	})
+	if err != nil {
+		t.Fatalf("Emit() error = %v", err)
+	}
+
+	var record struct {
+		AWS struct {
+			Timestamp         int64             `json:"Timestamp"`
+			CloudWatchMetrics []metricDirective `json:"CloudWatchMetrics"`
+		} `json:"_aws"`
+		DBInstanceIdentifier string `json:"DBInstanceIdentifier"`
+		RecordsCreated       int    `json:"RecordsCreated"`
+		DiscoveryLagSeconds  int    `json:"DiscoveryLagSeconds"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("record %q is not JSON: %v", buf.String(), err)
+	}
+
+	want := []metricDirective{{
+		Namespace:  "Test",
+		Dimensions: [][]string{{"DBInstanceIdentifier"}},
+		Metrics:    []metricDefinition{{Name: "RecordsCreated", Unit: Count}, {Name: "DiscoveryLagSeconds", Unit: Seconds}},
+	}}
+	if !reflect.DeepEqual(record.AWS.CloudWatchMetrics, want) {
+		t.Errorf("CloudWatchMetrics = %+v, want %+v", record.AWS.CloudWatchMetrics, want)
+	}
+	if record.AWS.Timestamp == 0 {
+		t.Error("Timestamp not set")
+	}
+	if record.DBInstanceIdentifier != "db-1" || record.RecordsCreated != 2 || record.DiscoveryLagSeconds != 30 {
+		t.Errorf("record = %+v, want the dimension and metric values", record)
+	}
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		t.Error("record doesn't end with a newline")
+	}
+}
@@ -0,0 +1,93 @@
+// Package ratelimit spaces out API calls with a token bucket shared by concurrent callers,
+// so the Lambda functions don't use up an API quota shared with other tooling.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket refilled at a fixed rate. Every call takes a token; a caller finding
+// the bucket empty reserves the next token under the lock and waits for it outside, so concurrent
+// callers are served in turn. A nil Limiter doesn't limit.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64 // Tokens added per second
+	burst  float64 // Capacity of the bucket
+	tokens float64 // Tokens left, negative when calls are waiting
+	last   time.Time
+
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// New returns a limiter allowing rate calls per second, with bursts of up to rate calls (at least one).
+// A rate of 0 returns nil, which doesn't limit.
+func New(rate float64) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	burst := math.Max(1, math.Ceil(rate))
+	return &Limiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+		now:    time.Now,
+		sleep:  sleep,
+	}
+}
+
+// ParseRate parses a calls-per-second setting such as RDS_API_RPS; empty or 0 means unlimited
+func ParseRate(value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate < 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return 0, fmt.Errorf("invalid rate %q", value)
+	}
+	return rate, nil
+}
+
+// Wait blocks until the caller may make a call and returns how long it waited.
+// It returns the context's error when the context is done first; the reserved token isn't given back.
+func (l *Limiter) Wait(ctx context.Context) (time.Duration, error) {
+	if l == nil {
+		return 0, nil
+	}
+
+	l.mu.Lock()
+	now := l.now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens--
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay == 0 {
+		return 0, nil
+	}
+	return delay, l.sleep(ctx, delay)
+}
+
+// sleep waits for d or until the context is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,140 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLimiter returns a limiter whose clock is controlled by the test and whose waits are only recorded
+func fakeLimiter(rate float64, now *time.Time) (*Limiter, *[]time.Duration) {
+	var mu sync.Mutex
+	var waits []time.Duration
+
+	l := New(rate)
+	l.last = *now
+	l.now = func() time.Time { return *now }
+	l.sleep = func(ctx context.Context, d time.Duration) error {
+		mu.Lock()
+		defer mu.Unlock()
+		waits = append(waits, d)
+		return nil
+	}
+	return l, &waits
+}
+
+func TestWait(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	l, waits := fakeLimiter(2, &now)
+
+	// The burst is used up, then every call waits half a second longer than the previous one
+	var delays []time.Duration
+	for range 5 {
+		delay, err := l.Wait(context.Background())
+		if err != nil {
+			t.Fatalf("Wait() error = %v", err)
+		}
+		delays = append(delays, delay)
+	}
+	want := []time.Duration{0, 0, 500 * time.Millisecond, time.Second, 1500 * time.Millisecond}
+	if !slices.Equal(delays, want) {
+		t.Errorf("delays = %v, want %v", delays, want)
+	}
+	if len(*waits) != 3 {
+		t.Errorf("slept %d times, want 3", len(*waits))
+	}
+
+	// Once the reserved calls are made, the bucket refills up to the burst
+	now = now.Add(time.Minute)
+	for range 2 {
+		if delay, _ := l.Wait(context.Background()); delay != 0 {
+			t.Errorf("delay after refill = %v, want 0", delay)
+		}
+	}
+}
+
+func TestWaitConcurrent(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	l, _ := fakeLimiter(4, &now)
+
+	// Every caller reserves its own slot, so no two callers share a delay
+	var mu sync.Mutex
+	var delays []time.Duration
+	var wg sync.WaitGroup
+	for range 12 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			delay, err := l.Wait(context.Background())
+			if err != nil {
+				t.Errorf("Wait() error = %v", err)
+			}
+			mu.Lock()
+			delays = append(delays, delay)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	slices.Sort(delays)
+	want := []time.Duration{0, 0, 0, 0}
+	for i := 1; i <= 8; i++ {
+		want = append(want, time.Duration(i)*250*time.Millisecond)
+	}
+	if !slices.Equal(delays, want) {
+		t.Errorf("delays = %v, want %v", delays, want)
+	}
+}
+
+func TestWaitContextDone(t *testing.T) {
+	l := New(1)
+	if _, err := l.Wait(context.Background()); err != nil {
+		t.Fatalf("first Wait() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Wait() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	l := New(0)
+	if l != nil {
+		t.Fatalf("New(0) = %v, want nil", l)
+	}
+	if delay, err := l.Wait(context.Background()); delay != 0 || err != nil {
+		t.Errorf("Wait() = %v, %v, want no wait", delay, err)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    float64
+		wantErr bool
+	}{
+		{value: "", want: 0},
+		{value: "0", want: 0},
+		{value: "5", want: 5},
+		{value: "0.5", want: 0.5},
+		{value: "-1", wantErr: true},
+		{value: "fast", wantErr: true},
+		{value: "Inf", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRate(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRate(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRate(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
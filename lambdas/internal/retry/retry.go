@@ -0,0 +1,84 @@
+// Package retry retries AWS calls that failed with throttling or server errors.
+package retry
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+// Policy controls the exponential backoff between attempts
+type Policy struct {
+	InitialInterval time.Duration // Upper bound of the first backoff
+	MaxInterval     time.Duration // Upper bound of any backoff
+	MaxElapsedTime  time.Duration // Time after which no further attempt is made
+	MaxAttempts     int           // Attempts after which no further attempt is made; 0 doesn't limit them
+	// DeadlineMargin is kept free before the context deadline, e.g. the Lambda deadline,
+	// so the caller still has time to handle the last error
+	DeadlineMargin time.Duration
+}
+
+// DefaultPolicy is suited to DynamoDB calls made from a Lambda function
+var DefaultPolicy = Policy{
+	InitialInterval: 100 * time.Millisecond,
+	MaxInterval:     5 * time.Second,
+	MaxElapsedTime:  30 * time.Second,
+	DeadlineMargin:  5 * time.Second,
+}
+
+// retryableCodes are the error codes of throttled or temporarily failing requests
+var retryableCodes = map[string]bool{
+	"ProvisionedThroughputExceededException": true,
+	"ThrottlingException":                    true,
+	"Throttling":                             true, // RDS
+	"RequestLimitExceeded":                   true,
+	"InternalServerError":                    true,
+	"ServiceUnavailable":                     true,
+}
+
+// IsRetryable reports whether err is a throttling or 5xx error worth another attempt.
+// Every other error, such as a validation error or a failed condition, is terminal.
+func IsRetryable(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && retryableCodes[apiErr.ErrorCode()] {
+		return true
+	}
+
+	var responseErr interface{ HTTPStatusCode() int }
+	return errors.As(err, &responseErr) && responseErr.HTTPStatusCode() >= 500
+}
+
+// Do calls fn until it succeeds, returns a terminal error or the policy's time or attempts run out,
+// sleeping a random duration of up to the exponentially growing interval between attempts.
+// It returns the number of retries made and the error of the last attempt.
+func Do(ctx context.Context, policy Policy, fn func() error) (int, error) {
+	stopAt := time.Now().Add(policy.MaxElapsedTime)
+	if deadline, ok := ctx.Deadline(); ok && deadline.Add(-policy.DeadlineMargin).Before(stopAt) {
+		stopAt = deadline.Add(-policy.DeadlineMargin)
+	}
+
+	interval := policy.InitialInterval
+	for retries := 0; ; retries++ {
+		err := fn()
+		if err == nil || !IsRetryable(err) || (policy.MaxAttempts > 0 && retries+1 >= policy.MaxAttempts) {
+			return retries, err
+		}
+
+		// Full jitter spreads out the retries of concurrent callers
+		backoff := rand.N(interval + 1)
+		if time.Now().Add(backoff).After(stopAt) {
+			return retries, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return retries, err
+		case <-time.After(backoff):
+		}
+
+		interval = min(interval*2, policy.MaxInterval)
+	}
+}
@@ -0,0 +1,128 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+)
+
+// statusError is a response error with an HTTP status code
+type statusError int
+
+func (e statusError) Error() string       { return fmt.Sprintf("status %d", int(e)) }
+func (e statusError) HTTPStatusCode() int { return int(e) }
+
+var fastPolicy = Policy{InitialInterval: time.Millisecond, MaxInterval: 2 * time.Millisecond, MaxElapsedTime: time.Second}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "provisioned throughput exceeded", err: &types.ProvisionedThroughputExceededException{}, want: true},
+		{name: "throttling", err: &smithy.GenericAPIError{Code: "ThrottlingException"}, want: true},
+		{name: "RDS throttling", err: &smithy.GenericAPIError{Code: "Throttling"}, want: true},
+		{name: "internal server error", err: &types.InternalServerError{}, want: true},
+		{name: "wrapped 503", err: fmt.Errorf("operation error: %w", statusError(503)), want: true},
+		{name: "400", err: statusError(400)},
+		{name: "validation", err: &smithy.GenericAPIError{Code: "ValidationException"}},
+		{name: "conditional check failed", err: &types.ConditionalCheckFailedException{}},
+		{name: "other", err: errors.New("other")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Errorf("IsRetryable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDo(t *testing.T) {
+	throttled := &types.ProvisionedThroughputExceededException{}
+	validation := &smithy.GenericAPIError{Code: "ValidationException"}
+
+	tests := []struct {
+		name        string
+		errs        []error // Errors of the successive attempts, then success
+		wantRetries int
+		wantErr     error
+	}{
+		{name: "first attempt succeeds"},
+		{name: "throttled then succeeds", errs: []error{throttled, throttled}, wantRetries: 2},
+		{name: "terminal error is not retried", errs: []error{validation}, wantErr: validation},
+		{name: "terminal error after a retry", errs: []error{throttled, validation}, wantRetries: 1, wantErr: validation},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			retries, err := Do(context.Background(), fastPolicy, func() error {
+				attempts++
+				if attempts <= len(tt.errs) {
+					return tt.errs[attempts-1]
+				}
+				return nil
+			})
+			if retries != tt.wantRetries {
+				t.Errorf("retries = %d, want %d", retries, tt.wantRetries)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDoStopsAfterMaxAttempts(t *testing.T) {
+	policy := fastPolicy
+	policy.MaxAttempts = 3
+
+	attempts := 0
+	retries, err := Do(context.Background(), policy, func() error {
+		attempts++
+		return &types.ProvisionedThroughputExceededException{}
+	})
+	if err == nil {
+		t.Fatal("Do() error = nil, want the throttling error")
+	}
+	if attempts != 3 || retries != 2 {
+		t.Errorf("made %d attempts and %d retries, want 3 and 2", attempts, retries)
+	}
+}
+
+func TestDoStopsBeforeDeadline(t *testing.T) {
+	policy := Policy{InitialInterval: 20 * time.Millisecond, MaxInterval: 20 * time.Millisecond, MaxElapsedTime: time.Minute, DeadlineMargin: 50 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := Do(ctx, policy, func() error { return &types.ProvisionedThroughputExceededException{} })
+	if err == nil {
+		t.Fatal("Do() error = nil, want the throttling error")
+	}
+	// Do stops at 100ms; the rest of the margin absorbs timer delays
+	if elapsed := time.Since(start); elapsed > 125*time.Millisecond {
+		t.Errorf("Do() took %s, want it to stop %s before the deadline", elapsed, policy.DeadlineMargin)
+	}
+}
+
+func TestDoStopsAfterMaxElapsedTime(t *testing.T) {
+	policy := Policy{InitialInterval: 10 * time.Millisecond, MaxInterval: 10 * time.Millisecond, MaxElapsedTime: 50 * time.Millisecond}
+
+	start := time.Now()
+	_, err := Do(context.Background(), policy, func() error { return &types.ProvisionedThroughputExceededException{} })
+	if err == nil {
+		t.Fatal("Do() error = nil, want the throttling error")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Do() took %s, want about %s", elapsed, policy.MaxElapsedTime)
+	}
+}
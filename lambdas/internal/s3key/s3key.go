@@ -0,0 +1,79 @@
+// Package s3key builds the S3 keys log files are backed up to, for the Log Downloader that writes them
+// and the tools that read them back.
+package s3key
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/timeutil"
+)
+
+// DefaultTemplate is the S3 key layout used when S3_KEY_TEMPLATE is not set.
+// Every version of a log file gets its own key from its LastWritten time, so a backup of a file that
+// grew since the last one doesn't overwrite it.
+const DefaultTemplate = "{prefix}/{instance}/{yyyy}/{MM}/{dd}/{file}.{lastWritten}"
+
+// PartitionedTemplate is the Hive-style layout used when PARTITION_BY_DATE is enabled.
+// The date comes from the log's LastWritten time so re-backups land in the same partition.
+const PartitionedTemplate = "{prefix}/dbinstance={instance}/dt={year}-{month}-{day}/{logfile}.{lastWritten}"
+
+// LegacyTemplate and LegacyPartitionedTemplate are the layouts used with LEGACY_KEYS, which keep one
+// object per log file, overwritten by every backup
+const (
+	LegacyTemplate            = "{prefix}/{instance}/{logfile}"
+	LegacyPartitionedTemplate = "{prefix}/dbinstance={instance}/dt={year}-{month}-{day}/{logfile}"
+)
+
+// Build renders the S3 key template for a log file.
+// Supported placeholders are {prefix}, {instance}, {logfile} or {file}, {year} or {yyyy}, {month} or {MM},
+// {day} or {dd}, and {ts} or {lastWritten}; the date placeholders are derived from the log file's LastWritten
+// time (epoch milliseconds, UTC).
+func Build(template, prefix, dbInstanceID, logFileName string, lastWritten int64) string {
+	written := timeutil.FromEpochMillis(lastWritten).UTC()
+	year, month, day := written.Format("2006"), written.Format("01"), written.Format("02")
+	ts := strconv.FormatInt(lastWritten, 10)
+
+	replacer := strings.NewReplacer(
+		"{prefix}", prefix,
+		"{instance}", dbInstanceID,
+		"{logfile}", logFileName,
+		"{file}", logFileName,
+		"{year}", year,
+		"{yyyy}", year,
+		"{month}", month,
+		"{MM}", month,
+		"{day}", day,
+		"{dd}", day,
+		"{ts}", ts,
+		"{lastWritten}", ts,
+	)
+
+	return replacer.Replace(template)
+}
+
+// convertedExts are the suffixes of the objects the Log Downloader converted to JSON, one per OUTPUT_FORMAT
+var convertedExts = []string{".ndjson", ".jsonl"}
+
+// Converted reports whether the object at key holds a log file converted to JSON, whose content
+// doesn't match the checksum of the downloaded log file
+func Converted(key string) bool {
+	for _, ext := range convertedExts {
+		if strings.Contains(key, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// PartKey returns the key of the nth part appended to the object at key, ahead of its .ndjson, .jsonl
+// and .gz suffixes
+func PartKey(key string, n int64) string {
+	var suffix string
+	for _, ext := range append([]string{".gz"}, convertedExts...) {
+		if strings.HasSuffix(key, ext) {
+			key, suffix = strings.TrimSuffix(key, ext), ext+suffix
+		}
+	}
+	return key + ".part" + strconv.FormatInt(n, 10) + suffix
+}
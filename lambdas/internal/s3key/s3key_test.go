@@ -0,0 +1,58 @@
+package s3key
+
+import "testing"
+
+func TestBuild(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{template: DefaultTemplate, want: "logs/db-1/2023/11/14/audit/server_audit.log.1.1700000000000"},
+		{template: PartitionedTemplate, want: "logs/dbinstance=db-1/dt=2023-11-14/audit/server_audit.log.1.1700000000000"},
+		{template: LegacyTemplate, want: "logs/db-1/audit/server_audit.log.1"},
+		{template: LegacyPartitionedTemplate, want: "logs/dbinstance=db-1/dt=2023-11-14/audit/server_audit.log.1"},
+		{template: "{prefix}/{instance}/{year}{month}{day}/{logfile}-{ts}", want: "logs/db-1/20231114/audit/server_audit.log.1-1700000000000"},
+	}
+
+	for _, tt := range tests {
+		if got := Build(tt.template, "logs", "db-1", "audit/server_audit.log.1", 1700000000000); got != tt.want {
+			t.Errorf("Build(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestPartKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{key: "logs/db-1/audit/server_audit.log", want: "logs/db-1/audit/server_audit.log.part3"},
+		{key: "logs/db-1/audit/server_audit.log.gz", want: "logs/db-1/audit/server_audit.log.part3.gz"},
+		{key: "logs/db-1/audit/server_audit.log.ndjson.gz", want: "logs/db-1/audit/server_audit.log.part3.ndjson.gz"},
+		{key: "logs/db-1/audit/server_audit.log.jsonl", want: "logs/db-1/audit/server_audit.log.part3.jsonl"},
+	}
+
+	for _, tt := range tests {
+		if got := PartKey(tt.key, 3); got != tt.want {
+			t.Errorf("PartKey(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestConverted(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{key: "logs/db-1/audit/server_audit.log.1700000000000"},
+		{key: "logs/db-1/audit/server_audit.log.1700000000000.gz"},
+		{key: "logs/db-1/audit/server_audit.log.1700000000000.ndjson", want: true},
+		{key: "logs/db-1/audit/server_audit.log.1700000000000.part2.jsonl.gz", want: true},
+	}
+
+	for _, tt := range tests {
+		if got := Converted(tt.key); got != tt.want {
+			t.Errorf("Converted(%q) = %t, want %t", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Package s3object reads back the objects the Log Downloader uploads, for the restore and verify tools.
+package s3object
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// GetObjectAPI is the subset of the S3 client used to download an object
+type GetObjectAPI interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// Copy writes the content of an object to w, decompressing it when its key ends in .gz
+func Copy(ctx context.Context, client GetObjectAPI, bucketName, key string, w io.Writer) error {
+	resp, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var body io.Reader = resp.Body
+	if strings.HasSuffix(key, ".gz") {
+		// Large objects are a series of gzip members, which the reader joins
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		body = gz
+	}
+	_, err = io.Copy(w, body)
+	return err
+}
@@ -0,0 +1,69 @@
+package s3object
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fakeObjects serves object bodies by key
+type fakeObjects map[string][]byte
+
+func (f fakeObjects) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	body, ok := f[aws.ToString(params.Key)]
+	if !ok {
+		return nil, &s3types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(body))}, nil
+}
+
+// gzipped compresses data as one gzip member
+func gzipped(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCopy(t *testing.T) {
+	client := fakeObjects{
+		"plain.log":  []byte("line 1\n"),
+		"joined.gz":  append(gzipped(t, "line 1\n"), gzipped(t, "line 2\n")...), // Compressed one part at a time
+		"corrupt.gz": []byte("line 1\n"),
+	}
+
+	tests := []struct {
+		key     string
+		want    string
+		wantErr bool
+	}{
+		{key: "plain.log", want: "line 1\n"},
+		{key: "joined.gz", want: "line 1\nline 2\n"},
+		{key: "corrupt.gz", wantErr: true},
+		{key: "missing.log", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		var out strings.Builder
+		err := Copy(context.Background(), client, "bucket", tt.key, &out)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("Copy(%q) error = %v, wantErr %v", tt.key, err, tt.wantErr)
+		}
+		if !tt.wantErr && out.String() != tt.want {
+			t.Errorf("Copy(%q) wrote %q, want %q", tt.key, out.String(), tt.want)
+		}
+	}
+}
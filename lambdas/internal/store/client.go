@@ -0,0 +1,48 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// DefaultMaxAttempts is the number of attempts per DynamoDB call when DYNAMODB_MAX_ATTEMPTS isn't set
+const DefaultMaxAttempts = 8
+
+// maxBackoff bounds the jittered exponential backoff between attempts, as retry.DefaultPolicy does
+const maxBackoff = 5 * time.Second
+
+// ParseMaxAttempts parses a DYNAMODB_MAX_ATTEMPTS setting; empty means DefaultMaxAttempts
+func ParseMaxAttempts(value string) (int, error) {
+	if value == "" {
+		return DefaultMaxAttempts, nil
+	}
+	attempts, err := strconv.Atoi(value)
+	if err != nil || attempts <= 0 {
+		return 0, fmt.Errorf("invalid max attempts %q", value)
+	}
+	return attempts, nil
+}
+
+// NewRetryer returns the SDK retryer of the DynamoDB clients. It retries throttled calls, such as
+// ProvisionedThroughputExceededException under a burst of writes, and server errors with exponential
+// backoff and full jitter, up to maxAttempts attempts. The client-side retry quota is turned off, since
+// a burst of throttles would otherwise use it up and fail the remaining calls without a retry.
+func NewRetryer(maxAttempts int) aws.Retryer {
+	return retry.AddWithMaxAttempts(retry.NewStandard(func(o *retry.StandardOptions) {
+		o.MaxBackoff = maxBackoff
+		o.RateLimiter = ratelimit.None
+	}), maxAttempts)
+}
+
+// NewClient returns a DynamoDB client of the configuration that retries with NewRetryer
+func NewClient(cfg aws.Config, maxAttempts int) *dynamodb.Client {
+	return dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		o.Retryer = NewRetryer(maxAttempts)
+	})
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/smithy-go"
+)
+
+func TestParseMaxAttempts(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{value: "", want: DefaultMaxAttempts},
+		{value: "3", want: 3},
+		{value: "1", want: 1},
+		{value: "0", wantErr: true},
+		{value: "-1", wantErr: true},
+		{value: "many", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseMaxAttempts(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseMaxAttempts(%q) = %d, %v, want %d, error %t", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestNewClientRetryer(t *testing.T) {
+	client := NewClient(aws.Config{Region: "us-east-1"}, 5)
+
+	retryer := client.Options().Retryer
+	if retryer == nil {
+		t.Fatal("client has no retryer")
+	}
+	if got := retryer.MaxAttempts(); got != 5 {
+		t.Errorf("MaxAttempts() = %d, want 5", got)
+	}
+	if !retryer.IsErrorRetryable(&smithy.GenericAPIError{Code: "ProvisionedThroughputExceededException"}) {
+		t.Error("a throttled write isn't retried")
+	}
+
+	// The quota isn't used up by a burst of throttles
+	throttled := &smithy.GenericAPIError{Code: "ThrottlingException"}
+	for range 1000 {
+		if _, err := retryer.GetRetryToken(t.Context(), throttled); err != nil {
+			t.Fatalf("GetRetryToken() error = %v, want no retry quota", err)
+		}
+	}
+
+	// The backoff is capped
+	for attempt := 1; attempt <= 20; attempt++ {
+		delay, err := retryer.RetryDelay(attempt, errors.New("throttled"))
+		if err != nil {
+			t.Fatalf("RetryDelay(%d) error = %v", attempt, err)
+		}
+		if delay > maxBackoff {
+			t.Errorf("RetryDelay(%d) = %s, want at most %s", attempt, delay, maxBackoff)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Package store holds the DynamoDB access shared by the log backup Lambda functions.
+package store
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// StatusIndexName is the global secondary index on Status (hash key) and LastWritten (range key).
+// It projects only the keys and Size, and only contains records that have a Status.
+const StatusIndexName = "StatusIndex"
+
+// Record statuses
+const (
+	StatusPending     = "PENDING"
+	StatusDownloading = "DOWNLOADING"
+	StatusDownloaded  = "DOWNLOADED"
+	StatusFailed      = "FAILED"
+	StatusWaiting     = "WAITING" // Written too recently to download; the detector sets it back to PENDING
+	StatusPartial     = "PARTIAL" // Backed up up to MAX_FILE_BYTES; the next download continues from LastMarker
+)
+
+// Statuses of the per-instance summary item, set by the Log Detector while it can't list the instance's log files
+const (
+	StatusUnauthorized = "UNAUTHORIZED" // DescribeDBLogFiles was denied
+	StatusMissing      = "MISSING"      // The DB instance no longer exists
+)
+
+// SummarySortKey is the LogFileName of the per-instance summary item maintained by the Log Detector.
+// Its PendingCount is decremented by the Log Downloader when it starts backing up a PENDING record.
+const SummarySortKey = "#SUMMARY"
+
+// QueryAPI is the subset of the DynamoDB client used to query the table
+type QueryAPI interface {
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+}
+
+// IndexRecord is a log file record as projected into the status index
+type IndexRecord struct {
+	DBInstanceIdentifier string `dynamodbav:"DBInstanceIdentifier"`
+	LogFileName          string `dynamodbav:"LogFileName"`
+	Status               string `dynamodbav:"Status"`
+	LastWritten          int64  `dynamodbav:"LastWritten"`
+	Size                 int64  `dynamodbav:"Size"`
+}
+
+// QueryByStatus returns the records with the given status across all DB instances,
+// oldest LastWritten first, read from the status index
+func QueryByStatus(ctx context.Context, client QueryAPI, tableName, status string) ([]IndexRecord, error) {
+	var records []IndexRecord
+	var exclusiveStartKey map[string]types.AttributeValue
+
+	// Use pagination to get all records with the status
+	for {
+		resp, err := client.Query(ctx, &dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			IndexName:              aws.String(StatusIndexName),
+			KeyConditionExpression: aws.String("#status = :status"),
+			ExpressionAttributeNames: map[string]string{
+				"#status": "Status", // STATUS is a DynamoDB reserved word
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":status": &types.AttributeValueMemberS{Value: status},
+			},
+			ExclusiveStartKey: exclusiveStartKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var page []IndexRecord
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, err
+		}
+		records = append(records, page...)
+
+		// Check if there are more pages
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		exclusiveStartKey = resp.LastEvaluatedKey
+	}
+
+	return records, nil
+}
+
+// CountByInstance returns the number of records with the given status per DB instance,
+// read from the status index
+func CountByInstance(ctx context.Context, client QueryAPI, tableName, status string) (map[string]int, error) {
+	counts := make(map[string]int)
+	var exclusiveStartKey map[string]types.AttributeValue
+
+	// Use pagination to get all records with the status
+	for {
+		resp, err := client.Query(ctx, &dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			IndexName:              aws.String(StatusIndexName),
+			KeyConditionExpression: aws.String("#status = :status"),
+			ExpressionAttributeNames: map[string]string{
+				"#status": "Status", // STATUS is a DynamoDB reserved word
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":status": &types.AttributeValueMemberS{Value: status},
+			},
+			ProjectionExpression: aws.String("DBInstanceIdentifier"),
+			ExclusiveStartKey:    exclusiveStartKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range resp.Items {
+			if id, ok := item["DBInstanceIdentifier"].(*types.AttributeValueMemberS); ok {
+				counts[id.Value]++
+			}
+		}
+
+		// Check if there are more pages
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		exclusiveStartKey = resp.LastEvaluatedKey
+	}
+
+	return counts, nil
+}
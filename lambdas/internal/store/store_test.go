@@ -0,0 +1,103 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fakeIndex serves the DB instance IDs of the records per status, one item per page
+type fakeIndex struct {
+	records map[string][]string
+	err     error
+	queries []*dynamodb.QueryInput
+}
+
+func (f *fakeIndex) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	f.queries = append(f.queries, params)
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	ids := f.records[params.ExpressionAttributeValues[":status"].(*types.AttributeValueMemberS).Value]
+	start := 0
+	if params.ExclusiveStartKey != nil {
+		start, _ = strconv.Atoi(params.ExclusiveStartKey["page"].(*types.AttributeValueMemberN).Value)
+	}
+	if start >= len(ids) {
+		return &dynamodb.QueryOutput{}, nil
+	}
+
+	resp := &dynamodb.QueryOutput{Items: []map[string]types.AttributeValue{
+		{"DBInstanceIdentifier": &types.AttributeValueMemberS{Value: ids[start]}},
+	}}
+	if start < len(ids)-1 {
+		resp.LastEvaluatedKey = map[string]types.AttributeValue{"page": &types.AttributeValueMemberN{Value: strconv.Itoa(start + 1)}}
+	}
+	return resp, nil
+}
+
+func TestCountByInstance(t *testing.T) {
+	client := &fakeIndex{records: map[string][]string{
+		StatusPending: {"db-1", "db-2", "db-1"},
+		StatusFailed:  {"db-2"},
+	}}
+
+	got, err := CountByInstance(context.Background(), client, "table", StatusPending)
+	if err != nil {
+		t.Fatalf("CountByInstance() error = %v", err)
+	}
+	if want := map[string]int{"db-1": 2, "db-2": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("CountByInstance() = %v, want %v", got, want)
+	}
+	if len(client.queries) != 3 {
+		t.Errorf("Query calls = %d, want 3", len(client.queries))
+	}
+	if indexName := aws.ToString(client.queries[0].IndexName); indexName != StatusIndexName {
+		t.Errorf("IndexName = %q, want %q", indexName, StatusIndexName)
+	}
+}
+
+func TestCountByInstanceError(t *testing.T) {
+	client := &fakeIndex{err: errors.New("throttled")}
+
+	if _, err := CountByInstance(context.Background(), client, "table", StatusFailed); err == nil {
+		t.Error("CountByInstance() error = nil, want an error")
+	}
+}
+
+func TestQueryByStatus(t *testing.T) {
+	client := &fakeIndex{records: map[string][]string{
+		StatusFailed:  {"db-1", "db-2"},
+		StatusPending: {"db-1"},
+	}}
+
+	got, err := QueryByStatus(context.Background(), client, "table", StatusFailed)
+	if err != nil {
+		t.Fatalf("QueryByStatus() error = %v", err)
+	}
+	want := []IndexRecord{{DBInstanceIdentifier: "db-1"}, {DBInstanceIdentifier: "db-2"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("QueryByStatus() = %+v, want %+v", got, want)
+	}
+	if len(client.queries) != 2 {
+		t.Errorf("Query calls = %d, want 2", len(client.queries))
+	}
+	if indexName := aws.ToString(client.queries[0].IndexName); indexName != StatusIndexName {
+		t.Errorf("IndexName = %q, want %q", indexName, StatusIndexName)
+	}
+}
+
+func TestQueryByStatusError(t *testing.T) {
+	client := &fakeIndex{err: errors.New("throttled")}
+
+	if _, err := QueryByStatus(context.Background(), client, "table", StatusFailed); err == nil {
+		t.Error("QueryByStatus() error = nil, want an error")
+	}
+}
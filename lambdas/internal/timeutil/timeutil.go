@@ -0,0 +1,38 @@
+// Package timeutil converts the epoch timestamps stored in the log file records.
+// LastWritten, as reported by RDS, and LastBackup are both in milliseconds since the epoch.
+package timeutil
+
+import "time"
+
+// secondsThreshold separates epoch seconds from epoch milliseconds: in milliseconds it is in 1973,
+// in seconds it is in the year 5138, so no real timestamp below it is in milliseconds
+const secondsThreshold = 100_000_000_000
+
+// EpochMillis returns t in milliseconds since the epoch
+func EpochMillis(t time.Time) int64 {
+	return t.UnixMilli()
+}
+
+// NormalizeMillis returns a stored epoch timestamp in milliseconds. Values written in seconds by earlier
+// versions are converted, so records are migrated lazily as they are read.
+func NormalizeMillis(value int64) int64 {
+	if value > 0 && value < secondsThreshold {
+		return value * 1000
+	}
+	return value
+}
+
+// FromEpochMillis returns the time of an epoch timestamp in milliseconds
+func FromEpochMillis(value int64) time.Time {
+	return time.UnixMilli(value)
+}
+
+// Since returns how long before now the epoch timestamp in milliseconds is. A timestamp after now,
+// due to clock skew, returns 0.
+func Since(value int64, now time.Time) time.Duration {
+	elapsed := now.Sub(FromEpochMillis(value))
+	if elapsed < 0 {
+		return 0
+	}
+	return elapsed
+}
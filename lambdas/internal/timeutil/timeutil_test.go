@@ -0,0 +1,55 @@
+package timeutil
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalizeMillis(t *testing.T) {
+	tests := []struct {
+		name  string
+		value int64
+		want  int64
+	}{
+		{name: "milliseconds", value: 1714564800123, want: 1714564800123},
+		{name: "seconds", value: 1714564800, want: 1714564800000},
+		{name: "unset", value: 0, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NormalizeMillis(tt.value); got != tt.want {
+				t.Errorf("NormalizeMillis(%d) = %d, want %d", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFromEpochMillis(t *testing.T) {
+	want := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if got := FromEpochMillis(EpochMillis(want)); !got.Equal(want) {
+		t.Errorf("FromEpochMillis() = %s, want %s", got, want)
+	}
+}
+
+func TestSince(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		value int64
+		want  time.Duration
+	}{
+		{name: "milliseconds before now", value: now.Add(-90 * time.Second).UnixMilli(), want: 90 * time.Second},
+		{name: "normalized seconds before now", value: NormalizeMillis(now.Add(-25 * time.Hour).Unix()), want: 25 * time.Hour},
+		{name: "after now", value: now.Add(time.Second).UnixMilli()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Since(tt.value, now); got != tt.want {
+				t.Errorf("Since() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
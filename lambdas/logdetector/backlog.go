@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/store"
+)
+
+// backlogMode is the mode of a direct invocation that reports the backup backlog:
+//
+//	{"mode": "backlog"}
+const backlogMode = "backlog"
+
+// BacklogRequest is the payload of a direct invocation that reports the files waiting for a backup
+type BacklogRequest struct {
+	Mode string `json:"mode"`
+}
+
+// BacklogResponse is the result of a backlog invocation:
+//
+//	{"instances": [{"dbInstanceIdentifier": "my-instance-1", "pending": 3, "failed": 1}], "pending": 3, "failed": 1}
+type BacklogResponse struct {
+	Instances []InstanceBacklog `json:"instances"`
+	Pending   int               `json:"pending"`
+	Failed    int               `json:"failed"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// InstanceBacklog counts the records of one DB instance waiting for a backup
+type InstanceBacklog struct {
+	DBInstanceIdentifier string `json:"dbInstanceIdentifier"`
+	Pending              int    `json:"pending"`
+	Failed               int    `json:"failed"`
+}
+
+// NewBacklogHandler returns a Lambda function handler for backlog invocations
+func NewBacklogHandler(deps HandlerDeps) func(ctx context.Context, request BacklogRequest) (BacklogResponse, error) {
+	return deps.handleBacklog
+}
+
+// handleBacklog counts the PENDING and FAILED records per DB instance using the status index
+func (deps HandlerDeps) handleBacklog(ctx context.Context, request BacklogRequest) (BacklogResponse, error) {
+	// Initialize logger
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	logger.Println("Starting backlog report")
+
+	var response BacklogResponse
+
+	// Fail the invocation when required settings are missing
+	if err := validateConfig(); err != nil {
+		logger.Printf("Error: %v\n", err)
+		response.Error = err.Error()
+		return response, err
+	}
+
+	// Read the settings from the environment
+	cfg, err := loadDetectorConfig()
+	if err != nil {
+		logger.Printf("Error: %v\n", err)
+		response.Error = err.Error()
+		return response, err
+	}
+
+	var metrics detectorMetrics
+	dynamoClient := withRetries(deps.DynamoDB, &metrics)
+
+	pending, err := store.CountByInstance(ctx, dynamoClient, cfg.TableName, StatusPending)
+	if err != nil {
+		logger.Printf("Error counting pending records: %v\n", err)
+		return response, err
+	}
+	failed, err := store.CountByInstance(ctx, dynamoClient, cfg.TableName, StatusFailed)
+	if err != nil {
+		logger.Printf("Error counting failed records: %v\n", err)
+		return response, err
+	}
+
+	// Report every instance with a backlog, sorted by identifier
+	ids := make(map[string]bool)
+	for id := range pending {
+		ids[id] = true
+	}
+	for id := range failed {
+		ids[id] = true
+	}
+	for id := range ids {
+		response.Instances = append(response.Instances, InstanceBacklog{
+			DBInstanceIdentifier: id,
+			Pending:              pending[id],
+			Failed:               failed[id],
+		})
+		response.Pending += pending[id]
+		response.Failed += failed[id]
+	}
+	sort.Slice(response.Instances, func(i, j int) bool {
+		return response.Instances[i].DBInstanceIdentifier < response.Instances[j].DBInstanceIdentifier
+	})
+
+	logger.Printf("%d pending and %d failed records across %d instances, %d DynamoDB retries\n", response.Pending, response.Failed, len(response.Instances), metrics.Retries)
+	return response, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestHandleBacklog(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+
+	store := &fakeRecordStore{records: []LogFileRecord{
+		{DBInstanceIdentifier: "db-2", LogFileName: "audit/server_audit.log", Status: StatusPending},
+		{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log", Status: StatusPending},
+		{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log.1", Status: StatusPending},
+		{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log.2", Status: StatusFailed},
+		{DBInstanceIdentifier: "db-3", LogFileName: "audit/server_audit.log", Status: StatusDownloaded},
+		{DBInstanceIdentifier: "db-3", LogFileName: "#WATERMARK"},
+	}}
+
+	got, err := NewInvokeHandler(HandlerDeps{RDS: &fakeLogFiles{}, DynamoDB: store})(context.Background(), json.RawMessage(`{"mode": "backlog"}`))
+	if err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+
+	want := BacklogResponse{
+		Instances: []InstanceBacklog{
+			{DBInstanceIdentifier: "db-1", Pending: 2, Failed: 1},
+			{DBInstanceIdentifier: "db-2", Pending: 1},
+		},
+		Pending: 3,
+		Failed:  1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("response = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+	rdstypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/aurora"
+)
+
+// DescribeDBClustersAPI is the subset of the RDS client used to resolve the member instances of a DB cluster.
+// The RDS clients of HandlerDeps implement it alongside DescribeDBLogFilesAPI.
+type DescribeDBClustersAPI = aurora.DescribeDBClustersAPI
+
+// processCluster records the log files of the member instances of the DB cluster named by an SQS message, one
+// after the other. The writer is listed first, and a log file name already listed for an earlier member isn't
+// recorded again, so a log file listed by both the writer and a reader is backed up once, from the writer.
+// Every member is attempted; the errors of the members that failed are returned together.
+func (deps HandlerDeps) processCluster(ctx context.Context, cfg detectorConfig, message events.SQSMessage, clusterID string, clusterClient DescribeDBClustersAPI, rdsClient DescribeDBLogFilesAPI, dynamoClient RecordStoreAPI, metrics *detectorMetrics, logger *log.Logger) error {
+	logger.Printf("Processing DB cluster: %s\n", clusterID)
+
+	if err := waitForRateLimit(ctx, deps.RDSLimiter, metrics); err != nil {
+		return err
+	}
+	members, err := aurora.ClusterMembers(ctx, clusterClient, clusterID)
+	if isDBClusterNotFound(err) {
+		// The cluster was deleted after it was queued, so retrying the message can't succeed
+		logger.Printf("DB cluster %s no longer exists, skipping message %s\n", clusterID, message.MessageId)
+		metrics.MissingInstances++
+		return nil
+	}
+	if isAccessDenied(err) {
+		logger.Printf("Not authorized to describe DB cluster %s, not retrying: %v\n", clusterID, err)
+		metrics.UnauthorizedInstances++
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("describing DB cluster: %w", err)
+	}
+	logger.Printf("DB cluster %s has %d member instances\n", clusterID, len(members))
+
+	cfg.ClusterID = clusterID
+	cfg.ClusterLogFiles = make(map[string]bool)
+	var errs []error
+	for _, dbInstanceID := range members {
+		if cfg.Deadline.reached() {
+			logger.Printf("Less than %s left before the Lambda deadline, stopping DB cluster %s\n", cfg.SafetyMargin, clusterID)
+			errs = append(errs, errDeadlineReached)
+			break
+		}
+		memberLogger := instanceLogger(logger, dbInstanceID)
+		if err := detectInstance(ctx, rdsClient, dynamoClient, cfg, message, dbInstanceID, metrics, memberLogger); err != nil {
+			memberLogger.Printf("Error processing member instance %s of DB cluster %s: %v\n", dbInstanceID, clusterID, err)
+			errs = append(errs, fmt.Errorf("instance %s: %w", dbInstanceID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// clusterLogger returns a logger that prefixes every message with the DB cluster ID
+func clusterLogger(logger *log.Logger, clusterID string) *log.Logger {
+	return log.New(logger.Writer(), logger.Prefix()+"cluster="+clusterID+" ", logger.Flags()|log.Lmsgprefix)
+}
+
+// isDBClusterNotFound reports whether an RDS call failed because the DB cluster doesn't exist
+func isDBClusterNotFound(err error) bool {
+	var notFound *rdstypes.DBClusterNotFoundFault
+	return errors.As(err, &notFound)
+}
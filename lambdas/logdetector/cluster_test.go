@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	rdstypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
+)
+
+// fakeClusterLogFiles serves the members of the configured DB clusters, and the log files of fakeLogFiles
+type fakeClusterLogFiles struct {
+	*fakeLogFiles
+	clusters map[string][]rdstypes.DBClusterMember
+}
+
+func (f *fakeClusterLogFiles) DescribeDBClusters(ctx context.Context, params *rds.DescribeDBClustersInput, optFns ...func(*rds.Options)) (*rds.DescribeDBClustersOutput, error) {
+	members, ok := f.clusters[aws.ToString(params.DBClusterIdentifier)]
+	if !ok {
+		return nil, &rdstypes.DBClusterNotFoundFault{}
+	}
+	return &rds.DescribeDBClustersOutput{DBClusters: []rdstypes.DBCluster{{DBClusterMembers: members}}}, nil
+}
+
+// clusterMember returns a member instance of a DB cluster
+func clusterMember(dbInstanceID string, writer bool) rdstypes.DBClusterMember {
+	return rdstypes.DBClusterMember{DBInstanceIdentifier: aws.String(dbInstanceID), IsClusterWriter: aws.Bool(writer)}
+}
+
+func TestHandleClusterMessage(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("LOG_TYPES", "audit,error")
+
+	rdsClient := &fakeClusterLogFiles{
+		fakeLogFiles: &fakeLogFiles{},
+		clusters: map[string][]rdstypes.DBClusterMember{
+			"cluster-1": {clusterMember("db-2", false), clusterMember("db-1", true)},
+		},
+	}
+	store := &fakeRecordStore{}
+	event := sqsEvent(`{"clusterId":"cluster-1"}`, `{"clusterId":"cluster-2"}`)
+
+	var metrics bytes.Buffer
+	response, err := NewHandler(HandlerDeps{RDS: rdsClient, DynamoDB: store, Metrics: &metrics})(context.Background(), event)
+	if err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+
+	// The missing cluster is acknowledged, as a missing instance is
+	if len(response.BatchItemFailures) != 0 {
+		t.Errorf("BatchItemFailures = %v, want none", response.BatchItemFailures)
+	}
+	if len(rdsClient.fileLastWritten) != 2 {
+		t.Errorf("DescribeDBLogFiles calls = %d, want one per member", len(rdsClient.fileLastWritten))
+	}
+
+	// Both members list the same log files, which are only recorded for the writer
+	if want := []string{"audit/server_audit.log", "error/mysql-error.log"}; !reflect.DeepEqual(store.written, want) {
+		t.Errorf("written = %v, want %v", store.written, want)
+	}
+	if want := []string{"cluster-1", "cluster-1"}; !reflect.DeepEqual(store.writtenClusters, want) {
+		t.Errorf("written clusters = %v, want %v", store.writtenClusters, want)
+	}
+	if writer, reader := store.summaries["db-1"].FilesTracked, store.summaries["db-2"].FilesTracked; writer != 2 || reader != 0 {
+		t.Errorf("files tracked = %d for the writer, %d for the reader, want 2 and 0", writer, reader)
+	}
+	if !strings.Contains(metrics.String(), `"MissingInstances":1`) {
+		t.Errorf("metrics %s don't count the missing cluster", metrics.String())
+	}
+}
+
+// clusterUpdates records the ClusterIdentifier written by each update of a log file record
+type clusterUpdates struct {
+	*fakeRecordStore
+	clusters map[string]string
+}
+
+func (f *clusterUpdates) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	if cluster, ok := params.ExpressionAttributeValues[":clusterIdentifier"].(*types.AttributeValueMemberS); ok {
+		f.clusters[params.Key["LogFileName"].(*types.AttributeValueMemberS).Value] = cluster.Value
+	}
+	return f.fakeRecordStore.UpdateItem(ctx, params, optFns...)
+}
+
+func TestHandleStoresInstanceCluster(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("LOG_TYPES", "audit,error")
+
+	// The audit log was recorded before its instance's messages named the cluster
+	store := &clusterUpdates{
+		fakeRecordStore: &fakeRecordStore{records: []LogFileRecord{{
+			DBInstanceIdentifier: "db-1",
+			LogFileName:          "audit/server_audit.log",
+			Size:                 100,
+			LastWritten:          1000,
+			ExpiresAt:            expiresAt(1000, defaultRetentionDays),
+			Status:               StatusDownloaded,
+		}}},
+		clusters: make(map[string]string),
+	}
+	event := sqsEvent(`{"instanceId":"db-1","clusterId":"cluster-1"}`)
+
+	response, err := NewHandler(HandlerDeps{RDS: &fakeLogFiles{}, DynamoDB: store})(context.Background(), event)
+	if err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+	if len(response.BatchItemFailures) != 0 {
+		t.Fatalf("BatchItemFailures = %v, want none", response.BatchItemFailures)
+	}
+
+	if want := []string{"cluster-1"}; !reflect.DeepEqual(store.writtenClusters, want) {
+		t.Errorf("clusters of the new records = %v, want %v", store.writtenClusters, want)
+	}
+	if got := store.clusters["audit/server_audit.log"]; got != "cluster-1" {
+		t.Errorf("cluster of the existing record = %q, want cluster-1", got)
+	}
+	// Picking up the cluster isn't a change of the log file, which stays backed up
+	if status, ok := store.statuses["audit/server_audit.log"]; ok {
+		t.Errorf("status of the existing record set to %s, want it unchanged", status)
+	}
+}
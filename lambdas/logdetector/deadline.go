@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// defaultSafetyMargin is the default for DEADLINE_SAFETY_MARGIN_SECONDS
+const defaultSafetyMargin = 10 * time.Second
+
+// errDeadlineReached is returned when the invocation stopped before the Lambda deadline.
+// The message is reported as a batch item failure, so SQS delivers it again; the records already
+// written are rewritten idempotently and the watermark isn't advanced past the unprocessed log files.
+var errDeadlineReached = errors.New("stopped before the Lambda deadline")
+
+// deadlineGuard tells when an invocation must stop starting new work.
+// The zero value never stops.
+type deadlineGuard struct {
+	stopAt time.Time        // Lambda deadline minus the safety margin, zero without a deadline
+	now    func() time.Time // Clock compared with stopAt
+}
+
+// newDeadlineGuard returns the guard of an invocation whose context carries the Lambda deadline
+func newDeadlineGuard(ctx context.Context, safetyMargin time.Duration, now func() time.Time) deadlineGuard {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return deadlineGuard{}
+	}
+	if now == nil {
+		now = time.Now
+	}
+	return deadlineGuard{stopAt: deadline.Add(-safetyMargin), now: now}
+}
+
+// reached reports whether less than the safety margin is left before the deadline
+func (g deadlineGuard) reached() bool {
+	return !g.stopAt.IsZero() && !g.now().Before(g.stopAt)
+}
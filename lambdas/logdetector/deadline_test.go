@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// fakeClock returns now and advances it by step on every call. It is safe for concurrent use.
+type fakeClock struct {
+	mu   sync.Mutex
+	now  time.Time
+	step time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now
+	c.now = c.now.Add(c.step)
+	return now
+}
+
+func TestDeadlineGuard(t *testing.T) {
+	deadline := time.Now().Add(time.Hour)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		now  time.Time
+		want bool
+	}{
+		{name: "no deadline", ctx: context.Background(), now: deadline, want: false},
+		{name: "before the safety margin", ctx: ctx, now: deadline.Add(-11 * time.Second), want: false},
+		{name: "at the safety margin", ctx: ctx, now: deadline.Add(-10 * time.Second), want: true},
+		{name: "within the safety margin", ctx: ctx, now: deadline.Add(-time.Second), want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guard := newDeadlineGuard(tt.ctx, 10*time.Second, func() time.Time { return tt.now })
+			if got := guard.reached(); got != tt.want {
+				t.Errorf("reached() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessDBInstanceStopsBeforeDeadline(t *testing.T) {
+	rdsClient := staticLogFiles{
+		{LogFileName: aws.String("audit/server_audit.log"), Size: aws.Int64(100), LastWritten: aws.Int64(3000)},
+		{LogFileName: aws.String("audit/server_audit.log.1"), Size: aws.Int64(100), LastWritten: aws.Int64(2000)},
+		{LogFileName: aws.String("audit/server_audit.log.2"), Size: aws.Int64(100), LastWritten: aws.Int64(1000)},
+	}
+	store := &fakeRecordStore{}
+
+	// The third log file is reached at the safety margin
+	stopAt := time.Now()
+	clock := &fakeClock{now: stopAt.Add(-2 * time.Second), step: time.Second}
+	cfg := detectorConfig{
+		TableName:     "table",
+		RetentionDays: defaultRetentionDays,
+		Deadline:      deadlineGuard{stopAt: stopAt, now: clock.Now},
+	}
+
+	var metrics detectorMetrics
+	err := processDBInstance(context.Background(), rdsClient, store, cfg, "db-1", &metrics, discardLogger)
+	if !errors.Is(err, errDeadlineReached) {
+		t.Fatalf("processDBInstance() error = %v, want %v", err, errDeadlineReached)
+	}
+	if want := []string{"audit/server_audit.log", "audit/server_audit.log.1"}; !reflect.DeepEqual(store.written, want) {
+		t.Errorf("written = %v, want %v", store.written, want)
+	}
+	if mark, ok := store.watermarks["db-1"]; ok {
+		t.Errorf("watermark = %+v, want none so the redelivered message lists every log file again", mark)
+	}
+	if summary := store.summaries["db-1"]; summary.LastError != "" {
+		t.Errorf("summary LastError = %q, want none", summary.LastError)
+	}
+}
+
+func TestHandleReturnsUnprocessedMessagesBeforeDeadline(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("DETECTOR_CONCURRENCY", "1")
+	t.Setenv("DEADLINE_SAFETY_MARGIN_SECONDS", "10")
+
+	deadline := time.Now().Add(time.Hour)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	// Every message and log file checks the clock once. db-1 and its two log files are done before
+	// the safety margin, which is reached at the first log file of db-2; db-3 isn't started.
+	clock := &fakeClock{now: deadline.Add(-14 * time.Second), step: time.Second}
+	store := &fakeRecordStore{}
+	deps := HandlerDeps{RDS: &fakeLogFiles{}, DynamoDB: store, Metrics: io.Discard, Now: clock.Now}
+
+	response, err := NewHandler(deps)(ctx, sqsEvent("db-1", "db-2", "db-3"))
+	if err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+
+	var failed []string
+	for _, failure := range response.BatchItemFailures {
+		failed = append(failed, failure.ItemIdentifier)
+	}
+	if want := []string{"msg-2", "msg-3"}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("BatchItemFailures = %v, want %v", failed, want)
+	}
+	if want := []string{"audit/server_audit.log"}; !reflect.DeepEqual(store.written, want) {
+		t.Errorf("written = %v, want only the log file of db-1", store.written)
+	}
+	if _, ok := store.watermarks["db-2"]; ok {
+		t.Error("watermark of db-2 was advanced")
+	}
+}
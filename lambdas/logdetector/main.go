@@ -2,141 +2,1218 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go-v2/service/rds"
 	rdstypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/aurora"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/awsregion"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/emf"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/ratelimit"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/store"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/timeutil"
+	"golang.org/x/sync/errgroup"
 )
 
 // LogFileRecord represents a record in the DynamoDB table
 type LogFileRecord struct {
-	DBInstanceIdentifier string `dynamodbav:"DBInstanceIdentifier"`
-	LogFileName          string `dynamodbav:"LogFileName"`
-	Size                 int64  `dynamodbav:"Size"`
-	LastWritten          int64  `dynamodbav:"LastWritten"`
-	LastBackup           int64  `dynamodbav:"LastBackup,omitempty"`
+	DBInstanceIdentifier string      `dynamodbav:"DBInstanceIdentifier"`
+	LogFileName          string      `dynamodbav:"LogFileName"`
+	LogFileType          LogFileType `dynamodbav:"LogFileType,omitempty"`
+	Size                 int64       `dynamodbav:"Size"`
+	LastWritten          int64       `dynamodbav:"LastWritten"`
+	LastBackup           int64       `dynamodbav:"LastBackup,omitempty"`
+	Status               string      `dynamodbav:"Status,omitempty"`
+	ExpiresAt            int64       `dynamodbav:"ExpiresAt,omitempty"` // TTL in epoch seconds
+	Deleted              bool        `dynamodbav:"Deleted,omitempty"`   // The log file no longer exists on the instance
+	DeletedAt            int64       `dynamodbav:"DeletedAt,omitempty"`
+	// SizeHistory holds the last sizeHistoryLength sizes recorded, oldest first
+	SizeHistory []sizeObservation `dynamodbav:"SizeHistory,omitempty"`
+	Rotated     bool              `dynamodbav:"Rotated,omitempty"` // The log file shrank, so an earlier generation was replaced
+	// DiscoveryLagSeconds is how long after the log file was last written the detector first recorded it
+	DiscoveryLagSeconds int64 `dynamodbav:"DiscoveryLagSeconds,omitempty"`
+	// Region is the region of the DB instance, empty when it is in the Lambda's region
+	Region string `dynamodbav:"Region,omitempty"`
+	// ClusterIdentifier is the DB cluster of the instance, as named by its SQS message. It is empty for an instance
+	// outside a cluster, or whose message doesn't name its cluster.
+	ClusterIdentifier string `dynamodbav:"ClusterIdentifier,omitempty"`
+	// Version counts the detector's writes, so updateLogFileRecord doesn't overwrite a concurrent update.
+	// Records written before it was introduced have none.
+	Version int64 `dynamodbav:"Version,omitempty"`
 }
 
-// Handler is the Lambda function handler
-func Handler(ctx context.Context, sqsEvent events.SQSEvent) error {
+// sizeObservation is a log file size and when it was recorded
+type sizeObservation struct {
+	Size       int64 `dynamodbav:"Size"`
+	ObservedAt int64 `dynamodbav:"ObservedAt"` // Epoch seconds
+}
+
+// sizeHistoryLength is the number of sizes kept in a record's SizeHistory
+const sizeHistoryLength = 5
+
+// maxUpdateAttempts is how many times a log file record is read and updated before a concurrent update fails it
+const maxUpdateAttempts = 3
+
+// Record statuses. The detector sets StatusPending when a log file needs a backup;
+// the downloader moves the record through the others.
+const (
+	StatusPending     = store.StatusPending
+	StatusDownloading = store.StatusDownloading
+	StatusDownloaded  = store.StatusDownloaded
+	StatusFailed      = store.StatusFailed
+	StatusWaiting     = store.StatusWaiting
+	// Statuses of the summary item
+	StatusUnauthorized = store.StatusUnauthorized
+	StatusMissing      = store.StatusMissing
+)
+
+// watermarkSortKey is the LogFileName of the per-instance item holding the newest LastWritten seen.
+// Sort keys starting with "#" are reserved for bookkeeping items and are ignored by the downloader.
+const watermarkSortKey = "#WATERMARK"
+
+// summarySortKey is the LogFileName of the per-instance item summarizing its log file records, so dashboards
+// don't have to query every record. It holds FilesTracked and PendingCount, kept up to date with ADD
+// (the downloader decrements PendingCount when it starts a backup), LastDetectedAt in epoch milliseconds
+// and the LastError of the last detection, removed once a detection succeeds. Its Status is StatusUnauthorized
+// or StatusMissing while the instance's log files can't be listed.
+const summarySortKey = store.SummarySortKey
+
+// summaryChange is the change a detection makes to the counts of the instance's summary item
+type summaryChange struct {
+	FilesTracked int // Records created or reappeared, minus the records marked deleted
+	PendingCount int // Records that became PENDING
+	// Status is StatusUnauthorized or StatusMissing when the log files couldn't be listed; empty removes it
+	Status string
+}
+
+// fullListingInterval is how often the log files are listed without the watermark,
+// so the records of log files removed from the instance are still marked as deleted
+const fullListingInterval = 24 * time.Hour
+
+// watermark is the per-instance listing checkpoint
+type watermark struct {
+	LastWritten     int64 `dynamodbav:"Watermark"`       // Newest LastWritten recorded, in epoch milliseconds
+	LastFullListing int64 `dynamodbav:"LastFullListing"` // Time of the last listing without the watermark, in epoch seconds
+	// Position and filter of a listing cut short by MAX_PAGES, continued by the next invocation
+	ListingMarker          string `dynamodbav:"ListingMarker,omitempty"`
+	ListingFileLastWritten int64  `dynamodbav:"ListingFileLastWritten,omitempty"`
+	// Oldest LastWritten of the log files skipped below the size or age thresholds, which filtered listings
+	// keep listing until they are recorded. It is kept apart from the watermark, which never moves back.
+	HeldBack int64 `dynamodbav:"HeldBack,omitempty"`
+}
+
+// defaultDetectionCooldown is the default for DETECTION_COOLDOWN_SECONDS
+const defaultDetectionCooldown = 60 * time.Second
+
+// defaultConcurrency is the default for DETECTOR_CONCURRENCY
+const defaultConcurrency = 4
+
+// defaultMaxPages is the default for MAX_PAGES
+const defaultMaxPages = 100
+
+// errListingTruncated is returned by processDBInstance when the listing stopped at MAX_PAGES,
+// so the SQS message is retried and the listing continues where it stopped
+var errListingTruncated = errors.New("log file listing stopped at the page limit")
+
+// defaultRetentionDays is how long a record is kept after its log file was last written
+const defaultRetentionDays = 14
+
+// LogFileType classifies a log file by the name pattern it matched
+type LogFileType = aurora.LogFileType
+
+// Supported log file types
+const (
+	LogFileTypeAudit     = aurora.LogFileTypeAudit
+	LogFileTypeError     = aurora.LogFileTypeError
+	LogFileTypeSlowQuery = aurora.LogFileTypeSlowQuery
+	LogFileTypeGeneral   = aurora.LogFileTypeGeneral
+)
+
+// The log name patterns are compiled once per cold start. An invalid LOG_NAME_PATTERNS value
+// is reported by every invocation so the misconfiguration can't go unnoticed.
+var logNamePatterns, logNamePatternsErr = aurora.ParseLogNamePatterns(os.Getenv("LOG_NAME_PATTERNS"))
+
+// detectorConfig holds the settings read from the environment
+type detectorConfig struct {
+	TableName         string
+	RetentionDays     int
+	FullRescan        bool              // Ignore the watermarks and list every log file
+	Thresholds        aurora.Thresholds // Log files below the minimum size or age are not recorded yet
+	Debug             bool              // Log the skipped log files
+	MaxRecords        int32             // DescribeDBLogFiles page size (0 uses the RDS default)
+	MaxPages          int               // DescribeDBLogFiles pages listed per invocation (0 means unlimited)
+	Concurrency       int               // SQS messages processed at the same time
+	DetectionCooldown time.Duration     // Time during which further messages for an instance are skipped (0 disables it)
+	MetricsByInstance bool              // Dimension the metrics by DB instance instead of only by function
+	AllowedTables     map[string]bool   // Tables a message may route its records to instead of TableName
+	DLQURL            string            // Dead-letter queue poison messages are forwarded to (empty acknowledges them)
+	// LogTypes are the log file types recorded; nil records only audit logs
+	LogTypes map[LogFileType]bool
+	// SafetyMargin is the time before the Lambda deadline at which no further message or log file is started
+	SafetyMargin time.Duration
+	// Deadline is the invocation's deadline guard, set by the handler
+	Deadline deadlineGuard
+	// Region is the region of the DB instance being processed, stored on its records; set per message
+	Region string
+	// ClusterID is the DB cluster of the instance being processed, stored on its records; set per message
+	ClusterID string
+	// ClusterLogFiles are the log file names already listed for an earlier member of the cluster being processed,
+	// which aren't recorded again; nil outside a cluster
+	ClusterLogFiles map[string]bool
+}
+
+// logTypeEnabled reports whether log files of the type are recorded
+func (cfg detectorConfig) logTypeEnabled(fileType LogFileType) bool {
+	if cfg.LogTypes == nil {
+		return fileType == LogFileTypeAudit
+	}
+	return cfg.LogTypes[fileType]
+}
+
+// detectorMetrics counts notable outcomes of one invocation
+type detectorMetrics struct {
+	// ConditionalCheckFailures counts writes rejected because another invocation already wrote newer data
+	ConditionalCheckFailures int
+	// Retries counts DynamoDB calls repeated after throttling or a server error
+	Retries int
+
+	// Counters published as CloudWatch metrics
+	FilesListed      int // Log files returned by DescribeDBLogFiles
+	RecordsCreated   int // Records created for new log files
+	RecordsUpdated   int // Records updated for changed log files
+	RecordsUnchanged int // Log files whose record is up to date
+	Errors           int // Log files or instances that could not be recorded
+	PoisonMessages   int // SQS messages that can never be processed
+	RateLimitWaits   int // RDS calls delayed by RDS_API_RPS
+	// Instances whose log files can't be listed, which are not retried
+	UnauthorizedInstances int // DescribeDBLogFiles was denied
+	MissingInstances      int // The DB instance no longer exists
+	// RateLimitDelay is the total time RDS calls waited for RDS_API_RPS
+	RateLimitDelay time.Duration
+	// MaxDiscoveryLag is the longest time between a new log file's LastWritten and its first record
+	MaxDiscoveryLag time.Duration
+}
+
+// cloudWatchMetrics returns the metrics published to CloudWatch.
+// The discovery lag is only published when records were created, and poison messages, instances that
+// can't be listed and rate limit waits when there were any.
+func (m detectorMetrics) cloudWatchMetrics() []emf.Metric {
+	metrics := []emf.Metric{
+		{Name: "FilesListed", Value: float64(m.FilesListed), Unit: emf.Count},
+		{Name: "RecordsCreated", Value: float64(m.RecordsCreated), Unit: emf.Count},
+		{Name: "RecordsUpdated", Value: float64(m.RecordsUpdated), Unit: emf.Count},
+		{Name: "RecordsUnchanged", Value: float64(m.RecordsUnchanged), Unit: emf.Count},
+		{Name: "Errors", Value: float64(m.Errors), Unit: emf.Count},
+	}
+	if m.RecordsCreated > 0 {
+		metrics = append(metrics, emf.Metric{Name: "DiscoveryLagSeconds", Value: m.MaxDiscoveryLag.Seconds(), Unit: emf.Seconds})
+	}
+	if m.PoisonMessages > 0 {
+		metrics = append(metrics, emf.Metric{Name: "PoisonMessages", Value: float64(m.PoisonMessages), Unit: emf.Count})
+	}
+	if m.UnauthorizedInstances > 0 {
+		metrics = append(metrics, emf.Metric{Name: "UnauthorizedInstances", Value: float64(m.UnauthorizedInstances), Unit: emf.Count})
+	}
+	if m.MissingInstances > 0 {
+		metrics = append(metrics, emf.Metric{Name: "MissingInstances", Value: float64(m.MissingInstances), Unit: emf.Count})
+	}
+	if m.RateLimitWaits > 0 {
+		metrics = append(metrics,
+			emf.Metric{Name: "RDSRateLimitWaits", Value: float64(m.RateLimitWaits), Unit: emf.Count},
+			emf.Metric{Name: "RDSRateLimitDelaySeconds", Value: m.RateLimitDelay.Seconds(), Unit: emf.Seconds},
+		)
+	}
+	return metrics
+}
+
+// recordCreated counts a created record and its discovery lag
+func (m *detectorMetrics) recordCreated(record LogFileRecord) {
+	m.RecordsCreated++
+	m.observeDiscoveryLag(time.Duration(record.DiscoveryLagSeconds) * time.Second)
+}
+
+// observeDiscoveryLag keeps the longest discovery lag
+func (m *detectorMetrics) observeDiscoveryLag(lag time.Duration) {
+	if lag > m.MaxDiscoveryLag {
+		m.MaxDiscoveryLag = lag
+	}
+}
+
+// add adds the counts of other to m
+func (m *detectorMetrics) add(other detectorMetrics) {
+	m.ConditionalCheckFailures += other.ConditionalCheckFailures
+	m.Retries += other.Retries
+	m.FilesListed += other.FilesListed
+	m.RecordsCreated += other.RecordsCreated
+	m.RecordsUpdated += other.RecordsUpdated
+	m.RecordsUnchanged += other.RecordsUnchanged
+	m.Errors += other.Errors
+	m.PoisonMessages += other.PoisonMessages
+	m.UnauthorizedInstances += other.UnauthorizedInstances
+	m.MissingInstances += other.MissingInstances
+	m.RateLimitWaits += other.RateLimitWaits
+	m.RateLimitDelay += other.RateLimitDelay
+	m.observeDiscoveryLag(other.MaxDiscoveryLag)
+}
+
+// DescribeDBLogFilesAPI is the subset of the RDS client used by the detector
+type DescribeDBLogFilesAPI interface {
+	DescribeDBLogFiles(ctx context.Context, params *rds.DescribeDBLogFilesInput, optFns ...func(*rds.Options)) (*rds.DescribeDBLogFilesOutput, error)
+}
+
+// RecordStoreAPI is the subset of the DynamoDB client used to read and write log file records
+type RecordStoreAPI interface {
+	RecordCreateAPI
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+}
+
+// HandlerDeps holds the AWS clients used by the handler, and where its metrics are written
+type HandlerDeps struct {
+	RDS      DescribeDBLogFilesAPI
+	DynamoDB RecordStoreAPI
+	// SQS forwards poison messages to the dead-letter queue (only used when DLQ_URL is set)
+	SQS SendMessageAPI
+	// Metrics receives the CloudWatch embedded metric format records (nil writes them to stdout)
+	Metrics io.Writer
+	// Now is the clock checked against the Lambda deadline (nil uses time.Now)
+	Now func() time.Time
+	// RDSLimiter spaces out the RDS calls of all invocations of the execution environment (nil doesn't limit)
+	RDSLimiter *ratelimit.Limiter
+	// Region is the Lambda's region, whose instances are listed with RDS
+	Region string
+	// RegionalRDS holds the RDS clients of the other regions listed in REGIONS
+	RegionalRDS map[string]DescribeDBLogFilesAPI
+}
+
+// requiredEnvVars are the environment variables the detector can't run without
+var requiredEnvVars = []string{"DYNAMODB_TABLE_NAME"}
+
+// validateConfig returns an error naming every required environment variable that is not set
+func validateConfig() error {
+	var missing []string
+	for _, name := range requiredEnvVars {
+		if os.Getenv(name) == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("required environment variables not set: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// NewHandlerDeps creates the AWS clients from the given configuration
+func NewHandlerDeps(cfg aws.Config) HandlerDeps {
+	// An invalid RDS_API_RPS is reported by loadDetectorConfig, which then fails every invocation
+	rdsRate, _ := ratelimit.ParseRate(os.Getenv("RDS_API_RPS"))
+	// An invalid DYNAMODB_MAX_ATTEMPTS is reported by loadDetectorConfig as well
+	dynamoMaxAttempts, _ := store.ParseMaxAttempts(os.Getenv("DYNAMODB_MAX_ATTEMPTS"))
+
+	rdsCfg := rdsConfig(cfg)
+	regionalRDS := make(map[string]DescribeDBLogFilesAPI)
+	// An invalid REGIONS is reported by loadDetectorConfig as well
+	regions, _ := awsregion.ParseList(os.Getenv("REGIONS"), cfg.Region)
+	for _, region := range regions {
+		if region == cfg.Region {
+			continue
+		}
+		regionalCfg := rdsCfg.Copy()
+		regionalCfg.Region = region
+		regionalRDS[region] = rds.NewFromConfig(regionalCfg)
+	}
+
+	return HandlerDeps{
+		RDS:         rds.NewFromConfig(rdsCfg),
+		DynamoDB:    store.NewClient(cfg, dynamoMaxAttempts),
+		SQS:         sqs.NewFromConfig(cfg),
+		RDSLimiter:  ratelimit.New(rdsRate),
+		Region:      cfg.Region,
+		RegionalRDS: regionalRDS,
+	}
+}
+
+// rdsClient returns the RDS client of a region, or nil if there is none.
+// An empty region is the Lambda's region.
+func (deps HandlerDeps) rdsClient(region string) DescribeDBLogFilesAPI {
+	if region == "" || region == deps.Region {
+		return deps.RDS
+	}
+	return deps.RegionalRDS[region]
+}
+
+// rdsConfig returns the configuration for the RDS client. When ASSUME_ROLE_ARN is set, the RDS client
+// assumes that role to reach instances in another account; the other clients stay in the local account.
+func rdsConfig(cfg aws.Config) aws.Config {
+	roleARN := os.Getenv("ASSUME_ROLE_ARN")
+	if roleARN == "" {
+		return cfg
+	}
+
+	rdsCfg := cfg.Copy()
+	rdsCfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), roleARN))
+	return rdsCfg
+}
+
+// NewHandler returns a Lambda function handler using the given clients
+func NewHandler(deps HandlerDeps) func(ctx context.Context, sqsEvent events.SQSEvent) (events.SQSEventResponse, error) {
+	return deps.handle
+}
+
+// Handler is the Lambda function handler.
+// It creates the AWS clients on every invocation; main uses NewHandler to create them once per cold start.
+func Handler(ctx context.Context, sqsEvent events.SQSEvent) (events.SQSEventResponse, error) {
+	// Load AWS configuration
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		log.Printf("Error loading AWS config: %v\n", err)
+		return events.SQSEventResponse{}, err
+	}
+
+	return NewHandler(NewHandlerDeps(cfg))(ctx, sqsEvent)
+}
+
+// handle records the log files of the DB instances in the SQS messages.
+// Messages that fail are reported as batch item failures so only they are retried by SQS.
+func (deps HandlerDeps) handle(ctx context.Context, sqsEvent events.SQSEvent) (events.SQSEventResponse, error) {
 	// Initialize logger
 	logger := log.New(os.Stdout, "", log.LstdFlags)
 	logger.Println("Starting Log File Detector Lambda")
 
+	var response events.SQSEventResponse
+
+	// Fail the invocation when required settings are missing, so the messages are retried
+	if err := validateConfig(); err != nil {
+		logger.Printf("Error: %v\n", err)
+		return response, err
+	}
+
+	// Read the settings from the environment
+	cfg, err := loadDetectorConfig()
+	if err != nil {
+		logger.Printf("Error: %v\n", err)
+		return response, err
+	}
+
+	// Fail the invocation when the log name patterns can't be compiled
+	if logNamePatternsErr != nil {
+		logger.Printf("Error: invalid LOG_NAME_PATTERNS: %v\n", logNamePatternsErr)
+		return response, logNamePatternsErr
+	}
+
+	// Messages not started before the safety margin are returned to the queue
+	cfg.Deadline = newDeadlineGuard(ctx, cfg.SafetyMargin, deps.Now)
+
+	// Process the SQS messages concurrently. Each message has its own metrics and error,
+	// so a failing instance only fails its own message.
+	messageMetrics := make([]detectorMetrics, len(sqsEvent.Records))
+	messageErrs := make([]error, len(sqsEvent.Records))
+	poison := make([]bool, len(sqsEvent.Records))
+	instanceIDs := make([]string, len(sqsEvent.Records))
+
+	handleMessage := func(i int) {
+		message := sqsEvent.Records[i]
+		if cfg.Deadline.reached() {
+			logger.Printf("Less than %s left before the Lambda deadline, returning message %s to the queue\n", cfg.SafetyMargin, message.MessageId)
+			messageErrs[i] = errDeadlineReached
+			return
+		}
+
+		// A message that doesn't name a DB instance would fail on every delivery until it expires
+		target, reason := parseMessageBody(message.Body)
+		if reason != nil {
+			poison[i] = true
+			messageMetrics[i].PoisonMessages = 1
+			messageErrs[i] = deps.handlePoisonMessage(ctx, cfg, message, reason, logger)
+			if messageErrs[i] != nil {
+				logger.Printf("Error handling poison message %s: %v\n", message.MessageId, messageErrs[i])
+			}
+			return
+		}
+
+		// A cluster message is dimensioned by its cluster identifier
+		instanceIDs[i] = target.InstanceID
+		messageLogger := instanceLogger(logger, target.InstanceID)
+		if target.InstanceID == "" {
+			instanceIDs[i] = target.ClusterID
+			messageLogger = clusterLogger(logger, target.ClusterID)
+		}
+
+		messageErrs[i] = deps.processMessage(ctx, cfg, message, target, &messageMetrics[i], messageLogger)
+		if messageErrs[i] != nil {
+			messageLogger.Printf("Error processing message %s for %s: %v\n", message.MessageId, target, messageErrs[i])
+		}
+	}
+
+	// The messages of a FIFO message group, which the DB Scanner sets to the instance ID, are processed in order
+	// one at a time. Once one fails, the rest of its group are returned to the queue so they stay in order.
+	var group errgroup.Group
+	group.SetLimit(cfg.Concurrency)
+	for _, indexes := range messageGroups(sqsEvent.Records) {
+		group.Go(func() error {
+			for n, i := range indexes {
+				handleMessage(i)
+				if messageErrs[i] == nil {
+					continue
+				}
+				for _, j := range indexes[n+1:] {
+					logger.Printf("Returning message %s to the queue after message %s of its group failed\n", sqsEvent.Records[j].MessageId, sqsEvent.Records[i].MessageId)
+					messageErrs[j] = errEarlierMessageFailed
+				}
+				break
+			}
+			return nil
+		})
+	}
+	group.Wait()
+
+	var metrics detectorMetrics
+	for i, message := range sqsEvent.Records {
+		// An instance that failed before its log files were attempted still counts as an error,
+		// unless it was only stopped by the deadline or held back behind a failed message
+		if messageErrs[i] != nil && !errors.Is(messageErrs[i], errDeadlineReached) && !errors.Is(messageErrs[i], errEarlierMessageFailed) && messageMetrics[i].Errors == 0 {
+			messageMetrics[i].Errors = 1
+		}
+		metrics.add(messageMetrics[i])
+		if messageErrs[i] != nil {
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{
+				ItemIdentifier: message.MessageId,
+			})
+		}
+	}
+
+	// Publish the metrics per instance, or once for the whole invocation.
+	// Poison messages have no instance, so they are only published by function.
+	functionDimensions := map[string]string{"FunctionName": os.Getenv("AWS_LAMBDA_FUNCTION_NAME")}
+	if cfg.MetricsByInstance {
+		for i := range sqsEvent.Records {
+			if !poison[i] {
+				deps.emitMetrics(map[string]string{"DBInstanceIdentifier": instanceIDs[i]}, messageMetrics[i].cloudWatchMetrics(), logger)
+			}
+		}
+		if metrics.PoisonMessages > 0 {
+			deps.emitMetrics(functionDimensions, []emf.Metric{{Name: "PoisonMessages", Value: float64(metrics.PoisonMessages), Unit: emf.Count}}, logger)
+		}
+	} else {
+		deps.emitMetrics(functionDimensions, metrics.cloudWatchMetrics(), logger)
+	}
+
+	logger.Printf("Processed %d messages, %d failed, %d poison, %d unauthorized instances, %d missing instances, %d conditional check failures, %d DynamoDB retries, %d RDS rate limit waits (%s)\n", len(sqsEvent.Records), len(response.BatchItemFailures), metrics.PoisonMessages, metrics.UnauthorizedInstances, metrics.MissingInstances, metrics.ConditionalCheckFailures, metrics.Retries, metrics.RateLimitWaits, metrics.RateLimitDelay)
+	return response, nil
+}
+
+// errEarlierMessageFailed returns a message to the queue behind a failed message of its FIFO message group
+var errEarlierMessageFailed = errors.New("an earlier message of its message group failed")
+
+// messageGroups returns the indexes of the messages of each FIFO message group, in batch order.
+// A message from a standard queue has no MessageGroupId and is a group of its own.
+func messageGroups(messages []events.SQSMessage) [][]int {
+	var groups [][]int
+	byID := make(map[string]int)
+	for i, message := range messages {
+		groupID, ok := message.Attributes["MessageGroupId"]
+		if !ok {
+			groups = append(groups, []int{i})
+			continue
+		}
+		if g, ok := byID[groupID]; ok {
+			groups[g] = append(groups[g], i)
+			continue
+		}
+		byID[groupID] = len(groups)
+		groups = append(groups, []int{i})
+	}
+	return groups
+}
+
+// emitMetrics writes the metrics in CloudWatch embedded metric format, dimensioned by the given dimensions
+func (deps HandlerDeps) emitMetrics(dimensions map[string]string, metrics []emf.Metric, logger *log.Logger) {
+	w := deps.Metrics
+	if w == nil {
+		w = os.Stdout
+	}
+	if err := emf.New(w, emf.Namespace).Emit(dimensions, metrics); err != nil {
+		logger.Printf("Error emitting metrics: %v\n", err)
+	}
+}
+
+// processMessage records the log files of the DB instance, or of the member instances of the DB cluster, named by
+// an SQS message, with the RDS client of its region.
+// A TableName attribute routes the records to one of cfg.AllowedTables instead of cfg.TableName.
+func (deps HandlerDeps) processMessage(ctx context.Context, cfg detectorConfig, message events.SQSMessage, target instanceMessage, metrics *detectorMetrics, logger *log.Logger) error {
+	regionalClient := deps.rdsClient(target.Region)
+	if regionalClient == nil {
+		return fmt.Errorf("no RDS client for region %s, which is not in REGIONS", target.Region)
+	}
+	cfg.Region = target.Region
+	if cfg.Region == "" {
+		cfg.Region = deps.Region
+	}
+	rdsClient := withRateLimit(regionalClient, deps.RDSLimiter, metrics)
+	dynamoClient := withRetries(deps.DynamoDB, metrics)
+
+	if attribute, ok := message.MessageAttributes["TableName"]; ok {
+		tableName := aws.ToString(attribute.StringValue)
+		if tableName != cfg.TableName && !cfg.AllowedTables[tableName] {
+			return fmt.Errorf("table %q is not in ALLOWED_TABLES", tableName)
+		}
+		logger.Printf("Message %s routes %s to table %s\n", message.MessageId, target, tableName)
+		cfg.TableName = tableName
+	}
+
+	cfg.ClusterID = target.ClusterID
+	if target.InstanceID == "" {
+		clusterClient, ok := regionalClient.(DescribeDBClustersAPI)
+		if !ok {
+			return fmt.Errorf("the RDS client of region %s can't describe DB clusters", cfg.Region)
+		}
+		return deps.processCluster(ctx, cfg, message, target.ClusterID, clusterClient, rdsClient, dynamoClient, metrics, logger)
+	}
+	return detectInstance(ctx, rdsClient, dynamoClient, cfg, message, target.InstanceID, metrics, logger)
+}
+
+// detectInstance records the log files of a DB instance of an SQS message.
+// Duplicate deliveries within cfg.DetectionCooldown are skipped, unless the message has a ForceRescan attribute.
+func detectInstance(ctx context.Context, rdsClient DescribeDBLogFilesAPI, dynamoClient RecordStoreAPI, cfg detectorConfig, message events.SQSMessage, dbInstanceID string, metrics *detectorMetrics, logger *log.Logger) error {
+	if _, ok := message.MessageAttributes["ForceRescan"]; ok {
+		logger.Printf("Message %s forces a rescan of instance %s\n", message.MessageId, dbInstanceID)
+		cfg.FullRescan = true
+		return processDBInstance(ctx, rdsClient, dynamoClient, cfg, dbInstanceID, metrics, logger)
+	}
+
+	if cfg.DetectionCooldown <= 0 {
+		return processDBInstance(ctx, rdsClient, dynamoClient, cfg, dbInstanceID, metrics, logger)
+	}
+
+	// Only one invocation per cooldown gets to process the instance
+	now := time.Now()
+	claimed, err := claimDetection(ctx, dynamoClient, cfg.TableName, dbInstanceID, now, cfg.DetectionCooldown, logger)
+	if err != nil {
+		return fmt.Errorf("claiming detection: %w", err)
+	}
+	if !claimed {
+		logger.Printf("Instance %s was processed in the last %s, skipping duplicate message %s\n", dbInstanceID, cfg.DetectionCooldown, message.MessageId)
+		return nil
+	}
+
+	err = processDBInstance(ctx, rdsClient, dynamoClient, cfg, dbInstanceID, metrics, logger)
+	if err != nil {
+		// Let the retried message through the gate
+		if releaseErr := releaseDetection(ctx, dynamoClient, cfg.TableName, dbInstanceID, now, logger); releaseErr != nil {
+			logger.Printf("Error releasing detection of instance %s: %v\n", dbInstanceID, releaseErr)
+		}
+	}
+	return err
+}
+
+// instanceLogger returns a logger that prefixes every message with the DB instance ID,
+// so the output of instances processed concurrently can be told apart
+func instanceLogger(logger *log.Logger, dbInstanceID string) *log.Logger {
+	return log.New(logger.Writer(), logger.Prefix()+"instance="+dbInstanceID+" ", logger.Flags()|log.Lmsgprefix)
+}
+
+// loadDetectorConfig reads the settings from environment variables, which validateConfig checked.
+// It returns an error naming the first variable that is invalid.
+func loadDetectorConfig() (detectorConfig, error) {
 	// Get DynamoDB table name from environment variable
 	tableName := os.Getenv("DYNAMODB_TABLE_NAME")
-	if tableName == "" {
-		logger.Println("Error: DYNAMODB_TABLE_NAME environment variable not set")
-		return nil
+
+	// Get the record retention from environment variable
+	retentionDays := defaultRetentionDays
+	if retentionDaysStr := os.Getenv("RETENTION_DAYS"); retentionDaysStr != "" {
+		val, err := strconv.Atoi(retentionDaysStr)
+		if err != nil || val <= 0 {
+			return detectorConfig{}, fmt.Errorf("invalid RETENTION_DAYS value %q", retentionDaysStr)
+		}
+		retentionDays = val
 	}
 
-	// Load AWS configuration
-	cfg, err := config.LoadDefaultConfig(ctx)
+	// List every log file instead of the ones written since the watermark
+	fullRescan := false
+	if fullRescanStr := os.Getenv("FULL_RESCAN"); fullRescanStr != "" {
+		val, err := strconv.ParseBool(fullRescanStr)
+		if err != nil {
+			return detectorConfig{}, fmt.Errorf("invalid FULL_RESCAN value %q", fullRescanStr)
+		}
+		fullRescan = val
+	}
+
+	// Don't record log files until they reach a minimum size and age
+	thresholds, err := aurora.ParseThresholds(os.Getenv("MIN_FILE_SIZE_BYTES"), os.Getenv("MIN_FILE_AGE_SECONDS"))
 	if err != nil {
-		logger.Printf("Error loading AWS config: %v\n", err)
-		return err
+		return detectorConfig{}, err
+	}
+
+	// Bound the DescribeDBLogFiles pagination
+	var maxRecords int32
+	if maxRecordsStr := os.Getenv("DESCRIBE_LOGS_MAX_RECORDS"); maxRecordsStr != "" {
+		val, err := strconv.ParseInt(maxRecordsStr, 10, 32)
+		if err != nil || val < 0 {
+			return detectorConfig{}, fmt.Errorf("invalid DESCRIBE_LOGS_MAX_RECORDS value %q", maxRecordsStr)
+		}
+		maxRecords = int32(val)
+	}
+
+	maxPages := defaultMaxPages
+	if maxPagesStr := os.Getenv("MAX_PAGES"); maxPagesStr != "" {
+		val, err := strconv.Atoi(maxPagesStr)
+		if err != nil || val < 0 {
+			return detectorConfig{}, fmt.Errorf("invalid MAX_PAGES value %q", maxPagesStr)
+		}
+		maxPages = val
+	}
+
+	// Number of DB instances processed at the same time
+	concurrency := defaultConcurrency
+	if concurrencyStr := os.Getenv("DETECTOR_CONCURRENCY"); concurrencyStr != "" {
+		val, err := strconv.Atoi(concurrencyStr)
+		if err != nil || val <= 0 {
+			return detectorConfig{}, fmt.Errorf("invalid DETECTOR_CONCURRENCY value %q", concurrencyStr)
+		}
+		concurrency = val
+	}
+
+	// Skip duplicate deliveries of the same instance within the cooldown
+	detectionCooldown := defaultDetectionCooldown
+	if cooldownStr := os.Getenv("DETECTION_COOLDOWN_SECONDS"); cooldownStr != "" {
+		val, err := strconv.Atoi(cooldownStr)
+		if err != nil || val < 0 {
+			return detectorConfig{}, fmt.Errorf("invalid DETECTION_COOLDOWN_SECONDS value %q", cooldownStr)
+		}
+		detectionCooldown = time.Duration(val) * time.Second
+	}
+
+	// Dimensioning by instance creates one set of CloudWatch metrics per instance
+	metricsByInstance := true
+	if metricsByInstanceStr := os.Getenv("METRICS_BY_INSTANCE"); metricsByInstanceStr != "" {
+		val, err := strconv.ParseBool(metricsByInstanceStr)
+		if err != nil {
+			return detectorConfig{}, fmt.Errorf("invalid METRICS_BY_INSTANCE value %q", metricsByInstanceStr)
+		}
+		metricsByInstance = val
+	}
+
+	// Tables the TableName message attribute may select
+	allowedTables := make(map[string]bool)
+	for _, name := range strings.Split(os.Getenv("ALLOWED_TABLES"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			allowedTables[name] = true
+		}
 	}
 
-	// Create RDS client
-	rdsClient := rds.NewFromConfig(cfg)
+	// Poison messages are forwarded here instead of only being acknowledged
+	dlqURL := os.Getenv("DLQ_URL")
 
-	// Create DynamoDB client
-	dynamoClient := dynamodb.NewFromConfig(cfg)
+	// Regions of the instances named by messages (the RDS clients are created by NewHandlerDeps)
+	if _, err := awsregion.ParseList(os.Getenv("REGIONS"), ""); err != nil {
+		return detectorConfig{}, fmt.Errorf("invalid REGIONS value %q", os.Getenv("REGIONS"))
+	}
+
+	// RDS calls per second, shared by the worker pool (the limiter is created by NewHandlerDeps)
+	if _, err := ratelimit.ParseRate(os.Getenv("RDS_API_RPS")); err != nil {
+		return detectorConfig{}, fmt.Errorf("invalid RDS_API_RPS value %q", os.Getenv("RDS_API_RPS"))
+	}
+
+	// Attempts per DynamoDB call by the SDK's retryer (the client is created by NewHandlerDeps)
+	if _, err := store.ParseMaxAttempts(os.Getenv("DYNAMODB_MAX_ATTEMPTS")); err != nil {
+		return detectorConfig{}, fmt.Errorf("invalid DYNAMODB_MAX_ATTEMPTS value %q", os.Getenv("DYNAMODB_MAX_ATTEMPTS"))
+	}
+
+	// Stop starting new work this long before the Lambda deadline
+	safetyMargin := defaultSafetyMargin
+	if safetyMarginStr := os.Getenv("DEADLINE_SAFETY_MARGIN_SECONDS"); safetyMarginStr != "" {
+		val, err := strconv.Atoi(safetyMarginStr)
+		if err != nil || val < 0 {
+			return detectorConfig{}, fmt.Errorf("invalid DEADLINE_SAFETY_MARGIN_SECONDS value %q", safetyMarginStr)
+		}
+		safetyMargin = time.Duration(val) * time.Second
+	}
 
-	// Process each SQS message
-	for _, message := range sqsEvent.Records {
-		// The message body contains the DB instance ID
-		dbInstanceID := message.Body
-		logger.Printf("Processing DB instance: %s\n", dbInstanceID)
+	// Log file types to record; log files of the other types are ignored
+	logTypes, err := aurora.ParseLogTypes(os.Getenv("LOG_TYPES"))
+	if err != nil {
+		return detectorConfig{}, fmt.Errorf("invalid LOG_TYPES value %q: %w", os.Getenv("LOG_TYPES"), err)
+	}
 
-		// Get log files for the DB instance
-		logFiles, err := getDBLogFiles(ctx, rdsClient, dbInstanceID, logger)
+	debug := false
+	if debugStr := os.Getenv("DEBUG"); debugStr != "" {
+		val, err := strconv.ParseBool(debugStr)
 		if err != nil {
-			logger.Printf("Error getting log files for instance %s: %v\n", dbInstanceID, err)
+			return detectorConfig{}, fmt.Errorf("invalid DEBUG value %q", debugStr)
+		}
+		debug = val
+	}
+
+	return detectorConfig{
+		TableName:         tableName,
+		RetentionDays:     retentionDays,
+		FullRescan:        fullRescan,
+		Thresholds:        thresholds,
+		Debug:             debug,
+		MaxRecords:        maxRecords,
+		MaxPages:          maxPages,
+		Concurrency:       concurrency,
+		DetectionCooldown: detectionCooldown,
+		MetricsByInstance: metricsByInstance,
+		AllowedTables:     allowedTables,
+		DLQURL:            dlqURL,
+		LogTypes:          logTypes,
+		SafetyMargin:      safetyMargin,
+	}, nil
+}
+
+// processDBInstance records the log files of one DB instance in DynamoDB.
+// Every log file is attempted; an error is returned if any of them could not be recorded.
+func processDBInstance(ctx context.Context, rdsClient DescribeDBLogFilesAPI, dynamoClient RecordStoreAPI, cfg detectorConfig, dbInstanceID string, metrics *detectorMetrics, logger *log.Logger) (err error) {
+	logger.Printf("Processing DB instance: %s\n", dbInstanceID)
+
+	tableName := cfg.TableName
+
+	// Update the instance's summary item with the outcome of the detection. Every created record is new and PENDING.
+	// An instance that can't be listed is recorded with its listing error, although the message isn't retried.
+	var summary summaryChange
+	var listErr error
+	createdBefore := metrics.RecordsCreated
+	defer func() {
+		created := metrics.RecordsCreated - createdBefore
+		summary.FilesTracked += created
+		summary.PendingCount += created
+		detectErr := err
+		if detectErr == nil {
+			detectErr = listErr
+		}
+		if summaryErr := updateSummary(ctx, dynamoClient, tableName, dbInstanceID, summary, time.Now(), detectErr, logger); summaryErr != nil {
+			logger.Printf("Error updating summary of DB instance %s: %v\n", dbInstanceID, summaryErr)
+		}
+	}()
+
+	// Get the listing checkpoint of the instance
+	mark, err := getWatermark(ctx, dynamoClient, tableName, dbInstanceID, logger)
+	if err != nil {
+		return fmt.Errorf("getting watermark: %w", err)
+	}
+
+	// Only list the log files written since the watermark, unless a full listing is due
+	now := time.Now()
+	fullListing := cfg.FullRescan || mark == nil || now.Sub(time.Unix(mark.LastFullListing, 0)) >= fullListingInterval
+	var fileLastWritten int64
+	if !fullListing {
+		fileLastWritten = mark.LastWritten
+		// List the log files held back below the thresholds again
+		if mark.HeldBack > 0 && mark.HeldBack <= fileLastWritten {
+			fileLastWritten = mark.HeldBack - 1
+		}
+	}
+
+	// Continue a listing cut short by the page limit. The continued listing is partial,
+	// so it can't mark deleted log files even if it started as a full listing.
+	var startMarker *string
+	if !cfg.FullRescan && mark != nil && mark.ListingMarker != "" {
+		logger.Printf("Continuing the log file listing of DB instance %s\n", dbInstanceID)
+		fullListing = false
+		fileLastWritten = mark.ListingFileLastWritten
+		startMarker = aws.String(mark.ListingMarker)
+	}
+
+	// Get log files for the DB instance
+	logFiles, nextMarker, err := getDBLogFiles(ctx, rdsClient, cfg, dbInstanceID, fileLastWritten, startMarker, logger)
+	if isDBInstanceNotFound(err) {
+		// The instance was deleted after it was scanned, so retrying the message can't succeed
+		logger.Printf("DB instance %s no longer exists, marking its log files as deleted\n", dbInstanceID)
+		summary.Status, listErr = StatusMissing, err
+		metrics.MissingInstances++
+		deleted, err := tombstoneDBInstance(ctx, dynamoClient, tableName, dbInstanceID, logger)
+		summary.FilesTracked -= deleted
+		return err
+	}
+	if isAccessDenied(err) {
+		// Retrying can't succeed until the permissions are fixed, so the message is acknowledged
+		logger.Printf("Not authorized to list the log files of DB instance %s, not retrying: %v\n", dbInstanceID, err)
+		summary.Status, listErr = StatusUnauthorized, err
+		metrics.UnauthorizedInstances++
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("getting log files: %w", err)
+	}
+	metrics.FilesListed += len(logFiles)
+
+	failed := 0
+	// Every failure is also counted in the Errors metric
+	defer func() { metrics.Errors += failed }()
+
+	// Oldest LastWritten of the log files skipped for being below the thresholds
+	var heldBack int64
+
+	// New records are buffered and written in batches
+	writeBuffer := newRecordWriteBuffer(dynamoClient, tableName, metrics, logger)
+
+	// Process each log file, until the Lambda deadline is close
+	stopped := false
+	for _, logFile := range logFiles {
+		if cfg.Deadline.reached() {
+			logger.Printf("Less than %s left before the Lambda deadline, stopping DB instance %s\n", cfg.SafetyMargin, dbInstanceID)
+			stopped = true
+			break
+		}
+
+		// Log files without a name can't be recorded
+		if logFile.LogFileName == nil {
+			logger.Printf("Skipping a log file of instance %s without a name\n", dbInstanceID)
 			continue
 		}
 
-		// Process each log file
-		for _, logFile := range logFiles {
-			// Check if the log file is an audit log
-			if logFile.LogFileName == nil || !isAuditLog(*logFile.LogFileName) {
+		// Check if the log file matches one of the configured name patterns
+		logFileType, ok := aurora.ClassifyLogFile(logNamePatterns, aws.ToString(logFile.LogFileName))
+		if !ok || !cfg.logTypeEnabled(logFileType) {
+			continue
+		}
+
+		// A log file name already listed for an earlier member of the cluster is only recorded for that member
+		if cfg.ClusterLogFiles != nil {
+			if cfg.ClusterLogFiles[aws.ToString(logFile.LogFileName)] {
+				logger.Printf("Log file %s was already listed for another member of DB cluster %s, skipping\n", aws.ToString(logFile.LogFileName), cfg.ClusterID)
 				continue
 			}
+			cfg.ClusterLogFiles[aws.ToString(logFile.LogFileName)] = true
+		}
 
-			// Create a record for the log file
-			record := LogFileRecord{
-				DBInstanceIdentifier: dbInstanceID,
-				LogFileName:          *logFile.LogFileName,
-				Size:                 0, // Default value
-				LastWritten:          0, // Default value
-			}
+		// Create a record for the log file; a missing Size or LastWritten is recorded as 0
+		record := LogFileRecord{
+			DBInstanceIdentifier: dbInstanceID,
+			LogFileName:          aws.ToString(logFile.LogFileName),
+			LogFileType:          logFileType,
+			Size:                 aws.ToInt64(logFile.Size),
+			LastWritten:          aws.ToInt64(logFile.LastWritten),
+			Region:               cfg.Region,
+			ClusterIdentifier:    cfg.ClusterID,
+		}
 
-			// Handle nullable Size field
-			if logFile.Size != nil {
-				record.Size = *logFile.Size
+		// Wait for small or recently created log files to grow and settle
+		if cfg.Thresholds.Below(record.Size, record.LastWritten, now) {
+			if cfg.Debug {
+				logger.Printf("Debug: log file %s (%d bytes, last written %d) is below the size or age threshold, skipping\n", record.LogFileName, record.Size, record.LastWritten)
 			}
-
-			// Handle nullable LastWritten field
-			if logFile.LastWritten != nil {
-				record.LastWritten = *logFile.LastWritten
+			if heldBack == 0 || record.LastWritten < heldBack {
+				heldBack = record.LastWritten
 			}
+			continue
+		}
+
+		// Let DynamoDB expire the record once the log file is past retention
+		record.ExpiresAt = expiresAt(record.LastWritten, cfg.RetentionDays)
 
-			// Check if the record already exists in DynamoDB
-			existingRecord, err := getLogFileRecord(ctx, dynamoClient, tableName, dbInstanceID, *logFile.LogFileName, logger)
+		// Another invocation may update the record between the read and the write. The update is conditional on
+		// the Version read, so it is then rejected, and the log file is compared again with the record re-read.
+		for attempt := 1; ; attempt++ {
+			existingRecord, err := getLogFileRecord(ctx, dynamoClient, tableName, dbInstanceID, record.LogFileName, logger)
 			if err != nil {
 				logger.Printf("Error checking for existing record: %v\n", err)
-				continue
+				failed++
+				break
 			}
 
 			if existingRecord == nil {
-				// Record doesn't exist, create a new one
-				err = createLogFileRecord(ctx, dynamoClient, tableName, record, logger)
+				// Record doesn't exist, queue it for creation
+				record.Status = StatusPending
+				record.Version = 1
+				record.SizeHistory, _ = observeSize(nil, record.Size, now)
+				lag := timeutil.Since(record.LastWritten, now)
+				record.DiscoveryLagSeconds = int64(lag / time.Second)
+				err = writeBuffer.add(ctx, record)
 				if err != nil {
-					logger.Printf("Error creating record: %v\n", err)
-					continue
+					logger.Printf("Error creating records: %v\n", err)
+					failed++
+				}
+			} else if existingRecord.LastWritten > record.LastWritten {
+				// Another invocation already recorded a newer version of the log file
+				logger.Printf("Skipping stale update for log file %s\n", record.LogFileName)
+			} else if existingRecord.Size != record.Size || existingRecord.LastWritten != record.LastWritten || existingRecord.ExpiresAt != record.ExpiresAt || existingRecord.Deleted || existingRecord.Status == StatusWaiting || clusterChanged(existingRecord, record) {
+				// Record exists but has changed (predates the current retention, the file reappeared, or the record
+				// doesn't have the instance's cluster yet), update it.
+				// New content needs another backup, as does a log file the downloader left WAITING for its writes
+				// to settle.
+				update := record
+				if existingRecord.Size != record.Size || existingRecord.LastWritten != record.LastWritten || existingRecord.Status == StatusWaiting {
+					update.Status = StatusPending
+				}
+				// Keep track of the sizes to notice rotations
+				if existingRecord.Size != record.Size {
+					update.SizeHistory, update.Rotated = observeSize(existingRecord, record.Size, now)
+					if update.Rotated {
+						logger.Printf("Log file %s shrank from %d to %d bytes, it was rotated\n", record.LogFileName, existingRecord.Size, record.Size)
+					}
+				}
+				err = updateLogFileRecord(ctx, dynamoClient, tableName, update, existingRecord.Version, logger)
+				if isConditionalCheckFailed(err) {
+					metrics.ConditionalCheckFailures++
+					if attempt < maxUpdateAttempts {
+						logger.Printf("Record of log file %s was updated concurrently, reading it again\n", record.LogFileName)
+						continue
+					}
+					err = fmt.Errorf("record updated concurrently %d times", attempt)
 				}
-			} else if existingRecord.Size != record.Size || existingRecord.LastWritten != record.LastWritten {
-				// Record exists but has changed, update it
-				record.LastBackup = existingRecord.LastBackup // Preserve the LastBackup value
-				err = updateLogFileRecord(ctx, dynamoClient, tableName, record, logger)
 				if err != nil {
 					logger.Printf("Error updating record: %v\n", err)
-					continue
+					failed++
+					break
+				}
+				metrics.RecordsUpdated++
+				if existingRecord.Deleted {
+					summary.FilesTracked++
+				}
+				if update.Status == StatusPending && existingRecord.Status != StatusPending {
+					summary.PendingCount++
 				}
 			} else {
 				// Record exists and hasn't changed, skip it
 				logger.Printf("Log file %s hasn't changed, skipping\n", record.LogFileName)
+				metrics.RecordsUnchanged++
 			}
+			break
+		}
+	}
+
+	// Write the remaining new records
+	if err := writeBuffer.flush(ctx); err != nil {
+		logger.Printf("Error creating records: %v\n", err)
+		failed++
+	}
+
+	// Leave the listing marker and watermark alone, so the redelivered message lists the same log files
+	if stopped {
+		return errDeadlineReached
+	}
+
+	// Save where the listing stopped so the retried message continues from there
+	if nextMarker != nil {
+		if failed > 0 {
+			// List the same pages again so the failed log files are retried
+			return fmt.Errorf("%d log files could not be recorded", failed)
 		}
+		err = saveListingMarker(ctx, dynamoClient, tableName, dbInstanceID, aws.ToString(nextMarker), fileLastWritten, logger)
+		if err != nil {
+			return fmt.Errorf("saving listing marker: %w", err)
+		}
+		return errListingTruncated
+	}
+
+	// Mark the records of log files that are no longer on the instance as deleted.
+	// A listing filtered by the watermark omits unchanged files, so only a full listing can tell.
+	if fullListing {
+		deleted, err := markDeletedLogFiles(ctx, dynamoClient, tableName, dbInstanceID, logFiles, logger)
+		if err != nil {
+			logger.Printf("Error marking deleted log files: %v\n", err)
+			failed++
+		}
+		summary.FilesTracked -= deleted
+		if deleted > 0 {
+			logger.Printf("Marked %d log files of instance %s as deleted\n", deleted, dbInstanceID)
+		}
+	}
+
+	if failed > 0 {
+		// Keep the watermark so the failed log files are listed again
+		return fmt.Errorf("%d log files could not be recorded", failed)
+	}
+
+	// Advance the watermark to the newest log file listed
+	next := watermark{LastWritten: fileLastWritten}
+	if mark != nil {
+		next = *mark
+	}
+	for _, logFile := range logFiles {
+		if lastWritten := aws.ToInt64(logFile.LastWritten); lastWritten > next.LastWritten {
+			next.LastWritten = lastWritten
+		}
+	}
+	// Keep the skipped log files in the next filtered listing
+	next.HeldBack = heldBack
+	if fullListing {
+		next.LastFullListing = now.Unix()
+	}
+	err = updateWatermark(ctx, dynamoClient, tableName, dbInstanceID, next, logger)
+	if isConditionalCheckFailed(err) {
+		// Another invocation already advanced the watermark further
+		logger.Printf("Watermark of instance %s is already newer, skipping\n", dbInstanceID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("updating watermark: %w", err)
 	}
 
 	return nil
 }
 
-// getDBLogFiles gets all log files for a DB instance
-func getDBLogFiles(ctx context.Context, client *rds.Client, dbInstanceID string, logger *log.Logger) ([]rdstypes.DescribeDBLogFilesDetails, error) {
-	logger.Printf("Getting log files for DB instance %s\n", dbInstanceID)
+// clusterChanged reports whether a record should pick up the cluster its instance was detected with. A message
+// that doesn't name the cluster leaves the record's cluster alone.
+func clusterChanged(existing *LogFileRecord, record LogFileRecord) bool {
+	return record.ClusterIdentifier != "" && existing.ClusterIdentifier != record.ClusterIdentifier
+}
+
+// observeSize appends size to the SizeHistory of the existing record, which may be nil, keeping the last
+// sizeHistoryLength entries. It reports whether the log file shrank, which means it was rotated.
+func observeSize(existing *LogFileRecord, size int64, now time.Time) ([]sizeObservation, bool) {
+	var history []sizeObservation
+	rotated := false
+	if existing != nil {
+		history = existing.SizeHistory
+		rotated = size < existing.Size
+	}
+
+	history = append(history, sizeObservation{Size: size, ObservedAt: now.Unix()})
+	if len(history) > sizeHistoryLength {
+		history = history[len(history)-sizeHistoryLength:]
+	}
+	return history, rotated
+}
+
+// markDeletedLogFiles sets Deleted and DeletedAt on the instance's records whose log file is missing
+// from the listing, and returns the number of records marked
+func markDeletedLogFiles(ctx context.Context, client RecordStoreAPI, tableName string, dbInstanceID string, logFiles []rdstypes.DescribeDBLogFilesDetails, logger *log.Logger) (int, error) {
+	listed := make(map[string]bool, len(logFiles))
+	for _, logFile := range logFiles {
+		listed[aws.ToString(logFile.LogFileName)] = true
+	}
+
+	records, err := queryLogFileRecords(ctx, client, tableName, dbInstanceID, logger)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, record := range records {
+		// Skip bookkeeping items, records already marked and files that still exist
+		if strings.HasPrefix(record.LogFileName, "#") || record.Deleted || listed[record.LogFileName] {
+			continue
+		}
+
+		err := markLogFileDeleted(ctx, client, tableName, record, logger)
+		if isConditionalCheckFailed(err) {
+			// The record expired or was removed in the meantime
+			continue
+		}
+		if err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// tombstoneDBInstance marks all log file records of a deleted DB instance as deleted and removes its watermark,
+// so a new instance created with the same identifier starts with a full listing.
+// It returns the number of records marked deleted.
+func tombstoneDBInstance(ctx context.Context, client RecordStoreAPI, tableName string, dbInstanceID string, logger *log.Logger) (int, error) {
+	deleted, err := markDeletedLogFiles(ctx, client, tableName, dbInstanceID, nil, logger)
+	if err != nil {
+		return deleted, fmt.Errorf("marking log files deleted: %w", err)
+	}
+	logger.Printf("Marked %d log files of deleted instance %s as deleted\n", deleted, dbInstanceID)
+
+	_, err = client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"DBInstanceIdentifier": &types.AttributeValueMemberS{Value: dbInstanceID},
+			"LogFileName":          &types.AttributeValueMemberS{Value: watermarkSortKey},
+		},
+	})
+	if err != nil {
+		return deleted, fmt.Errorf("deleting watermark: %w", err)
+	}
+
+	return deleted, nil
+}
+
+// updateSummary adds the change to the counts of the instance's summary item and records when the detection
+// ended and the error it ended with. A listing stopped at the page limit or before the Lambda deadline is not an error.
+func updateSummary(ctx context.Context, client RecordStoreAPI, tableName string, dbInstanceID string, change summaryChange, now time.Time, detectErr error, logger *log.Logger) error {
+	logger.Printf("Updating summary of DB instance %s: %+d files tracked, %+d pending\n", dbInstanceID, change.FilesTracked, change.PendingCount)
+
+	setExpressions := []string{"LastDetectedAt = :now"}
+	var removeExpressions []string
+	expressionAttributeValues := map[string]types.AttributeValue{
+		":now":          &types.AttributeValueMemberN{Value: strconv.FormatInt(now.UnixMilli(), 10)},
+		":filesTracked": &types.AttributeValueMemberN{Value: strconv.Itoa(change.FilesTracked)},
+		":pendingCount": &types.AttributeValueMemberN{Value: strconv.Itoa(change.PendingCount)},
+	}
+	if detectErr != nil && !errors.Is(detectErr, errListingTruncated) && !errors.Is(detectErr, errDeadlineReached) {
+		setExpressions = append(setExpressions, "LastError = :lastError")
+		expressionAttributeValues[":lastError"] = &types.AttributeValueMemberS{Value: detectErr.Error()}
+	} else {
+		removeExpressions = append(removeExpressions, "LastError")
+	}
+	if change.Status != "" {
+		setExpressions = append(setExpressions, "#status = :status")
+		expressionAttributeValues[":status"] = &types.AttributeValueMemberS{Value: change.Status}
+	} else {
+		removeExpressions = append(removeExpressions, "#status")
+	}
+
+	updateExpression := "SET " + strings.Join(setExpressions, ", ") + " ADD FilesTracked :filesTracked, PendingCount :pendingCount"
+	if len(removeExpressions) > 0 {
+		updateExpression += " REMOVE " + strings.Join(removeExpressions, ", ")
+	}
+
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"DBInstanceIdentifier": &types.AttributeValueMemberS{Value: dbInstanceID},
+			"LogFileName":          &types.AttributeValueMemberS{Value: summarySortKey},
+		},
+		UpdateExpression:          aws.String(updateExpression),
+		ExpressionAttributeNames:  map[string]string{"#status": "Status"}, // STATUS is a DynamoDB reserved word
+		ExpressionAttributeValues: expressionAttributeValues,
+	})
+
+	return err
+}
+
+// getDBLogFiles gets the log files for a DB instance, starting at marker when it is set.
+// When fileLastWritten (epoch milliseconds) is set, only the files written since then are returned.
+// After cfg.MaxPages pages the files listed so far are returned with the marker of the next page.
+func getDBLogFiles(ctx context.Context, client DescribeDBLogFilesAPI, cfg detectorConfig, dbInstanceID string, fileLastWritten int64, marker *string, logger *log.Logger) ([]rdstypes.DescribeDBLogFilesDetails, *string, error) {
+	logger.Printf("Getting log files for DB instance %s written since %d\n", dbInstanceID, fileLastWritten)
 
 	var logFiles []rdstypes.DescribeDBLogFilesDetails
-	var marker *string
+
+	input := &rds.DescribeDBLogFilesInput{
+		DBInstanceIdentifier: aws.String(dbInstanceID),
+	}
+	if fileLastWritten > 0 {
+		input.FileLastWritten = aws.Int64(fileLastWritten)
+	}
+	if cfg.MaxRecords > 0 {
+		input.MaxRecords = aws.Int32(cfg.MaxRecords)
+	}
 
 	// Use pagination to get all log files
-	for {
-		resp, err := client.DescribeDBLogFiles(ctx, &rds.DescribeDBLogFilesInput{
-			DBInstanceIdentifier: aws.String(dbInstanceID),
-			Marker:               marker,
-		})
+	for page := 1; ; page++ {
+		input.Marker = marker
+		resp, err := client.DescribeDBLogFiles(ctx, input)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		logFiles = append(logFiles, resp.DescribeDBLogFiles...)
@@ -145,33 +1222,33 @@ func getDBLogFiles(ctx context.Context, client *rds.Client, dbInstanceID string,
 		if resp.Marker == nil {
 			break
 		}
+		if marker != nil && *resp.Marker == *marker {
+			return nil, nil, fmt.Errorf("listing marker %q of DB instance %s did not advance", *marker, dbInstanceID)
+		}
 		marker = resp.Marker
+
+		if cfg.MaxPages > 0 && page >= cfg.MaxPages {
+			logger.Printf("Warning: stopped listing log files for DB instance %s after %d pages (%d log files)\n", dbInstanceID, page, len(logFiles))
+			return logFiles, marker, nil
+		}
 	}
 
 	logger.Printf("Found %d log files for DB instance %s\n", len(logFiles), dbInstanceID)
-	return logFiles, nil
-}
-
-// isAuditLog checks if a log file is an audit log
-func isAuditLog(logFileName string) bool {
-	// Check if the log file name contains "audit" or has a specific pattern
-	// This will depend on your Aurora MySQL audit log naming convention
-	return logFileName == "audit.log" ||
-		logFileName == "audit/server_audit.log" ||
-		logFileName == "error/mysql-audit.log" ||
-		(len(logFileName) >= 5 && logFileName[0:5] == "audit")
+	return logFiles, nil, nil
 }
 
 // getLogFileRecord gets a log file record from DynamoDB
-func getLogFileRecord(ctx context.Context, client *dynamodb.Client, tableName string, dbInstanceID string, logFileName string, logger *log.Logger) (*LogFileRecord, error) {
+func getLogFileRecord(ctx context.Context, client RecordStoreAPI, tableName string, dbInstanceID string, logFileName string, logger *log.Logger) (*LogFileRecord, error) {
 	logger.Printf("Checking for existing record for log file %s\n", logFileName)
 
+	// A strongly consistent read returns the Version of the last update, which updateLogFileRecord expects
 	resp, err := client.GetItem(ctx, &dynamodb.GetItemInput{
 		TableName: aws.String(tableName),
 		Key: map[string]types.AttributeValue{
 			"DBInstanceIdentifier": &types.AttributeValueMemberS{Value: dbInstanceID},
 			"LogFileName":          &types.AttributeValueMemberS{Value: logFileName},
 		},
+		ConsistentRead: aws.Bool(true),
 	})
 	if err != nil {
 		return nil, err
@@ -192,8 +1269,178 @@ func getLogFileRecord(ctx context.Context, client *dynamodb.Client, tableName st
 	return &record, nil
 }
 
-// createLogFileRecord creates a new log file record in DynamoDB
-func createLogFileRecord(ctx context.Context, client *dynamodb.Client, tableName string, record LogFileRecord, logger *log.Logger) error {
+// getWatermark gets the listing checkpoint of a DB instance from DynamoDB, or nil if it has none
+func getWatermark(ctx context.Context, client RecordStoreAPI, tableName string, dbInstanceID string, logger *log.Logger) (*watermark, error) {
+	resp, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"DBInstanceIdentifier": &types.AttributeValueMemberS{Value: dbInstanceID},
+			"LogFileName":          &types.AttributeValueMemberS{Value: watermarkSortKey},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Item) == 0 {
+		logger.Printf("No watermark for DB instance %s, listing all log files\n", dbInstanceID)
+		return nil, nil
+	}
+
+	var mark watermark
+	err = attributevalue.UnmarshalMap(resp.Item, &mark)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mark, nil
+}
+
+// updateWatermark stores the listing checkpoint of a DB instance.
+// The write is rejected with a ConditionalCheckFailedException if the stored watermark is newer.
+func updateWatermark(ctx context.Context, client RecordStoreAPI, tableName string, dbInstanceID string, mark watermark, logger *log.Logger) error {
+	logger.Printf("Updating watermark of DB instance %s to %d\n", dbInstanceID, mark.LastWritten)
+
+	values := map[string]types.AttributeValue{
+		":watermark":       &types.AttributeValueMemberN{Value: strconv.FormatInt(mark.LastWritten, 10)},
+		":lastFullListing": &types.AttributeValueMemberN{Value: strconv.FormatInt(mark.LastFullListing, 10)},
+	}
+	updateExpression := "SET Watermark = :watermark, LastFullListing = :lastFullListing REMOVE ListingMarker, ListingFileLastWritten, HeldBack"
+	if mark.HeldBack > 0 {
+		values[":heldBack"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(mark.HeldBack, 10)}
+		updateExpression = "SET Watermark = :watermark, LastFullListing = :lastFullListing, HeldBack = :heldBack REMOVE ListingMarker, ListingFileLastWritten"
+	}
+
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"DBInstanceIdentifier": &types.AttributeValueMemberS{Value: dbInstanceID},
+			"LogFileName":          &types.AttributeValueMemberS{Value: watermarkSortKey},
+		},
+		UpdateExpression:          aws.String(updateExpression),
+		ConditionExpression:       aws.String("attribute_not_exists(Watermark) OR Watermark <= :watermark"),
+		ExpressionAttributeValues: values,
+	})
+
+	return err
+}
+
+// claimDetection sets LastDetected on the watermark item of a DB instance unless it was set within the cooldown.
+// The conditional write lets only one of several concurrent invocations claim the instance.
+func claimDetection(ctx context.Context, client RecordStoreAPI, tableName string, dbInstanceID string, now time.Time, cooldown time.Duration, logger *log.Logger) (bool, error) {
+	logger.Printf("Claiming detection of DB instance %s\n", dbInstanceID)
+
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"DBInstanceIdentifier": &types.AttributeValueMemberS{Value: dbInstanceID},
+			"LogFileName":          &types.AttributeValueMemberS{Value: watermarkSortKey},
+		},
+		UpdateExpression:    aws.String("SET LastDetected = :now"),
+		ConditionExpression: aws.String("attribute_not_exists(LastDetected) OR LastDetected <= :cutoff"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now":    &types.AttributeValueMemberN{Value: strconv.FormatInt(now.UnixMilli(), 10)},
+			":cutoff": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(-cooldown).UnixMilli(), 10)},
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// releaseDetection removes the LastDetected set by claimDetection at claimedAt, so a retry isn't skipped
+func releaseDetection(ctx context.Context, client RecordStoreAPI, tableName string, dbInstanceID string, claimedAt time.Time, logger *log.Logger) error {
+	logger.Printf("Releasing detection of DB instance %s\n", dbInstanceID)
+
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"DBInstanceIdentifier": &types.AttributeValueMemberS{Value: dbInstanceID},
+			"LogFileName":          &types.AttributeValueMemberS{Value: watermarkSortKey},
+		},
+		UpdateExpression:    aws.String("REMOVE LastDetected"),
+		ConditionExpression: aws.String("LastDetected = :claimedAt"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":claimedAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(claimedAt.UnixMilli(), 10)},
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		// Another invocation claimed the instance since, or the item was deleted
+		return nil
+	}
+
+	return err
+}
+
+// saveListingMarker stores where a listing cut short by the page limit stopped, and the filter it used,
+// on the watermark item of a DB instance
+func saveListingMarker(ctx context.Context, client RecordStoreAPI, tableName string, dbInstanceID string, marker string, fileLastWritten int64, logger *log.Logger) error {
+	logger.Printf("Saving the listing marker of DB instance %s\n", dbInstanceID)
+
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"DBInstanceIdentifier": &types.AttributeValueMemberS{Value: dbInstanceID},
+			"LogFileName":          &types.AttributeValueMemberS{Value: watermarkSortKey},
+		},
+		UpdateExpression: aws.String("SET ListingMarker = :marker, ListingFileLastWritten = :fileLastWritten"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":marker":          &types.AttributeValueMemberS{Value: marker},
+			":fileLastWritten": &types.AttributeValueMemberN{Value: strconv.FormatInt(fileLastWritten, 10)},
+		},
+	})
+
+	return err
+}
+
+// queryLogFileRecords gets all records of a DB instance from DynamoDB
+func queryLogFileRecords(ctx context.Context, client RecordStoreAPI, tableName string, dbInstanceID string, logger *log.Logger) ([]LogFileRecord, error) {
+	logger.Printf("Querying records for DB instance %s\n", dbInstanceID)
+
+	var records []LogFileRecord
+	var exclusiveStartKey map[string]types.AttributeValue
+
+	// Use pagination to get all records
+	for {
+		resp, err := client.Query(ctx, &dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			KeyConditionExpression: aws.String("DBInstanceIdentifier = :dbInstanceID"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":dbInstanceID": &types.AttributeValueMemberS{Value: dbInstanceID},
+			},
+			ConsistentRead:    aws.Bool(true),
+			ExclusiveStartKey: exclusiveStartKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var page []LogFileRecord
+		err = attributevalue.UnmarshalListOfMaps(resp.Items, &page)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, page...)
+
+		// Check if there are more pages
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		exclusiveStartKey = resp.LastEvaluatedKey
+	}
+
+	return records, nil
+}
+
+// createLogFileRecord creates a new log file record in DynamoDB.
+// The write is rejected with a ConditionalCheckFailedException if the record already exists.
+func createLogFileRecord(ctx context.Context, client RecordCreateAPI, tableName string, record LogFileRecord, logger *log.Logger) error {
 	logger.Printf("Creating new record for log file %s\n", record.LogFileName)
 
 	item, err := attributevalue.MarshalMap(record)
@@ -202,33 +1449,84 @@ func createLogFileRecord(ctx context.Context, client *dynamodb.Client, tableName
 	}
 
 	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String(tableName),
-		Item:      item,
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(DBInstanceIdentifier)"),
 	})
 
 	return err
 }
 
-// updateLogFileRecord updates an existing log file record in DynamoDB
-func updateLogFileRecord(ctx context.Context, client *dynamodb.Client, tableName string, record LogFileRecord, logger *log.Logger) error {
+// updateLogFileRecord updates an existing log file record in DynamoDB and increments its Version.
+// The write is rejected with a ConditionalCheckFailedException if the stored Version isn't expectedVersion,
+// which is 0 for a record without one, or if the stored LastWritten is newer.
+// Attributes owned by the downloader, such as LastBackup, are left untouched.
+func updateLogFileRecord(ctx context.Context, client RecordStoreAPI, tableName string, record LogFileRecord, expectedVersion int64, logger *log.Logger) error {
 	logger.Printf("Updating record for log file %s\n", record.LogFileName)
 
 	// Create update expression
-	updateExpression := "SET #size = :size, #lastWritten = :lastWritten"
+	updateExpression := "SET #size = :size, #lastWritten = :lastWritten, #version = :version"
 	expressionAttributeNames := map[string]string{
 		"#size":        "Size",
 		"#lastWritten": "LastWritten",
+		"#version":     "Version",
 	}
 	expressionAttributeValues := map[string]types.AttributeValue{
-		":size":        &types.AttributeValueMemberN{Value: strconv.FormatInt(record.Size, 10)},
-		":lastWritten": &types.AttributeValueMemberN{Value: strconv.FormatInt(record.LastWritten, 10)},
+		":size":            &types.AttributeValueMemberN{Value: strconv.FormatInt(record.Size, 10)},
+		":lastWritten":     &types.AttributeValueMemberN{Value: strconv.FormatInt(record.LastWritten, 10)},
+		":version":         &types.AttributeValueMemberN{Value: strconv.FormatInt(expectedVersion+1, 10)},
+		":expectedVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(expectedVersion, 10)},
+	}
+
+	// Include ExpiresAt so the record expires relative to the new LastWritten
+	if record.ExpiresAt > 0 {
+		updateExpression += ", #expiresAt = :expiresAt"
+		expressionAttributeNames["#expiresAt"] = "ExpiresAt"
+		expressionAttributeValues[":expiresAt"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(record.ExpiresAt, 10)}
+	}
+
+	// Include Status when the log file needs another backup
+	if record.Status != "" {
+		updateExpression += ", #status = :status"
+		expressionAttributeNames["#status"] = "Status"
+		expressionAttributeValues[":status"] = &types.AttributeValueMemberS{Value: record.Status}
 	}
 
-	// Include LastBackup if it exists
-	if record.LastBackup > 0 {
-		updateExpression += ", #lastBackup = :lastBackup"
-		expressionAttributeNames["#lastBackup"] = "LastBackup"
-		expressionAttributeValues[":lastBackup"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(record.LastBackup, 10)}
+	// Include the size history, and flag a rotation
+	if len(record.SizeHistory) > 0 {
+		sizeHistory, err := attributevalue.Marshal(record.SizeHistory)
+		if err != nil {
+			return err
+		}
+		updateExpression += ", #sizeHistory = :sizeHistory"
+		expressionAttributeNames["#sizeHistory"] = "SizeHistory"
+		expressionAttributeValues[":sizeHistory"] = sizeHistory
+	}
+	if record.Rotated {
+		updateExpression += ", #rotated = :rotated"
+		expressionAttributeNames["#rotated"] = "Rotated"
+		expressionAttributeValues[":rotated"] = &types.AttributeValueMemberBOOL{Value: true}
+	}
+
+	// Include LogFileType so records created before classification pick it up
+	if record.LogFileType != "" {
+		updateExpression += ", #logFileType = :logFileType"
+		expressionAttributeNames["#logFileType"] = "LogFileType"
+		expressionAttributeValues[":logFileType"] = &types.AttributeValueMemberS{Value: string(record.LogFileType)}
+	}
+
+	// Include Region so the downloader reaches the instance with the RDS client of its region
+	if record.Region != "" {
+		updateExpression += ", #region = :region"
+		expressionAttributeNames["#region"] = "Region"
+		expressionAttributeValues[":region"] = &types.AttributeValueMemberS{Value: record.Region}
+	}
+
+	// Include ClusterIdentifier so records first detected for the instance pick it up
+	if record.ClusterIdentifier != "" {
+		updateExpression += ", #clusterIdentifier = :clusterIdentifier"
+		expressionAttributeNames["#clusterIdentifier"] = "ClusterIdentifier"
+		expressionAttributeValues[":clusterIdentifier"] = &types.AttributeValueMemberS{Value: record.ClusterIdentifier}
 	}
 
 	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
@@ -237,7 +1535,8 @@ func updateLogFileRecord(ctx context.Context, client *dynamodb.Client, tableName
 			"DBInstanceIdentifier": &types.AttributeValueMemberS{Value: record.DBInstanceIdentifier},
 			"LogFileName":          &types.AttributeValueMemberS{Value: record.LogFileName},
 		},
-		UpdateExpression:          aws.String(updateExpression),
+		UpdateExpression:          aws.String(updateExpression + " REMOVE Deleted, DeletedAt"),
+		ConditionExpression:       aws.String("(attribute_not_exists(#version) OR #version = :expectedVersion) AND #lastWritten <= :lastWritten"),
 		ExpressionAttributeNames:  expressionAttributeNames,
 		ExpressionAttributeValues: expressionAttributeValues,
 	})
@@ -245,6 +1544,72 @@ func updateLogFileRecord(ctx context.Context, client *dynamodb.Client, tableName
 	return err
 }
 
+// markLogFileDeleted flags a log file record as deleted.
+// The write is rejected with a ConditionalCheckFailedException if the record no longer exists.
+func markLogFileDeleted(ctx context.Context, client RecordStoreAPI, tableName string, record LogFileRecord, logger *log.Logger) error {
+	logger.Printf("Marking log file %s as deleted\n", record.LogFileName)
+
+	now := time.Now().Unix()
+
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"DBInstanceIdentifier": &types.AttributeValueMemberS{Value: record.DBInstanceIdentifier},
+			"LogFileName":          &types.AttributeValueMemberS{Value: record.LogFileName},
+		},
+		UpdateExpression:    aws.String("SET Deleted = :deleted, DeletedAt = :deletedAt"),
+		ConditionExpression: aws.String("attribute_exists(DBInstanceIdentifier)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":deleted":   &types.AttributeValueMemberBOOL{Value: true},
+			":deletedAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(now, 10)},
+		},
+	})
+
+	return err
+}
+
+// expiresAt returns the TTL for a log file last written at lastWritten (epoch milliseconds),
+// in the epoch seconds DynamoDB expects
+func expiresAt(lastWritten int64, retentionDays int) int64 {
+	return timeutil.FromEpochMillis(lastWritten).Unix() + int64(retentionDays)*24*60*60
+}
+
+// isDBInstanceNotFound reports whether an RDS call failed because the DB instance doesn't exist
+func isDBInstanceNotFound(err error) bool {
+	var notFound *rdstypes.DBInstanceNotFoundFault
+	return errors.As(err, &notFound)
+}
+
+// isAccessDenied reports whether an RDS call was denied by IAM
+func isAccessDenied(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.ErrorCode() == "AccessDenied" || apiErr.ErrorCode() == "AccessDeniedException"
+}
+
+// isConditionalCheckFailed reports whether a write was rejected by its condition expression
+func isConditionalCheckFailed(err error) bool {
+	var conditionalCheckFailed *types.ConditionalCheckFailedException
+	return errors.As(err, &conditionalCheckFailed)
+}
+
 func main() {
-	lambda.Start(Handler)
+	// Fail the cold start instead of every invocation when the configuration is incomplete or invalid
+	if err := validateConfig(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if _, err := loadDetectorConfig(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+
+	// Load AWS configuration once per cold start
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Error loading AWS config: %v\n", err)
+	}
+
+	// Serve both the SQS event source mapping and on-demand direct invocations
+	lambda.Start(NewInvokeHandler(NewHandlerDeps(cfg)))
 }
@@ -0,0 +1,1601 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	rdstypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
+	"github.com/aws/smithy-go"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/aurora"
+)
+
+// fakeLogFiles returns the same audit log for every instance and the configured error for failing instances.
+// The FileLastWritten filter of every call is recorded.
+type fakeLogFiles struct {
+	mu              sync.Mutex
+	fail            map[string]error
+	fileLastWritten []*int64
+}
+
+func (f *fakeLogFiles) DescribeDBLogFiles(ctx context.Context, params *rds.DescribeDBLogFilesInput, optFns ...func(*rds.Options)) (*rds.DescribeDBLogFilesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fileLastWritten = append(f.fileLastWritten, params.FileLastWritten)
+	if err := f.fail[aws.ToString(params.DBInstanceIdentifier)]; err != nil {
+		return nil, err
+	}
+	return &rds.DescribeDBLogFilesOutput{
+		DescribeDBLogFiles: []rdstypes.DescribeDBLogFilesDetails{
+			{LogFileName: aws.String("audit/server_audit.log"), Size: aws.Int64(100), LastWritten: aws.Int64(1000)},
+			{LogFileName: aws.String("error/mysql-error.log"), Size: aws.Int64(10), LastWritten: aws.Int64(1000)},
+		},
+	}, nil
+}
+
+// fakeRecordStore returns the configured watermarks and records from GetItem and Query,
+// fails every write for the configured instances and records the statuses written.
+// It is safe for concurrent use.
+type fakeRecordStore struct {
+	mu sync.Mutex
+	fakeRecordWriter
+	failWrites    map[string]bool
+	records       []LogFileRecord
+	markedDeleted []string
+	watermarks    map[string]watermark
+	// Log files whose download was requested
+	downloadRequested []string
+	// Instances whose watermark was deleted
+	deletedWatermarks []string
+	// Status written per log file
+	statuses map[string]string
+	// Log files flagged as rotated
+	rotated []string
+	// LastDetected per instance, in epoch milliseconds
+	lastDetected map[string]int64
+	// Summary item per instance
+	summaries map[string]fakeSummary
+}
+
+// fakeSummary is the summary item of an instance, built from the updates of the detector
+type fakeSummary struct {
+	FilesTracked   int
+	PendingCount   int
+	LastDetectedAt int64
+	LastError      string
+	Status         string
+}
+
+// updateSummary applies a summary item update to the instance's summary
+func (f *fakeRecordStore) updateSummary(dbInstanceID string, params *dynamodb.UpdateItemInput) {
+	if f.summaries == nil {
+		f.summaries = make(map[string]fakeSummary)
+	}
+	summary := f.summaries[dbInstanceID]
+	filesTracked, _ := strconv.Atoi(params.ExpressionAttributeValues[":filesTracked"].(*types.AttributeValueMemberN).Value)
+	pendingCount, _ := strconv.Atoi(params.ExpressionAttributeValues[":pendingCount"].(*types.AttributeValueMemberN).Value)
+	summary.FilesTracked += filesTracked
+	summary.PendingCount += pendingCount
+	summary.LastDetectedAt, _ = strconv.ParseInt(params.ExpressionAttributeValues[":now"].(*types.AttributeValueMemberN).Value, 10, 64)
+	summary.LastError = ""
+	if lastError, ok := params.ExpressionAttributeValues[":lastError"]; ok {
+		summary.LastError = lastError.(*types.AttributeValueMemberS).Value
+	}
+	summary.Status = ""
+	if status, ok := params.ExpressionAttributeValues[":status"]; ok {
+		summary.Status = status.(*types.AttributeValueMemberS).Value
+	}
+	f.summaries[dbInstanceID] = summary
+}
+
+func (f *fakeRecordStore) recordStatus(logFileName string, status types.AttributeValue) {
+	if status == nil {
+		return
+	}
+	if f.statuses == nil {
+		f.statuses = make(map[string]string)
+	}
+	f.statuses[logFileName] = status.(*types.AttributeValueMemberS).Value
+}
+
+func (f *fakeRecordStore) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dbInstanceID := params.Key["DBInstanceIdentifier"].(*types.AttributeValueMemberS).Value
+	logFileName := params.Key["LogFileName"].(*types.AttributeValueMemberS).Value
+	if logFileName != watermarkSortKey {
+		for _, record := range f.records {
+			if record.DBInstanceIdentifier == dbInstanceID && record.LogFileName == logFileName {
+				item, err := attributevalue.MarshalMap(record)
+				if err != nil {
+					return nil, err
+				}
+				return &dynamodb.GetItemOutput{Item: item}, nil
+			}
+		}
+		return &dynamodb.GetItemOutput{}, nil
+	}
+	mark, ok := f.watermarks[dbInstanceID]
+	if !ok {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+	item, err := attributevalue.MarshalMap(mark)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.GetItemOutput{Item: item}, nil
+}
+
+func (f *fakeRecordStore) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	updateExpression := aws.ToString(params.UpdateExpression)
+	if params.Key["LogFileName"].(*types.AttributeValueMemberS).Value == summarySortKey {
+		f.updateSummary(params.Key["DBInstanceIdentifier"].(*types.AttributeValueMemberS).Value, params)
+		return &dynamodb.UpdateItemOutput{}, nil
+	}
+	f.recordStatus(params.Key["LogFileName"].(*types.AttributeValueMemberS).Value, params.ExpressionAttributeValues[":status"])
+	if updateExpression == "SET LastDetected = :now" {
+		dbInstanceID := params.Key["DBInstanceIdentifier"].(*types.AttributeValueMemberS).Value
+		cutoff, _ := strconv.ParseInt(params.ExpressionAttributeValues[":cutoff"].(*types.AttributeValueMemberN).Value, 10, 64)
+		if lastDetected, ok := f.lastDetected[dbInstanceID]; ok && lastDetected > cutoff {
+			return nil, &types.ConditionalCheckFailedException{}
+		}
+		if f.lastDetected == nil {
+			f.lastDetected = make(map[string]int64)
+		}
+		f.lastDetected[dbInstanceID], _ = strconv.ParseInt(params.ExpressionAttributeValues[":now"].(*types.AttributeValueMemberN).Value, 10, 64)
+	}
+	if updateExpression == "REMOVE LastDetected" {
+		delete(f.lastDetected, params.Key["DBInstanceIdentifier"].(*types.AttributeValueMemberS).Value)
+	}
+	if _, ok := params.ExpressionAttributeValues[":rotated"]; ok {
+		f.rotated = append(f.rotated, params.Key["LogFileName"].(*types.AttributeValueMemberS).Value)
+	}
+	if strings.HasPrefix(updateExpression, "SET Deleted") {
+		f.markedDeleted = append(f.markedDeleted, params.Key["LogFileName"].(*types.AttributeValueMemberS).Value)
+	}
+	if strings.HasPrefix(updateExpression, "SET DownloadRequestedAt") {
+		f.downloadRequested = append(f.downloadRequested, params.Key["LogFileName"].(*types.AttributeValueMemberS).Value)
+	}
+	if strings.HasPrefix(updateExpression, "SET ListingMarker") {
+		dbInstanceID := params.Key["DBInstanceIdentifier"].(*types.AttributeValueMemberS).Value
+		mark := f.watermarks[dbInstanceID]
+		mark.ListingMarker = params.ExpressionAttributeValues[":marker"].(*types.AttributeValueMemberS).Value
+		mark.ListingFileLastWritten, _ = strconv.ParseInt(params.ExpressionAttributeValues[":fileLastWritten"].(*types.AttributeValueMemberN).Value, 10, 64)
+		if f.watermarks == nil {
+			f.watermarks = make(map[string]watermark)
+		}
+		f.watermarks[dbInstanceID] = mark
+	}
+	if strings.HasPrefix(updateExpression, "SET Watermark") {
+		var mark watermark
+		mark.LastWritten, _ = strconv.ParseInt(params.ExpressionAttributeValues[":watermark"].(*types.AttributeValueMemberN).Value, 10, 64)
+		mark.LastFullListing, _ = strconv.ParseInt(params.ExpressionAttributeValues[":lastFullListing"].(*types.AttributeValueMemberN).Value, 10, 64)
+		if heldBack, ok := params.ExpressionAttributeValues[":heldBack"]; ok {
+			mark.HeldBack, _ = strconv.ParseInt(heldBack.(*types.AttributeValueMemberN).Value, 10, 64)
+		}
+		// The watermark never moves back
+		dbInstanceID := params.Key["DBInstanceIdentifier"].(*types.AttributeValueMemberS).Value
+		if existing, ok := f.watermarks[dbInstanceID]; ok && existing.LastWritten > mark.LastWritten {
+			return nil, &types.ConditionalCheckFailedException{}
+		}
+		if f.watermarks == nil {
+			f.watermarks = make(map[string]watermark)
+		}
+		f.watermarks[dbInstanceID] = mark
+	}
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (f *fakeRecordStore) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if params.Key["LogFileName"].(*types.AttributeValueMemberS).Value == watermarkSortKey {
+		f.deletedWatermarks = append(f.deletedWatermarks, params.Key["DBInstanceIdentifier"].(*types.AttributeValueMemberS).Value)
+	}
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func (f *fakeRecordStore) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Status index queries match on Status, table queries on DBInstanceIdentifier
+	matches := func(record LogFileRecord) bool {
+		if params.IndexName != nil {
+			return record.Status == params.ExpressionAttributeValues[":status"].(*types.AttributeValueMemberS).Value
+		}
+		return record.DBInstanceIdentifier == params.ExpressionAttributeValues[":dbInstanceID"].(*types.AttributeValueMemberS).Value
+	}
+
+	resp := &dynamodb.QueryOutput{}
+	for _, record := range f.records {
+		if !matches(record) {
+			continue
+		}
+		item, err := attributevalue.MarshalMap(record)
+		if err != nil {
+			return nil, err
+		}
+		resp.Items = append(resp.Items, item)
+	}
+	return resp, nil
+}
+
+func (f *fakeRecordStore) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, transactItem := range params.TransactItems {
+		if f.failWrites[transactItem.Put.Item["DBInstanceIdentifier"].(*types.AttributeValueMemberS).Value] {
+			return nil, errors.New("write failed")
+		}
+	}
+	for _, transactItem := range params.TransactItems {
+		f.recordStatus(transactItem.Put.Item["LogFileName"].(*types.AttributeValueMemberS).Value, transactItem.Put.Item["Status"])
+	}
+	return f.fakeRecordWriter.TransactWriteItems(ctx, params, optFns...)
+}
+
+func (f *fakeRecordStore) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fakeRecordWriter.PutItem(ctx, params, optFns...)
+}
+
+func sqsEvent(bodies ...string) events.SQSEvent {
+	var event events.SQSEvent
+	for i, body := range bodies {
+		event.Records = append(event.Records, events.SQSMessage{
+			MessageId: "msg-" + strconv.Itoa(i+1),
+			Body:      body,
+		})
+	}
+	return event
+}
+
+func TestHandleReportsBatchItemFailures(t *testing.T) {
+	tests := []struct {
+		name        string
+		event       events.SQSEvent
+		rds         *fakeLogFiles
+		store       *fakeRecordStore
+		wantFailed  []string
+		wantWritten []string
+	}{
+		{
+			name:        "all messages succeed",
+			event:       sqsEvent("db-1", "db-2", "db-3"),
+			rds:         &fakeLogFiles{},
+			store:       &fakeRecordStore{},
+			wantWritten: []string{"audit/server_audit.log", "audit/server_audit.log", "audit/server_audit.log"},
+		},
+		{
+			name:        "instance lookup fails for one message",
+			event:       sqsEvent("db-1", "db-2", "db-3"),
+			rds:         &fakeLogFiles{fail: map[string]error{"db-2": errors.New("throttled")}},
+			store:       &fakeRecordStore{},
+			wantFailed:  []string{"msg-2"},
+			wantWritten: []string{"audit/server_audit.log", "audit/server_audit.log"},
+		},
+		{
+			name:        "record write fails for one message",
+			event:       sqsEvent("db-1", "db-2", "db-3"),
+			rds:         &fakeLogFiles{},
+			store:       &fakeRecordStore{failWrites: map[string]bool{"db-3": true}},
+			wantFailed:  []string{"msg-3"},
+			wantWritten: []string{"audit/server_audit.log", "audit/server_audit.log"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DYNAMODB_TABLE_NAME", "table")
+
+			handler := NewHandler(HandlerDeps{RDS: tt.rds, DynamoDB: tt.store})
+			response, err := handler(context.Background(), tt.event)
+			if err != nil {
+				t.Fatalf("handler error = %v", err)
+			}
+
+			var failed []string
+			for _, failure := range response.BatchItemFailures {
+				failed = append(failed, failure.ItemIdentifier)
+			}
+			if !reflect.DeepEqual(failed, tt.wantFailed) {
+				t.Errorf("BatchItemFailures = %v, want %v", failed, tt.wantFailed)
+			}
+			if !reflect.DeepEqual(tt.store.written, tt.wantWritten) {
+				t.Errorf("written = %v, want %v", tt.store.written, tt.wantWritten)
+			}
+		})
+	}
+}
+
+// slowLogFiles tracks the most DescribeDBLogFiles calls in flight at the same time
+type slowLogFiles struct {
+	fakeLogFiles
+	inFlight    atomic.Int32
+	maxInFlight atomic.Int32
+}
+
+func (f *slowLogFiles) DescribeDBLogFiles(ctx context.Context, params *rds.DescribeDBLogFilesInput, optFns ...func(*rds.Options)) (*rds.DescribeDBLogFilesOutput, error) {
+	inFlight := f.inFlight.Add(1)
+	defer f.inFlight.Add(-1)
+	for {
+		maxInFlight := f.maxInFlight.Load()
+		if inFlight <= maxInFlight || f.maxInFlight.CompareAndSwap(maxInFlight, inFlight) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return f.fakeLogFiles.DescribeDBLogFiles(ctx, params, optFns...)
+}
+
+func TestHandleBoundsConcurrency(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("DETECTOR_CONCURRENCY", "2")
+
+	rdsClient := &slowLogFiles{fakeLogFiles: fakeLogFiles{fail: map[string]error{"db-4": errors.New("throttled")}}}
+	store := &fakeRecordStore{}
+
+	response, err := NewHandler(HandlerDeps{RDS: rdsClient, DynamoDB: store})(context.Background(), sqsEvent("db-1", "db-2", "db-3", "db-4", "db-5", "db-6"))
+	if err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+	if got := rdsClient.maxInFlight.Load(); got != 2 {
+		t.Errorf("max concurrent instances = %d, want 2", got)
+	}
+	if want := []events.SQSBatchItemFailure{{ItemIdentifier: "msg-4"}}; !reflect.DeepEqual(response.BatchItemFailures, want) {
+		t.Errorf("BatchItemFailures = %v, want %v", response.BatchItemFailures, want)
+	}
+	if got := len(store.written); got != 5 {
+		t.Errorf("wrote %d records, want 5", got)
+	}
+}
+
+// fifoEvent returns an SQS event from a FIFO queue, with the message group of every body
+func fifoEvent(groups map[string]string, bodies ...string) events.SQSEvent {
+	event := sqsEvent(bodies...)
+	for i := range event.Records {
+		event.Records[i].Attributes = map[string]string{"MessageGroupId": groups[event.Records[i].Body]}
+	}
+	return event
+}
+
+func TestMessageGroups(t *testing.T) {
+	tests := []struct {
+		name  string
+		event events.SQSEvent
+		want  [][]int
+	}{
+		{name: "standard queue", event: sqsEvent("db-1", "db-1", "db-2"), want: [][]int{{0}, {1}, {2}}},
+		{
+			name:  "FIFO queue",
+			event: fifoEvent(map[string]string{"db-1": "db-1", "db-2": "db-2", "db-3": "db-1"}, "db-1", "db-2", "db-3", "db-1"),
+			want:  [][]int{{0, 2, 3}, {1}},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := messageGroups(tt.event.Records); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: messageGroups() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHandleProcessesMessageGroupsInOrder(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("DETECTOR_CONCURRENCY", "4")
+
+	// db-1 to db-3 share a message group; db-2 fails, so db-3 is returned to the queue without being processed
+	groups := map[string]string{"db-1": "a", "db-2": "a", "db-3": "a", "db-4": "b"}
+	rdsClient := &slowLogFiles{fakeLogFiles: fakeLogFiles{fail: map[string]error{"db-2": errors.New("throttled")}}}
+	store := &fakeRecordStore{}
+
+	response, err := NewHandler(HandlerDeps{RDS: rdsClient, DynamoDB: store})(context.Background(), fifoEvent(groups, "db-1", "db-2", "db-3", "db-4"))
+	if err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+	if got := rdsClient.maxInFlight.Load(); got != 2 {
+		t.Errorf("max concurrent instances = %d, want one per message group", got)
+	}
+	want := []events.SQSBatchItemFailure{{ItemIdentifier: "msg-2"}, {ItemIdentifier: "msg-3"}}
+	if !reflect.DeepEqual(response.BatchItemFailures, want) {
+		t.Errorf("BatchItemFailures = %v, want %v", response.BatchItemFailures, want)
+	}
+	if got := len(rdsClient.fileLastWritten); got != 3 {
+		t.Errorf("listed %d instances, want 3", got)
+	}
+}
+
+func TestHandleFailsWithoutRequiredConfig(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "")
+
+	rdsClient := &fakeLogFiles{}
+	_, err := NewHandler(HandlerDeps{RDS: rdsClient, DynamoDB: &fakeRecordStore{}})(context.Background(), sqsEvent("db-1"))
+	if err == nil || !strings.Contains(err.Error(), "DYNAMODB_TABLE_NAME") {
+		t.Errorf("handler error = %v, want one naming DYNAMODB_TABLE_NAME", err)
+	}
+	if len(rdsClient.fileLastWritten) > 0 {
+		t.Errorf("DescribeDBLogFiles called %d times, want none", len(rdsClient.fileLastWritten))
+	}
+}
+
+func TestHandleFailsWithInvalidConfig(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("MIN_FILE_SIZE_BYTES", "1KB")
+
+	// An invocation error returns every message to the queue instead of deleting the batch
+	rdsClient := &fakeLogFiles{}
+	deps := HandlerDeps{RDS: rdsClient, DynamoDB: &fakeRecordStore{}}
+	_, err := NewHandler(deps)(context.Background(), sqsEvent("db-1"))
+	if err == nil || !strings.Contains(err.Error(), "MIN_FILE_SIZE_BYTES") {
+		t.Errorf("handler error = %v, want one naming MIN_FILE_SIZE_BYTES", err)
+	}
+	if len(rdsClient.fileLastWritten) > 0 {
+		t.Errorf("DescribeDBLogFiles called %d times, want none", len(rdsClient.fileLastWritten))
+	}
+
+	response, err := NewOnDemandHandler(deps)(context.Background(), OnDemandRequest{DBInstanceIdentifier: "db-1"})
+	if err == nil || response.Error == "" {
+		t.Errorf("on-demand handler = %+v, %v, want an error", response, err)
+	}
+	if _, err := NewBacklogHandler(deps)(context.Background(), BacklogRequest{}); err == nil {
+		t.Error("backlog handler error = nil, want one")
+	}
+}
+
+func TestHandleSkipsDuplicateDeliveries(t *testing.T) {
+	forceRescan := func(event events.SQSEvent, i int) events.SQSEvent {
+		event.Records[i].MessageAttributes = map[string]events.SQSMessageAttribute{
+			"ForceRescan": {DataType: "String", StringValue: aws.String("true")},
+		}
+		return event
+	}
+
+	tests := []struct {
+		name             string
+		cooldown         string
+		event            events.SQSEvent
+		rds              *fakeLogFiles
+		lastDetected     map[string]int64
+		wantListings     int
+		wantFailed       int
+		wantLastDetected bool
+	}{
+		{
+			name:             "duplicate in the same batch",
+			event:            sqsEvent("db-1", "db-1"),
+			rds:              &fakeLogFiles{},
+			wantListings:     1,
+			wantLastDetected: true,
+		},
+		{
+			name:             "processed within the cooldown",
+			event:            sqsEvent("db-1"),
+			rds:              &fakeLogFiles{},
+			lastDetected:     map[string]int64{"db-1": time.Now().Add(-30 * time.Second).UnixMilli()},
+			wantLastDetected: true,
+		},
+		{
+			name:             "processed before the cooldown",
+			event:            sqsEvent("db-1"),
+			rds:              &fakeLogFiles{},
+			lastDetected:     map[string]int64{"db-1": time.Now().Add(-2 * time.Minute).UnixMilli()},
+			wantListings:     1,
+			wantLastDetected: true,
+		},
+		{
+			name:             "ForceRescan bypasses the cooldown",
+			event:            forceRescan(sqsEvent("db-1", "db-1"), 1),
+			rds:              &fakeLogFiles{},
+			wantListings:     2,
+			wantLastDetected: true,
+		},
+		{
+			name:         "cooldown disabled",
+			cooldown:     "0",
+			event:        sqsEvent("db-1", "db-1"),
+			rds:          &fakeLogFiles{},
+			wantListings: 2,
+		},
+		{
+			name:         "failure releases the instance for the retry",
+			event:        sqsEvent("db-1"),
+			rds:          &fakeLogFiles{fail: map[string]error{"db-1": errors.New("throttled")}},
+			wantListings: 1,
+			wantFailed:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DYNAMODB_TABLE_NAME", "table")
+			t.Setenv("DETECTION_COOLDOWN_SECONDS", tt.cooldown)
+			// Process the messages one after the other so the duplicate sees the claim
+			t.Setenv("DETECTOR_CONCURRENCY", "1")
+
+			store := &fakeRecordStore{lastDetected: tt.lastDetected}
+			response, err := NewHandler(HandlerDeps{RDS: tt.rds, DynamoDB: store})(context.Background(), tt.event)
+			if err != nil {
+				t.Fatalf("handler error = %v", err)
+			}
+			if got := len(tt.rds.fileLastWritten); got != tt.wantListings {
+				t.Errorf("listed log files %d times, want %d", got, tt.wantListings)
+			}
+			if got := len(response.BatchItemFailures); got != tt.wantFailed {
+				t.Errorf("BatchItemFailures = %v, want %d", response.BatchItemFailures, tt.wantFailed)
+			}
+			if _, got := store.lastDetected["db-1"]; got != tt.wantLastDetected {
+				t.Errorf("LastDetected set = %v, want %v", got, tt.wantLastDetected)
+			}
+		})
+	}
+}
+
+func TestHandleRoutesMessagesToAllowedTables(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("ALLOWED_TABLES", "staging-table, other-table")
+	// Process the messages one after the other so the writes are in message order
+	t.Setenv("DETECTOR_CONCURRENCY", "1")
+
+	event := sqsEvent("db-1", "db-2", "db-3")
+	event.Records[0].MessageAttributes = map[string]events.SQSMessageAttribute{
+		"TableName": {DataType: "String", StringValue: aws.String("staging-table")},
+	}
+	event.Records[1].MessageAttributes = map[string]events.SQSMessageAttribute{
+		"TableName": {DataType: "String", StringValue: aws.String("unknown-table")},
+	}
+
+	store := &fakeRecordStore{}
+	response, err := NewHandler(HandlerDeps{RDS: &fakeLogFiles{}, DynamoDB: store})(context.Background(), event)
+	if err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+	if len(response.BatchItemFailures) != 1 || response.BatchItemFailures[0].ItemIdentifier != "msg-2" {
+		t.Errorf("BatchItemFailures = %v, want msg-2", response.BatchItemFailures)
+	}
+	if want := []string{"staging-table", "table"}; !reflect.DeepEqual(store.writtenTables, want) {
+		t.Errorf("written tables = %v, want %v", store.writtenTables, want)
+	}
+}
+
+func TestHandleUsesRegionalRDSClients(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("REGIONS", "us-east-1,eu-west-1")
+	// Process the messages one after the other so the writes are in message order
+	t.Setenv("DETECTOR_CONCURRENCY", "1")
+
+	// A plain body and a body naming the Lambda's region use the local client
+	event := sqsEvent(
+		"db-1",
+		`{"instanceId":"db-2","region":"eu-west-1"}`,
+		`{"instanceId":"db-3","region":"us-east-1"}`,
+		`{"instanceId":"db-4","region":"ap-south-1"}`,
+	)
+
+	local, regional := &fakeLogFiles{}, &fakeLogFiles{}
+	store := &fakeRecordStore{}
+	deps := HandlerDeps{
+		RDS:         local,
+		DynamoDB:    store,
+		Region:      "us-east-1",
+		RegionalRDS: map[string]DescribeDBLogFilesAPI{"eu-west-1": regional},
+	}
+	response, err := NewHandler(deps)(context.Background(), event)
+	if err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+
+	// The region without a client is retried rather than dropped
+	if len(response.BatchItemFailures) != 1 || response.BatchItemFailures[0].ItemIdentifier != "msg-4" {
+		t.Errorf("BatchItemFailures = %v, want msg-4", response.BatchItemFailures)
+	}
+	if len(local.fileLastWritten) != 2 || len(regional.fileLastWritten) != 1 {
+		t.Errorf("DescribeDBLogFiles calls = %d local, %d regional, want 2 and 1", len(local.fileLastWritten), len(regional.fileLastWritten))
+	}
+	if want := []string{"us-east-1", "eu-west-1", "us-east-1"}; !reflect.DeepEqual(store.writtenRegions, want) {
+		t.Errorf("written regions = %v, want %v", store.writtenRegions, want)
+	}
+}
+
+func TestLoadDetectorConfigRejectsInvalidRegions(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("REGIONS", "us-east-1,Europe")
+
+	if _, err := loadDetectorConfig(); err == nil {
+		t.Error("loadDetectorConfig() error = nil, want one for an invalid region")
+	}
+}
+
+// staticLogFiles returns the same log file details for every instance
+type staticLogFiles []rdstypes.DescribeDBLogFilesDetails
+
+func (f staticLogFiles) DescribeDBLogFiles(ctx context.Context, params *rds.DescribeDBLogFilesInput, optFns ...func(*rds.Options)) (*rds.DescribeDBLogFilesOutput, error) {
+	return &rds.DescribeDBLogFilesOutput{DescribeDBLogFiles: f}, nil
+}
+
+func TestProcessDBInstanceSkipsLogFilesWithoutName(t *testing.T) {
+	rdsClient := staticLogFiles{
+		{LogFileName: nil, Size: aws.Int64(100), LastWritten: aws.Int64(1000)},
+		{LogFileName: aws.String("audit/server_audit.log")},
+	}
+	store := &fakeRecordStore{}
+	cfg := detectorConfig{TableName: "table", RetentionDays: defaultRetentionDays}
+
+	var metrics detectorMetrics
+	if err := processDBInstance(context.Background(), rdsClient, store, cfg, "db-1", &metrics, discardLogger); err != nil {
+		t.Fatalf("processDBInstance() error = %v", err)
+	}
+	if want := []string{"audit/server_audit.log"}; !reflect.DeepEqual(store.written, want) {
+		t.Errorf("written = %v, want %v", store.written, want)
+	}
+}
+
+func TestProcessDBInstanceRecordsEnabledLogTypes(t *testing.T) {
+	rdsClient := staticLogFiles{
+		{LogFileName: aws.String("audit/server_audit.log"), Size: aws.Int64(100), LastWritten: aws.Int64(1000)},
+		{LogFileName: aws.String("error/mysql-error-running.log"), Size: aws.Int64(100), LastWritten: aws.Int64(1000)},
+		{LogFileName: aws.String("slowquery/mysql-slowquery.log"), Size: aws.Int64(100), LastWritten: aws.Int64(1000)},
+	}
+
+	tests := []struct {
+		name     string
+		logTypes map[LogFileType]bool
+		want     []string
+	}{
+		{name: "default", want: []string{"audit/server_audit.log"}},
+		{name: "audit and error", logTypes: map[LogFileType]bool{LogFileTypeAudit: true, LogFileTypeError: true}, want: []string{"audit/server_audit.log", "error/mysql-error-running.log"}},
+		{name: "slow query only", logTypes: map[LogFileType]bool{LogFileTypeSlowQuery: true}, want: []string{"slowquery/mysql-slowquery.log"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeRecordStore{}
+			cfg := detectorConfig{TableName: "table", RetentionDays: defaultRetentionDays, LogTypes: tt.logTypes}
+
+			var metrics detectorMetrics
+			if err := processDBInstance(context.Background(), rdsClient, store, cfg, "db-1", &metrics, discardLogger); err != nil {
+				t.Fatalf("processDBInstance() error = %v", err)
+			}
+			if !reflect.DeepEqual(store.written, tt.want) {
+				t.Errorf("written = %v, want %v", store.written, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpiresAt(t *testing.T) {
+	tests := []struct {
+		name          string
+		lastWritten   int64
+		retentionDays int
+		want          int64
+	}{
+		{name: "default retention", lastWritten: 1700000000123, retentionDays: 14, want: 1700000000 + 14*86400},
+		{name: "one day", lastWritten: 1000, retentionDays: 1, want: 1 + 86400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := expiresAt(tt.lastWritten, tt.retentionDays); got != tt.want {
+				t.Errorf("expiresAt() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleMarksDeletedLogFiles(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+
+	store := &fakeRecordStore{records: []LogFileRecord{
+		{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log"},
+		{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log.1"},
+		{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log.2", Deleted: true},
+		{DBInstanceIdentifier: "db-1", LogFileName: "#CHECKPOINT"},
+		{DBInstanceIdentifier: "db-2", LogFileName: "audit/server_audit.log.1"},
+	}}
+
+	handler := NewHandler(HandlerDeps{RDS: &fakeLogFiles{}, DynamoDB: store})
+	response, err := handler(context.Background(), sqsEvent("db-1"))
+	if err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+	if len(response.BatchItemFailures) > 0 {
+		t.Errorf("BatchItemFailures = %v, want none", response.BatchItemFailures)
+	}
+	if want := []string{"audit/server_audit.log.1"}; !reflect.DeepEqual(store.markedDeleted, want) {
+		t.Errorf("marked deleted = %v, want %v", store.markedDeleted, want)
+	}
+}
+
+func TestProcessDBInstanceWatermark(t *testing.T) {
+	now := time.Now().Unix()
+	records := []LogFileRecord{{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log.1"}}
+
+	tests := []struct {
+		name                string
+		fullRescan          bool
+		watermark           *watermark
+		wantFileLastWritten *int64
+		wantMarkedDeleted   bool
+		wantWatermark       int64
+		wantFullListing     bool
+	}{
+		{
+			name:              "no watermark lists every file",
+			wantMarkedDeleted: true,
+			wantWatermark:     1000,
+			wantFullListing:   true,
+		},
+		{
+			name:                "recent full listing filters by the watermark",
+			watermark:           &watermark{LastWritten: 500, LastFullListing: now},
+			wantFileLastWritten: aws.Int64(500),
+			wantWatermark:       1000,
+		},
+		{
+			name:              "full listing is due",
+			watermark:         &watermark{LastWritten: 500, LastFullListing: now - int64(fullListingInterval.Seconds())},
+			wantMarkedDeleted: true,
+			wantWatermark:     1000,
+			wantFullListing:   true,
+		},
+		{
+			name:              "full rescan ignores the watermark",
+			fullRescan:        true,
+			watermark:         &watermark{LastWritten: 500, LastFullListing: now},
+			wantMarkedDeleted: true,
+			wantWatermark:     1000,
+			wantFullListing:   true,
+		},
+		{
+			name:                "watermark never moves backwards",
+			watermark:           &watermark{LastWritten: 5000, LastFullListing: now},
+			wantFileLastWritten: aws.Int64(5000),
+			wantWatermark:       5000,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rdsClient := &fakeLogFiles{}
+			store := &fakeRecordStore{records: records}
+			if tt.watermark != nil {
+				store.watermarks = map[string]watermark{"db-1": *tt.watermark}
+			}
+			cfg := detectorConfig{TableName: "table", RetentionDays: defaultRetentionDays, FullRescan: tt.fullRescan}
+
+			var metrics detectorMetrics
+			if err := processDBInstance(context.Background(), rdsClient, store, cfg, "db-1", &metrics, discardLogger); err != nil {
+				t.Fatalf("processDBInstance() error = %v", err)
+			}
+
+			if len(rdsClient.fileLastWritten) != 1 || !reflect.DeepEqual(rdsClient.fileLastWritten[0], tt.wantFileLastWritten) {
+				t.Errorf("FileLastWritten = %v, want %v", rdsClient.fileLastWritten, tt.wantFileLastWritten)
+			}
+			if got := len(store.markedDeleted) > 0; got != tt.wantMarkedDeleted {
+				t.Errorf("marked deleted = %v, want %v", store.markedDeleted, tt.wantMarkedDeleted)
+			}
+
+			mark := store.watermarks["db-1"]
+			if mark.LastWritten != tt.wantWatermark {
+				t.Errorf("watermark = %d, want %d", mark.LastWritten, tt.wantWatermark)
+			}
+			if tt.wantFullListing && mark.LastFullListing < now {
+				t.Errorf("LastFullListing = %d, want at least %d", mark.LastFullListing, now)
+			}
+			if !tt.wantFullListing && mark.LastFullListing != tt.watermark.LastFullListing {
+				t.Errorf("LastFullListing = %d, want unchanged %d", mark.LastFullListing, tt.watermark.LastFullListing)
+			}
+		})
+	}
+}
+
+func TestProcessDBInstanceKeepsWatermarkOnFailure(t *testing.T) {
+	store := &fakeRecordStore{failWrites: map[string]bool{"db-1": true}}
+	cfg := detectorConfig{TableName: "table", RetentionDays: defaultRetentionDays}
+
+	var metrics detectorMetrics
+	if err := processDBInstance(context.Background(), &fakeLogFiles{}, store, cfg, "db-1", &metrics, discardLogger); err == nil {
+		t.Fatal("processDBInstance() error = nil, want an error")
+	}
+	if _, ok := store.watermarks["db-1"]; ok {
+		t.Errorf("watermark = %v, want none", store.watermarks["db-1"])
+	}
+}
+
+func TestHandleTombstonesDeletedInstances(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+
+	rdsClient := &fakeLogFiles{fail: map[string]error{"db-2": &rdstypes.DBInstanceNotFoundFault{Message: aws.String("DBInstance db-2 not found.")}}}
+	store := &fakeRecordStore{records: []LogFileRecord{
+		{DBInstanceIdentifier: "db-2", LogFileName: "audit/server_audit.log"},
+		{DBInstanceIdentifier: "db-2", LogFileName: "audit/server_audit.log.1"},
+		{DBInstanceIdentifier: "db-2", LogFileName: "#WATERMARK"},
+	}}
+
+	response, err := NewHandler(HandlerDeps{RDS: rdsClient, DynamoDB: store})(context.Background(), sqsEvent("db-1", "db-2"))
+	if err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+	if len(response.BatchItemFailures) > 0 {
+		t.Errorf("BatchItemFailures = %v, want none", response.BatchItemFailures)
+	}
+	if want := []string{"audit/server_audit.log", "audit/server_audit.log.1"}; !reflect.DeepEqual(store.markedDeleted, want) {
+		t.Errorf("marked deleted = %v, want %v", store.markedDeleted, want)
+	}
+	if want := []string{"db-2"}; !reflect.DeepEqual(store.deletedWatermarks, want) {
+		t.Errorf("deleted watermarks = %v, want %v", store.deletedWatermarks, want)
+	}
+}
+
+func TestHandleRecordsUnlistableInstances(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+
+	rdsClient := &fakeLogFiles{fail: map[string]error{
+		"db-2": &smithy.GenericAPIError{Code: "AccessDenied", Message: "not authorized to perform: rds:DescribeDBLogFiles"},
+		"db-3": &rdstypes.DBInstanceNotFoundFault{Message: aws.String("DBInstance db-3 not found.")},
+	}}
+	store := &fakeRecordStore{}
+	var metrics bytes.Buffer
+
+	response, err := NewHandler(HandlerDeps{RDS: rdsClient, DynamoDB: store, Metrics: &metrics})(context.Background(), sqsEvent("db-1", "db-2", "db-3"))
+	if err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+
+	// Retrying can't succeed, so neither message is returned to the queue
+	if len(response.BatchItemFailures) > 0 {
+		t.Errorf("BatchItemFailures = %v, want none", response.BatchItemFailures)
+	}
+	for dbInstanceID, wantStatus := range map[string]string{"db-1": "", "db-2": StatusUnauthorized, "db-3": StatusMissing} {
+		summary := store.summaries[dbInstanceID]
+		if summary.Status != wantStatus {
+			t.Errorf("summary Status of %s = %q, want %q", dbInstanceID, summary.Status, wantStatus)
+		}
+		if (summary.LastError != "") != (wantStatus != "") {
+			t.Errorf("summary LastError of %s = %q, want one only with a status", dbInstanceID, summary.LastError)
+		}
+	}
+	for _, metric := range []string{`"UnauthorizedInstances":1`, `"MissingInstances":1`} {
+		if !strings.Contains(metrics.String(), metric) {
+			t.Errorf("metrics %s don't contain %s", metrics.String(), metric)
+		}
+	}
+}
+
+func TestProcessDBInstanceClearsInstanceStatus(t *testing.T) {
+	cfg := detectorConfig{TableName: "table", RetentionDays: defaultRetentionDays}
+	store := &fakeRecordStore{}
+
+	denied := &fakeLogFiles{fail: map[string]error{"db-1": &smithy.GenericAPIError{Code: "AccessDenied"}}}
+	var metrics detectorMetrics
+	if err := processDBInstance(context.Background(), denied, store, cfg, "db-1", &metrics, discardLogger); err != nil {
+		t.Fatalf("denied processDBInstance() error = %v, want nil", err)
+	}
+	if metrics.UnauthorizedInstances != 1 || metrics.Errors != 0 {
+		t.Errorf("metrics = %+v, want 1 unauthorized instance and no errors", metrics)
+	}
+	if status := store.summaries["db-1"].Status; status != StatusUnauthorized {
+		t.Errorf("summary Status = %q, want %q", status, StatusUnauthorized)
+	}
+
+	// Once the permissions are fixed, the next detection removes the status
+	if err := processDBInstance(context.Background(), &fakeLogFiles{}, store, cfg, "db-1", &metrics, discardLogger); err != nil {
+		t.Fatalf("processDBInstance() error = %v", err)
+	}
+	if summary := store.summaries["db-1"]; summary.Status != "" || summary.LastError != "" {
+		t.Errorf("summary = %+v, want no Status or LastError", summary)
+	}
+}
+
+func TestIsAccessDenied(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: &smithy.GenericAPIError{Code: "AccessDenied"}, want: true},
+		{err: fmt.Errorf("getting log files: %w", &smithy.GenericAPIError{Code: "AccessDeniedException"}), want: true},
+		{err: &smithy.GenericAPIError{Code: "Throttling"}},
+		{err: &rdstypes.DBInstanceNotFoundFault{}},
+		{err: errors.New("AccessDenied")},
+		{err: nil},
+	}
+
+	for _, tt := range tests {
+		if got := isAccessDenied(tt.err); got != tt.want {
+			t.Errorf("isAccessDenied(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestProcessDBInstanceSetsPendingStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		existing   *LogFileRecord
+		wantStatus string
+	}{
+		{
+			name:       "new log file",
+			wantStatus: StatusPending,
+		},
+		{
+			name:       "changed log file",
+			existing:   &LogFileRecord{Size: 50, LastWritten: 900, Status: StatusDownloaded},
+			wantStatus: StatusPending,
+		},
+		{
+			name:     "only the retention changed",
+			existing: &LogFileRecord{Size: 100, LastWritten: 1000, ExpiresAt: 1, Status: StatusDownloaded},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeRecordStore{}
+			if tt.existing != nil {
+				existing := *tt.existing
+				existing.DBInstanceIdentifier = "db-1"
+				existing.LogFileName = "audit/server_audit.log"
+				store.records = []LogFileRecord{existing}
+			}
+			cfg := detectorConfig{TableName: "table", RetentionDays: defaultRetentionDays}
+
+			var metrics detectorMetrics
+			if err := processDBInstance(context.Background(), &fakeLogFiles{}, store, cfg, "db-1", &metrics, discardLogger); err != nil {
+				t.Fatalf("processDBInstance() error = %v", err)
+			}
+			if got := store.statuses["audit/server_audit.log"]; got != tt.wantStatus {
+				t.Errorf("Status = %q, want %q", got, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestProcessDBInstanceSkipsFilesBelowThresholds(t *testing.T) {
+	tests := []struct {
+		name          string
+		minFileSize   int64
+		wantRecorded  bool
+		wantWatermark int64
+		wantHeldBack  int64
+	}{
+		{name: "file at the minimum size is recorded", minFileSize: 100, wantRecorded: true, wantWatermark: 1000},
+		{name: "file below the minimum size is skipped", minFileSize: 101, wantWatermark: 1000, wantHeldBack: 1000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeRecordStore{}
+			cfg := detectorConfig{TableName: "table", RetentionDays: defaultRetentionDays, Thresholds: aurora.Thresholds{MinFileSize: tt.minFileSize}}
+
+			var metrics detectorMetrics
+			if err := processDBInstance(context.Background(), &fakeLogFiles{}, store, cfg, "db-1", &metrics, discardLogger); err != nil {
+				t.Fatalf("processDBInstance() error = %v", err)
+			}
+			if _, got := store.statuses["audit/server_audit.log"]; got != tt.wantRecorded {
+				t.Errorf("recorded = %v, want %v", got, tt.wantRecorded)
+			}
+			if mark := store.watermarks["db-1"]; mark.LastWritten != tt.wantWatermark || mark.HeldBack != tt.wantHeldBack {
+				t.Errorf("watermark = %+v, want %d held back at %d", mark, tt.wantWatermark, tt.wantHeldBack)
+			}
+		})
+	}
+}
+
+func TestProcessDBInstanceHoldsBackFilesBelowAnExistingWatermark(t *testing.T) {
+	// The last listing was cut short by the page limit, and a full listing is due
+	store := &fakeRecordStore{watermarks: map[string]watermark{"db-1": {LastWritten: 1000, ListingMarker: "3"}}}
+	cfg := detectorConfig{TableName: "table", RetentionDays: defaultRetentionDays, Thresholds: aurora.Thresholds{MinFileSize: 101}}
+	rdsClient := &fakeLogFiles{}
+
+	// The continued listing ends the truncated one, without moving the watermark back
+	var metrics detectorMetrics
+	if err := processDBInstance(context.Background(), rdsClient, store, cfg, "db-1", &metrics, discardLogger); err != nil {
+		t.Fatalf("processDBInstance() error = %v", err)
+	}
+	if len(store.statuses) > 0 {
+		t.Errorf("recorded %v, want the log files below the minimum size skipped", store.statuses)
+	}
+	if mark := store.watermarks["db-1"]; mark.LastWritten != 1000 || mark.HeldBack != 1000 || mark.ListingMarker != "" {
+		t.Errorf("watermark = %+v, want 1000 held back at 1000 without a listing marker", mark)
+	}
+
+	// The full listing is recorded as done
+	if err := processDBInstance(context.Background(), rdsClient, store, cfg, "db-1", &metrics, discardLogger); err != nil {
+		t.Fatalf("processDBInstance() error = %v", err)
+	}
+	if mark := store.watermarks["db-1"]; mark.LastFullListing == 0 {
+		t.Errorf("watermark = %+v, want the full listing recorded", mark)
+	}
+
+	// The next listing is filtered, and still includes the log files held back
+	if err := processDBInstance(context.Background(), rdsClient, store, cfg, "db-1", &metrics, discardLogger); err != nil {
+		t.Fatalf("processDBInstance() error = %v", err)
+	}
+	if got := rdsClient.fileLastWritten[len(rdsClient.fileLastWritten)-1]; aws.ToInt64(got) != 999 {
+		t.Errorf("FileLastWritten = %v, want 999", aws.ToInt64(got))
+	}
+}
+
+// fakePagedLogFiles serves one audit log per page, with the page number as the marker.
+// The requests of every call are recorded.
+type fakePagedLogFiles struct {
+	pages    int
+	stuck    bool // Return the requested marker again instead of the next one
+	requests []rds.DescribeDBLogFilesInput
+}
+
+func (f *fakePagedLogFiles) DescribeDBLogFiles(ctx context.Context, params *rds.DescribeDBLogFilesInput, optFns ...func(*rds.Options)) (*rds.DescribeDBLogFilesOutput, error) {
+	f.requests = append(f.requests, *params)
+
+	page := 1
+	if params.Marker != nil {
+		page, _ = strconv.Atoi(*params.Marker)
+	}
+	resp := &rds.DescribeDBLogFilesOutput{
+		DescribeDBLogFiles: []rdstypes.DescribeDBLogFilesDetails{
+			{LogFileName: aws.String("audit/server_audit.log." + strconv.Itoa(page)), Size: aws.Int64(100), LastWritten: aws.Int64(int64(1000 + page))},
+		},
+	}
+	if f.stuck && params.Marker != nil {
+		resp.Marker = params.Marker
+	} else if page < f.pages {
+		resp.Marker = aws.String(strconv.Itoa(page + 1))
+	}
+	return resp, nil
+}
+
+func TestProcessDBInstanceContinuesTruncatedListing(t *testing.T) {
+	rdsClient := &fakePagedLogFiles{pages: 3}
+	store := &fakeRecordStore{}
+	cfg := detectorConfig{TableName: "table", RetentionDays: defaultRetentionDays, MaxRecords: 50, MaxPages: 2}
+
+	var metrics detectorMetrics
+	err := processDBInstance(context.Background(), rdsClient, store, cfg, "db-1", &metrics, discardLogger)
+	if !errors.Is(err, errListingTruncated) {
+		t.Fatalf("processDBInstance() error = %v, want %v", err, errListingTruncated)
+	}
+	if got := len(store.statuses); got != 2 {
+		t.Errorf("recorded %d log files, want 2", got)
+	}
+	if mark := store.watermarks["db-1"]; mark.ListingMarker != "3" || mark.LastWritten != 0 {
+		t.Errorf("watermark = %+v, want the listing marker 3 and no watermark", mark)
+	}
+	if len(store.markedDeleted) > 0 {
+		t.Errorf("marked deleted = %v, want none after a partial listing", store.markedDeleted)
+	}
+	for _, request := range rdsClient.requests {
+		if aws.ToInt32(request.MaxRecords) != 50 {
+			t.Errorf("MaxRecords = %v, want 50", request.MaxRecords)
+		}
+	}
+
+	// The retried message continues at the saved marker
+	rdsClient.requests = nil
+	if err := processDBInstance(context.Background(), rdsClient, store, cfg, "db-1", &metrics, discardLogger); err != nil {
+		t.Fatalf("processDBInstance() error = %v", err)
+	}
+	if len(rdsClient.requests) != 1 || aws.ToString(rdsClient.requests[0].Marker) != "3" {
+		t.Errorf("requests = %+v, want one request at marker 3", rdsClient.requests)
+	}
+	if got := len(store.statuses); got != 3 {
+		t.Errorf("recorded %d log files, want 3", got)
+	}
+	if mark := store.watermarks["db-1"]; mark.LastWritten != 1003 {
+		t.Errorf("watermark = %+v, want 1003", mark)
+	}
+}
+
+func TestGetDBLogFilesRejectsStuckMarker(t *testing.T) {
+	rdsClient := &fakePagedLogFiles{pages: 3, stuck: true}
+	cfg := detectorConfig{TableName: "table"}
+
+	_, _, err := getDBLogFiles(context.Background(), rdsClient, cfg, "db-1", 0, nil, discardLogger)
+	if err == nil {
+		t.Fatal("getDBLogFiles() error = nil, want an error")
+	}
+	if len(rdsClient.requests) != 2 {
+		t.Errorf("made %d requests, want 2", len(rdsClient.requests))
+	}
+}
+
+func TestObserveSize(t *testing.T) {
+	now := time.Unix(600, 0)
+	history := func(sizes ...int64) []sizeObservation {
+		var result []sizeObservation
+		for i, size := range sizes {
+			result = append(result, sizeObservation{Size: size, ObservedAt: int64(100 * (i + 1))})
+		}
+		return result
+	}
+
+	tests := []struct {
+		name        string
+		existing    *LogFileRecord
+		size        int64
+		wantHistory []sizeObservation
+		wantRotated bool
+	}{
+		{
+			name:        "new record",
+			size:        10,
+			wantHistory: []sizeObservation{{Size: 10, ObservedAt: 600}},
+		},
+		{
+			name:        "growing file",
+			existing:    &LogFileRecord{Size: 20, SizeHistory: history(10, 20)},
+			size:        30,
+			wantHistory: append(history(10, 20), sizeObservation{Size: 30, ObservedAt: 600}),
+		},
+		{
+			name:        "shrinking file was rotated",
+			existing:    &LogFileRecord{Size: 20, SizeHistory: history(10, 20)},
+			size:        5,
+			wantHistory: append(history(10, 20), sizeObservation{Size: 5, ObservedAt: 600}),
+			wantRotated: true,
+		},
+		{
+			name:        "record without history",
+			existing:    &LogFileRecord{Size: 20},
+			size:        19,
+			wantHistory: []sizeObservation{{Size: 19, ObservedAt: 600}},
+			wantRotated: true,
+		},
+		{
+			name:        "history keeps the last entries",
+			existing:    &LogFileRecord{Size: 50, SizeHistory: history(10, 20, 30, 40, 50)},
+			size:        60,
+			wantHistory: append(history(10, 20, 30, 40, 50)[1:], sizeObservation{Size: 60, ObservedAt: 600}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotHistory, gotRotated := observeSize(tt.existing, tt.size, now)
+			if !reflect.DeepEqual(gotHistory, tt.wantHistory) {
+				t.Errorf("history = %v, want %v", gotHistory, tt.wantHistory)
+			}
+			if gotRotated != tt.wantRotated {
+				t.Errorf("rotated = %v, want %v", gotRotated, tt.wantRotated)
+			}
+		})
+	}
+}
+
+func TestProcessDBInstanceFlagsRotatedFiles(t *testing.T) {
+	tests := []struct {
+		name        string
+		existing    LogFileRecord
+		wantRotated bool
+	}{
+		{name: "grown file", existing: LogFileRecord{Size: 50, LastWritten: 900, Status: StatusDownloaded}},
+		{name: "shrunk file", existing: LogFileRecord{Size: 500, LastWritten: 900, Status: StatusDownloaded}, wantRotated: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			existing := tt.existing
+			existing.DBInstanceIdentifier = "db-1"
+			existing.LogFileName = "audit/server_audit.log"
+			store := &fakeRecordStore{records: []LogFileRecord{existing}}
+			cfg := detectorConfig{TableName: "table", RetentionDays: defaultRetentionDays}
+
+			var metrics detectorMetrics
+			if err := processDBInstance(context.Background(), &fakeLogFiles{}, store, cfg, "db-1", &metrics, discardLogger); err != nil {
+				t.Fatalf("processDBInstance() error = %v", err)
+			}
+			if got := len(store.rotated) > 0; got != tt.wantRotated {
+				t.Errorf("rotated = %v, want %v", store.rotated, tt.wantRotated)
+			}
+			if got := store.statuses["audit/server_audit.log"]; got != StatusPending {
+				t.Errorf("Status = %q, want %q", got, StatusPending)
+			}
+		})
+	}
+}
+
+// racingRecordStore rejects the next races log file record updates, as if another invocation updated
+// the record first with concurrent, and keeps the updates it lets through
+type racingRecordStore struct {
+	*fakeRecordStore
+	races      int
+	concurrent LogFileRecord
+	updates    []*dynamodb.UpdateItemInput
+}
+
+func (f *racingRecordStore) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	if _, ok := params.ExpressionAttributeValues[":expectedVersion"]; !ok {
+		return f.fakeRecordStore.UpdateItem(ctx, params, optFns...)
+	}
+	if f.races > 0 {
+		f.races--
+		f.records[0] = f.concurrent
+		return nil, &types.ConditionalCheckFailedException{}
+	}
+	f.updates = append(f.updates, params)
+	return f.fakeRecordStore.UpdateItem(ctx, params, optFns...)
+}
+
+func TestProcessDBInstanceRetriesConcurrentUpdates(t *testing.T) {
+	existing := LogFileRecord{
+		DBInstanceIdentifier: "db-1",
+		LogFileName:          "audit/server_audit.log",
+		Size:                 50,
+		LastWritten:          900,
+		Status:               StatusDownloaded,
+		SizeHistory:          []sizeObservation{{Size: 50, ObservedAt: 1}},
+		Version:              1,
+	}
+	// concurrentWrite returns existing as another invocation listing the log file at size and lastWritten updated it
+	concurrentWrite := func(size, lastWritten int64) LogFileRecord {
+		record := existing
+		record.Size, record.LastWritten, record.Status, record.Version = size, lastWritten, StatusPending, 2
+		record.ExpiresAt = expiresAt(lastWritten, defaultRetentionDays)
+		record.SizeHistory = append(slices.Clone(existing.SizeHistory), sizeObservation{Size: size, ObservedAt: 2})
+		return record
+	}
+
+	tests := []struct {
+		name       string
+		races      int
+		concurrent LogFileRecord
+		wantSizes  []int64 // SizeHistory written by the update let through, nil when there is none
+		wantErr    bool
+		want       detectorMetrics
+	}{
+		{
+			name:       "concurrent update of an older size",
+			races:      1,
+			concurrent: concurrentWrite(80, 950),
+			wantSizes:  []int64{50, 80, 100},
+			want:       detectorMetrics{FilesListed: 2, RecordsUpdated: 1, ConditionalCheckFailures: 1},
+		},
+		{
+			name:       "concurrent update of the same size",
+			races:      1,
+			concurrent: concurrentWrite(100, 1000),
+			want:       detectorMetrics{FilesListed: 2, RecordsUnchanged: 1, ConditionalCheckFailures: 1},
+		},
+		{
+			name:       "concurrent update of a newer size",
+			races:      1,
+			concurrent: concurrentWrite(120, 1100),
+			want:       detectorMetrics{FilesListed: 2, ConditionalCheckFailures: 1},
+		},
+		{
+			name:       "updated concurrently on every attempt",
+			races:      maxUpdateAttempts,
+			concurrent: concurrentWrite(80, 950),
+			wantErr:    true,
+			want:       detectorMetrics{FilesListed: 2, ConditionalCheckFailures: maxUpdateAttempts, Errors: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &racingRecordStore{fakeRecordStore: &fakeRecordStore{records: []LogFileRecord{existing}}, races: tt.races, concurrent: tt.concurrent}
+			cfg := detectorConfig{TableName: "table", RetentionDays: defaultRetentionDays}
+
+			var metrics detectorMetrics
+			err := processDBInstance(context.Background(), &fakeLogFiles{}, store, cfg, "db-1", &metrics, discardLogger)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("processDBInstance() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if metrics != tt.want {
+				t.Errorf("metrics = %+v, want %+v", metrics, tt.want)
+			}
+
+			if tt.wantSizes == nil {
+				if len(store.updates) != 0 {
+					t.Errorf("updated the record %d times, want none", len(store.updates))
+				}
+				return
+			}
+			if len(store.updates) != 1 {
+				t.Fatalf("updated the record %d times, want once", len(store.updates))
+			}
+
+			// The update is made over the record re-read, and expects its version
+			values := store.updates[0].ExpressionAttributeValues
+			versions := []string{values[":expectedVersion"].(*types.AttributeValueMemberN).Value, values[":version"].(*types.AttributeValueMemberN).Value}
+			if want := []string{"2", "3"}; !slices.Equal(versions, want) {
+				t.Errorf("expected and new Version = %v, want %v", versions, want)
+			}
+			var history []sizeObservation
+			if err := attributevalue.Unmarshal(values[":sizeHistory"], &history); err != nil {
+				t.Fatal(err)
+			}
+			var sizes []int64
+			for _, observation := range history {
+				sizes = append(sizes, observation.Size)
+			}
+			if !slices.Equal(sizes, tt.wantSizes) {
+				t.Errorf("SizeHistory sizes = %v, want %v", sizes, tt.wantSizes)
+			}
+		})
+	}
+}
+
+func TestRDSConfigAssumesRole(t *testing.T) {
+	cfg := aws.Config{Region: "us-east-1", Credentials: aws.AnonymousCredentials{}}
+
+	t.Setenv("ASSUME_ROLE_ARN", "")
+	if got := rdsConfig(cfg); got.Credentials != cfg.Credentials {
+		t.Errorf("rdsConfig() credentials = %T, want the local credentials", got.Credentials)
+	}
+
+	t.Setenv("ASSUME_ROLE_ARN", "arn:aws:iam::123456789012:role/audit-log-backup")
+	got := rdsConfig(cfg)
+	cache, ok := got.Credentials.(*aws.CredentialsCache)
+	if !ok || !cache.IsCredentialsProvider(&stscreds.AssumeRoleProvider{}) {
+		t.Errorf("rdsConfig() credentials = %T, want an assume role provider", got.Credentials)
+	}
+	if cfg.Credentials != (aws.AnonymousCredentials{}) {
+		t.Errorf("rdsConfig() changed the local credentials to %T", cfg.Credentials)
+	}
+}
+
+func TestProcessDBInstanceCountsRecords(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing *LogFileRecord
+		store    *fakeRecordStore
+		want     detectorMetrics
+	}{
+		{
+			name:  "new log file",
+			store: &fakeRecordStore{},
+			want:  detectorMetrics{FilesListed: 2, RecordsCreated: 1},
+		},
+		{
+			name:     "changed log file",
+			existing: &LogFileRecord{Size: 50, LastWritten: 900},
+			store:    &fakeRecordStore{},
+			want:     detectorMetrics{FilesListed: 2, RecordsUpdated: 1},
+		},
+		{
+			name:     "unchanged log file",
+			existing: &LogFileRecord{Size: 100, LastWritten: 1000, ExpiresAt: expiresAt(1000, defaultRetentionDays)},
+			store:    &fakeRecordStore{},
+			want:     detectorMetrics{FilesListed: 2, RecordsUnchanged: 1},
+		},
+		{
+			// The downloader left it waiting for its writes to settle, so it is set back to PENDING
+			name:     "unchanged log file left waiting",
+			existing: &LogFileRecord{Size: 100, LastWritten: 1000, ExpiresAt: expiresAt(1000, defaultRetentionDays), Status: StatusWaiting},
+			store:    &fakeRecordStore{},
+			want:     detectorMetrics{FilesListed: 2, RecordsUpdated: 1},
+		},
+		{
+			name:  "failed write",
+			store: &fakeRecordStore{failWrites: map[string]bool{"db-1": true}},
+			want:  detectorMetrics{FilesListed: 2, Errors: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.existing != nil {
+				existing := *tt.existing
+				existing.DBInstanceIdentifier = "db-1"
+				existing.LogFileName = "audit/server_audit.log"
+				tt.store.records = []LogFileRecord{existing}
+			}
+			cfg := detectorConfig{TableName: "table", RetentionDays: defaultRetentionDays}
+
+			var metrics detectorMetrics
+			processDBInstance(context.Background(), &fakeLogFiles{}, tt.store, cfg, "db-1", &metrics, discardLogger)
+			// The discovery lag depends on the current time
+			metrics.MaxDiscoveryLag = 0
+			if metrics != tt.want {
+				t.Errorf("metrics = %+v, want %+v", metrics, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessDBInstanceMaintainsSummary(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []LogFileRecord
+		rds      DescribeDBLogFilesAPI
+		store    *fakeRecordStore
+		want     fakeSummary
+	}{
+		{
+			name:  "new log file",
+			rds:   &fakeLogFiles{},
+			store: &fakeRecordStore{},
+			want:  fakeSummary{FilesTracked: 1, PendingCount: 1},
+		},
+		{
+			name:     "changed log file",
+			existing: []LogFileRecord{{LogFileName: "audit/server_audit.log", Size: 50, LastWritten: 900, Status: StatusDownloaded}},
+			rds:      &fakeLogFiles{},
+			store:    &fakeRecordStore{},
+			want:     fakeSummary{PendingCount: 1},
+		},
+		{
+			name:     "changed log file already pending",
+			existing: []LogFileRecord{{LogFileName: "audit/server_audit.log", Size: 50, LastWritten: 900, Status: StatusPending}},
+			rds:      &fakeLogFiles{},
+			store:    &fakeRecordStore{},
+			want:     fakeSummary{},
+		},
+		{
+			name:     "unchanged log file",
+			existing: []LogFileRecord{{LogFileName: "audit/server_audit.log", Size: 100, LastWritten: 1000, ExpiresAt: expiresAt(1000, defaultRetentionDays), Status: StatusDownloaded}},
+			rds:      &fakeLogFiles{},
+			store:    &fakeRecordStore{},
+			want:     fakeSummary{},
+		},
+		{
+			name:     "unchanged log file left waiting",
+			existing: []LogFileRecord{{LogFileName: "audit/server_audit.log", Size: 100, LastWritten: 1000, ExpiresAt: expiresAt(1000, defaultRetentionDays), Status: StatusWaiting}},
+			rds:      &fakeLogFiles{},
+			store:    &fakeRecordStore{},
+			want:     fakeSummary{PendingCount: 1},
+		},
+		{
+			name: "reappeared and removed log files",
+			existing: []LogFileRecord{
+				{LogFileName: "audit/server_audit.log", Size: 100, LastWritten: 1000, ExpiresAt: expiresAt(1000, defaultRetentionDays), Status: StatusDownloaded, Deleted: true},
+				{LogFileName: "audit/server_audit.log.1", Status: StatusDownloaded},
+				{LogFileName: "audit/server_audit.log.2", Status: StatusDownloaded},
+			},
+			rds:   &fakeLogFiles{},
+			store: &fakeRecordStore{},
+			want:  fakeSummary{FilesTracked: -1},
+		},
+		{
+			name:  "failed write",
+			rds:   &fakeLogFiles{},
+			store: &fakeRecordStore{failWrites: map[string]bool{"db-1": true}},
+			want:  fakeSummary{LastError: "1 log files could not be recorded"},
+		},
+		{
+			name:  "failed listing",
+			rds:   &fakeLogFiles{fail: map[string]error{"db-1": errors.New("throttled")}},
+			store: &fakeRecordStore{},
+			want:  fakeSummary{LastError: "getting log files: throttled"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, record := range tt.existing {
+				record.DBInstanceIdentifier = "db-1"
+				tt.store.records = append(tt.store.records, record)
+			}
+			cfg := detectorConfig{TableName: "table", RetentionDays: defaultRetentionDays}
+
+			var metrics detectorMetrics
+			before := time.Now().UnixMilli()
+			processDBInstance(context.Background(), tt.rds, tt.store, cfg, "db-1", &metrics, discardLogger)
+
+			got, ok := tt.store.summaries["db-1"]
+			if !ok {
+				t.Fatal("summary was not updated")
+			}
+			if got.LastDetectedAt < before {
+				t.Errorf("LastDetectedAt = %d, want at least %d", got.LastDetectedAt, before)
+			}
+			got.LastDetectedAt = 0
+			if got != tt.want {
+				t.Errorf("summary = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessDBInstanceSummaryAcrossDetections(t *testing.T) {
+	store := &fakeRecordStore{}
+	cfg := detectorConfig{TableName: "table", RetentionDays: defaultRetentionDays, FullRescan: true}
+
+	// The first detection creates the record, the second finds it unchanged
+	var metrics detectorMetrics
+	if err := processDBInstance(context.Background(), &fakeLogFiles{}, store, cfg, "db-1", &metrics, discardLogger); err != nil {
+		t.Fatalf("processDBInstance() error = %v", err)
+	}
+	store.records = []LogFileRecord{{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log", Size: 100, LastWritten: 1000, ExpiresAt: expiresAt(1000, defaultRetentionDays), Status: StatusPending}}
+	if err := processDBInstance(context.Background(), &fakeLogFiles{}, store, cfg, "db-1", &metrics, discardLogger); err != nil {
+		t.Fatalf("processDBInstance() error = %v", err)
+	}
+
+	if got, want := store.summaries["db-1"], (fakeSummary{FilesTracked: 1, PendingCount: 1}); got.FilesTracked != want.FilesTracked || got.PendingCount != want.PendingCount {
+		t.Errorf("summary = %+v, want %+v", got, want)
+	}
+}
+
+func TestProcessDBInstanceMeasuresDiscoveryLag(t *testing.T) {
+	lastWritten := time.Now().Add(-90 * time.Second).UnixMilli()
+	rdsClient := staticLogFiles{
+		{LogFileName: aws.String("audit/server_audit.log"), Size: aws.Int64(100), LastWritten: aws.Int64(lastWritten)},
+		{LogFileName: aws.String("audit/server_audit.log.1"), Size: aws.Int64(100), LastWritten: aws.Int64(lastWritten - 60000)},
+	}
+	cfg := detectorConfig{TableName: "table", RetentionDays: defaultRetentionDays}
+
+	var metrics detectorMetrics
+	if err := processDBInstance(context.Background(), rdsClient, &fakeRecordStore{}, cfg, "db-1", &metrics, discardLogger); err != nil {
+		t.Fatalf("processDBInstance() error = %v", err)
+	}
+	if metrics.MaxDiscoveryLag < 150*time.Second || metrics.MaxDiscoveryLag > 155*time.Second {
+		t.Errorf("MaxDiscoveryLag = %s, want about 150s", metrics.MaxDiscoveryLag)
+	}
+}
+
+func TestHandleEmitsMetrics(t *testing.T) {
+	tests := []struct {
+		name              string
+		metricsByInstance string
+		want              []map[string]any
+	}{
+		{
+			name: "dimensioned by instance",
+			want: []map[string]any{
+				{"DBInstanceIdentifier": "db-1", "FilesListed": 2.0, "RecordsCreated": 1.0, "Errors": 0.0},
+				{"DBInstanceIdentifier": "db-2", "FilesListed": 0.0, "RecordsCreated": 0.0, "Errors": 1.0},
+			},
+		},
+		{
+			name:              "dimensioned by function",
+			metricsByInstance: "false",
+			want: []map[string]any{
+				{"FunctionName": "log-detector", "FilesListed": 2.0, "RecordsCreated": 1.0, "Errors": 1.0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DYNAMODB_TABLE_NAME", "table")
+			t.Setenv("METRICS_BY_INSTANCE", tt.metricsByInstance)
+			t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "log-detector")
+
+			var output bytes.Buffer
+			rdsClient := &fakeLogFiles{fail: map[string]error{"db-2": errors.New("throttled")}}
+			_, err := NewHandler(HandlerDeps{RDS: rdsClient, DynamoDB: &fakeRecordStore{}, Metrics: &output})(context.Background(), sqsEvent("db-1", "db-2"))
+			if err != nil {
+				t.Fatalf("handler error = %v", err)
+			}
+
+			lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+			if len(lines) != len(tt.want) {
+				t.Fatalf("emitted %d records, want %d: %q", len(lines), len(tt.want), output.String())
+			}
+			for i, line := range lines {
+				var record map[string]any
+				if err := json.Unmarshal([]byte(line), &record); err != nil {
+					t.Fatalf("record %q is not JSON: %v", line, err)
+				}
+				if _, ok := record["_aws"]; !ok {
+					t.Errorf("record %q has no metric directive", line)
+				}
+				for key, want := range tt.want[i] {
+					if record[key] != want {
+						t.Errorf("record %d %s = %v, want %v", i, key, record[key], want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// OnDemandRequest is the payload of a direct invocation that backs up a single DB instance now,
+// instead of waiting for the scheduled scan:
+//
+//	{"dbInstanceIdentifier": "my-instance-1", "forceDownload": true}
+type OnDemandRequest struct {
+	DBInstanceIdentifier string `json:"dbInstanceIdentifier"`
+	// ForceDownload asks the Log Downloader to back up every log file of the instance,
+	// including the ones backed up within the last 24 hours
+	ForceDownload bool `json:"forceDownload,omitempty"`
+	// Region is the region of an instance outside the Lambda's region, which must be listed in REGIONS
+	Region string `json:"region,omitempty"`
+}
+
+// OnDemandResponse is the result of an on-demand invocation:
+//
+//	{"dbInstanceIdentifier": "my-instance-1", "success": true, "downloadsRequested": 3}
+type OnDemandResponse struct {
+	DBInstanceIdentifier string `json:"dbInstanceIdentifier"`
+	Success              bool   `json:"success"`
+	DownloadsRequested   int    `json:"downloadsRequested,omitempty"`
+	// InstanceStatus is UNAUTHORIZED or MISSING when the instance's log files can't be listed
+	InstanceStatus string `json:"instanceStatus,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// NewOnDemandHandler returns a Lambda function handler for on-demand direct invocations
+func NewOnDemandHandler(deps HandlerDeps) func(ctx context.Context, request OnDemandRequest) (OnDemandResponse, error) {
+	return deps.handleOnDemand
+}
+
+// NewInvokeHandler returns a Lambda function handler accepting SQS events, on-demand and backlog requests
+func NewInvokeHandler(deps HandlerDeps) func(ctx context.Context, payload json.RawMessage) (any, error) {
+	return deps.invoke
+}
+
+// invoke dispatches the payload to the SQS, on-demand or backlog handler depending on its shape
+func (deps HandlerDeps) invoke(ctx context.Context, payload json.RawMessage) (any, error) {
+	var backlogRequest BacklogRequest
+	if err := json.Unmarshal(payload, &backlogRequest); err == nil && backlogRequest.Mode == backlogMode {
+		return deps.handleBacklog(ctx, backlogRequest)
+	}
+
+	var request OnDemandRequest
+	if err := json.Unmarshal(payload, &request); err == nil && request.DBInstanceIdentifier != "" {
+		return deps.handleOnDemand(ctx, request)
+	}
+
+	var sqsEvent events.SQSEvent
+	if err := json.Unmarshal(payload, &sqsEvent); err != nil {
+		return nil, fmt.Errorf("unsupported payload: %w", err)
+	}
+	return deps.handle(ctx, sqsEvent)
+}
+
+// handleOnDemand records the log files of one DB instance and optionally requests their download.
+// Every log file is listed, regardless of the instance's watermark.
+func (deps HandlerDeps) handleOnDemand(ctx context.Context, request OnDemandRequest) (OnDemandResponse, error) {
+	// Initialize logger
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	logger.Printf("Starting on-demand backup of DB instance %s\n", request.DBInstanceIdentifier)
+
+	response := OnDemandResponse{DBInstanceIdentifier: request.DBInstanceIdentifier}
+
+	if request.DBInstanceIdentifier == "" {
+		response.Error = "dbInstanceIdentifier is required"
+		return response, nil
+	}
+
+	// Fail the invocation when required settings are missing
+	if err := validateConfig(); err != nil {
+		logger.Printf("Error: %v\n", err)
+		response.Error = err.Error()
+		return response, err
+	}
+
+	// Read the settings from the environment
+	cfg, err := loadDetectorConfig()
+	if err != nil {
+		logger.Printf("Error: %v\n", err)
+		response.Error = err.Error()
+		return response, err
+	}
+	cfg.FullRescan = true
+
+	// Fail the invocation when the log name patterns can't be compiled
+	if logNamePatternsErr != nil {
+		logger.Printf("Error: invalid LOG_NAME_PATTERNS: %v\n", logNamePatternsErr)
+		return response, logNamePatternsErr
+	}
+
+	var metrics detectorMetrics
+	dynamoClient := withRetries(deps.DynamoDB, &metrics)
+	defer func() {
+		logger.Printf("On-demand backup of DB instance %s made %d DynamoDB retries\n", request.DBInstanceIdentifier, metrics.Retries)
+	}()
+
+	regionalClient := deps.rdsClient(request.Region)
+	if regionalClient == nil {
+		response.Error = fmt.Sprintf("no RDS client for region %s, which is not in REGIONS", request.Region)
+		return response, nil
+	}
+	cfg.Region = request.Region
+	if cfg.Region == "" {
+		cfg.Region = deps.Region
+	}
+
+	rdsClient := withRateLimit(regionalClient, deps.RDSLimiter, &metrics)
+	err = processDBInstance(ctx, rdsClient, dynamoClient, cfg, request.DBInstanceIdentifier, &metrics, logger)
+	if err != nil {
+		logger.Printf("Error processing instance %s: %v\n", request.DBInstanceIdentifier, err)
+		response.Error = err.Error()
+		return response, nil
+	}
+	switch {
+	case metrics.UnauthorizedInstances > 0:
+		response.InstanceStatus = StatusUnauthorized
+		response.Error = "not authorized to list the log files of the DB instance"
+		return response, nil
+	case metrics.MissingInstances > 0:
+		response.InstanceStatus = StatusMissing
+		response.Error = "DB instance not found"
+		return response, nil
+	}
+
+	// Let the Log Downloader pick up every log file of the instance
+	if request.ForceDownload {
+		requested, err := requestDownloads(ctx, dynamoClient, cfg.TableName, request.DBInstanceIdentifier, logger)
+		response.DownloadsRequested = requested
+		if err != nil {
+			logger.Printf("Error requesting downloads for instance %s: %v\n", request.DBInstanceIdentifier, err)
+			response.Error = err.Error()
+			return response, nil
+		}
+	}
+
+	response.Success = true
+	return response, nil
+}
+
+// requestDownloads sets DownloadRequestedAt on the instance's records, which makes the Log Downloader
+// back them up regardless of LastBackup, and returns the number of records touched
+func requestDownloads(ctx context.Context, client RecordStoreAPI, tableName string, dbInstanceID string, logger *log.Logger) (int, error) {
+	records, err := queryLogFileRecords(ctx, client, tableName, dbInstanceID, logger)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().UnixNano()
+
+	requested := 0
+	for _, record := range records {
+		// Skip bookkeeping items and log files that are gone from the instance
+		if strings.HasPrefix(record.LogFileName, "#") || record.Deleted {
+			continue
+		}
+
+		logger.Printf("Requesting download of log file %s\n", record.LogFileName)
+		_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(tableName),
+			Key: map[string]types.AttributeValue{
+				"DBInstanceIdentifier": &types.AttributeValueMemberS{Value: record.DBInstanceIdentifier},
+				"LogFileName":          &types.AttributeValueMemberS{Value: record.LogFileName},
+			},
+			UpdateExpression:    aws.String("SET DownloadRequestedAt = :now"),
+			ConditionExpression: aws.String("attribute_exists(DBInstanceIdentifier)"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(now, 10)},
+			},
+		})
+		if isConditionalCheckFailed(err) {
+			// The record expired in the meantime
+			continue
+		}
+		if err != nil {
+			return requested, err
+		}
+		requested++
+	}
+
+	return requested, nil
+}
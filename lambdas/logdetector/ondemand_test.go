@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/smithy-go"
+)
+
+func TestHandleOnDemand(t *testing.T) {
+	records := []LogFileRecord{
+		{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log.1"},
+		{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log.2", Deleted: true},
+		{DBInstanceIdentifier: "db-1", LogFileName: "#WATERMARK"},
+	}
+
+	tests := []struct {
+		name                  string
+		request               OnDemandRequest
+		rds                   *fakeLogFiles
+		want                  OnDemandResponse
+		wantDownloadRequested []string
+	}{
+		{
+			name:    "records the instance's log files",
+			request: OnDemandRequest{DBInstanceIdentifier: "db-1"},
+			rds:     &fakeLogFiles{},
+			want:    OnDemandResponse{DBInstanceIdentifier: "db-1", Success: true},
+		},
+		{
+			name:                  "requests the download of every log file",
+			request:               OnDemandRequest{DBInstanceIdentifier: "db-1", ForceDownload: true},
+			rds:                   &fakeLogFiles{},
+			want:                  OnDemandResponse{DBInstanceIdentifier: "db-1", Success: true, DownloadsRequested: 1},
+			wantDownloadRequested: []string{"audit/server_audit.log.1"},
+		},
+		{
+			name:    "reports a failed listing",
+			request: OnDemandRequest{DBInstanceIdentifier: "db-1", ForceDownload: true},
+			rds:     &fakeLogFiles{fail: map[string]error{"db-1": errors.New("throttled")}},
+			want:    OnDemandResponse{DBInstanceIdentifier: "db-1", Error: "getting log files: throttled"},
+		},
+		{
+			name:    "reports an instance it isn't authorized to list",
+			request: OnDemandRequest{DBInstanceIdentifier: "db-1", ForceDownload: true},
+			rds:     &fakeLogFiles{fail: map[string]error{"db-1": &smithy.GenericAPIError{Code: "AccessDenied"}}},
+			want:    OnDemandResponse{DBInstanceIdentifier: "db-1", InstanceStatus: StatusUnauthorized, Error: "not authorized to list the log files of the DB instance"},
+		},
+		{
+			name:    "requires a client for the region",
+			request: OnDemandRequest{DBInstanceIdentifier: "db-1", Region: "eu-west-1"},
+			rds:     &fakeLogFiles{},
+			want:    OnDemandResponse{DBInstanceIdentifier: "db-1", Error: "no RDS client for region eu-west-1, which is not in REGIONS"},
+		},
+		{
+			name:    "requires an instance",
+			request: OnDemandRequest{},
+			rds:     &fakeLogFiles{},
+			want:    OnDemandResponse{Error: "dbInstanceIdentifier is required"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DYNAMODB_TABLE_NAME", "table")
+
+			store := &fakeRecordStore{records: records}
+			got, err := NewOnDemandHandler(HandlerDeps{RDS: tt.rds, DynamoDB: store})(context.Background(), tt.request)
+			if err != nil {
+				t.Fatalf("handler error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("response = %+v, want %+v", got, tt.want)
+			}
+			if !reflect.DeepEqual(store.downloadRequested, tt.wantDownloadRequested) {
+				t.Errorf("download requested = %v, want %v", store.downloadRequested, tt.wantDownloadRequested)
+			}
+		})
+	}
+}
+
+func TestHandleOnDemandIgnoresWatermark(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+
+	rdsClient := &fakeLogFiles{}
+	store := &fakeRecordStore{watermarks: map[string]watermark{"db-1": {LastWritten: 500, LastFullListing: time.Now().Unix()}}}
+
+	if _, err := NewOnDemandHandler(HandlerDeps{RDS: rdsClient, DynamoDB: store})(context.Background(), OnDemandRequest{DBInstanceIdentifier: "db-1"}); err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+	if len(rdsClient.fileLastWritten) != 1 || rdsClient.fileLastWritten[0] != nil {
+		t.Errorf("FileLastWritten = %v, want a full listing", rdsClient.fileLastWritten)
+	}
+}
+
+func TestInvokeDispatchesPayloads(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+
+	tests := []struct {
+		name    string
+		payload string
+		want    any
+	}{
+		{
+			name:    "on-demand request",
+			payload: `{"dbInstanceIdentifier": "db-1"}`,
+			want:    OnDemandResponse{DBInstanceIdentifier: "db-1", Success: true},
+		},
+		{
+			name:    "SQS event",
+			payload: `{"Records": [{"messageId": "msg-1", "body": "db-1"}]}`,
+			want:    events.SQSEventResponse{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewInvokeHandler(HandlerDeps{RDS: &fakeLogFiles{}, DynamoDB: &fakeRecordStore{}})(context.Background(), json.RawMessage(tt.payload))
+			if err != nil {
+				t.Fatalf("handler error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("response = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/awsregion"
+)
+
+// SendMessageAPI is the subset of the SQS client used to forward poison messages to the dead-letter queue
+type SendMessageAPI interface {
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+}
+
+// dbInstanceIDPattern matches RDS DB instance identifiers: 1 to 63 letters, digits or hyphens,
+// starting with a letter, without two consecutive hyphens or a trailing hyphen
+var dbInstanceIDPattern = regexp.MustCompile(`^[A-Za-z](?:-?[A-Za-z0-9])*$`)
+
+// instanceMessage is the DB instance an SQS message names. Region is empty for an instance in the Lambda's region.
+// A message with a ClusterID and no InstanceID names every member instance of the DB cluster.
+type instanceMessage struct {
+	InstanceID string `json:"instanceId,omitempty"`
+	ClusterID  string `json:"clusterId,omitempty"`
+	Region     string `json:"region,omitempty"`
+}
+
+// String names the DB instance or cluster of the message in log messages
+func (m instanceMessage) String() string {
+	if m.InstanceID == "" {
+		return "cluster " + m.ClusterID
+	}
+	return "instance " + m.InstanceID
+}
+
+// parseMessageBody returns the DB instance an SQS message body names, or why it names none. The body is either
+// a DB instance ID in the Lambda's region, as sent before cross-region scans, or a JSON {"instanceId", "region"}
+// or {"clusterId", "region"}.
+// Such a message fails on every delivery, so it is handled as a poison message instead of being retried.
+func parseMessageBody(body string) (instanceMessage, error) {
+	if body == "" {
+		return instanceMessage{}, fmt.Errorf("empty body")
+	}
+
+	target := instanceMessage{InstanceID: body}
+	if strings.HasPrefix(body, "{") {
+		target = instanceMessage{}
+		if err := json.Unmarshal([]byte(body), &target); err != nil {
+			return instanceMessage{}, fmt.Errorf("body is not valid JSON: %v", err)
+		}
+		if target.Region != "" && !awsregion.Valid(target.Region) {
+			return instanceMessage{}, fmt.Errorf("invalid region %q", target.Region)
+		}
+		// DB cluster identifiers follow the rules of DB instance identifiers
+		if target.ClusterID != "" && (len(target.ClusterID) > 63 || !dbInstanceIDPattern.MatchString(target.ClusterID)) {
+			return instanceMessage{}, fmt.Errorf("clusterId is not a DB cluster identifier")
+		}
+		if target.InstanceID == "" && target.ClusterID != "" {
+			return target, nil
+		}
+	}
+
+	if len(target.InstanceID) > 63 || !dbInstanceIDPattern.MatchString(target.InstanceID) {
+		return instanceMessage{}, fmt.Errorf("body is not a DB instance identifier")
+	}
+	return target, nil
+}
+
+// handlePoisonMessage logs a message that can never be processed and, when cfg.DLQURL is set, forwards it
+// to the dead-letter queue with the reason in its PoisonReason attribute. A nil error acknowledges the message;
+// an error keeps it in the queue so it isn't lost when the forward fails.
+func (deps HandlerDeps) handlePoisonMessage(ctx context.Context, cfg detectorConfig, message events.SQSMessage, reason error, logger *log.Logger) error {
+	logger.Printf("Warning: poison message %s: %v, body: %q\n", message.MessageId, reason, message.Body)
+
+	if cfg.DLQURL == "" {
+		return nil
+	}
+	if deps.SQS == nil {
+		return fmt.Errorf("forwarding poison message %s: no SQS client", message.MessageId)
+	}
+
+	_, err := deps.SQS.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(cfg.DLQURL),
+		MessageBody: aws.String(message.Body),
+		MessageAttributes: map[string]sqstypes.MessageAttributeValue{
+			"PoisonReason": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(reason.Error()),
+			},
+			"OriginalMessageId": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(message.MessageId),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("forwarding poison message %s to the dead-letter queue: %w", message.MessageId, err)
+	}
+
+	logger.Printf("Forwarded poison message %s to the dead-letter queue\n", message.MessageId)
+	return nil
+}
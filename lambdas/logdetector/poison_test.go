@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// fakeDLQ records the messages sent to it and fails every send when err is set
+type fakeDLQ struct {
+	mu   sync.Mutex
+	sent []*sqs.SendMessageInput
+	err  error
+}
+
+func (f *fakeDLQ) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, params)
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func TestParseMessageBody(t *testing.T) {
+	tests := []struct {
+		body    string
+		want    instanceMessage
+		wantErr bool
+	}{
+		{body: "db-1", want: instanceMessage{InstanceID: "db-1"}},
+		{body: "aurora-cluster-instance-1", want: instanceMessage{InstanceID: "aurora-cluster-instance-1"}},
+		{body: `{"instanceId":"db-1","region":"eu-west-1"}`, want: instanceMessage{InstanceID: "db-1", Region: "eu-west-1"}},
+		{body: `{"instanceId":"db-1"}`, want: instanceMessage{InstanceID: "db-1"}},
+		{body: `{"clusterId":"cluster-1","region":"eu-west-1"}`, want: instanceMessage{ClusterID: "cluster-1", Region: "eu-west-1"}},
+		{body: `{"instanceId":"db-1","clusterId":"cluster-1"}`, want: instanceMessage{InstanceID: "db-1", ClusterID: "cluster-1"}},
+		{body: `{"clusterId":"cluster--1"}`, wantErr: true},
+		{body: `{"instanceId":"1db","clusterId":"cluster-1"}`, wantErr: true},
+		{body: "", wantErr: true},
+		{body: `{"dbInstanceIdentifier":"db-1"}`, wantErr: true},
+		{body: `{"instanceId":"db-1","region":"Europe"}`, wantErr: true},
+		{body: `{"instanceId":"1db","region":"eu-west-1"}`, wantErr: true},
+		{body: `{"instanceId":"db-1"`, wantErr: true},
+		{body: "1db", wantErr: true},
+		{body: "db--1", wantErr: true},
+		{body: "db-1-", wantErr: true},
+		{body: " db-1", wantErr: true},
+		{body: "d" + strings.Repeat("b", 63), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseMessageBody(tt.body)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseMessageBody(%q) error = %v, wantErr %v", tt.body, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseMessageBody(%q) = %+v, want %+v", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestHandlePoisonMessages(t *testing.T) {
+	tests := []struct {
+		name       string
+		dlqURL     string
+		dlq        *fakeDLQ
+		wantFailed []string
+		wantSent   []string
+	}{
+		{
+			name: "acknowledged without a DLQ",
+			dlq:  &fakeDLQ{},
+		},
+		{
+			name:     "forwarded to the DLQ",
+			dlqURL:   "https://sqs.example.com/dlq",
+			dlq:      &fakeDLQ{},
+			wantSent: []string{"", `{"source":"other"}`},
+		},
+		{
+			name:       "kept in the queue when the forward fails",
+			dlqURL:     "https://sqs.example.com/dlq",
+			dlq:        &fakeDLQ{err: errors.New("throttled")},
+			wantFailed: []string{"msg-1", "msg-3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DYNAMODB_TABLE_NAME", "table")
+			t.Setenv("DLQ_URL", tt.dlqURL)
+			t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "log-detector")
+
+			var output bytes.Buffer
+			store := &fakeRecordStore{}
+			deps := HandlerDeps{RDS: &fakeLogFiles{}, DynamoDB: store, SQS: tt.dlq, Metrics: &output}
+			response, err := NewHandler(deps)(context.Background(), sqsEvent("", "db-2", `{"source":"other"}`))
+			if err != nil {
+				t.Fatalf("handler error = %v", err)
+			}
+
+			var failed []string
+			for _, failure := range response.BatchItemFailures {
+				failed = append(failed, failure.ItemIdentifier)
+			}
+			if !reflect.DeepEqual(failed, tt.wantFailed) {
+				t.Errorf("BatchItemFailures = %v, want %v", failed, tt.wantFailed)
+			}
+			if !reflect.DeepEqual(store.written, []string{"audit/server_audit.log"}) {
+				t.Errorf("written = %v, want only the log file of db-2", store.written)
+			}
+
+			var sent []string
+			for _, message := range tt.dlq.sent {
+				if aws.ToString(message.QueueUrl) != tt.dlqURL {
+					t.Errorf("QueueUrl = %q, want %q", aws.ToString(message.QueueUrl), tt.dlqURL)
+				}
+				if _, ok := message.MessageAttributes["PoisonReason"]; !ok {
+					t.Errorf("forwarded message %q has no PoisonReason attribute", aws.ToString(message.MessageBody))
+				}
+				sent = append(sent, aws.ToString(message.MessageBody))
+			}
+			// Messages are handled concurrently, so compare them in order of the event
+			if len(sent) == 2 && sent[0] != "" {
+				sent[0], sent[1] = sent[1], sent[0]
+			}
+			if !reflect.DeepEqual(sent, tt.wantSent) {
+				t.Errorf("forwarded %q, want %q", sent, tt.wantSent)
+			}
+
+			// db-2 is published by instance, the poison messages only by function
+			lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+			if len(lines) != 2 {
+				t.Fatalf("emitted %d records, want 2: %q", len(lines), output.String())
+			}
+			var record map[string]any
+			if err := json.Unmarshal([]byte(lines[1]), &record); err != nil {
+				t.Fatalf("record %q is not JSON: %v", lines[1], err)
+			}
+			if record["FunctionName"] != "log-detector" || record["PoisonMessages"] != 2.0 {
+				t.Errorf("poison record = %v, want FunctionName log-detector and 2 PoisonMessages", record)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/ratelimit"
+)
+
+// rateLimitedLogFiles waits for the RDS rate limiter before every call and counts the calls it delayed
+type rateLimitedLogFiles struct {
+	client  DescribeDBLogFilesAPI
+	limiter *ratelimit.Limiter
+	metrics *detectorMetrics
+}
+
+// withRateLimit wraps the client so its calls are spaced out by the limiter shared by the worker pool.
+// Without a limiter the client is returned as is.
+func withRateLimit(client DescribeDBLogFilesAPI, limiter *ratelimit.Limiter, metrics *detectorMetrics) DescribeDBLogFilesAPI {
+	if limiter == nil {
+		return client
+	}
+	return &rateLimitedLogFiles{client: client, limiter: limiter, metrics: metrics}
+}
+
+func (c *rateLimitedLogFiles) DescribeDBLogFiles(ctx context.Context, params *rds.DescribeDBLogFilesInput, optFns ...func(*rds.Options)) (*rds.DescribeDBLogFilesOutput, error) {
+	if err := waitForRateLimit(ctx, c.limiter, c.metrics); err != nil {
+		return nil, err
+	}
+	return c.client.DescribeDBLogFiles(ctx, params, optFns...)
+}
+
+// waitForRateLimit waits for the limiter before an RDS call and counts the delay.
+// Without a limiter it returns at once.
+func waitForRateLimit(ctx context.Context, limiter *ratelimit.Limiter, metrics *detectorMetrics) error {
+	if limiter == nil {
+		return nil
+	}
+	delay, err := limiter.Wait(ctx)
+	if delay > 0 {
+		metrics.RateLimitWaits++
+		metrics.RateLimitDelay += delay
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/ratelimit"
+)
+
+func TestHandleCountsRateLimitWaits(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "log-detector")
+
+	// Use up the burst, so every DescribeDBLogFiles call waits 10ms for its token
+	limiter := ratelimit.New(100)
+	for range 100 {
+		if _, err := limiter.Wait(context.Background()); err != nil {
+			t.Fatalf("Wait() error = %v", err)
+		}
+	}
+
+	var output bytes.Buffer
+	rdsClient := &fakeLogFiles{}
+	deps := HandlerDeps{RDS: rdsClient, DynamoDB: &fakeRecordStore{}, Metrics: &output, RDSLimiter: limiter}
+	response, err := NewHandler(deps)(context.Background(), sqsEvent("db-1", "db-2", "db-3"))
+	if err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+	if len(response.BatchItemFailures) != 0 {
+		t.Fatalf("BatchItemFailures = %v, want none", response.BatchItemFailures)
+	}
+	if len(rdsClient.fileLastWritten) != 3 {
+		t.Fatalf("DescribeDBLogFiles called %d times, want 3", len(rdsClient.fileLastWritten))
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("record %q is not JSON: %v", line, err)
+		}
+		if record["RDSRateLimitWaits"] != 1.0 {
+			t.Errorf("RDSRateLimitWaits of %v = %v, want 1", record["DBInstanceIdentifier"], record["RDSRateLimitWaits"])
+		}
+		if delay, _ := record["RDSRateLimitDelaySeconds"].(float64); delay <= 0 {
+			t.Errorf("RDSRateLimitDelaySeconds of %v = %v, want a delay", record["DBInstanceIdentifier"], record["RDSRateLimitDelaySeconds"])
+		}
+	}
+}
+
+func TestLoadDetectorConfigRejectsInvalidRDSRate(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("RDS_API_RPS", "-1")
+
+	if _, err := loadDetectorConfig(); err == nil {
+		t.Error("loadDetectorConfig() error = nil, want one for a negative RDS_API_RPS")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/retry"
+)
+
+// retryingRecordStore retries the DynamoDB calls of the wrapped client that were throttled
+// or failed with a server error, and counts the retries in metrics
+type retryingRecordStore struct {
+	client  RecordStoreAPI
+	metrics *detectorMetrics
+}
+
+// withRetries wraps the client so its throttled calls are retried with backoff
+func withRetries(client RecordStoreAPI, metrics *detectorMetrics) RecordStoreAPI {
+	return &retryingRecordStore{client: client, metrics: metrics}
+}
+
+// do calls fn with retries and adds the retries made to the metrics
+func (s *retryingRecordStore) do(ctx context.Context, fn func() error) error {
+	retries, err := retry.Do(ctx, retry.DefaultPolicy, fn)
+	s.metrics.Retries += retries
+	return err
+}
+
+func (s *retryingRecordStore) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (out *dynamodb.GetItemOutput, err error) {
+	err = s.do(ctx, func() error {
+		out, err = s.client.GetItem(ctx, params, optFns...)
+		return err
+	})
+	return out, err
+}
+
+func (s *retryingRecordStore) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (out *dynamodb.UpdateItemOutput, err error) {
+	err = s.do(ctx, func() error {
+		out, err = s.client.UpdateItem(ctx, params, optFns...)
+		return err
+	})
+	return out, err
+}
+
+func (s *retryingRecordStore) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (out *dynamodb.QueryOutput, err error) {
+	err = s.do(ctx, func() error {
+		out, err = s.client.Query(ctx, params, optFns...)
+		return err
+	})
+	return out, err
+}
+
+func (s *retryingRecordStore) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (out *dynamodb.DeleteItemOutput, err error) {
+	err = s.do(ctx, func() error {
+		out, err = s.client.DeleteItem(ctx, params, optFns...)
+		return err
+	})
+	return out, err
+}
+
+func (s *retryingRecordStore) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (out *dynamodb.PutItemOutput, err error) {
+	err = s.do(ctx, func() error {
+		out, err = s.client.PutItem(ctx, params, optFns...)
+		return err
+	})
+	return out, err
+}
+
+func (s *retryingRecordStore) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (out *dynamodb.TransactWriteItemsOutput, err error) {
+	err = s.do(ctx, func() error {
+		out, err = s.client.TransactWriteItems(ctx, params, optFns...)
+		return err
+	})
+	return out, err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// throttledRecordStore fails the first throttles calls with a ProvisionedThroughputExceededException
+type throttledRecordStore struct {
+	*fakeRecordStore
+	throttles int
+	calls     int
+}
+
+func (f *throttledRecordStore) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	f.calls++
+	if f.calls <= f.throttles {
+		return nil, &types.ProvisionedThroughputExceededException{}
+	}
+	return f.fakeRecordStore.GetItem(ctx, params, optFns...)
+}
+
+func TestRetryingRecordStore(t *testing.T) {
+	throttled := &throttledRecordStore{fakeRecordStore: &fakeRecordStore{}, throttles: 2}
+	var metrics detectorMetrics
+
+	mark, err := getWatermark(context.Background(), withRetries(throttled, &metrics), "table", "db-1", discardLogger)
+	if err != nil || mark != nil {
+		t.Fatalf("getWatermark() = %v, %v, want no watermark and no error", mark, err)
+	}
+	if throttled.calls != 3 {
+		t.Errorf("GetItem called %d times, want 3", throttled.calls)
+	}
+	if metrics.Retries != 2 {
+		t.Errorf("Retries = %d, want 2", metrics.Retries)
+	}
+}
+
+func TestRetryingRecordStoreTerminalError(t *testing.T) {
+	store := &fakeRecordStore{}
+	var metrics detectorMetrics
+
+	// Conditional check failures are returned at once
+	err := createLogFileRecord(context.Background(), withRetries(&conditionalStore{store}, &metrics), "table", LogFileRecord{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log"}, discardLogger)
+	var conditionalCheckFailed *types.ConditionalCheckFailedException
+	if !errors.As(err, &conditionalCheckFailed) {
+		t.Fatalf("createLogFileRecord() error = %v, want a ConditionalCheckFailedException", err)
+	}
+	if metrics.Retries != 0 {
+		t.Errorf("Retries = %d, want 0", metrics.Retries)
+	}
+}
+
+// conditionalStore fails every PutItem condition
+type conditionalStore struct {
+	*fakeRecordStore
+}
+
+func (f *conditionalStore) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	return nil, &types.ConditionalCheckFailedException{}
+}
+
+func TestNewHandlerDepsDynamoDBRetryer(t *testing.T) {
+	t.Setenv("DYNAMODB_MAX_ATTEMPTS", "4")
+
+	deps := NewHandlerDeps(aws.Config{Region: "us-east-1"})
+	client, ok := deps.DynamoDB.(*dynamodb.Client)
+	if !ok {
+		t.Fatalf("DynamoDB = %T, want *dynamodb.Client", deps.DynamoDB)
+	}
+	if got := client.Options().Retryer.MaxAttempts(); got != 4 {
+		t.Errorf("retryer MaxAttempts() = %d, want DYNAMODB_MAX_ATTEMPTS", got)
+	}
+}
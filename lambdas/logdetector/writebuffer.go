@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// transactWriteLimit is the number of records created per TransactWriteItems call.
+// DynamoDB accepts up to 100 items; smaller transactions limit the work redone when one is cancelled.
+const transactWriteLimit = 25
+
+// transactWriteAttempts is how many times a cancelled transaction is retried before falling back to PutItem
+const transactWriteAttempts = 5
+
+// transactWriteBaseDelay is the initial backoff between TransactWriteItems retries; it doubles on every attempt
+const transactWriteBaseDelay = 50 * time.Millisecond
+
+// RecordCreateAPI is the subset of the DynamoDB client used to create log file records
+type RecordCreateAPI interface {
+	TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error)
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+}
+
+// recordWriteBuffer accumulates new log file records and creates them with TransactWriteItems
+type recordWriteBuffer struct {
+	client    RecordCreateAPI
+	tableName string
+	metrics   *detectorMetrics
+	logger    *log.Logger
+	pending   []LogFileRecord
+}
+
+// newRecordWriteBuffer creates an empty write buffer for the table
+func newRecordWriteBuffer(client RecordCreateAPI, tableName string, metrics *detectorMetrics, logger *log.Logger) *recordWriteBuffer {
+	return &recordWriteBuffer{
+		client:    client,
+		tableName: tableName,
+		metrics:   metrics,
+		logger:    logger,
+	}
+}
+
+// add queues a record and flushes the buffer once it holds a full batch
+func (b *recordWriteBuffer) add(ctx context.Context, record LogFileRecord) error {
+	b.pending = append(b.pending, record)
+	if len(b.pending) < transactWriteLimit {
+		return nil
+	}
+	return b.flush(ctx)
+}
+
+// flush writes all queued records
+func (b *recordWriteBuffer) flush(ctx context.Context) error {
+	if len(b.pending) == 0 {
+		return nil
+	}
+
+	records := b.pending
+	b.pending = nil
+
+	return batchCreateLogFileRecords(ctx, b.client, b.tableName, records, b.metrics, b.logger)
+}
+
+// batchCreateLogFileRecords creates up to transactWriteLimit log file records with a single TransactWriteItems call.
+// Like createLogFileRecord, every put is conditional on the record not existing yet. A record created
+// concurrently by another invocation cancels the transaction; it is dropped and the rest are retried.
+// Transactions cancelled for other reasons are retried with exponential backoff, after which the
+// remaining records are written one by one.
+func batchCreateLogFileRecords(ctx context.Context, client RecordCreateAPI, tableName string, records []LogFileRecord, metrics *detectorMetrics, logger *log.Logger) error {
+	logger.Printf("Creating %d new records in a transaction\n", len(records))
+
+	delay := transactWriteBaseDelay
+	for attempt := 1; attempt <= transactWriteAttempts && len(records) > 0; attempt++ {
+		// Build a conditional put for each record
+		transactItems := make([]types.TransactWriteItem, 0, len(records))
+		for _, record := range records {
+			item, err := attributevalue.MarshalMap(record)
+			if err != nil {
+				return err
+			}
+			transactItems = append(transactItems, types.TransactWriteItem{
+				Put: &types.Put{
+					TableName:           aws.String(tableName),
+					Item:                item,
+					ConditionExpression: aws.String("attribute_not_exists(DBInstanceIdentifier)"),
+				},
+			})
+		}
+
+		_, err := client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: transactItems,
+		})
+		if err == nil {
+			for _, record := range records {
+				metrics.recordCreated(record)
+			}
+			return nil
+		}
+
+		var canceled *types.TransactionCanceledException
+		if !errors.As(err, &canceled) {
+			return err
+		}
+
+		// Drop the records that already exist and retry the others
+		retry := records
+		backoff := true
+		if len(canceled.CancellationReasons) == len(records) {
+			retry = nil
+			backoff = false
+			for i, reason := range canceled.CancellationReasons {
+				switch aws.ToString(reason.Code) {
+				case "ConditionalCheckFailed":
+					logger.Printf("Record for log file %s was created by another invocation, skipping\n", records[i].LogFileName)
+					metrics.ConditionalCheckFailures++
+					continue
+				case "None":
+				default:
+					backoff = true
+				}
+				retry = append(retry, records[i])
+			}
+		}
+		records = retry
+
+		logger.Printf("Transaction attempt %d cancelled, %d records left to create\n", attempt, len(records))
+		if !backoff || attempt == transactWriteAttempts {
+			continue
+		}
+
+		// Back off before retrying after a conflict or throttling
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+
+	// Fall back to individual writes for the records that couldn't be created in a transaction
+	for _, record := range records {
+		err := createLogFileRecord(ctx, client, tableName, record, logger)
+		if isConditionalCheckFailed(err) {
+			logger.Printf("Record for log file %s was created by another invocation, skipping\n", record.LogFileName)
+			metrics.ConditionalCheckFailures++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		metrics.recordCreated(record)
+	}
+
+	return nil
+}
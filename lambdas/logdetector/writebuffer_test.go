@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var discardLogger = log.New(io.Discard, "", 0)
+
+// fakeRecordWriter counts the DynamoDB write calls and records the written log file names and their tables.
+// A transaction is cancelled when it puts an existing record, or with a TransactionConflict
+// for its last conflicts items during the first conflictCalls calls.
+type fakeRecordWriter struct {
+	conflicts              int
+	conflictCalls          int
+	existing               map[string]bool // Log files that already exist, failing their put condition
+	transactWriteItemCalls int
+	putItemCalls           int
+	written                []string
+	writtenTables          []string
+	writtenRegions         []string // Region attribute of every written record, empty when it has none
+	writtenClusters        []string // ClusterIdentifier attribute of every written record, empty when it has none
+}
+
+// itemString returns a string attribute of an item, or "" when it has none
+func itemString(item map[string]types.AttributeValue, name string) string {
+	if value, ok := item[name].(*types.AttributeValueMemberS); ok {
+		return value.Value
+	}
+	return ""
+}
+
+func (f *fakeRecordWriter) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	f.transactWriteItemCalls++
+
+	var names, tables, regions, clusters []string
+	canceled := false
+	reasons := make([]types.CancellationReason, len(params.TransactItems))
+	for i, transactItem := range params.TransactItems {
+		name := transactItem.Put.Item["LogFileName"].(*types.AttributeValueMemberS).Value
+		names = append(names, name)
+		tables = append(tables, aws.ToString(transactItem.Put.TableName))
+		regions = append(regions, itemString(transactItem.Put.Item, "Region"))
+		clusters = append(clusters, itemString(transactItem.Put.Item, "ClusterIdentifier"))
+		reasons[i].Code = aws.String("None")
+		if f.existing[name] {
+			reasons[i].Code = aws.String("ConditionalCheckFailed")
+			canceled = true
+		} else if f.transactWriteItemCalls <= f.conflictCalls && i >= len(params.TransactItems)-f.conflicts {
+			reasons[i].Code = aws.String("TransactionConflict")
+			canceled = true
+		}
+	}
+	if canceled {
+		return nil, &types.TransactionCanceledException{CancellationReasons: reasons}
+	}
+
+	f.written = append(f.written, names...)
+	f.writtenTables = append(f.writtenTables, tables...)
+	f.writtenRegions = append(f.writtenRegions, regions...)
+	f.writtenClusters = append(f.writtenClusters, clusters...)
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+func (f *fakeRecordWriter) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	f.putItemCalls++
+	name := params.Item["LogFileName"].(*types.AttributeValueMemberS).Value
+	if f.existing[name] {
+		return nil, &types.ConditionalCheckFailedException{}
+	}
+	f.written = append(f.written, name)
+	f.writtenTables = append(f.writtenTables, aws.ToString(params.TableName))
+	f.writtenRegions = append(f.writtenRegions, itemString(params.Item, "Region"))
+	f.writtenClusters = append(f.writtenClusters, itemString(params.Item, "ClusterIdentifier"))
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func newLogFileRecords(n int) []LogFileRecord {
+	records := make([]LogFileRecord, n)
+	for i := range records {
+		records[i] = LogFileRecord{
+			DBInstanceIdentifier: "db-1",
+			LogFileName:          fmt.Sprintf("audit/audit.log.%d", i),
+			Size:                 int64(i),
+			LastWritten:          int64(i),
+		}
+	}
+	return records
+}
+
+func TestRecordWriteBuffer(t *testing.T) {
+	tests := []struct {
+		name                   string
+		records                int
+		client                 *fakeRecordWriter
+		wantTransactWriteCalls int
+		wantPutItemCalls       int
+		wantWritten            int
+		wantSkipped            int
+	}{
+		{name: "single record", records: 1, client: &fakeRecordWriter{}, wantTransactWriteCalls: 1, wantWritten: 1},
+		{name: "one full batch", records: 25, client: &fakeRecordWriter{}, wantTransactWriteCalls: 1, wantWritten: 25},
+		{name: "one record over a batch", records: 26, client: &fakeRecordWriter{}, wantTransactWriteCalls: 2, wantWritten: 26},
+		{name: "freshly onboarded cluster", records: 300, client: &fakeRecordWriter{}, wantTransactWriteCalls: 12, wantWritten: 300},
+		{
+			name:                   "existing records are skipped",
+			records:                10,
+			client:                 &fakeRecordWriter{existing: map[string]bool{"audit/audit.log.3": true}},
+			wantTransactWriteCalls: 2,
+			wantWritten:            9,
+			wantSkipped:            1,
+		},
+		{
+			name:                   "conflicting transactions are retried",
+			records:                10,
+			client:                 &fakeRecordWriter{conflicts: 3, conflictCalls: 1},
+			wantTransactWriteCalls: 2,
+			wantWritten:            10,
+		},
+		{
+			name:                   "falls back to single writes",
+			records:                10,
+			client:                 &fakeRecordWriter{conflicts: 2, conflictCalls: transactWriteAttempts, existing: map[string]bool{"audit/audit.log.0": true}},
+			wantTransactWriteCalls: transactWriteAttempts,
+			wantPutItemCalls:       9,
+			wantWritten:            9,
+			wantSkipped:            1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var metrics detectorMetrics
+			buffer := newRecordWriteBuffer(tt.client, "table", &metrics, discardLogger)
+
+			for _, record := range newLogFileRecords(tt.records) {
+				if err := buffer.add(context.Background(), record); err != nil {
+					t.Fatalf("add() error = %v", err)
+				}
+			}
+			if err := buffer.flush(context.Background()); err != nil {
+				t.Fatalf("flush() error = %v", err)
+			}
+
+			if tt.client.transactWriteItemCalls != tt.wantTransactWriteCalls {
+				t.Errorf("TransactWriteItems calls = %d, want %d", tt.client.transactWriteItemCalls, tt.wantTransactWriteCalls)
+			}
+			if tt.client.putItemCalls != tt.wantPutItemCalls {
+				t.Errorf("PutItem calls = %d, want %d", tt.client.putItemCalls, tt.wantPutItemCalls)
+			}
+			if len(tt.client.written) != tt.wantWritten {
+				t.Errorf("written records = %d, want %d", len(tt.client.written), tt.wantWritten)
+			}
+			if metrics.ConditionalCheckFailures != tt.wantSkipped {
+				t.Errorf("ConditionalCheckFailures = %d, want %d", metrics.ConditionalCheckFailures, tt.wantSkipped)
+			}
+		})
+	}
+}
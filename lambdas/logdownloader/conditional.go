@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"maps"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/checksum"
+)
+
+// contentChecksum is the checksum of the downloaded content of an upload
+type contentChecksum struct {
+	Algorithm string // checksum.MD5 or checksum.SHA256
+	Value     string // Hex
+}
+
+// metadataKey returns the object metadata holding the checksum, content-md5 or content-sha256, so an object
+// already at a key can be compared without downloading it
+func (c contentChecksum) metadataKey() string {
+	return checksum.MetadataKey(c.Algorithm)
+}
+
+// ifAbsent makes a PutObject or CompleteMultipartUpload call conditional on no object existing at its key.
+// S3 fails the call with 412 Precondition Failed otherwise.
+func ifAbsent(o *s3.Options) {
+	o.APIOptions = append(o.APIOptions, smithyhttp.AddHeaderValue("If-None-Match", "*"))
+}
+
+// objectExists reports whether a conditional write failed because an object exists at its key
+func objectExists(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed"
+}
+
+// withChecksum returns a copy of metadata with the content checksum added
+func withChecksum(metadata map[string]string, sum contentChecksum) map[string]string {
+	metadata = maps.Clone(metadata)
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	metadata[sum.metadataKey()] = sum.Value
+	return metadata
+}
+
+// holdsContent reports whether the object at key was uploaded with the given content checksum and has the
+// given size, which differs for the same content uploaded in other gzip members. Objects without the checksum,
+// such as those uploaded before it was recorded, count as holding other content.
+func holdsContent(ctx context.Context, client S3Putter, bucketName, key string, sum contentChecksum, size int64, logger *log.Logger) (bool, error) {
+	resp, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return false, err
+	}
+	if sum.Value == "" || resp.Metadata[sum.metadataKey()] != sum.Value || aws.ToInt64(resp.ContentLength) != size {
+		logger.Printf("s3://%s/%s holds other content, overwriting it\n", bucketName, key)
+		return false, nil
+	}
+	logger.Printf("s3://%s/%s already holds this content (checksum %s), not overwriting it\n", bucketName, key, sum.Value)
+	return true, nil
+}
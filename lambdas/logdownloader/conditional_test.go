@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/checksum"
+)
+
+// conditionalS3 fails writes made with ifAbsent when the key exists, and keeps the metadata of PutObject
+// and CopyObject
+type conditionalS3 struct {
+	*fakeS3
+	metadata map[string]map[string]string
+	writes   int
+}
+
+// conditional reports whether ifAbsent is among the options of a call
+func conditional(optFns []func(*s3.Options)) bool {
+	var o s3.Options
+	for _, fn := range optFns {
+		fn(&o)
+	}
+	return len(o.APIOptions) > 0
+}
+
+func (f *conditionalS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if _, ok := f.objects[aws.ToString(params.Key)]; ok && conditional(optFns) {
+		return nil, &smithy.GenericAPIError{Code: "PreconditionFailed"}
+	}
+	f.writes++
+	f.metadata[aws.ToString(params.Key)] = params.Metadata
+	return f.fakeS3.PutObject(ctx, params, optFns...)
+}
+
+func (f *conditionalS3) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	if _, ok := f.objects[aws.ToString(params.Key)]; ok && conditional(optFns) {
+		return nil, &smithy.GenericAPIError{Code: "PreconditionFailed"}
+	}
+	f.writes++
+	delete(f.metadata, aws.ToString(params.Key))
+	return f.fakeS3.CompleteMultipartUpload(ctx, params, optFns...)
+}
+
+func (f *conditionalS3) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	f.metadata[aws.ToString(params.Key)] = params.Metadata
+	return f.fakeS3.CopyObject(ctx, params, optFns...)
+}
+
+func (f *conditionalS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	resp, err := f.fakeS3.HeadObject(ctx, params, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	resp.Metadata = f.metadata[aws.ToString(params.Key)]
+	return resp, nil
+}
+
+func TestUploadToS3IfAbsent(t *testing.T) {
+	content := []byte("line 1\n")
+	metadata := map[string]string{"last-written-epoch": "1700000000000"}
+	sum := contentChecksum{Algorithm: checksum.SHA256, Value: "abc"}
+
+	tests := []struct {
+		name      string
+		existing  []byte
+		metadata  map[string]string
+		overwrite bool
+		wantWrite bool
+	}{
+		{name: "absent", wantWrite: true},
+		{name: "same content", existing: content, metadata: map[string]string{"content-sha256": "abc"}},
+		{name: "other content", existing: []byte("line 2\n"), metadata: map[string]string{"content-sha256": "def"}, wantWrite: true},
+		{name: "same checksum in other gzip members", existing: []byte("line 1\n\n"), metadata: map[string]string{"content-sha256": "abc"}, wantWrite: true},
+		{name: "checksum of another algorithm", existing: content, metadata: map[string]string{"content-md5": "abc"}, wantWrite: true},
+		{name: "no checksum", existing: content, wantWrite: true},
+		{name: "overwrite", existing: content, metadata: map[string]string{"content-sha256": "abc"}, overwrite: true, wantWrite: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &conditionalS3{fakeS3: newFakeS3(), metadata: map[string]map[string]string{}}
+			if tt.existing != nil {
+				client.objects["key"] = tt.existing
+				client.metadata["key"] = tt.metadata
+			}
+
+			err := uploadToS3(context.Background(), client, "bucket", "key", "text/plain", "", content, metadata, sum, objectEncryption{}, tt.overwrite, discardLogger)
+			if err != nil {
+				t.Fatalf("uploadToS3() error = %v", err)
+			}
+			if got := client.writes > 0; got != tt.wantWrite {
+				t.Errorf("wrote the object = %v, want %v", got, tt.wantWrite)
+			}
+			if tt.wantWrite && (string(client.objects["key"]) != string(content) || client.metadata["key"]["content-sha256"] != "abc") {
+				t.Errorf("object = %q with metadata %v, want the content with its checksum", client.objects["key"], client.metadata["key"])
+			}
+		})
+	}
+}
+
+func TestMultipartCompleteIfAbsent(t *testing.T) {
+	content := []byte("line 1\n")
+
+	tests := []struct {
+		name          string
+		metadata      map[string]string
+		wantCompleted bool
+	}{
+		{name: "same content", metadata: map[string]string{"content-md5": "abc"}},
+		{name: "other content", metadata: map[string]string{"content-md5": "def"}, wantCompleted: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &conditionalS3{fakeS3: newFakeS3(), metadata: map[string]map[string]string{"key": tt.metadata}}
+			client.objects["key"] = content
+
+			upload, err := createMultipartUpload(context.Background(), client, "bucket", "key", "text/plain", "", nil, objectEncryption{}, discardLogger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := upload.uploadPart(context.Background(), content, discardLogger); err != nil {
+				t.Fatal(err)
+			}
+			completed, err := upload.complete(context.Background(), false, contentChecksum{Value: "abc"}, int64(len(content)), discardLogger)
+			if err != nil {
+				t.Fatalf("complete() error = %v", err)
+			}
+			if completed != tt.wantCompleted || (client.writes > 0) != tt.wantCompleted {
+				t.Errorf("complete() = %v after %d writes, want %v", completed, client.writes, tt.wantCompleted)
+			}
+			if len(client.uploads) != 0 {
+				t.Errorf("%d uploads left in progress, want the upload completed or aborted", len(client.uploads))
+			}
+		})
+	}
+}
+
+func TestDownloadLogFileKeepsIdenticalObject(t *testing.T) {
+	record := LogFileRecord{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log", LastWritten: 1700000000000}
+	opts := downloadOptions{PortionLines: defaultPortionLines}
+	client := &conditionalS3{fakeS3: newFakeS3(), metadata: map[string]map[string]string{}}
+
+	// The second download is of a record whose backup was never recorded, so its checksum isn't known
+	for range 2 {
+		rdsClient := &fakeLogFile{portions: portionChain("line 1\n", "line 2\n")}
+		result, err := downloadLogFile(context.Background(), rdsClient, client, &fakeRecords{}, "table", "bucket", "key", "text/plain", objectMetadata(record), opts, record, discardLogger)
+		if err != nil {
+			t.Fatalf("downloadLogFile() error = %v", err)
+		}
+		if result.Skipped {
+			t.Error("downloadLogFile() skipped the upload, want it attempted")
+		}
+	}
+	if client.writes != 1 {
+		t.Errorf("wrote the object %d times, want once", client.writes)
+	}
+}
+
+func TestDownloadLogFileKeepsIdenticalMultipartObject(t *testing.T) {
+	record := LogFileRecord{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log", LastWritten: 1700000000000}
+	opts := downloadOptions{PortionLines: defaultPortionLines, PartSize: 64 * 1024}
+	portions := randomPortions(4, 100*1024)
+	client := &conditionalS3{fakeS3: newFakeS3(), metadata: map[string]map[string]string{}}
+
+	// The first upload is a multipart upload that was never resumed, whose checksum is added once it completes
+	for range 2 {
+		rdsClient := &fakeLogFile{portions: portionChain(portions...)}
+		_, err := downloadLogFile(context.Background(), rdsClient, client, &fakeRecords{}, "table", "bucket", "key", "text/plain", objectMetadata(record), opts, record, discardLogger)
+		if err != nil {
+			t.Fatalf("downloadLogFile() error = %v", err)
+		}
+		if client.metadata["key"]["content-md5"] == "" {
+			t.Fatalf("metadata = %v, want the content checksum", client.metadata["key"])
+		}
+	}
+	if client.writes != 1 {
+		t.Errorf("wrote the object %d times, want once", client.writes)
+	}
+	if len(client.uploads) != 0 {
+		t.Errorf("%d uploads left in progress, want the second one aborted", len(client.uploads))
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/emf"
+)
+
+// maxCopySize is the largest object a single CopyObject call copies
+const maxCopySize = 5 * 1024 * 1024 * 1024
+
+// ObjectCopier is the subset of the S3 client of DR_REGION used to copy backups to DR_BUCKET_NAME
+type ObjectCopier interface {
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+}
+
+// copyToDR copies an uploaded object, the given version of it in a versioned bucket, to the same key of the
+// DR bucket. The client is of the DR bucket's region, which S3 copies to from the source bucket's region.
+// The copy keeps the object's metadata and is encrypted with the DR bucket's default encryption, since
+// KMS keys don't leave their region.
+func copyToDR(ctx context.Context, client ObjectCopier, bucketName, drBucketName, key, versionID string, size int64, logger *log.Logger) error {
+	if size > maxCopySize {
+		return fmt.Errorf("s3://%s/%s is %d bytes, larger than CopyObject copies", bucketName, key, size)
+	}
+	logger.Printf("Copying s3://%s/%s to DR bucket %s\n", bucketName, key, drBucketName)
+
+	// The copy source is URL-encoded, one path segment at a time
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	source := bucketName + "/" + strings.Join(segments, "/")
+	if versionID != "" {
+		source += "?versionId=" + url.QueryEscape(versionID)
+	}
+
+	_, err := client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(drBucketName),
+		Key:        aws.String(key),
+		CopySource: aws.String(source),
+	})
+	return err
+}
+
+// emitDRFailure publishes a backup that wasn't copied to the DR bucket in CloudWatch embedded metric format,
+// so it can be alarmed on
+func (deps HandlerDeps) emitDRFailure(logger *log.Logger) {
+	w := deps.Metrics
+	if w == nil {
+		w = os.Stdout
+	}
+	dimensions := map[string]string{"FunctionName": os.Getenv("AWS_LAMBDA_FUNCTION_NAME")}
+	metrics := []emf.Metric{{Name: "DRCopyFailures", Value: 1, Unit: emf.Count}}
+	if err := emf.New(w, emf.Namespace).Emit(dimensions, metrics); err != nil {
+		logger.Printf("Error emitting metrics: %v\n", err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// fakeCopier records the CopyObject calls made to the DR bucket and fails them with err when set
+type fakeCopier struct {
+	copies []*s3.CopyObjectInput
+	err    error
+}
+
+func (f *fakeCopier) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	f.copies = append(f.copies, params)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func TestCopyToDR(t *testing.T) {
+	tests := []struct {
+		name       string
+		key        string
+		versionID  string
+		size       int64
+		wantSource string
+		wantErr    bool
+	}{
+		{name: "object", key: "logs/db-1/audit/server_audit.log", size: 7, wantSource: "bucket/logs/db-1/audit/server_audit.log"},
+		{name: "version", key: "logs/db-1/audit/server_audit.log", versionID: "a+b", size: 7, wantSource: "bucket/logs/db-1/audit/server_audit.log?versionId=a%2Bb"},
+		{name: "escaped key", key: "logs/db 1/audit/server_audit.log", size: 7, wantSource: "bucket/logs/db%201/audit/server_audit.log"},
+		{name: "too large", key: "logs/db-1/audit/server_audit.log", size: maxCopySize + 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeCopier{}
+			err := copyToDR(context.Background(), client, "bucket", "dr-bucket", tt.key, tt.versionID, tt.size, discardLogger)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("copyToDR() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if len(client.copies) != 0 {
+					t.Errorf("copied %d objects, want none", len(client.copies))
+				}
+				return
+			}
+			if len(client.copies) != 1 {
+				t.Fatalf("copied %d objects, want 1", len(client.copies))
+			}
+			input := client.copies[0]
+			if aws.ToString(input.Bucket) != "dr-bucket" || aws.ToString(input.Key) != tt.key || aws.ToString(input.CopySource) != tt.wantSource {
+				t.Errorf("copied %s to s3://%s/%s, want %s to s3://dr-bucket/%s", aws.ToString(input.CopySource), aws.ToString(input.Bucket), aws.ToString(input.Key), tt.wantSource, tt.key)
+			}
+		})
+	}
+}
+
+func TestHandleCopiesToDR(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+	t.Setenv("DR_BUCKET_NAME", "dr-bucket")
+	const key = "logs/db-1/2023/11/14/audit/server_audit.log.1700000000000"
+
+	tests := []struct {
+		name         string
+		required     string
+		copyErr      error
+		wantFailed   bool
+		wantRecorded bool
+	}{
+		{name: "copied", wantRecorded: true},
+		{name: "copy fails", copyErr: errors.New("access denied"), wantRecorded: true},
+		{name: "required copy fails", required: "true", copyErr: errors.New("access denied"), wantFailed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DR_REQUIRED", tt.required)
+
+			var metrics bytes.Buffer
+			dynamoClient := &fakeRecords{}
+			drClient := &fakeCopier{err: tt.copyErr}
+			deps := HandlerDeps{RDS: &fakeLogFile{portions: portionChain("line 1\n")}, S3: newFakeS3(), DynamoDB: dynamoClient, Metrics: &metrics, DRS3: drClient}
+			event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{insertRecord("audit/server_audit.log", "")}}
+			response, err := NewHandler(deps)(context.Background(), event)
+			if err != nil {
+				t.Fatalf("handler error = %v", err)
+			}
+
+			if len(drClient.copies) != 1 || aws.ToString(drClient.copies[0].Key) != key {
+				t.Fatalf("copied %d objects to the DR bucket, want %s", len(drClient.copies), key)
+			}
+			if got := len(response.BatchItemFailures) == 1; got != tt.wantFailed {
+				t.Errorf("batch item failures = %v, want failed %v", response.BatchItemFailures, tt.wantFailed)
+			}
+			if got := strings.Contains(metrics.String(), "DRCopyFailures"); got != (tt.copyErr != nil) {
+				t.Errorf("metrics = %q, want DRCopyFailures %v", metrics.String(), tt.copyErr != nil)
+			}
+			recorded := false
+			for _, update := range dynamoClient.updates {
+				if _, ok := update.ExpressionAttributeValues[":lastBackup"].(*types.AttributeValueMemberN); ok {
+					recorded = true
+				}
+			}
+			if recorded != tt.wantRecorded {
+				t.Errorf("recorded the backup = %v, want %v", recorded, tt.wantRecorded)
+			}
+		})
+	}
+}
+
+func TestHandleRequiresDRRegion(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+	t.Setenv("DR_BUCKET_NAME", "dr-bucket")
+
+	rdsClient := &fakeLogFile{portions: portionChain("line 1\n")}
+	deps := HandlerDeps{RDS: rdsClient, S3: newFakeS3(), DynamoDB: &fakeRecords{}}
+	event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{insertRecord("audit/server_audit.log", "")}}
+	if _, err := NewHandler(deps)(context.Background(), event); err == nil || !strings.Contains(err.Error(), "DR_REGION") {
+		t.Fatalf("handler error = %v, want one naming DR_REGION", err)
+	}
+	if len(rdsClient.markers) != 0 {
+		t.Errorf("downloaded markers %q, want nothing downloaded without a DR client", rdsClient.markers)
+	}
+}
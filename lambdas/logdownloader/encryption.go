@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// objectEncryption is the server-side encryption requested for the uploaded objects.
+// The zero value requests none, which leaves the objects to the bucket's default encryption.
+type objectEncryption struct {
+	SSE      s3types.ServerSideEncryption // aws:kms or AES256
+	KMSKeyID string                       // Key ARN of aws:kms; empty uses the AWS managed key
+}
+
+// parseObjectEncryption parses the S3_SSE and KMS_KEY_ARN settings. A KMS key without S3_SSE implies aws:kms.
+func parseObjectEncryption(sse, kmsKeyARN string) (objectEncryption, error) {
+	if sse == "" && kmsKeyARN != "" {
+		sse = string(s3types.ServerSideEncryptionAwsKms)
+	}
+
+	switch s3types.ServerSideEncryption(sse) {
+	case "":
+		return objectEncryption{}, nil
+	case s3types.ServerSideEncryptionAes256:
+		if kmsKeyARN != "" {
+			return objectEncryption{}, fmt.Errorf("a KMS key needs %s, not %s", s3types.ServerSideEncryptionAwsKms, sse)
+		}
+		return objectEncryption{SSE: s3types.ServerSideEncryptionAes256}, nil
+	case s3types.ServerSideEncryptionAwsKms:
+		return objectEncryption{SSE: s3types.ServerSideEncryptionAwsKms, KMSKeyID: kmsKeyARN}, nil
+	default:
+		return objectEncryption{}, fmt.Errorf("unsupported server-side encryption %q", sse)
+	}
+}
+
+// kmsKeyID returns the SSEKMSKeyId of the upload requests, nil to leave it unset
+func (e objectEncryption) kmsKeyID() *string {
+	if e.KMSKeyID == "" {
+		return nil
+	}
+	return aws.String(e.KMSKeyID)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const testKMSKeyARN = "arn:aws:kms:ap-southeast-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+
+// encryptingS3 records the encryption every object was written with, by key
+type encryptingS3 struct {
+	*fakeS3
+	encryption map[string]objectEncryption
+}
+
+func newEncryptingS3() *encryptingS3 {
+	return &encryptingS3{fakeS3: newFakeS3(), encryption: make(map[string]objectEncryption)}
+}
+
+func (f *encryptingS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	f.encryption[aws.ToString(params.Key)] = objectEncryption{SSE: params.ServerSideEncryption, KMSKeyID: aws.ToString(params.SSEKMSKeyId)}
+	return f.fakeS3.PutObject(ctx, params, optFns...)
+}
+
+func (f *encryptingS3) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	f.encryption[aws.ToString(params.Key)] = objectEncryption{SSE: params.ServerSideEncryption, KMSKeyID: aws.ToString(params.SSEKMSKeyId)}
+	return f.fakeS3.CreateMultipartUpload(ctx, params, optFns...)
+}
+
+func (f *encryptingS3) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	f.encryption["copy:"+aws.ToString(params.Key)] = objectEncryption{SSE: params.ServerSideEncryption, KMSKeyID: aws.ToString(params.SSEKMSKeyId)}
+	return f.fakeS3.CopyObject(ctx, params, optFns...)
+}
+
+func TestParseObjectEncryption(t *testing.T) {
+	tests := []struct {
+		sse       string
+		kmsKeyARN string
+		want      objectEncryption
+		wantErr   bool
+	}{
+		{},
+		{sse: "AES256", want: objectEncryption{SSE: s3types.ServerSideEncryptionAes256}},
+		{sse: "aws:kms", want: objectEncryption{SSE: s3types.ServerSideEncryptionAwsKms}},
+		{sse: "aws:kms", kmsKeyARN: testKMSKeyARN, want: objectEncryption{SSE: s3types.ServerSideEncryptionAwsKms, KMSKeyID: testKMSKeyARN}},
+		{kmsKeyARN: testKMSKeyARN, want: objectEncryption{SSE: s3types.ServerSideEncryptionAwsKms, KMSKeyID: testKMSKeyARN}},
+		{sse: "AES256", kmsKeyARN: testKMSKeyARN, wantErr: true},
+		{sse: "kms", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseObjectEncryption(tt.sse, tt.kmsKeyARN)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseObjectEncryption(%q, %q) error = %v, wantErr %v", tt.sse, tt.kmsKeyARN, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseObjectEncryption(%q, %q) = %+v, want %+v", tt.sse, tt.kmsKeyARN, got, tt.want)
+		}
+	}
+}
+
+func TestHandleEncryptsUploads(t *testing.T) {
+	const key = "logs/db-1/2023/11/14/audit/server_audit.log.1700000000000"
+	kms := objectEncryption{SSE: s3types.ServerSideEncryptionAwsKms, KMSKeyID: testKMSKeyARN}
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		want objectEncryption
+	}{
+		{name: "bucket default"},
+		{name: "KMS key", env: map[string]string{"S3_SSE": "aws:kms", "KMS_KEY_ARN": testKMSKeyARN}, want: kms},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DYNAMODB_TABLE_NAME", "table")
+			t.Setenv("S3_BUCKET_NAME", "bucket")
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			s3Client := newEncryptingS3()
+			deps := HandlerDeps{RDS: &fakeLogFile{portions: portionChain("line 1\n")}, S3: s3Client, DynamoDB: &fakeRecords{}}
+			event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{insertRecord("audit/server_audit.log", "")}}
+			if _, err := NewHandler(deps)(context.Background(), event); err != nil {
+				t.Fatalf("handler error = %v", err)
+			}
+
+			// The manifest is encrypted like the log files
+			want := map[string]objectEncryption{key: tt.want, manifestKey("logs", "db-1"): tt.want}
+			if !reflect.DeepEqual(s3Client.encryption, want) {
+				t.Errorf("encryption = %+v, want %+v", s3Client.encryption, want)
+			}
+		})
+	}
+}
+
+func TestDownloadLogFileEncryptsMultipartUploads(t *testing.T) {
+	kms := objectEncryption{SSE: s3types.ServerSideEncryptionAwsKms, KMSKeyID: testKMSKeyARN}
+	opts := downloadOptions{PortionLines: defaultPortionLines, PartSize: 64 * 1024, Encryption: kms}
+	portions := randomPortions(4, 100*1024)
+	record := LogFileRecord{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log", LastWritten: 1700000000000}
+
+	s3Client := newEncryptingS3()
+	_, err := downloadLogFile(context.Background(), &fakeLogFile{portions: portionChain(portions...)}, s3Client, &fakeRecords{}, "table", "bucket", "key", "text/plain", nil, opts, record, discardLogger)
+	if err != nil {
+		t.Fatalf("downloadLogFile() error = %v", err)
+	}
+	// The copy that adds the content checksum to the metadata is encrypted again
+	if want := map[string]objectEncryption{"key": kms, "copy:key": kms}; !reflect.DeepEqual(s3Client.encryption, want) {
+		t.Errorf("encryption = %+v, want %+v", s3Client.encryption, want)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Kinds of error that fail a stream record. Each failure is logged as "Error [<kind>]: ..." so CloudWatch Logs
+// Insights can group the failures by kind.
+var (
+	// ErrRecordParse is a stream record whose image isn't a log file record
+	ErrRecordParse = errors.New("record parse failed")
+	// ErrDownloadFailed is a log file that couldn't be downloaded from RDS
+	ErrDownloadFailed = errors.New("download failed")
+	// ErrUploadFailed is a download that couldn't be uploaded to S3, or whose upload wasn't verified or copied
+	ErrUploadFailed = errors.New("upload failed")
+	// ErrRecordUpdate is a log file record that couldn't be read or updated in DynamoDB
+	ErrRecordUpdate = errors.New("record update failed")
+)
+
+// errorKinds are the names of the kinds in the logs, the most specific first: an upload failing a download is
+// an ErrUploadFailed
+var errorKinds = []struct {
+	err  error
+	name string
+}{
+	{ErrRecordParse, "RecordParse"},
+	{ErrUploadFailed, "UploadFailed"},
+	{ErrDownloadFailed, "DownloadFailed"},
+	{ErrRecordUpdate, "RecordUpdate"},
+}
+
+// recordError wraps err with its kind and the instance and log file of the record it failed
+func recordError(kind error, record LogFileRecord, err error) error {
+	return fmt.Errorf("%w: log file %s of instance %s: %w", kind, record.LogFileName, record.DBInstanceIdentifier, err)
+}
+
+// parseError wraps the error of a stream record whose image couldn't be parsed, with the record's keys
+func parseError(record events.DynamoDBEventRecord, err error) error {
+	return fmt.Errorf("%w: stream record %s with keys %v: %w", ErrRecordParse, record.Change.SequenceNumber, record.Change.Keys, err)
+}
+
+// uploadError wraps an S3 error of downloadLogFile, which the handler wraps as a failed download
+func uploadError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%w: %w", ErrUploadFailed, err)
+}
+
+// errorKind returns the name of the kind of err, "Unknown" when it has none
+func errorKind(err error) string {
+	for _, kind := range errorKinds {
+		if errors.Is(err, kind.err) {
+			return kind.name
+		}
+	}
+	return "Unknown"
+}
+
+// summarizeErrors counts the errors by kind, e.g. "DownloadFailed=2 UploadFailed=1", or returns "none"
+func summarizeErrors(errs []error) string {
+	if len(errs) == 0 {
+		return "none"
+	}
+	counts := make(map[string]int)
+	for _, err := range errs {
+		counts[errorKind(err)]++
+	}
+	summary := make([]string, 0, len(counts))
+	for kind, count := range counts {
+		summary = append(summary, fmt.Sprintf("%s=%d", kind, count))
+	}
+	slices.Sort(summary)
+	return strings.Join(summary, " ")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// deniedS3 fails the PutObject calls of failKey
+type deniedS3 struct {
+	*fakeS3
+	failKey string
+}
+
+func (f *deniedS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if aws.ToString(params.Key) == f.failKey {
+		return nil, errors.New("access denied")
+	}
+	return f.fakeS3.PutObject(ctx, params, optFns...)
+}
+
+func TestErrorKind(t *testing.T) {
+	record := LogFileRecord{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log"}
+	cause := errors.New("throttled")
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "download", err: recordError(ErrDownloadFailed, record, cause), want: "DownloadFailed"},
+		{name: "upload during a download", err: recordError(ErrDownloadFailed, record, uploadError(cause)), want: "UploadFailed"},
+		{name: "record update", err: recordError(ErrRecordUpdate, record, cause), want: "RecordUpdate"},
+		{name: "parse", err: parseError(events.DynamoDBEventRecord{}, cause), want: "RecordParse"},
+		{name: "no kind", err: cause, want: "Unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorKind(tt.err); got != tt.want {
+				t.Errorf("errorKind() = %s, want %s", got, tt.want)
+			}
+			if !errors.Is(tt.err, cause) {
+				t.Errorf("%v doesn't wrap the underlying error", tt.err)
+			}
+		})
+	}
+
+	if err := recordError(ErrDownloadFailed, record, cause); !strings.Contains(err.Error(), "log file audit/server_audit.log of instance db-1") {
+		t.Errorf("error = %q, want the instance and log file", err)
+	}
+	if uploadError(nil) != nil {
+		t.Error("uploadError(nil) != nil")
+	}
+}
+
+func TestSummarizeErrors(t *testing.T) {
+	record := LogFileRecord{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log"}
+	cause := errors.New("throttled")
+	errs := []error{
+		recordError(ErrUploadFailed, record, cause),
+		recordError(ErrDownloadFailed, record, cause),
+		recordError(ErrDownloadFailed, record, cause),
+	}
+
+	if got, want := summarizeErrors(errs), "DownloadFailed=2 UploadFailed=1"; got != want {
+		t.Errorf("summarizeErrors() = %q, want %q", got, want)
+	}
+	if got := summarizeErrors(nil); got != "none" {
+		t.Errorf("summarizeErrors(nil) = %q, want none", got)
+	}
+}
+
+func TestHandleReportsRecordErrors(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+
+	sequenced := func(logFileName, sequenceNumber string) events.DynamoDBEventRecord {
+		record := insertRecord(logFileName, "")
+		record.Change.SequenceNumber = sequenceNumber
+		return record
+	}
+	malformed := sequenced("audit/server_audit.log.1", "200")
+	malformed.Change.NewImage["Size"] = events.NewStringAttribute("seven")
+	event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{
+		sequenced("audit/server_audit.log", "100"),
+		malformed,
+		sequenced("audit/server_audit.log.2", "300"),
+	}}
+
+	s3Client := &deniedS3{fakeS3: newFakeS3(), failKey: "logs/db-1/2023/11/14/audit/server_audit.log.2.1700000000000"}
+	response, err := NewHandler(HandlerDeps{RDS: &fakeLogFile{portions: portionChain("line 1\n")}, S3: s3Client, DynamoDB: &fakeRecords{}})(context.Background(), event)
+	if err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+
+	// The record that doesn't parse is retried rather than dropped
+	want := []events.DynamoDBBatchItemFailure{{ItemIdentifier: "200"}, {ItemIdentifier: "300"}}
+	if !reflect.DeepEqual(response.BatchItemFailures, want) {
+		t.Errorf("BatchItemFailures = %+v, want %+v", response.BatchItemFailures, want)
+	}
+	if _, ok := s3Client.objects["logs/db-1/2023/11/14/audit/server_audit.log.1700000000000"]; !ok {
+		t.Error("the record without an error wasn't uploaded")
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/aws/smithy-go"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/checksum"
+)
+
+// canDownloadDelta reports whether a log file grew past the end of its last backup, which recorded where it ended,
+// and the checksum state of the backup is of the given algorithm, so it can be continued.
+// A log file rotated and written past that size between two backups can't be told apart from one that grew.
+func canDownloadDelta(record LogFileRecord, algorithm string) bool {
+	if checksum.Normalize(record.LastChecksumAlgorithm) != checksum.Normalize(algorithm) {
+		return false
+	}
+	return record.LastS3Key != "" && record.LastMarker != "" && record.LastHashState != "" && record.Size > record.LastMarkerBytes
+}
+
+// isMarkerRejected reports whether DownloadDBLogFilePortion rejected the marker it was given
+func isMarkerRejected(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.ErrorCode() == "InvalidParameterValue" || apiErr.ErrorCode() == "InvalidParameterCombination"
+}
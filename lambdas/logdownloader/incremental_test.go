@@ -0,0 +1,215 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/aws/smithy-go"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/checksum"
+)
+
+// rejectingLogFile rejects the marker of the first DownloadDBLogFilePortion call when it is rejectMarker,
+// and serves the portions of fakeLogFile
+type rejectingLogFile struct {
+	*fakeLogFile
+	rejectMarker string
+}
+
+func (f *rejectingLogFile) DownloadDBLogFilePortion(ctx context.Context, params *rds.DownloadDBLogFilePortionInput, optFns ...func(*rds.Options)) (*rds.DownloadDBLogFilePortionOutput, error) {
+	if f.rejectMarker != "" && len(f.markers) == 0 && aws.ToString(params.Marker) == f.rejectMarker {
+		f.markers = append(f.markers, aws.ToString(params.Marker))
+		return nil, &smithy.GenericAPIError{Code: "InvalidParameterValue", Message: "invalid marker"}
+	}
+	return f.fakeLogFile.DownloadDBLogFilePortion(ctx, params, optFns...)
+}
+
+// backedUpRecord returns the record of a log file whose last backup downloaded content up to marker
+func backedUpRecord(t *testing.T, content, marker, s3Key string) LogFileRecord {
+	t.Helper()
+
+	checksum := md5.New()
+	io.WriteString(checksum, content)
+	hashState, err := marshalHashState(checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return LogFileRecord{
+		DBInstanceIdentifier: "db-1",
+		LogFileName:          "audit/server_audit.log",
+		Size:                 int64(len(content)),
+		LastWritten:          1699999000000,
+		Status:               StatusDownloaded,
+		LastBackup:           1699999001000,
+		LastChecksum:         hex.EncodeToString(checksum.Sum(nil)),
+		LastS3Key:            s3Key,
+		LastMarker:           marker,
+		LastMarkerBytes:      int64(len(content)),
+		LastHashState:        hashState,
+	}
+}
+
+func TestCanDownloadDelta(t *testing.T) {
+	backedUp := backedUpRecord(t, "line 1\nline 2\n", "m2", "key")
+
+	tests := []struct {
+		name   string
+		change func(record *LogFileRecord)
+		want   bool
+	}{
+		{name: "grown", change: func(record *LogFileRecord) { record.Size += 7 }, want: true},
+		{name: "unchanged", change: func(record *LogFileRecord) {}},
+		{name: "shrunk", change: func(record *LogFileRecord) { record.Size = 3 }},
+		{name: "backed up without a marker", change: func(record *LogFileRecord) { record.Size += 7; record.LastMarker = "" }},
+		{name: "backed up without a checksum state", change: func(record *LogFileRecord) { record.Size += 7; record.LastHashState = "" }},
+		{name: "backed up with another checksum algorithm", change: func(record *LogFileRecord) { record.Size += 7; record.LastChecksumAlgorithm = checksum.SHA256 }},
+	}
+
+	for _, tt := range tests {
+		record := backedUp
+		tt.change(&record)
+		if got := canDownloadDelta(record, checksum.MD5); got != tt.want {
+			t.Errorf("%s: canDownloadDelta() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIsMarkerRejected(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: &smithy.GenericAPIError{Code: "InvalidParameterValue"}, want: true},
+		{err: fmt.Errorf("portion: %w", &smithy.GenericAPIError{Code: "InvalidParameterCombination"}), want: true},
+		{err: &smithy.GenericAPIError{Code: "Throttling"}},
+		{err: errors.New("connection reset")},
+	}
+
+	for _, tt := range tests {
+		if got := isMarkerRejected(tt.err); got != tt.want {
+			t.Errorf("isMarkerRejected(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadLogFileDelta(t *testing.T) {
+	record := backedUpRecord(t, "line 1\nline 2\n", "m2", "key")
+	record.Size += int64(len("line 3\n"))
+
+	rdsClient := &fakeLogFile{portions: portionChain("line 1\n", "line 2\n", "line 3\n")}
+	s3Client := newFakeS3()
+	opts := downloadOptions{PortionLines: defaultPortionLines, Delta: true}
+	result, err := downloadLogFile(context.Background(), rdsClient, s3Client, &fakeRecords{}, "table", "bucket", "key.part1", "text/plain", nil, opts, record, discardLogger)
+	if err != nil {
+		t.Fatalf("downloadLogFile() error = %v", err)
+	}
+
+	if want := []string{"m2"}; !reflect.DeepEqual(rdsClient.markers, want) {
+		t.Errorf("markers = %v, want %v", rdsClient.markers, want)
+	}
+	if got := string(s3Client.objects["key.part1"]); got != "line 3\n" {
+		t.Errorf("uploaded %q, want only the appended line", got)
+	}
+	sum := md5.Sum([]byte("line 1\nline 2\nline 3\n"))
+	if result.Checksum != hex.EncodeToString(sum[:]) {
+		t.Errorf("checksum = %s, want the checksum of the whole log file %x", result.Checksum, sum)
+	}
+	if result.RawBytes != 7 || result.Marker != "m3" || !result.Delta {
+		t.Errorf("result = %+v, want 7 raw bytes up to marker m3", result)
+	}
+
+	// Nothing appended since leaves nothing to upload
+	record = backedUpRecord(t, "line 1\nline 2\nline 3\n", "m3", "key")
+	rdsClient = &fakeLogFile{portions: map[string]fakePortion{"m3": {marker: "m3"}}}
+	result, err = downloadLogFile(context.Background(), rdsClient, newFakeS3(), &fakeRecords{}, "table", "bucket", "key.part1", "text/plain", nil, opts, record, discardLogger)
+	if err != nil {
+		t.Fatalf("downloadLogFile() error = %v", err)
+	}
+	if !result.Skipped {
+		t.Error("empty delta wasn't skipped")
+	}
+}
+
+func TestHandleDownloadsDeltas(t *testing.T) {
+	const baseKey = "logs/db-1/2023/11/14/audit/server_audit.log.1699999000000"
+	const fullKey = "logs/db-1/2023/11/14/audit/server_audit.log.1700000000000"
+
+	tests := []struct {
+		name         string
+		incremental  string
+		size         string
+		rejectMarker string
+		algorithm    string // CHECKSUM_ALGO; the backup was checksummed with MD5
+		wantKey      string
+		wantContent  string
+		wantS3Key    string // LastS3Key recorded
+		wantParts    string
+		wantBytes    string // LastMarkerBytes recorded
+	}{
+		{name: "appended lines", incremental: "true", size: "21", wantKey: baseKey + ".part2", wantContent: "line 3\n", wantS3Key: baseKey, wantParts: "2", wantBytes: "21"},
+		{name: "marker rejected", incremental: "true", size: "21", rejectMarker: "m2", wantKey: fullKey, wantContent: "line 1\nline 2\nline 3\n", wantS3Key: fullKey, wantParts: "0", wantBytes: "21"},
+		{name: "shrunk", incremental: "true", size: "7", wantKey: fullKey, wantContent: "line 1\nline 2\nline 3\n", wantS3Key: fullKey, wantParts: "0", wantBytes: "21"},
+		{name: "disabled", incremental: "false", size: "21", wantKey: fullKey, wantContent: "line 1\nline 2\nline 3\n", wantS3Key: fullKey, wantParts: "0", wantBytes: "21"},
+		{name: "checksum algorithm changed", incremental: "true", size: "21", algorithm: checksum.SHA256, wantKey: fullKey, wantContent: "line 1\nline 2\nline 3\n", wantS3Key: fullKey, wantParts: "0", wantBytes: "21"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DYNAMODB_TABLE_NAME", "table")
+			t.Setenv("S3_BUCKET_NAME", "bucket")
+			t.Setenv("INCREMENTAL_DOWNLOAD", tt.incremental)
+			t.Setenv("CHECKSUM_ALGO", cmp.Or(tt.algorithm, checksum.MD5))
+
+			current := backedUpRecord(t, "line 1\nline 2\n", "m2", baseKey)
+			current.LastPartCount = 1
+			item, err := attributevalue.MarshalMap(current)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dynamoClient := &fakeRecords{item: item}
+
+			rdsClient := &rejectingLogFile{fakeLogFile: &fakeLogFile{portions: portionChain("line 1\n", "line 2\n", "line 3\n")}, rejectMarker: tt.rejectMarker}
+			s3Client := newFakeS3()
+			record := insertRecord("audit/server_audit.log", "")
+			record.Change.NewImage["Size"] = events.NewNumberAttribute(tt.size)
+			deps := HandlerDeps{RDS: rdsClient, S3: s3Client, DynamoDB: dynamoClient}
+			if _, err := NewHandler(deps)(context.Background(), events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{record}}); err != nil {
+				t.Fatalf("handler error = %v", err)
+			}
+
+			if got := string(s3Client.objects[tt.wantKey]); got != tt.wantContent {
+				t.Errorf("uploaded %q to %s, want %q; objects = %v", got, tt.wantKey, tt.wantContent, s3Client.contentTypes)
+			}
+
+			var backup map[string]types.AttributeValue
+			for _, update := range dynamoClient.updates {
+				if _, ok := update.ExpressionAttributeValues[":partCount"]; ok {
+					backup = update.ExpressionAttributeValues
+				}
+			}
+			if backup == nil {
+				t.Fatal("backup wasn't recorded")
+			}
+			got := []string{
+				backup[":s3Key"].(*types.AttributeValueMemberS).Value,
+				backup[":partCount"].(*types.AttributeValueMemberN).Value,
+				backup[":markerBytes"].(*types.AttributeValueMemberN).Value,
+				backup[":marker"].(*types.AttributeValueMemberS).Value,
+			}
+			if want := []string{tt.wantS3Key, tt.wantParts, tt.wantBytes, "m3"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("recorded LastS3Key, LastPartCount, LastMarkerBytes and LastMarker = %v, want %v", got, want)
+			}
+		})
+	}
+}
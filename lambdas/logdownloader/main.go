@@ -2,322 +2,1997 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"log"
+	"maps"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go-v2/service/rds"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/auditlog"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/awsregion"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/checksum"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/ratelimit"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/s3key"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/store"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/timeutil"
 )
 
 // LogFileRecord represents a record in the DynamoDB table
 type LogFileRecord struct {
-	DBInstanceIdentifier string `dynamodbav:"DBInstanceIdentifier"`
-	LogFileName          string `dynamodbav:"LogFileName"`
-	Size                 int64  `dynamodbav:"Size"`
-	LastWritten          int64  `dynamodbav:"LastWritten"`
-	LastBackup           int64  `dynamodbav:"LastBackup,omitempty"`
+	DBInstanceIdentifier  string `dynamodbav:"DBInstanceIdentifier"`
+	LogFileName           string `dynamodbav:"LogFileName"`
+	LogFileType           string `dynamodbav:"LogFileType,omitempty"` // Set by the detector; empty for audit logs recorded before classification
+	Size                  int64  `dynamodbav:"Size"`
+	LastWritten           int64  `dynamodbav:"LastWritten"`
+	LastBackup            int64  `dynamodbav:"LastBackup,omitempty"`            // Epoch milliseconds
+	LastChecksum          string `dynamodbav:"LastChecksum,omitempty"`          // Hex checksum of the last uploaded content
+	LastChecksumAlgorithm string `dynamodbav:"LastChecksumAlgorithm,omitempty"` // Algorithm of LastChecksum and LastHashState; MD5 when absent
+	LastS3Key             string `dynamodbav:"LastS3Key,omitempty"`             // S3 key LastChecksum was uploaded to
+	LastRawSize           int64  `dynamodbav:"LastRawSize,omitempty"`           // Bytes downloaded by the last backup
+	LastObjectSize        int64  `dynamodbav:"LastObjectSize,omitempty"`        // Bytes of the object uploaded by the last backup, compressed with COMPRESSION=gzip
+	LastS3Bucket          string `dynamodbav:"LastS3Bucket,omitempty"`          // Bucket LastS3Key is in
+	LastS3VersionId       string `dynamodbav:"LastS3VersionId,omitempty"`       // Version of the object uploaded by the last backup, in a versioned bucket
+	LastBackupDurationMs  int64  `dynamodbav:"LastBackupDurationMs,omitempty"`  // Time the invocation that completed the last backup spent downloading and uploading
+	Status                string `dynamodbav:"Status,omitempty"`
+	ErrorMessage          string `dynamodbav:"ErrorMessage,omitempty"` // Why the download failed, only present while FAILED
+	LastError             string `dynamodbav:"LastError,omitempty"`    // Most recent download error, kept after later successes
+	AttemptCount          int64  `dynamodbav:"AttemptCount,omitempty"` // Downloads started since the last successful backup
+	// Download checkpoint, only present while a download is in progress
+	DownloadMarker      string `dynamodbav:"DownloadMarker,omitempty"`
+	DownloadedBytes     int64  `dynamodbav:"DownloadedBytes,omitempty"`
+	DownloadRawBytes    int64  `dynamodbav:"DownloadRawBytes,omitempty"` // Bytes of the log file behind DownloadedBytes
+	DownloadUploadId    string `dynamodbav:"DownloadUploadId,omitempty"`
+	DownloadHashState   string `dynamodbav:"DownloadHashState,omitempty"`   // Serialized checksum state at DownloadedBytes
+	DownloadFileSize    int64  `dynamodbav:"DownloadFileSize,omitempty"`    // Size of the log file at the last checkpoint
+	DownloadLastWritten int64  `dynamodbav:"DownloadLastWritten,omitempty"` // LastWritten in the multipart upload's metadata
+	DownloadS3Key       string `dynamodbav:"DownloadS3Key,omitempty"`       // S3 key of the multipart upload
+	// Set when a download stopped before the Lambda deadline, so the stream event resumes it
+	DownloadResumeRequestedAt int64 `dynamodbav:"DownloadResumeRequestedAt,omitempty"`
+	// Region of the DB instance, set by the detector; empty when it is in the Lambda's region
+	Region string `dynamodbav:"Region,omitempty"`
+	// Where the last backup ended, so INCREMENTAL_DOWNLOAD can download only what was appended since
+	LastMarker      string `dynamodbav:"LastMarker,omitempty"`      // Marker after the last portion downloaded
+	LastMarkerBytes int64  `dynamodbav:"LastMarkerBytes,omitempty"` // Bytes of the log file up to LastMarker
+	LastHashState   string `dynamodbav:"LastHashState,omitempty"`   // Serialized checksum state at LastMarker
+	LastPartCount   int64  `dynamodbav:"LastPartCount,omitempty"`   // Appended parts uploaded after LastS3Key, as its .partN keys
+	// Set when the last backup stopped at MAX_FILE_BYTES, so the next download continues from LastMarker
+	LastBackupPartial bool `dynamodbav:"LastBackupPartial,omitempty"`
 }
 
-// Handler is the Lambda function handler
-func Handler(ctx context.Context, event events.DynamoDBEvent) error {
+// Record statuses. The detector sets StatusPending; the downloader moves the record through the others.
+const (
+	StatusPending     = store.StatusPending
+	StatusDownloading = store.StatusDownloading
+	StatusDownloaded  = store.StatusDownloaded
+	StatusFailed      = store.StatusFailed
+	StatusWaiting     = store.StatusWaiting
+	StatusPartial     = store.StatusPartial
+)
+
+// downloadOptions control how a log file is downloaded and uploaded
+type downloadOptions struct {
+	ForceUpload  bool          // Upload even when the content is unchanged
+	SafetyMargin time.Duration // Time before the Lambda deadline at which no new portion is requested
+	PortionLines int32         // NumberOfLines requested per DownloadDBLogFilePortion call
+	PartSize     int           // Bytes buffered per multipart upload part; multipartPartSize unless set
+	DryRun       bool          // Download and checksum the log file without writing to S3 or DynamoDB
+	// Algorithm of the checksum of the downloaded content; checksum.MD5 unless set
+	ChecksumAlgorithm string
+	// Encoding of the uploaded objects; raw and uncompressed unless set
+	OutputFormat string // outputFormatRaw, outputFormatNDJSON or outputFormatJSONL
+	Compression  string // compressionNone or compressionGzip
+	// Download only what was appended since the last backup, from the record's LastMarker
+	Delta bool
+	// Server-side encryption of the uploaded objects; the bucket's default unless set
+	Encryption objectEncryption
+	// Save no checkpoints, for the final backup of a removed record that a checkpoint would recreate
+	NoCheckpoints bool
+	// Bytes downloaded before the download stops and uploads what it has as a partial backup; no limit when 0
+	MaxBytes int64
+}
+
+// Log file types, as classified by the detector
+const (
+	logFileTypeAudit     = "audit"
+	logFileTypeError     = "error"
+	logFileTypeSlowQuery = "slowquery"
+	logFileTypeGeneral   = "general"
+)
+
+// Output formats of the uploaded objects. Both JSON formats convert audit logs to one JSON object per
+// record; ndjson keeps the lines that aren't records under "_raw", jsonl under auditlog.RawField.
+const (
+	outputFormatRaw    = "raw"
+	outputFormatNDJSON = "ndjson"
+	outputFormatJSONL  = "jsonl"
+)
+
+// rawFields are the fields of the lines that aren't records, per JSON output format
+var rawFields = map[string]string{
+	outputFormatNDJSON: "_raw",
+	outputFormatJSONL:  auditlog.RawField,
+}
+
+// Compressions of the uploaded objects
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+)
+
+// defaultLogTypes is the default for LOG_TYPES
+const defaultLogTypes = logFileTypeAudit
+
+// downloadResult describes the outcome of a log file download
+type downloadResult struct {
+	Bytes    int64 // Bytes of the uploaded object
+	RawBytes int64 // Bytes downloaded, which Checksum is computed over
+	Checksum string
+	S3Key    string // Key the object was written to, which is the checkpointed key when the upload was resumed
+	Skipped  bool   // The content matched LastChecksum, so nothing was written to S3
+	// Algorithm of Checksum and HashState
+	ChecksumAlgorithm string
+	// Where the download ended, for the next delta download
+	Marker    string
+	HashState string
+	Delta     bool // Only what was appended since the record's LastMarker was downloaded
+	Partial   bool // Stopped at MaxBytes with more of the log file pending
+	// Set by the handler once the upload is verified
+	VersionID string
+	Duration  time.Duration
+}
+
+// numericRecordFields are the LogFileRecord attributes parsed as int64 from stream images
+var numericRecordFields = map[string]bool{
+	"Size":                 true,
+	"LastWritten":          true,
+	"LastBackup":           true,
+	"DownloadedBytes":      true,
+	"DownloadRawBytes":     true,
+	"DownloadFileSize":     true,
+	"DownloadLastWritten":  true,
+	"AttemptCount":         true,
+	"LastRawSize":          true,
+	"LastObjectSize":       true,
+	"LastBackupDurationMs": true,
+	"LastMarkerBytes":      true,
+	"LastPartCount":        true,
+	// Resume requests
+	"DownloadResumeRequestedAt": true,
+}
+
+// S3 key layouts: the default, the PARTITION_BY_DATE layout, and those kept with LEGACY_KEYS
+const (
+	defaultS3KeyTemplate           = s3key.DefaultTemplate
+	partitionedS3KeyTemplate       = s3key.PartitionedTemplate
+	legacyS3KeyTemplate            = s3key.LegacyTemplate
+	legacyPartitionedS3KeyTemplate = s3key.LegacyPartitionedTemplate
+)
+
+// defaultSafetyMargin is the default for DEADLINE_SAFETY_MARGIN_SECONDS
+const defaultSafetyMargin = 20 * time.Second
+
+// defaultPortionLines is the default for PORTION_LINES
+const defaultPortionLines = 10000
+
+// portionSizeCap is the most data DownloadDBLogFilePortion returns per call; longer portions are truncated
+const portionSizeCap = 1024 * 1024
+
+// nearCapPortions is the number of consecutive portions within 10% of portionSizeCap after which
+// the requested line count is halved
+const nearCapPortions = 2
+
+// maxPortions bounds the DownloadDBLogFilePortion calls per download, so a log file whose portions never end
+// fails instead of running until the Lambda timeout. At the portion size cap it allows for about 50 GB.
+const maxPortions = 50000
+
+// portionTimeout bounds a single DownloadDBLogFilePortion call
+const portionTimeout = 30 * time.Second
+
+// errDeadlineReached is returned by downloadLogFile when it stops early to stay within the Lambda deadline
+var errDeadlineReached = errors.New("stopped before the Lambda deadline")
+
+// errMarkerRejected is returned by a delta download when RDS doesn't accept the marker the last backup ended at
+var errMarkerRejected = errors.New("marker of the last backup was rejected")
+
+// checkpointAttributes are written by the downloader itself to track a download in progress
+var checkpointAttributes = map[string]bool{
+	"DownloadMarker":      true,
+	"DownloadedBytes":     true,
+	"DownloadRawBytes":    true,
+	"DownloadUploadId":    true,
+	"DownloadHashState":   true,
+	"DownloadFileSize":    true,
+	"DownloadLastWritten": true,
+	"DownloadS3Key":       true,
+	"Status":              true,
+	"AttemptCount":        true,
+	"ErrorMessage":        true,
+	"LastError":           true,
+}
+
+// backupAttributes are written by updateLastBackup when it records a backup, together with the checkpoint it removes.
+// A resume request is removed too; setting one is a change of its own.
+var backupAttributes = map[string]bool{
+	"LastBackup":                true,
+	"LastS3Key":                 true,
+	"LastS3Bucket":              true,
+	"LastS3VersionId":           true,
+	"LastChecksum":              true,
+	"LastChecksumAlgorithm":     true,
+	"LastRawSize":               true,
+	"LastObjectSize":            true,
+	"LastBackupDurationMs":      true,
+	"LastMarker":                true,
+	"LastMarkerBytes":           true,
+	"LastHashState":             true,
+	"LastPartCount":             true,
+	"LastBackupPartial":         true,
+	"DownloadResumeRequestedAt": true,
+}
+
+// RDSLogAPI is the subset of the RDS client used to read log files
+type RDSLogAPI interface {
+	DescribeDBLogFiles(ctx context.Context, params *rds.DescribeDBLogFilesInput, optFns ...func(*rds.Options)) (*rds.DescribeDBLogFilesOutput, error)
+	DownloadDBLogFilePortion(ctx context.Context, params *rds.DownloadDBLogFilePortionInput, optFns ...func(*rds.Options)) (*rds.DownloadDBLogFilePortionOutput, error)
+}
+
+// S3Putter is the subset of the S3 client used to write the backups, in one request or as a multipart upload,
+// and to verify them
+type S3Putter interface {
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	ListParts(ctx context.Context, params *s3.ListPartsInput, optFns ...func(*s3.Options)) (*s3.ListPartsOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+}
+
+// DynamoUpdater is the subset of the DynamoDB client used to read and update the log file records,
+// and to query the records of an instance for its manifest
+type DynamoUpdater interface {
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+}
+
+// HandlerDeps holds the AWS clients used by the handler, so tests can replace them with fakes
+type HandlerDeps struct {
+	RDS      RDSLogAPI
+	S3       S3Putter
+	DynamoDB DynamoUpdater
+	// RDSLimiter spaces out the RDS calls of all invocations of the execution environment (nil doesn't limit)
+	RDSLimiter *ratelimit.Limiter
+	// Metrics receives the CloudWatch embedded metric format records (nil writes them to stdout)
+	Metrics io.Writer
+	// Region is the Lambda's region, whose instances are reached with RDS
+	Region string
+	// RegionalRDS holds the RDS clients of the other regions listed in REGIONS
+	RegionalRDS map[string]RDSLogAPI
+	// Now is the clock compared with STABILITY_WINDOW_SECONDS (nil uses time.Now)
+	Now func() time.Time
+	// DRS3 is the S3 client of DR_REGION that copies backups to DR_BUCKET_NAME (nil when DR_REGION is not set)
+	DRS3 ObjectCopier
+	// SNS publishes notifications to SNS_TOPIC_ARN (nil when SNS_TOPIC_ARN is not set)
+	SNS SNSPublisher
+}
+
+// NewHandlerDeps creates the AWS clients from the given configuration
+func NewHandlerDeps(cfg aws.Config) HandlerDeps {
+	// An invalid RDS_API_RPS is reported by the handler, which then fails every invocation
+	rdsRate, _ := ratelimit.ParseRate(os.Getenv("RDS_API_RPS"))
+	// An invalid DYNAMODB_MAX_ATTEMPTS is reported by the handler as well
+	dynamoMaxAttempts, _ := store.ParseMaxAttempts(os.Getenv("DYNAMODB_MAX_ATTEMPTS"))
+
+	rdsCfg := rdsConfig(cfg)
+	regionalRDS := make(map[string]RDSLogAPI)
+	// An invalid REGIONS is reported by the handler as well
+	regions, _ := awsregion.ParseList(os.Getenv("REGIONS"), cfg.Region)
+	for _, region := range regions {
+		if region == cfg.Region {
+			continue
+		}
+		regionalCfg := rdsCfg.Copy()
+		regionalCfg.Region = region
+		regionalRDS[region] = rds.NewFromConfig(regionalCfg)
+	}
+
+	deps := HandlerDeps{
+		RDS:         rds.NewFromConfig(rdsCfg),
+		S3:          s3.NewFromConfig(cfg),
+		DynamoDB:    store.NewClient(cfg, dynamoMaxAttempts),
+		RDSLimiter:  ratelimit.New(rdsRate),
+		Region:      cfg.Region,
+		RegionalRDS: regionalRDS,
+	}
+	if region := os.Getenv("DR_REGION"); region != "" {
+		drCfg := cfg.Copy()
+		drCfg.Region = region
+		deps.DRS3 = s3.NewFromConfig(drCfg)
+	}
+	if os.Getenv("SNS_TOPIC_ARN") != "" {
+		deps.SNS = sns.NewFromConfig(cfg)
+	}
+	return deps
+}
+
+// rdsClient returns the RDS client of a region, or nil if there is none.
+// An empty region is the Lambda's region.
+func (deps HandlerDeps) rdsClient(region string) RDSLogAPI {
+	if region == "" || region == deps.Region {
+		return deps.RDS
+	}
+	return deps.RegionalRDS[region]
+}
+
+// NewHandler returns a Lambda function handler using the given clients
+func NewHandler(deps HandlerDeps) func(ctx context.Context, event events.DynamoDBEvent) (events.DynamoDBEventResponse, error) {
+	return deps.handle
+}
+
+// requiredEnvVars are the environment variables the downloader can't run without
+var requiredEnvVars = []string{"DYNAMODB_TABLE_NAME", "S3_BUCKET_NAME"}
+
+// validateConfig returns an error naming every required environment variable that is not set
+func validateConfig() error {
+	var missing []string
+	for _, name := range requiredEnvVars {
+		if os.Getenv(name) == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("required environment variables not set: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// downloaderConfig holds the settings of the downloader, read from environment variables
+type downloaderConfig struct {
+	TableName     string
+	BucketName    string
+	S3Prefix      string
+	S3KeyTemplate string
+	// How every log file is downloaded and uploaded
+	Options downloadOptions
+	// Download only what was appended to a grown log file since its last backup
+	Incremental bool
+	// Time a log file must go unwritten before it is downloaded (0 doesn't wait)
+	StabilityWindow time.Duration
+	// Fraction of the function's memory above which a log file is reported as too large
+	MemoryWarningFraction float64
+	// Attempts per log file portion that was throttled or failed with a server error
+	PortionMaxAttempts int
+	// Bucket that receives a copy of every backup, and whether a failed copy fails the backup
+	DRBucketName string
+	DRRequired   bool
+	// Download the log file of a removed record that wasn't backed up one last time
+	RemoveFinalBackup bool
+	// Topic notified of every failed backup, checksum mismatch and partial backup
+	SNSTopicARN string
+	// Log file types backed up
+	LogTypes map[string]bool
+	// Also dimension the metrics of every log file by DB instance
+	MetricsByInstance bool
+}
+
+// loadDownloaderConfig reads the settings from environment variables, which validateConfig checked.
+// It returns an error naming the first variable that is invalid.
+func loadDownloaderConfig() (downloaderConfig, error) {
+	cfg := downloaderConfig{
+		TableName:  os.Getenv("DYNAMODB_TABLE_NAME"),
+		BucketName: os.Getenv("S3_BUCKET_NAME"),
+		S3Prefix:   os.Getenv("S3_PREFIX"),
+	}
+	if cfg.S3Prefix == "" {
+		cfg.S3Prefix = "logs" // Default prefix
+	}
+
+	// An explicit S3_KEY_TEMPLATE takes precedence over PARTITION_BY_DATE
+	partitionByDate, err := parseBoolEnv("PARTITION_BY_DATE")
+	if err != nil {
+		return downloaderConfig{}, err
+	}
+
+	// LEGACY_KEYS keeps the layouts without the LastWritten time, where every backup overwrites the last one
+	legacyKeys, err := parseBoolEnv("LEGACY_KEYS")
+	if err != nil {
+		return downloaderConfig{}, err
+	}
+
+	cfg.S3KeyTemplate = os.Getenv("S3_KEY_TEMPLATE")
+	if cfg.S3KeyTemplate == "" {
+		switch {
+		case partitionByDate && legacyKeys:
+			cfg.S3KeyTemplate = legacyPartitionedS3KeyTemplate
+		case partitionByDate:
+			cfg.S3KeyTemplate = partitionedS3KeyTemplate
+		case legacyKeys:
+			cfg.S3KeyTemplate = legacyS3KeyTemplate
+		default:
+			cfg.S3KeyTemplate = defaultS3KeyTemplate
+		}
+	}
+
+	// INCREMENTAL_DOWNLOAD downloads only what was appended to a grown log file since its last backup
+	if cfg.Incremental, err = parseBoolEnv("INCREMENTAL_DOWNLOAD"); err != nil {
+		return downloaderConfig{}, err
+	}
+
+	// FORCE_UPLOAD writes every downloaded file even when its checksum is unchanged
+	opts := &cfg.Options
+	if opts.ForceUpload, err = parseBoolEnv("FORCE_UPLOAD"); err != nil {
+		return downloaderConfig{}, err
+	}
+
+	// CHECKSUM_ALGO is the algorithm of the checksum recorded for the downloaded content. Records checksummed
+	// with another algorithm are uploaded again, as their checksum can't be compared.
+	opts.ChecksumAlgorithm = os.Getenv("CHECKSUM_ALGO")
+	if opts.ChecksumAlgorithm == "" {
+		opts.ChecksumAlgorithm = checksum.Default
+	}
+	if opts.ChecksumAlgorithm != checksum.MD5 && opts.ChecksumAlgorithm != checksum.SHA256 {
+		return downloaderConfig{}, fmt.Errorf("invalid CHECKSUM_ALGO value %q", opts.ChecksumAlgorithm)
+	}
+
+	// Stop requesting portions this long before the Lambda deadline
+	opts.SafetyMargin = defaultSafetyMargin
+	if value := os.Getenv("DEADLINE_SAFETY_MARGIN_SECONDS"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			return downloaderConfig{}, fmt.Errorf("invalid DEADLINE_SAFETY_MARGIN_SECONDS value %q", value)
+		}
+		opts.SafetyMargin = time.Duration(seconds) * time.Second
+	}
+
+	// Wait until a log file hasn't been written for this long before downloading it (0 doesn't wait)
+	if value := os.Getenv("STABILITY_WINDOW_SECONDS"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			return downloaderConfig{}, fmt.Errorf("invalid STABILITY_WINDOW_SECONDS value %q", value)
+		}
+		cfg.StabilityWindow = time.Duration(seconds) * time.Second
+	}
+
+	// Warn about log files larger than this fraction of the function's memory
+	cfg.MemoryWarningFraction, err = parseMemoryWarningFraction(os.Getenv("MEMORY_WARNING_FRACTION"))
+	if err != nil {
+		return downloaderConfig{}, fmt.Errorf("invalid MEMORY_WARNING_FRACTION value %q: %w", os.Getenv("MEMORY_WARNING_FRACTION"), err)
+	}
+
+	// Lines requested per log file portion
+	opts.PortionLines = defaultPortionLines
+	if value := os.Getenv("PORTION_LINES"); value != "" {
+		lines, err := strconv.ParseInt(value, 10, 32)
+		if err != nil || lines <= 0 {
+			return downloaderConfig{}, fmt.Errorf("invalid PORTION_LINES value %q", value)
+		}
+		opts.PortionLines = int32(lines)
+	}
+
+	// Bytes downloaded per log file and invocation; a larger log file is backed up in parts (0 is no limit)
+	if value := os.Getenv("MAX_FILE_BYTES"); value != "" {
+		maxBytes, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || maxBytes < 0 {
+			return downloaderConfig{}, fmt.Errorf("invalid MAX_FILE_BYTES value %q", value)
+		}
+		opts.MaxBytes = maxBytes
+	}
+
+	// Attempts per log file portion that was throttled or failed with a server error
+	cfg.PortionMaxAttempts = defaultPortionMaxAttempts
+	if value := os.Getenv("PORTION_MAX_ATTEMPTS"); value != "" {
+		attempts, err := strconv.Atoi(value)
+		if err != nil || attempts <= 0 {
+			return downloaderConfig{}, fmt.Errorf("invalid PORTION_MAX_ATTEMPTS value %q", value)
+		}
+		cfg.PortionMaxAttempts = attempts
+	}
+
+	// Bytes buffered before they are uploaded as a part, which bounds the memory used per download
+	opts.PartSize = multipartPartSize
+	if value := os.Getenv("MULTIPART_PART_SIZE_MB"); value != "" {
+		megabytes, err := strconv.Atoi(value)
+		if err != nil || megabytes < multipartPartSize>>20 || megabytes > maxMultipartPartSize>>20 {
+			return downloaderConfig{}, fmt.Errorf("invalid MULTIPART_PART_SIZE_MB value %q", value)
+		}
+		opts.PartSize = megabytes << 20
+	}
+
+	// Regions of the instances in the records (the RDS clients are created by NewHandlerDeps)
+	if _, err := awsregion.ParseList(os.Getenv("REGIONS"), ""); err != nil {
+		return downloaderConfig{}, fmt.Errorf("invalid REGIONS value %q: %w", os.Getenv("REGIONS"), err)
+	}
+
+	// RDS calls per second (the limiter is created by NewHandlerDeps)
+	if _, err := ratelimit.ParseRate(os.Getenv("RDS_API_RPS")); err != nil {
+		return downloaderConfig{}, fmt.Errorf("invalid RDS_API_RPS value %q", os.Getenv("RDS_API_RPS"))
+	}
+
+	// Attempts per DynamoDB call by the SDK's retryer (the client is created by NewHandlerDeps)
+	if _, err := store.ParseMaxAttempts(os.Getenv("DYNAMODB_MAX_ATTEMPTS")); err != nil {
+		return downloaderConfig{}, fmt.Errorf("invalid DYNAMODB_MAX_ATTEMPTS value %q", os.Getenv("DYNAMODB_MAX_ATTEMPTS"))
+	}
+
+	// DRY_RUN downloads the log files without backing them up, to validate IAM and connectivity
+	if opts.DryRun, err = parseBoolEnv("DRY_RUN"); err != nil {
+		return downloaderConfig{}, err
+	}
+
+	// DR_BUCKET_NAME receives a copy of every backup, from the client of DR_REGION. A failed copy only fails
+	// the backup with DR_REQUIRED.
+	cfg.DRBucketName = os.Getenv("DR_BUCKET_NAME")
+	if cfg.DRRequired, err = parseBoolEnv("DR_REQUIRED"); err != nil {
+		return downloaderConfig{}, err
+	}
+
+	// REMOVE_FINAL_BACKUP downloads the log file of a removed record that wasn't backed up one last time
+	if cfg.RemoveFinalBackup, err = parseBoolEnv("REMOVE_FINAL_BACKUP"); err != nil {
+		return downloaderConfig{}, err
+	}
+
+	// SNS_TOPIC_ARN receives a notification of every failed backup, checksum mismatch and partial backup
+	cfg.SNSTopicARN = os.Getenv("SNS_TOPIC_ARN")
+
+	// OUTPUT_FORMAT=ndjson or jsonl converts audit logs to one JSON object per record
+	opts.OutputFormat = outputFormatRaw
+	if value := os.Getenv("OUTPUT_FORMAT"); value != "" {
+		if _, ok := rawFields[value]; !ok && value != outputFormatRaw {
+			return downloaderConfig{}, fmt.Errorf("invalid OUTPUT_FORMAT value %q", value)
+		}
+		opts.OutputFormat = value
+	}
+
+	// COMPRESSION=gzip compresses the uploaded objects
+	opts.Compression = compressionNone
+	if value := os.Getenv("COMPRESSION"); value != "" {
+		if value != compressionNone && value != compressionGzip {
+			return downloaderConfig{}, fmt.Errorf("invalid COMPRESSION value %q", value)
+		}
+		opts.Compression = value
+	}
+
+	// S3_SSE and KMS_KEY_ARN encrypt the uploaded objects, e.g. with a customer-managed KMS key
+	opts.Encryption, err = parseObjectEncryption(os.Getenv("S3_SSE"), os.Getenv("KMS_KEY_ARN"))
+	if err != nil {
+		return downloaderConfig{}, fmt.Errorf("invalid S3_SSE or KMS_KEY_ARN: %w", err)
+	}
+
+	// Log file types backed up; records of the other types are skipped
+	cfg.LogTypes, err = parseLogTypes(os.Getenv("LOG_TYPES"))
+	if err != nil {
+		return downloaderConfig{}, fmt.Errorf("invalid LOG_TYPES value %q: %w", os.Getenv("LOG_TYPES"), err)
+	}
+
+	// METRICS_BY_INSTANCE also dimensions the metrics of every log file by DB instance, e.g. for debugging
+	if cfg.MetricsByInstance, err = parseBoolEnv("METRICS_BY_INSTANCE"); err != nil {
+		return downloaderConfig{}, err
+	}
+
+	return cfg, nil
+}
+
+// parseBoolEnv parses an optional boolean environment variable, which is false when it isn't set
+func parseBoolEnv(name string) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return false, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s value %q: %w", name, value, err)
+	}
+	return parsed, nil
+}
+
+// Handler is the Lambda function handler.
+// It creates the AWS clients on every invocation; main uses NewHandler to create them once per cold start.
+func Handler(ctx context.Context, event events.DynamoDBEvent) (events.DynamoDBEventResponse, error) {
+	// Load AWS configuration
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		log.Printf("Error loading AWS config: %v\n", err)
+		return events.DynamoDBEventResponse{}, err
+	}
+
+	return NewHandler(NewHandlerDeps(cfg))(ctx, event)
+}
+
+// handle downloads the log files of the changed records in the stream batch and backs them up to S3.
+// Records whose backup failed and may succeed when retried are reported as batch item failures, so the stream
+// is retried from the first of them; records after it that were backed up in the meantime are skipped.
+func (deps HandlerDeps) handle(ctx context.Context, event events.DynamoDBEvent) (events.DynamoDBEventResponse, error) {
 	// Initialize logger
 	logger := log.New(os.Stdout, "", log.LstdFlags)
 	logger.Println("Starting Log File Downloader Lambda")
+	start := time.Now()
+
+	var response events.DynamoDBEventResponse
+	reportFailure := func(record events.DynamoDBEventRecord) {
+		response.BatchItemFailures = append(response.BatchItemFailures, events.DynamoDBBatchItemFailure{
+			ItemIdentifier: record.Change.SequenceNumber,
+		})
+	}
+
+	// fail logs the error of a stream record with its kind and reports the record as failed
+	var failures []error
+	fail := func(record events.DynamoDBEventRecord, err error) {
+		logger.Printf("Error [%s]: %v\n", errorKind(err), err)
+		failures = append(failures, err)
+		reportFailure(record)
+	}
+
+	// Fail the invocation when required settings are missing, so the stream batch is retried
+	if err := validateConfig(); err != nil {
+		logger.Printf("Error: %v\n", err)
+		return response, err
+	}
+
+	// Fail on an invalid optional setting as well, which would otherwise acknowledge the batch without a backup
+	cfg, err := loadDownloaderConfig()
+	if err != nil {
+		logger.Printf("Error: %v\n", err)
+		return response, err
+	}
+	tableName, bucketName := cfg.TableName, cfg.BucketName
+	opts := cfg.Options
+
+	now := deps.Now
+	if now == nil {
+		now = time.Now
+	}
+
+	// DR_BUCKET_NAME is copied to with the client of DR_REGION, and SNS_TOPIC_ARN notified with the SNS client
+	if cfg.DRBucketName != "" && deps.DRS3 == nil {
+		err := fmt.Errorf("DR_BUCKET_NAME %q is set without DR_REGION", cfg.DRBucketName)
+		logger.Printf("Error: %v\n", err)
+		return response, err
+	}
+	if cfg.SNSTopicARN != "" && deps.SNS == nil {
+		err := fmt.Errorf("SNS_TOPIC_ARN %q is set without an SNS client", cfg.SNSTopicARN)
+		logger.Printf("Error: %v\n", err)
+		return response, err
+	}
+
+	s3Client, dynamoClient := deps.S3, deps.DynamoDB
+
+	// Count the RDS calls delayed by RDS_API_RPS, published once the stream records are processed
+	var waits rateLimitWaits
+	if deps.RDSLimiter != nil {
+		defer func() { deps.emitRateLimitMetrics(waits, logger) }()
+	}
+
+	// Count the retried log file portions and the downloads stopped by a marker that didn't advance
+	var retries portionRetries
+	defer func() {
+		if retries != (portionRetries{}) {
+			deps.emitPortionRetryMetrics(retries, logger)
+		}
+	}()
+
+	// Count the records removed from the table and the final backups made of them
+	var removals recordRemovals
+	defer func() {
+		if removals != (recordRemovals{}) {
+			deps.emitRemovalMetrics(removals, logger)
+		}
+	}()
+
+	// Measure the transfer and outcome of every log file downloaded, and their totals once the stream records
+	// are processed. Dry runs aren't measured.
+	var totals transferTotals
+	defer func() {
+		if len(totals.Outcomes) > 0 {
+			deps.emitInvocationMetrics(totals, logger)
+		}
+	}()
+	finish := func(logFileRecord LogFileRecord, transfer fileTransfer, outcome string) {
+		deps.emitFileMetrics(logFileRecord, transfer, outcome, cfg.MetricsByInstance, logger)
+		totals.observe(transfer, outcome)
+	}
+
+	// failBackup marks the record of a backup that failed with cause FAILED, reports its stream record as failed
+	// with the typed error err and notifies SNS_TOPIC_ARN. s3Key is the object written, if any.
+	failBackup := func(record events.DynamoDBEventRecord, logFileRecord LogFileRecord, transfer fileTransfer, cause, err error, s3Key string) {
+		markFailed(ctx, dynamoClient, tableName, logFileRecord.DBInstanceIdentifier, logFileRecord.LogFileName, cause, logger)
+		fail(record, err)
+		deps.notify(ctx, cfg.SNSTopicARN, failureNotification(logFileRecord, err, s3Key), logger)
+		finish(logFileRecord, transfer, outcomeFailed)
+	}
+
+	// Report the largest log file and the duration of the invocation, as a hint for sizing the function
+	sizing := invocationSizing{start: start, warnBytes: memoryWarningBytes(os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"), cfg.MemoryWarningFraction)}
+	defer sizing.log(logger)
+
+	// Reach the instance with the RDS client of its region; the record fails when REGIONS doesn't list it
+	rdsClientFor := func(logFileRecord LogFileRecord) (RDSLogAPI, error) {
+		regionalClient := deps.rdsClient(logFileRecord.Region)
+		if regionalClient == nil {
+			return nil, recordError(ErrDownloadFailed, logFileRecord, fmt.Errorf("no RDS client for region %s, which is not in REGIONS", logFileRecord.Region))
+		}
+		return withPortionRetries(withRateLimit(regionalClient, deps.RDSLimiter, &waits), cfg.PortionMaxAttempts, &retries), nil
+	}
+
+	// backupObject returns the download options, key and content type of the object a log file is backed up to
+	backupObject := func(logFileRecord LogFileRecord, logFileType string) (downloadOptions, string, string) {
+		// Only audit logs are in the server_audit format the JSON formats are converted from
+		recordOpts := opts
+		if logFileType != logFileTypeAudit {
+			recordOpts.OutputFormat = outputFormatRaw
+		}
+
+		s3Key := s3key.Build(cfg.S3KeyTemplate, logTypePrefix(cfg.S3Prefix, cfg.LogTypes, logFileType), logFileRecord.DBInstanceIdentifier, logFileRecord.LogFileName, logFileRecord.LastWritten)
+		if recordOpts.OutputFormat != outputFormatRaw {
+			s3Key += "." + recordOpts.OutputFormat
+		}
+		if recordOpts.Compression == compressionGzip {
+			s3Key += ".gz"
+		}
+		return recordOpts, s3Key, objectContentType(logFileType, recordOpts)
+	}
+
+	// finalBackup downloads the log file of a removed record, as of its old image. Nothing is written to the
+	// table, which would recreate the record: the download saves no checkpoints and the backup isn't recorded.
+	finalBackup := func(logFileRecord LogFileRecord) error {
+		rdsClient, err := rdsClientFor(logFileRecord)
+		if err != nil {
+			return err
+		}
+		recordOpts, s3Key, contentType := backupObject(logFileRecord, recordLogType(logFileRecord))
+		recordOpts.NoCheckpoints = true
+
+		sizing.observe(logFileRecord, logger)
+		result, err := downloadLogFile(ctx, rdsClient, s3Client, dynamoClient, tableName, bucketName, s3Key, contentType, objectMetadata(logFileRecord), recordOpts, logFileRecord, logger)
+		if err != nil {
+			return recordError(ErrDownloadFailed, logFileRecord, err)
+		}
+		if recordOpts.DryRun || result.Skipped {
+			return nil
+		}
+
+		result.VersionID, err = verifyUpload(ctx, s3Client, bucketName, result.S3Key, result.Bytes, logger)
+		if err != nil {
+			if errors.Is(err, errUploadMismatch) {
+				deps.emitVerificationFailure(logger)
+			}
+			return recordError(ErrUploadFailed, logFileRecord, fmt.Errorf("verifying upload: %w", err))
+		}
+		if cfg.DRBucketName != "" {
+			err = copyToDR(ctx, deps.DRS3, bucketName, cfg.DRBucketName, result.S3Key, result.VersionID, result.Bytes, logger)
+			if err != nil {
+				deps.emitDRFailure(logger)
+				if cfg.DRRequired {
+					return recordError(ErrUploadFailed, logFileRecord, fmt.Errorf("copying to DR bucket %s: %w", cfg.DRBucketName, err))
+				}
+				logger.Printf("Error copying log file to DR bucket %s: %v\n", cfg.DRBucketName, err)
+			}
+		}
+		logger.Printf("Final backup of log file %s for instance %s uploaded to s3://%s/%s\n", logFileRecord.LogFileName, logFileRecord.DBInstanceIdentifier, bucketName, result.S3Key)
+		return nil
+	}
+
+	// Process each DynamoDB stream record
+	for _, record := range event.Records {
+		// A removed record is forgotten by the table. With REMOVE_FINAL_BACKUP, a log file that wasn't backed up
+		// since it last changed is downloaded one last time, while RDS may still have it.
+		if record.EventName == "REMOVE" {
+			removals.observe(record, logger)
+			if !cfg.RemoveFinalBackup {
+				continue
+			}
+			var logFileRecord LogFileRecord
+			if err := unmarshalDynamoDBEvent(record.Change.OldImage, &logFileRecord); err != nil {
+				fail(record, parseError(record, err))
+				continue
+			}
+			if !needsFinalBackup(logFileRecord, cfg.LogTypes) {
+				continue
+			}
+			err := finalBackup(logFileRecord)
+			switch {
+			case logFileGone(err):
+				logger.Printf("Log file %s of instance %s is no longer in RDS, no final backup: %v\n", logFileRecord.LogFileName, logFileRecord.DBInstanceIdentifier, err)
+				removals.FinalBackupsMissed++
+			case err != nil:
+				fail(record, err)
+			default:
+				removals.FinalBackups++
+			}
+			continue
+		}
+
+		// Skip records that are not INSERT or MODIFY
+		if record.EventName != "INSERT" && record.EventName != "MODIFY" {
+			continue
+		}
+
+		// Parse the DynamoDB record
+		var logFileRecord LogFileRecord
+		err := unmarshalDynamoDBEvent(record.Change.NewImage, &logFileRecord)
+		if err != nil {
+			fail(record, parseError(record, err))
+			continue
+		}
+
+		// Skip bookkeeping items such as the scanner's enqueue checkpoint and the detector's instance summary
+		if strings.HasPrefix(logFileRecord.LogFileName, "#") {
+			continue
+		}
+
+		// Skip log file types that aren't backed up
+		logFileType := recordLogType(logFileRecord)
+		if !cfg.LogTypes[logFileType] {
+			logger.Printf("Skipping %s log file %s, not in LOG_TYPES\n", logFileType, logFileRecord.LogFileName)
+			continue
+		}
+
+		// Skip if LastBackup is recent and Size/LastWritten haven't changed
+		if record.EventName == "MODIFY" && !shouldDownload(record.Change.OldImage, record.Change.NewImage, logger) {
+			logger.Printf("Skipping download for %s, no significant changes\n", logFileRecord.LogFileName)
+			continue
+		}
+
+		// Read the current record to pick up a checkpoint left by an interrupted download,
+		// since the stream image predates any checkpoint written while downloading
+		currentRecord, err := getLogFileRecord(ctx, dynamoClient, tableName, logFileRecord.DBInstanceIdentifier, logFileRecord.LogFileName, logger)
+		if err != nil {
+			fail(record, recordError(ErrRecordUpdate, logFileRecord, fmt.Errorf("reading download checkpoint: %w", err)))
+			continue
+		}
+
+		// A retried stream record may already have been backed up by the attempt that failed on another record
+		if backedUpSince(currentRecord, record.Change.ApproximateCreationDateTime.Time) {
+			logger.Printf("Skipping download for %s, already backed up since the change\n", logFileRecord.LogFileName)
+			continue
+		}
+
+		// A log file Aurora is still appending to would be backed up halfway through a write. It is marked WAITING
+		// and its stream record succeeds, so it doesn't hold back the records after it in the shard; the detector
+		// sets the record back to PENDING on its next listing of the file, which triggers another attempt.
+		if writtenWithin(logFileRecord.LastWritten, cfg.StabilityWindow, now()) {
+			logger.Printf("Log file %s was written less than %s ago, waiting for it to settle\n", logFileRecord.LogFileName, cfg.StabilityWindow)
+			if opts.DryRun {
+				continue
+			}
+			err = markWaiting(ctx, dynamoClient, tableName, logFileRecord.DBInstanceIdentifier, logFileRecord.LogFileName, logger)
+			if err != nil {
+				// A record that couldn't be marked WAITING isn't set back to PENDING, so the stream retries it
+				logger.Printf("Error updating status: %v\n", err)
+				reportFailure(record)
+			} else if logFileRecord.Status == StatusPending {
+				// The detector counts the record as pending again when it sets it back to PENDING
+				err = decrementPendingCount(ctx, dynamoClient, tableName, logFileRecord.DBInstanceIdentifier, logger)
+				if err != nil {
+					logger.Printf("Error updating summary of instance %s: %v\n", logFileRecord.DBInstanceIdentifier, err)
+				}
+			}
+			continue
+		}
+
+		if currentRecord != nil {
+			logFileRecord.DownloadMarker = currentRecord.DownloadMarker
+			logFileRecord.DownloadedBytes = currentRecord.DownloadedBytes
+			logFileRecord.DownloadRawBytes = currentRecord.DownloadRawBytes
+			logFileRecord.DownloadUploadId = currentRecord.DownloadUploadId
+			logFileRecord.DownloadHashState = currentRecord.DownloadHashState
+			logFileRecord.DownloadFileSize = currentRecord.DownloadFileSize
+			logFileRecord.DownloadLastWritten = currentRecord.DownloadLastWritten
+			logFileRecord.DownloadS3Key = currentRecord.DownloadS3Key
+			logFileRecord.LastChecksum = currentRecord.LastChecksum
+			logFileRecord.LastChecksumAlgorithm = currentRecord.LastChecksumAlgorithm
+			logFileRecord.LastS3Key = currentRecord.LastS3Key
+			logFileRecord.LastMarker = currentRecord.LastMarker
+			logFileRecord.LastMarkerBytes = currentRecord.LastMarkerBytes
+			logFileRecord.LastHashState = currentRecord.LastHashState
+			logFileRecord.LastPartCount = currentRecord.LastPartCount
+			logFileRecord.LastBackupPartial = currentRecord.LastBackupPartial
+		}
+
+		rdsClient, clientErr := rdsClientFor(logFileRecord)
+		recordOpts, s3Key, contentType := backupObject(logFileRecord, logFileType)
+		metadata := objectMetadata(logFileRecord)
+
+		// A log file that grew since its last backup has what was appended uploaded as the next part of that
+		// backup. A checkpoint left by a whole download is resumed rather than replaced by a delta. A partial
+		// backup is always continued this way.
+		deltaOpts, deltaKey := recordOpts, ""
+		if (cfg.Incremental || logFileRecord.LastBackupPartial) && canDownloadDelta(logFileRecord, opts.ChecksumAlgorithm) {
+			deltaKey = s3key.PartKey(logFileRecord.LastS3Key, logFileRecord.LastPartCount+1)
+			deltaOpts.Delta = logFileRecord.DownloadUploadId == "" || logFileRecord.DownloadS3Key == deltaKey
+		}
+		var transfer fileTransfer
+		download := func() (downloadResult, error) {
+			sizing.observe(logFileRecord, logger)
+			rdsClient, s3Client := transfer.rds(rdsClient), transfer.s3(s3Client)
+			if deltaOpts.Delta {
+				result, err := downloadLogFile(ctx, rdsClient, s3Client, dynamoClient, tableName, bucketName, deltaKey, contentType, metadata, deltaOpts, logFileRecord, logger)
+				if !errors.Is(err, errMarkerRejected) {
+					return result, err
+				}
+				logger.Printf("%v, downloading the whole log file %s: %v\n", errMarkerRejected, logFileRecord.LogFileName, err)
+			}
+			return downloadLogFile(ctx, rdsClient, s3Client, dynamoClient, tableName, bucketName, s3Key, contentType, metadata, recordOpts, logFileRecord, logger)
+		}
+
+		// Download the log file without touching S3 or the record
+		if opts.DryRun {
+			if clientErr != nil {
+				logger.Printf("Dry run: error [%s]: %v\n", errorKind(clientErr), clientErr)
+				continue
+			}
+			result, err := download()
+			if err != nil {
+				err = recordError(ErrDownloadFailed, logFileRecord, err)
+				logger.Printf("Dry run: error [%s]: %v\n", errorKind(err), err)
+				continue
+			}
+			if result.Partial {
+				logger.Printf("Dry run: log file %s is larger than MAX_FILE_BYTES, would back up its first %d bytes\n", logFileRecord.LogFileName, result.RawBytes)
+			}
+			logger.Printf("Dry run: would upload %d bytes (checksum %s) to s3://%s/%s\n", result.Bytes, result.Checksum, bucketName, result.S3Key)
+			continue
+		}
+
+		// Record that the download started
+		err = markDownloading(ctx, dynamoClient, tableName, logFileRecord.DBInstanceIdentifier, logFileRecord.LogFileName, logger)
+		if err != nil {
+			fail(record, recordError(ErrRecordUpdate, logFileRecord, fmt.Errorf("updating status: %w", err)))
+			continue
+		}
+
+		// The record is no longer waiting for a backup
+		if logFileRecord.Status == StatusPending {
+			err = decrementPendingCount(ctx, dynamoClient, tableName, logFileRecord.DBInstanceIdentifier, logger)
+			if err != nil {
+				logger.Printf("Error updating summary of instance %s: %v\n", logFileRecord.DBInstanceIdentifier, err)
+			}
+		}
+
+		if clientErr != nil {
+			failBackup(record, logFileRecord, transfer, clientErr, clientErr, "")
+			continue
+		}
+
+		// Download the log file and stream it to S3
+		downloadStart := time.Now()
+		result, err := download()
+		if errors.Is(err, errDeadlineReached) {
+			// Let a new invocation pick up the download from its checkpoint. The stream redelivers the failed
+			// record; the resume request still triggers one once the stream's retries are exhausted, and is
+			// skipped by backedUpSince if the redelivery completed the backup.
+			logger.Printf("Download of %s stopped before the Lambda deadline, requesting resume\n", logFileRecord.LogFileName)
+			err = requestResume(ctx, dynamoClient, tableName, logFileRecord.DBInstanceIdentifier, logFileRecord.LogFileName, logger)
+			if err != nil {
+				logger.Printf("Error requesting resume: %v\n", err)
+			}
+			reportFailure(record)
+			finish(logFileRecord, transfer, outcomeFailed)
+			continue
+		}
+		if err != nil {
+			if errors.Is(err, errMarkerLoop) {
+				retries.MarkerLoops++
+			}
+			failBackup(record, logFileRecord, transfer, err, recordError(ErrDownloadFailed, logFileRecord, err), "")
+			continue
+		}
+
+		result.Duration = time.Since(downloadStart)
+
+		// Read the uploaded object back before recording it as the backup
+		if !result.Skipped {
+			result.VersionID, err = verifyUpload(ctx, s3Client, bucketName, result.S3Key, result.Bytes, logger)
+			if err != nil {
+				if errors.Is(err, errUploadMismatch) {
+					deps.emitVerificationFailure(logger)
+				}
+				failBackup(record, logFileRecord, transfer, err, recordError(ErrUploadFailed, logFileRecord, fmt.Errorf("verifying upload: %w", err)), result.S3Key)
+				continue
+			}
+		}
+
+		// Copy the new object to the DR bucket before the backup is recorded, so a required copy that failed
+		// is retried with the backup
+		if cfg.DRBucketName != "" && !result.Skipped {
+			err = copyToDR(ctx, deps.DRS3, bucketName, cfg.DRBucketName, result.S3Key, result.VersionID, result.Bytes, logger)
+			if err != nil {
+				logger.Printf("Error copying log file to DR bucket %s: %v\n", cfg.DRBucketName, err)
+				deps.emitDRFailure(logger)
+				if cfg.DRRequired {
+					failBackup(record, logFileRecord, transfer, err, recordError(ErrUploadFailed, logFileRecord, fmt.Errorf("copying to DR bucket %s: %w", cfg.DRBucketName, err)), result.S3Key)
+					continue
+				}
+			}
+		}
+
+		// Update LastBackup timestamp in DynamoDB, even when the unchanged content wasn't uploaded again
+		err = updateLastBackup(ctx, dynamoClient, tableName, bucketName, logFileRecord, result, logger)
+		if err != nil {
+			failBackup(record, logFileRecord, transfer, err, recordError(ErrRecordUpdate, logFileRecord, fmt.Errorf("updating LastBackup timestamp: %w", err)), result.S3Key)
+			continue
+		}
+
+		// A log file larger than MAX_FILE_BYTES is backed up in parts, one per download
+		outcome := outcomeSuccess
+		switch {
+		case result.Partial:
+			outcome = outcomePartial
+			deps.emitPartialBackup(logger)
+			deps.notify(ctx, cfg.SNSTopicARN, partialNotification(logFileRecord, result), logger)
+		case result.Skipped:
+			outcome = outcomeSkipped
+		}
+		finish(logFileRecord, transfer, outcome)
+
+		// A stale manifest is repaired by the next backup of the instance, so it doesn't fail this one
+		err = writeManifest(ctx, dynamoClient, s3Client, tableName, bucketName, cfg.S3Prefix, logFileRecord.DBInstanceIdentifier, timeutil.EpochMillis(time.Now()), opts.Encryption, logger)
+		if err != nil {
+			logger.Printf("Error writing manifest of instance %s: %v\n", logFileRecord.DBInstanceIdentifier, err)
+		}
+
+		logger.Printf("Successfully processed log file %s for instance %s\n", logFileRecord.LogFileName, logFileRecord.DBInstanceIdentifier)
+	}
+
+	if len(response.BatchItemFailures) > 0 {
+		logger.Printf("%d of %d stream records failed and will be retried, errors: %s\n", len(response.BatchItemFailures), len(event.Records), summarizeErrors(failures))
+	}
+	return response, nil
+}
+
+// backedUpSince reports whether the current record was backed up after a stream record was written.
+// LastBackup is compared with the next second, since the stream record's creation time is rounded down to
+// the second; a backup within that second is redone rather than risk skipping a change it didn't include.
+func backedUpSince(current *LogFileRecord, changedAt time.Time) bool {
+	if current == nil || current.Status != StatusDownloaded || changedAt.IsZero() {
+		return false
+	}
+	return timeutil.NormalizeMillis(current.LastBackup) >= timeutil.EpochMillis(changedAt.Add(time.Second))
+}
+
+// rdsConfig returns the configuration for the RDS client. When ASSUME_ROLE_ARN is set, the RDS client
+// assumes that role to reach instances in another account; the other clients stay in the local account.
+func rdsConfig(cfg aws.Config) aws.Config {
+	roleARN := os.Getenv("ASSUME_ROLE_ARN")
+	if roleARN == "" {
+		return cfg
+	}
+
+	rdsCfg := cfg.Copy()
+	rdsCfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), roleARN))
+	return rdsCfg
+}
+
+// isTTLExpiry reports whether a stream record was written by DynamoDB's TTL process
+func isTTLExpiry(record events.DynamoDBEventRecord) bool {
+	return record.UserIdentity != nil &&
+		record.UserIdentity.Type == "Service" &&
+		record.UserIdentity.PrincipalID == "dynamodb.amazonaws.com"
+}
+
+// unmarshalDynamoDBEvent unmarshals a DynamoDB event record into a struct
+func unmarshalDynamoDBEvent(image map[string]events.DynamoDBAttributeValue, out interface{}) error {
+	// Convert events.DynamoDBAttributeValue to map[string]interface{}
+	item := make(map[string]interface{})
+
+	// Special handling for numeric fields that might be strings
+	_, isLogRecord := out.(*LogFileRecord)
+
+	for k, v := range image {
+		switch v.DataType() {
+		case events.DataTypeString:
+			// Special handling for numeric fields that might be strings
+			if isLogRecord && numericRecordFields[k] {
+				// Try to convert string to int64
+				val, err := strconv.ParseInt(v.String(), 10, 64)
+				if err == nil {
+					item[k] = val
+				} else {
+					// If conversion fails, use the string value
+					item[k] = v.String()
+				}
+			} else {
+				item[k] = v.String()
+			}
+		case events.DataTypeNumber:
+			// For numeric fields, ensure they're parsed as int64
+			if isLogRecord && numericRecordFields[k] {
+				val, err := strconv.ParseInt(v.Number(), 10, 64)
+				if err == nil {
+					item[k] = val
+				} else {
+					item[k] = v.Number()
+				}
+			} else {
+				item[k] = v.Number()
+			}
+		case events.DataTypeBinary:
+			item[k] = v.Binary()
+		case events.DataTypeBoolean:
+			item[k] = v.Boolean()
+		case events.DataTypeNull:
+			item[k] = nil
+		case events.DataTypeList:
+			list := make([]interface{}, len(v.List()))
+			for i, lv := range v.List() {
+				var err error
+				list[i], err = convertDynamoDBAttributeValue(lv)
+				if err != nil {
+					return err
+				}
+			}
+			item[k] = list
+		case events.DataTypeMap:
+			m := make(map[string]interface{})
+			for mk, mv := range v.Map() {
+				var err error
+				m[mk], err = convertDynamoDBAttributeValue(mv)
+				if err != nil {
+					return err
+				}
+			}
+			item[k] = m
+		default:
+			return fmt.Errorf("unsupported data type: %v", v.DataType())
+		}
+	}
+
+	// Use attributevalue to unmarshal the map into the struct
+	av, err := attributevalue.MarshalMap(item)
+	if err != nil {
+		return err
+	}
+
+	return attributevalue.UnmarshalMap(av, out)
+}
+
+// convertDynamoDBAttributeValue converts a DynamoDB attribute value to a Go type
+func convertDynamoDBAttributeValue(v events.DynamoDBAttributeValue) (interface{}, error) {
+	switch v.DataType() {
+	case events.DataTypeString:
+		return v.String(), nil
+	case events.DataTypeNumber:
+		return v.Number(), nil
+	case events.DataTypeBinary:
+		return v.Binary(), nil
+	case events.DataTypeBoolean:
+		return v.Boolean(), nil
+	case events.DataTypeNull:
+		return nil, nil
+	case events.DataTypeList:
+		list := make([]interface{}, len(v.List()))
+		for i, lv := range v.List() {
+			var err error
+			list[i], err = convertDynamoDBAttributeValue(lv)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case events.DataTypeMap:
+		m := make(map[string]interface{})
+		for mk, mv := range v.Map() {
+			var err error
+			m[mk], err = convertDynamoDBAttributeValue(mv)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("unsupported data type: %v", v.DataType())
+	}
+}
+
+// shouldDownload determines if a log file should be downloaded based on changes
+func shouldDownload(oldImage, newImage map[string]events.DynamoDBAttributeValue, logger *log.Logger) bool {
+	// The detector released a log file that was waiting for its writes to settle. Status is also written
+	// by the downloader's own checkpoints, so this is checked first.
+	if newImage["Status"].String() == StatusPending && oldImage["Status"].String() == StatusWaiting {
+		return true
+	}
+
+	// Ignore the MODIFY events caused by our own checkpoint writes
+	if onlyCheckpointChanged(oldImage, newImage) {
+		return false
+	}
+
+	// Files that are gone from the instance can't be downloaded
+	if deleted, ok := newImage["Deleted"]; ok && deleted.DataType() == events.DataTypeBoolean && deleted.Boolean() {
+		return false
+	}
+
+	// A download stopped before the Lambda deadline asked to be resumed,
+	// or an on-demand backup asked for the file regardless of LastBackup
+	for _, requestAttribute := range []string{"DownloadResumeRequestedAt", "DownloadRequestedAt"} {
+		if _, ok := newImage[requestAttribute]; ok && !attributeEqual(oldImage, newImage, requestAttribute) {
+			return true
+		}
+	}
+
+	// Ignore the MODIFY events caused by recording a backup. updateLastBackup writes to the table feeding this
+	// stream, so each backup would otherwise invoke the downloader again for the same file.
+	if onlyChanged(oldImage, newImage, checkpointAttributes, backupAttributes) {
+		return false
+	}
+
+	// If Size or LastWritten has changed, download the log file.
+	// An old image without the attribute, e.g. written before it existed, counts as a change.
+	for _, name := range []string{"Size", "LastWritten"} {
+		newValue, ok := newImage[name]
+		if !ok {
+			continue
+		}
+		oldValue, ok := oldImage[name]
+		if !ok || oldValue.Number() != newValue.Number() {
+			return true
+		}
+	}
+
+	// If LastBackup doesn't exist or is older than 24 hours, download the log file
+	lastBackup, exists := newImage["LastBackup"]
+	if !exists {
+		return true
+	}
+
+	lastBackupStr := lastBackup.Number()
+	lastBackupVal, err := strconv.ParseInt(lastBackupStr, 10, 64)
+	if err != nil {
+		logger.Printf("Error parsing LastBackup: %v\n", err)
+		return true
+	}
+
+	return backupDue(lastBackupVal, time.Now())
+}
+
+// writtenWithin reports whether a log file last written at lastWritten (epoch milliseconds) was written less than
+// window before now. A window of 0 never holds a log file back.
+func writtenWithin(lastWritten int64, window time.Duration, now time.Time) bool {
+	return window > 0 && timeutil.Since(timeutil.NormalizeMillis(lastWritten), now) < window
+}
+
+// backupInterval is how long after its last backup an unchanged log file is backed up again
+const backupInterval = 24 * time.Hour
+
+// backupDue reports whether a log file backed up at lastBackup is due for another backup at now.
+// LastBackup is in epoch milliseconds; records written in seconds by earlier versions are still understood.
+func backupDue(lastBackup int64, now time.Time) bool {
+	return timeutil.Since(timeutil.NormalizeMillis(lastBackup), now) > backupInterval
+}
+
+// onlyCheckpointChanged reports whether the only attributes that differ between the images are the download checkpoint
+func onlyCheckpointChanged(oldImage, newImage map[string]events.DynamoDBAttributeValue) bool {
+	return onlyChanged(oldImage, newImage, checkpointAttributes)
+}
+
+// onlyChanged reports whether some attributes differ between the images and all of them are in one of the sets
+func onlyChanged(oldImage, newImage map[string]events.DynamoDBAttributeValue, attributeSets ...map[string]bool) bool {
+	changed := diffImages(oldImage, newImage)
+	for _, name := range changed {
+		if !slices.ContainsFunc(attributeSets, func(attributes map[string]bool) bool { return attributes[name] }) {
+			return false
+		}
+	}
+
+	return len(changed) > 0
+}
+
+// diffImages returns the sorted names of the attributes that were added, removed or changed between the images
+func diffImages(oldImage, newImage map[string]events.DynamoDBAttributeValue) []string {
+	var changed []string
+	for _, image := range []map[string]events.DynamoDBAttributeValue{oldImage, newImage} {
+		for name := range image {
+			if !attributeEqual(oldImage, newImage, name) && !slices.Contains(changed, name) {
+				changed = append(changed, name)
+			}
+		}
+	}
+	slices.Sort(changed)
+
+	return changed
+}
+
+// attributeEqual reports whether an attribute has the same value in both images
+func attributeEqual(oldImage, newImage map[string]events.DynamoDBAttributeValue, name string) bool {
+	oldValue, oldOk := oldImage[name]
+	newValue, newOk := newImage[name]
+	if oldOk != newOk {
+		return false
+	}
+	if !oldOk {
+		return true
+	}
+
+	oldJSON, err := json.Marshal(oldValue)
+	if err != nil {
+		return false
+	}
+	newJSON, err := json.Marshal(newValue)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(oldJSON, newJSON)
+}
+
+// downloadLogFile downloads a log file from an Aurora DB instance and streams it to S3.
+// Files larger than a single part (opts.PartSize) are written as a multipart upload, and the marker and byte offset
+// reached are checkpointed after every part so a later invocation can resume instead of restarting.
+// The object is uploaded with contentType and the metadata attached. Unless opts.ForceUpload is set, content whose MD5
+// matches the record's LastChecksum, of the same opts.ChecksumAlgorithm, is not written again to the same S3 key.
+// When the Lambda deadline is within opts.SafetyMargin, no further portion is requested and
+// errDeadlineReached is returned; the data since the last checkpointed part is downloaded again on resume.
+// A portion call still in flight when the safety margin is reached is cancelled with the same result.
+// With opts.DryRun, only the byte count and checksum are computed; nothing is written to S3 or DynamoDB.
+// With OutputFormat set to outputFormatNDJSON or outputFormatJSONL, the log file is uploaded converted to JSON.
+// The checksum stays that of the downloaded content, while the byte counts are those of the uploaded object.
+// With Compression set to compressionGzip, every part is uploaded as a gzip member; result.RawBytes
+// and the checksum still cover the uncompressed content.
+// With opts.Delta, the download starts at the record's LastMarker and result.RawBytes only counts what was
+// appended since, while the checksum continues from LastHashState to cover the whole log file. errMarkerRejected
+// is returned when RDS rejects LastMarker.
+func downloadLogFile(ctx context.Context, rdsClient RDSLogAPI, s3Client S3Putter, dynamoClient DynamoUpdater, tableName, bucketName, s3Key, contentType string, metadata map[string]string, opts downloadOptions, record LogFileRecord, logger *log.Logger) (downloadResult, error) {
+	dbInstanceID, logFileName := record.DBInstanceIdentifier, record.LogFileName
+	logger.Printf("Downloading log file %s from instance %s\n", logFileName, dbInstanceID)
+
+	var buffer bytes.Buffer
+	var marker *string
+	var upload *multipartUpload
+	var downloadedBytes int64
+	var rawBytes int64
+	var uploadLastWritten int64 // LastWritten the multipart upload's metadata was created with
+	var partial bool            // Stopped at opts.MaxBytes
+	algorithm := checksum.Normalize(opts.ChecksumAlgorithm)
+	contentHash, err := checksum.New(algorithm)
+	if err != nil {
+		return downloadResult{}, err
+	}
+	lines := &portionLines{lines: opts.PortionLines}
+	partSize := opts.partSize()
+
+	// The downloaded data is written to the buffer directly or through the JSON conversion and compression.
+	// Every part is compressed as a gzip member of its own, so a resumed download starts a new member
+	// instead of needing the compressor's state; concatenated members decompress as a single stream.
+	contentEncoding := objectContentEncoding(opts)
+	var out io.Writer = &buffer
+	var compressor *gzip.Writer
+	if opts.Compression == compressionGzip {
+		compressor = gzip.NewWriter(&buffer)
+		out = compressor
+	}
+	var converter *auditlog.Writer
+	if rawField, ok := rawFields[opts.OutputFormat]; ok {
+		converter = auditlog.NewWriter(out, rawField)
+		out = converter
+	}
+
+	// A download starts at the beginning of the log file, or at the end of the last backup for a delta
+	start := func() error {
+		contentHash.Reset()
+		marker = nil
+		if !opts.Delta {
+			return nil
+		}
+		marker = aws.String(record.LastMarker)
+		return restoreHashState(contentHash, record.LastHashState)
+	}
+	if err := start(); err != nil {
+		return downloadResult{}, fmt.Errorf("restoring the checksum state of the last backup: %w", err)
+	}
+
+	// Resume from the checkpoint left by an interrupted download. A dry run always starts over
+	// since it doesn't upload the parts.
+	if !opts.DryRun && record.DownloadUploadId != "" && record.DownloadMarker != "" {
+		// The upload continues under the key it was started with, which depends on the LastWritten time then.
+		// Checkpoints saved before the key was recorded were started under the current key.
+		uploadKey := s3Key
+		if record.DownloadS3Key != "" {
+			uploadKey = record.DownloadS3Key
+		}
+
+		// A download that restarts leaves the checkpointed parts behind, so their upload is aborted
+		abortStale := func() {
+			stale := &multipartUpload{client: s3Client, bucket: bucketName, key: uploadKey, uploadID: record.DownloadUploadId}
+			if err := stale.abort(ctx, logger); err != nil {
+				logger.Printf("Error aborting multipart upload %s: %v\n", record.DownloadUploadId, err)
+			}
+		}
+
+		if logFileRotated(record) {
+			// The checkpointed parts belong to the previous generation of the file
+			logger.Printf("Log file %s shrank to %d bytes since the checkpoint at %d bytes, restarting download\n", logFileName, record.Size, record.DownloadedBytes)
+			abortStale()
+		} else if err := restoreHashState(contentHash, record.DownloadHashState); err != nil {
+			logger.Printf("Checksum state of %s can't be restored, restarting download: %v\n", logFileName, err)
+			abortStale()
+			if err := start(); err != nil {
+				return downloadResult{}, err
+			}
+		} else {
+			resumed, err := resumeMultipartUpload(ctx, s3Client, bucketName, uploadKey, record.DownloadUploadId, record.DownloadedBytes, logger)
+			if err != nil {
+				var noSuchUpload *s3types.NoSuchUpload
+				if !errors.As(err, &noSuchUpload) {
+					return downloadResult{}, uploadError(err)
+				}
+				logger.Printf("Multipart upload %s no longer exists, restarting download of %s\n", record.DownloadUploadId, logFileName)
+				if err := start(); err != nil {
+					return downloadResult{}, err
+				}
+			} else {
+				upload = resumed
+				uploadLastWritten = record.DownloadLastWritten
+				s3Key = uploadKey
+				marker = aws.String(record.DownloadMarker)
+				downloadedBytes = record.DownloadedBytes
+				rawBytes = record.DownloadRawBytes
+				logger.Printf("Resuming download of %s at marker %s (%d bytes already uploaded)\n", logFileName, record.DownloadMarker, downloadedBytes)
+			}
+		}
+	}
+
+	// Use pagination to download the entire log file
+	repeatedMarkers := 0
+	for portions := 0; ; portions++ {
+		if portions == maxPortions {
+			return downloadResult{}, fmt.Errorf("log file %s has more than %d portions", logFileName, maxPortions)
+		}
+
+		// Stop while there is still time to record the resume request
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < opts.SafetyMargin {
+			logger.Printf("Less than %s left before the Lambda deadline, stopping download of %s at %d bytes\n", opts.SafetyMargin, logFileName, downloadedBytes)
+			return downloadResult{}, errDeadlineReached
+		}
+
+		// A portion call, with its retries, only gets the time left before the safety margin
+		timeout, budgeted := portionTimeout, false
+		if deadline, ok := ctx.Deadline(); ok {
+			if budget := time.Until(deadline) - opts.SafetyMargin; budget < timeout {
+				timeout, budgeted = budget, true
+			}
+		}
+		portionCtx, cancel := context.WithTimeout(ctx, timeout)
+		resp, err := rdsClient.DownloadDBLogFilePortion(portionCtx, &rds.DownloadDBLogFilePortionInput{
+			DBInstanceIdentifier: aws.String(dbInstanceID),
+			LogFileName:          aws.String(logFileName),
+			Marker:               marker,
+			NumberOfLines:        aws.Int32(lines.lines),
+		})
+		outOfBudget := budgeted && errors.Is(portionCtx.Err(), context.DeadlineExceeded)
+		cancel()
+		if err != nil {
+			if outOfBudget && ctx.Err() == nil {
+				logger.Printf("Portion of %s didn't complete before the safety margin, stopping download at %d bytes\n", logFileName, downloadedBytes)
+				return downloadResult{}, errDeadlineReached
+			}
+			if opts.Delta && portions == 0 && upload == nil && isMarkerRejected(err) {
+				return downloadResult{}, fmt.Errorf("%w: %w", errMarkerRejected, err)
+			}
+			return downloadResult{}, err
+		}
+
+		// A portion that returns the marker it was requested with hasn't advanced, and its data would be
+		// downloaded again. The marker is requested again after a wait, in case RDS recovers, e.g. from a failover.
+		pending := aws.ToBool(resp.AdditionalDataPending)
+		if pending && marker != nil && aws.ToString(resp.Marker) == *marker {
+			repeatedMarkers++
+			if repeatedMarkers == maxRepeatedMarkers {
+				return downloadResult{}, fmt.Errorf("%w: RDS returned marker %q of log file %s %d times in a row with more data pending", errMarkerLoop, *marker, logFileName, repeatedMarkers)
+			}
+			logger.Printf("Marker %q of log file %s did not advance, requesting it again\n", *marker, logFileName)
+			select {
+			case <-ctx.Done():
+				return downloadResult{}, ctx.Err()
+			case <-time.After(time.Duration(repeatedMarkers) * repeatedMarkerDelay):
+			}
+			continue
+		}
+		repeatedMarkers = 0
+
+		// Append the log file portion to the buffer and the checksum
+		if resp.LogFileData != nil {
+			if _, err := io.WriteString(out, *resp.LogFileData); err != nil {
+				return downloadResult{}, err
+			}
+			io.WriteString(contentHash, *resp.LogFileData)
+			rawBytes += int64(len(*resp.LogFileData))
+			lines.observe(len(*resp.LogFileData), logFileName, logger)
+		}
+		marker = resp.Marker
+
+		// Check if there are more pages
+		if !pending {
+			break
+		}
+
+		// Stop at the byte budget and back up what was downloaded, up to a record boundary for JSON
+		if opts.MaxBytes > 0 && rawBytes >= opts.MaxBytes && (converter == nil || !converter.Pending()) {
+			logger.Printf("Log file %s is larger than MAX_FILE_BYTES, stopping after %d bytes\n", logFileName, rawBytes)
+			partial = true
+			break
+		}
+
+		// A dry run only counts the bytes of a full part
+		if opts.DryRun && buffer.Len() >= partSize {
+			downloadedBytes += int64(buffer.Len())
+			buffer.Reset()
+			continue
+		}
+
+		// Flush a full part to S3 and checkpoint the position it covers. A line held back by the
+		// JSON conversion would be lost on resume, so a part only ends at a record boundary.
+		if buffer.Len() >= partSize && (converter == nil || !converter.Pending()) {
+			if compressor != nil {
+				if err := compressor.Close(); err != nil {
+					return downloadResult{}, err
+				}
+			}
+			if upload == nil {
+				upload, err = createMultipartUpload(ctx, s3Client, bucketName, s3Key, contentType, contentEncoding, metadata, opts.Encryption, logger)
+				if err != nil {
+					return downloadResult{}, uploadError(err)
+				}
+				uploadLastWritten = record.LastWritten
+			}
+
+			err = upload.uploadPart(ctx, buffer.Bytes(), logger)
+			if err != nil {
+				return downloadResult{}, uploadError(err)
+			}
+			downloadedBytes += int64(buffer.Len())
+			buffer.Reset()
+			if compressor != nil {
+				compressor.Reset(&buffer)
+			}
+
+			hashState, err := marshalHashState(contentHash)
+			if err != nil {
+				return downloadResult{}, err
+			}
+
+			if opts.NoCheckpoints {
+				continue
+			}
+			err = saveDownloadCheckpoint(ctx, dynamoClient, tableName, record, aws.ToString(marker), downloadedBytes, rawBytes, upload.uploadID, s3Key, uploadLastWritten, hashState, logger)
+			if err != nil {
+				return downloadResult{}, err
+			}
+		}
+	}
+	if converter != nil {
+		if err := converter.Close(); err != nil {
+			return downloadResult{}, err
+		}
+	}
+	if compressor != nil {
+		if err := compressor.Close(); err != nil {
+			return downloadResult{}, err
+		}
+	}
+	downloadedBytes += int64(buffer.Len())
+	logger.Printf("Downloaded %d bytes from log file %s\n", rawBytes, logFileName)
+
+	hashState, err := marshalHashState(contentHash)
+	if err != nil {
+		return downloadResult{}, err
+	}
+	result := downloadResult{
+		Bytes:     downloadedBytes,
+		RawBytes:  rawBytes,
+		Checksum:  hex.EncodeToString(contentHash.Sum(nil)),
+		S3Key:     s3Key,
+		Marker:    aws.ToString(marker),
+		HashState: hashState,
+		Delta:     opts.Delta,
+		Partial:   partial,
+
+		ChecksumAlgorithm: algorithm,
+	}
+	sum := contentChecksum{Algorithm: algorithm, Value: result.Checksum}
+	if partial {
+		metadata = maps.Clone(metadata)
+		if metadata == nil {
+			metadata = make(map[string]string)
+		}
+		metadata["partial"] = "true"
+	}
+	// Nothing was appended when a delta leaves the checksum of the whole file unchanged
+	sameChecksum := result.Checksum == record.LastChecksum && algorithm == checksum.Normalize(record.LastChecksumAlgorithm)
+	result.Skipped = !opts.ForceUpload && sameChecksum && (opts.Delta || s3Key == record.LastS3Key)
+
+	if opts.DryRun {
+		return result, nil
+	}
+
+	// Small files never need a multipart upload
+	if upload == nil {
+		if result.Skipped {
+			logger.Printf("Log file %s is unchanged (checksum %s), skipping upload\n", logFileName, result.Checksum)
+			return result, nil
+		}
+		return result, uploadError(uploadToS3(ctx, s3Client, bucketName, s3Key, contentType, contentEncoding, buffer.Bytes(), metadata, sum, opts.Encryption, opts.ForceUpload, logger))
+	}
+
+	// Discard the parts of an unchanged file instead of replacing the existing object
+	if result.Skipped {
+		logger.Printf("Log file %s is unchanged (checksum %s), aborting multipart upload\n", logFileName, result.Checksum)
+		return result, uploadError(upload.abort(ctx, logger))
+	}
+
+	// Upload the remainder as the last part and complete the upload
+	if buffer.Len() > 0 {
+		err := upload.uploadPart(ctx, buffer.Bytes(), logger)
+		if err != nil {
+			return downloadResult{}, uploadError(err)
+		}
+	}
+
+	completed, err := upload.complete(ctx, opts.ForceUpload, sum, result.Bytes, logger)
+	if err != nil || !completed {
+		return result, uploadError(err)
+	}
+
+	// The content checksum is only known once every part is uploaded, so it is added to the metadata of the
+	// completed object, which lets the next backup to this key leave it alone. A resumed upload also carries
+	// the metadata of the invocation that created it, which didn't know the backup would be partial.
+	err = upload.replaceMetadata(ctx, contentType, contentEncoding, withChecksum(metadata, sum), opts.Encryption, logger)
+	if err != nil {
+		return downloadResult{}, uploadError(err)
+	}
+
+	return result, nil
+}
+
+// partSize returns the bytes buffered per multipart upload part
+func (opts downloadOptions) partSize() int {
+	if opts.PartSize > 0 {
+		return opts.PartSize
+	}
+	return multipartPartSize
+}
+
+// portionLines is the number of lines requested per log file portion. Portions close to portionSizeCap
+// risk being truncated, so the line count is halved when they keep coming back near the cap.
+type portionLines struct {
+	lines   int32
+	nearCap int // Consecutive portions near the cap
+}
+
+// observe records the size of a downloaded portion and halves the line count after nearCapPortions
+// consecutive portions within 10% of portionSizeCap
+func (p *portionLines) observe(size int, logFileName string, logger *log.Logger) {
+	if size < portionSizeCap*9/10 {
+		p.nearCap = 0
+		return
+	}
+
+	p.nearCap++
+	if p.nearCap < nearCapPortions || p.lines == 1 {
+		return
+	}
+
+	p.nearCap = 0
+	previous := p.lines
+	p.lines = max(p.lines/2, 1)
+	logger.Printf("Portions of %s are close to the %d byte limit, reducing lines per portion from %d to %d\n", logFileName, portionSizeCap, previous, p.lines)
+}
+
+// logFileRotated reports whether the log file is smaller than when its download was checkpointed,
+// which means it was rotated and the checkpoint no longer applies. The downloaded bytes are only compared
+// for checkpoints without the file size, since they exceed it once the log file is converted to JSON.
+func logFileRotated(record LogFileRecord) bool {
+	if record.DownloadFileSize > 0 {
+		return record.Size < record.DownloadFileSize
+	}
+	return record.Size < record.DownloadedBytes
+}
+
+// marshalHashState serializes the internal state of a checksum so it can be checkpointed
+func marshalHashState(h hash.Hash) (string, error) {
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(state), nil
+}
+
+// restoreHashState restores a checksum from a checkpointed state
+func restoreHashState(h hash.Hash, hashState string) error {
+	if hashState == "" {
+		return errors.New("no checksum state in checkpoint")
+	}
+	state, err := base64.StdEncoding.DecodeString(hashState)
+	if err != nil {
+		return err
+	}
+	return h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+}
+
+// saveDownloadCheckpoint persists the marker and byte offset reached by an in-progress download,
+// together with the current size of the file and the key and the LastWritten in the metadata of the upload
+func saveDownloadCheckpoint(ctx context.Context, client DynamoUpdater, tableName string, record LogFileRecord, marker string, downloadedBytes, rawBytes int64, uploadID, uploadKey string, uploadLastWritten int64, hashState string, logger *log.Logger) error {
+	logger.Printf("Saving download checkpoint for log file %s at marker %s (%d bytes)\n", record.LogFileName, marker, downloadedBytes)
+
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"DBInstanceIdentifier": &types.AttributeValueMemberS{Value: record.DBInstanceIdentifier},
+			"LogFileName":          &types.AttributeValueMemberS{Value: record.LogFileName},
+		},
+		UpdateExpression: aws.String("SET DownloadMarker = :marker, DownloadedBytes = :downloadedBytes, DownloadRawBytes = :rawBytes, DownloadUploadId = :uploadId, DownloadHashState = :hashState, DownloadFileSize = :fileSize, DownloadLastWritten = :lastWritten, DownloadS3Key = :uploadKey"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":marker":          &types.AttributeValueMemberS{Value: marker},
+			":downloadedBytes": &types.AttributeValueMemberN{Value: strconv.FormatInt(downloadedBytes, 10)},
+			":rawBytes":        &types.AttributeValueMemberN{Value: strconv.FormatInt(rawBytes, 10)},
+			":uploadId":        &types.AttributeValueMemberS{Value: uploadID},
+			":hashState":       &types.AttributeValueMemberS{Value: hashState},
+			":fileSize":        &types.AttributeValueMemberN{Value: strconv.FormatInt(record.Size, 10)},
+			":lastWritten":     &types.AttributeValueMemberN{Value: strconv.FormatInt(uploadLastWritten, 10)},
+			":uploadKey":       &types.AttributeValueMemberS{Value: uploadKey},
+		},
+	})
+
+	return err
+}
+
+// requestResume touches the record so its stream event triggers a new invocation that resumes the download
+func requestResume(ctx context.Context, client DynamoUpdater, tableName, dbInstanceID, logFileName string, logger *log.Logger) error {
+	logger.Printf("Requesting resume of the download of log file %s\n", logFileName)
+
+	now := time.Now().UnixNano()
+
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"DBInstanceIdentifier": &types.AttributeValueMemberS{Value: dbInstanceID},
+			"LogFileName":          &types.AttributeValueMemberS{Value: logFileName},
+		},
+		UpdateExpression: aws.String("SET DownloadResumeRequestedAt = :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(now, 10)},
+		},
+	})
+
+	return err
+}
 
-	// Get environment variables
-	tableName := os.Getenv("DYNAMODB_TABLE_NAME")
-	if tableName == "" {
-		logger.Println("Error: DYNAMODB_TABLE_NAME environment variable not set")
-		return nil
-	}
+// getLogFileRecord gets a log file record from DynamoDB
+func getLogFileRecord(ctx context.Context, client DynamoUpdater, tableName, dbInstanceID, logFileName string, logger *log.Logger) (*LogFileRecord, error) {
+	logger.Printf("Reading current record for log file %s\n", logFileName)
 
-	bucketName := os.Getenv("S3_BUCKET_NAME")
-	if bucketName == "" {
-		logger.Println("Error: S3_BUCKET_NAME environment variable not set")
-		return nil
+	resp, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"DBInstanceIdentifier": &types.AttributeValueMemberS{Value: dbInstanceID},
+			"LogFileName":          &types.AttributeValueMemberS{Value: logFileName},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	s3Prefix := os.Getenv("S3_PREFIX")
-	if s3Prefix == "" {
-		s3Prefix = "logs" // Default prefix
+	if len(resp.Item) == 0 {
+		// Item not found
+		return nil, nil
 	}
 
-	// Load AWS configuration
-	cfg, err := config.LoadDefaultConfig(ctx)
+	// Unmarshal the item into a LogFileRecord
+	var record LogFileRecord
+	err = attributevalue.UnmarshalMap(resp.Item, &record)
 	if err != nil {
-		logger.Printf("Error loading AWS config: %v\n", err)
-		return err
+		return nil, err
 	}
 
-	// Create clients
-	rdsClient := rds.NewFromConfig(cfg)
-	s3Client := s3.NewFromConfig(cfg)
-	dynamoClient := dynamodb.NewFromConfig(cfg)
-
-	// Process each DynamoDB stream record
-	for _, record := range event.Records {
-		// Skip records that are not INSERT or MODIFY
-		if record.EventName != "INSERT" && record.EventName != "MODIFY" {
-			continue
-		}
-
-		// Parse the DynamoDB record
-		var logFileRecord LogFileRecord
-		err := unmarshalDynamoDBEvent(record.Change.NewImage, &logFileRecord)
-		if err != nil {
-			logger.Printf("Error unmarshalling DynamoDB record: %v\n", err)
-			continue
-		}
-
-		// Skip if LastBackup is recent and Size/LastWritten haven't changed
-		if record.EventName == "MODIFY" && !shouldDownload(record.Change.OldImage, record.Change.NewImage, logger) {
-			logger.Printf("Skipping download for %s, no significant changes\n", logFileRecord.LogFileName)
-			continue
-		}
+	return &record, nil
+}
 
-		// Download the log file
-		logContent, err := downloadLogFile(ctx, rdsClient, logFileRecord.DBInstanceIdentifier, logFileRecord.LogFileName, logger)
-		if err != nil {
-			logger.Printf("Error downloading log file: %v\n", err)
-			continue
-		}
+// objectMetadata returns the user-defined S3 metadata for a log file record.
+// S3 always sets Last-Modified to the upload time, so the time the log was written is kept here instead.
+func objectMetadata(record LogFileRecord) map[string]string {
+	return map[string]string{
+		"last-written":       timeutil.FromEpochMillis(record.LastWritten).UTC().Format(time.RFC3339),
+		"last-written-epoch": strconv.FormatInt(record.LastWritten, 10),
+	}
+}
 
-		// Upload to S3
-		s3Key := fmt.Sprintf("%s/%s/%s", s3Prefix, logFileRecord.DBInstanceIdentifier, logFileRecord.LogFileName)
-		err = uploadToS3(ctx, s3Client, bucketName, s3Key, logContent, logger)
-		if err != nil {
-			logger.Printf("Error uploading to S3: %v\n", err)
-			continue
-		}
+// parseLogTypes parses the comma-separated LOG_TYPES value, defaulting to audit logs only
+func parseLogTypes(value string) (map[string]bool, error) {
+	if strings.TrimSpace(value) == "" {
+		value = defaultLogTypes
+	}
 
-		// Update LastBackup timestamp in DynamoDB
-		err = updateLastBackup(ctx, dynamoClient, tableName, logFileRecord.DBInstanceIdentifier, logFileRecord.LogFileName, logger)
-		if err != nil {
-			logger.Printf("Error updating LastBackup timestamp: %v\n", err)
+	logTypes := make(map[string]bool)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		switch entry {
+		case "":
 			continue
+		case logFileTypeAudit, logFileTypeError, logFileTypeSlowQuery, logFileTypeGeneral:
+			logTypes[entry] = true
+		default:
+			return nil, fmt.Errorf("unknown log file type %q", entry)
 		}
-
-		logger.Printf("Successfully processed log file %s for instance %s\n", logFileRecord.LogFileName, logFileRecord.DBInstanceIdentifier)
 	}
 
-	return nil
+	return logTypes, nil
 }
 
-// unmarshalDynamoDBEvent unmarshals a DynamoDB event record into a struct
-func unmarshalDynamoDBEvent(image map[string]events.DynamoDBAttributeValue, out interface{}) error {
-	// Convert events.DynamoDBAttributeValue to map[string]interface{}
-	item := make(map[string]interface{})
-
-	// Special handling for numeric fields that might be strings
-	_, isLogRecord := out.(*LogFileRecord)
-
-	for k, v := range image {
-		switch v.DataType() {
-		case events.DataTypeString:
-			// Special handling for numeric fields that might be strings
-			if isLogRecord && (k == "Size" || k == "LastWritten" || k == "LastBackup") {
-				// Try to convert string to int64
-				val, err := strconv.ParseInt(v.String(), 10, 64)
-				if err == nil {
-					item[k] = val
-				} else {
-					// If conversion fails, use the string value
-					item[k] = v.String()
-				}
-			} else {
-				item[k] = v.String()
-			}
-		case events.DataTypeNumber:
-			// For numeric fields, ensure they're parsed as int64
-			if isLogRecord && (k == "Size" || k == "LastWritten" || k == "LastBackup") {
-				val, err := strconv.ParseInt(v.Number(), 10, 64)
-				if err == nil {
-					item[k] = val
-				} else {
-					item[k] = v.Number()
-				}
-			} else {
-				item[k] = v.Number()
-			}
-		case events.DataTypeBinary:
-			item[k] = v.Binary()
-		case events.DataTypeBoolean:
-			item[k] = v.Boolean()
-		case events.DataTypeNull:
-			item[k] = nil
-		case events.DataTypeList:
-			list := make([]interface{}, len(v.List()))
-			for i, lv := range v.List() {
-				var err error
-				list[i], err = convertDynamoDBAttributeValue(lv)
-				if err != nil {
-					return err
-				}
-			}
-			item[k] = list
-		case events.DataTypeMap:
-			m := make(map[string]interface{})
-			for mk, mv := range v.Map() {
-				var err error
-				m[mk], err = convertDynamoDBAttributeValue(mv)
-				if err != nil {
-					return err
-				}
-			}
-			item[k] = m
-		default:
-			return fmt.Errorf("unsupported data type: %s", v.DataType())
-		}
+// recordLogType returns the log file type of a record; records without one predate classification and are audit logs
+func recordLogType(record LogFileRecord) string {
+	if record.LogFileType == "" {
+		return logFileTypeAudit
 	}
+	return record.LogFileType
+}
 
-	// Use attributevalue to unmarshal the map into the struct
-	av, err := attributevalue.MarshalMap(item)
-	if err != nil {
-		return err
+// logTypePrefix returns the S3 prefix of a log file type. Once LOG_TYPES enables more than audit logs,
+// each type is kept under its own "<type>/" prefix below S3_PREFIX; audit-only deployments keep their keys.
+func logTypePrefix(s3Prefix string, logTypes map[string]bool, logFileType string) string {
+	if len(logTypes) == 1 && logTypes[logFileTypeAudit] {
+		return s3Prefix
 	}
-
-	return attributevalue.UnmarshalMap(av, out)
+	return s3Prefix + "/" + logFileType
 }
 
-// convertDynamoDBAttributeValue converts a DynamoDB attribute value to a Go type
-func convertDynamoDBAttributeValue(v events.DynamoDBAttributeValue) (interface{}, error) {
-	switch v.DataType() {
-	case events.DataTypeString:
-		return v.String(), nil
-	case events.DataTypeNumber:
-		return v.Number(), nil
-	case events.DataTypeBinary:
-		return v.Binary(), nil
-	case events.DataTypeBoolean:
-		return v.Boolean(), nil
-	case events.DataTypeNull:
-		return nil, nil
-	case events.DataTypeList:
-		list := make([]interface{}, len(v.List()))
-		for i, lv := range v.List() {
-			var err error
-			list[i], err = convertDynamoDBAttributeValue(lv)
-			if err != nil {
-				return nil, err
-			}
-		}
-		return list, nil
-	case events.DataTypeMap:
-		m := make(map[string]interface{})
-		for mk, mv := range v.Map() {
-			var err error
-			m[mk], err = convertDynamoDBAttributeValue(mv)
-			if err != nil {
-				return nil, err
-			}
-		}
-		return m, nil
+// objectContentType returns the Content-Type of the object a log file of the type is uploaded as,
+// which depends on the output format in opts. A compressed object keeps the Content-Type of its
+// uncompressed content. Error logs may contain non-ASCII messages, so their charset is declared.
+func objectContentType(logFileType string, opts downloadOptions) string {
+	switch {
+	case rawFields[opts.OutputFormat] != "" && logFileType == logFileTypeAudit:
+		return "application/json"
+	case logFileType == logFileTypeError:
+		return "text/plain; charset=utf-8"
 	default:
-		return nil, fmt.Errorf("unsupported data type: %s", v.DataType())
+		return "text/plain"
 	}
 }
 
-// shouldDownload determines if a log file should be downloaded based on changes
-func shouldDownload(oldImage, newImage map[string]events.DynamoDBAttributeValue, logger *log.Logger) bool {
-	// If Size or LastWritten has changed, download the log file
-	if oldSize, ok := oldImage["Size"]; ok {
-		if newSize, ok := newImage["Size"]; ok {
-			if oldSize.Number() != newSize.Number() {
-				return true
-			}
-		}
+// objectContentEncoding returns the Content-Encoding of the uploaded objects, empty when they aren't compressed
+func objectContentEncoding(opts downloadOptions) string {
+	if opts.Compression == compressionGzip {
+		return "gzip"
 	}
+	return ""
+}
 
-	if oldLastWritten, ok := oldImage["LastWritten"]; ok {
-		if newLastWritten, ok := newImage["LastWritten"]; ok {
-			if oldLastWritten.Number() != newLastWritten.Number() {
-				return true
-			}
-		}
-	}
+// uploadToS3 uploads a log file to S3; contentEncoding is only set when it isn't empty. The checksum of the
+// downloaded content is added to the metadata, and S3 checks the object against its SHA-256. Unless overwrite
+// is set, an object already at the key is only replaced when it doesn't hold the content of the checksum.
+func uploadToS3(ctx context.Context, client S3Putter, bucketName, key, contentType, contentEncoding string, content []byte, metadata map[string]string, sum contentChecksum, encryption objectEncryption, overwrite bool, logger *log.Logger) error {
+	logger.Printf("Uploading log file to S3: s3://%s/%s\n", bucketName, key)
 
-	// If LastBackup doesn't exist or is older than 24 hours, download the log file
-	lastBackup, exists := newImage["LastBackup"]
-	if !exists {
-		return true
+	input := &s3.PutObjectInput{
+		Bucket:               aws.String(bucketName),
+		Key:                  aws.String(key),
+		Body:                 bytes.NewReader(content),
+		ContentType:          aws.String(contentType),
+		Metadata:             withChecksum(metadata, sum),
+		ServerSideEncryption: encryption.SSE,
+		SSEKMSKeyId:          encryption.kmsKeyID(),
+		ChecksumSHA256:       objectChecksum(content),
 	}
-
-	lastBackupStr := lastBackup.Number()
-	lastBackupVal, err := strconv.ParseInt(lastBackupStr, 10, 64)
-	if err != nil {
-		logger.Printf("Error parsing LastBackup: %v\n", err)
-		return true
+	if contentEncoding != "" {
+		input.ContentEncoding = aws.String(contentEncoding)
+	}
+	if !overwrite {
+		_, err := client.PutObject(ctx, input, ifAbsent)
+		if !objectExists(err) {
+			return err
+		}
+		same, err := holdsContent(ctx, client, bucketName, key, sum, int64(len(content)), logger)
+		if err != nil || same {
+			return err
+		}
+		input.Body = bytes.NewReader(content)
 	}
+	_, err := client.PutObject(ctx, input)
 
-	// If LastBackup is older than 24 hours, download the log file
-	twentyFourHoursAgo := time.Now().Unix() - 24*60*60
-	return lastBackupVal < twentyFourHoursAgo
+	return err
 }
 
-// downloadLogFile downloads a log file from an Aurora DB instance
-func downloadLogFile(ctx context.Context, client *rds.Client, dbInstanceID, logFileName string, logger *log.Logger) ([]byte, error) {
-	logger.Printf("Downloading log file %s from instance %s\n", logFileName, dbInstanceID)
+// markDownloading sets the record's status to DOWNLOADING and counts the attempt
+func markDownloading(ctx context.Context, client DynamoUpdater, tableName, dbInstanceID, logFileName string, logger *log.Logger) error {
+	logger.Printf("Marking log file %s as %s\n", logFileName, StatusDownloading)
 
-	var logContent bytes.Buffer
-	var marker *string
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"DBInstanceIdentifier": &types.AttributeValueMemberS{Value: dbInstanceID},
+			"LogFileName":          &types.AttributeValueMemberS{Value: logFileName},
+		},
+		UpdateExpression: aws.String("SET #status = :status, AttemptCount = if_not_exists(AttemptCount, :zero) + :one"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "Status", // STATUS is a DynamoDB reserved word
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status": &types.AttributeValueMemberS{Value: StatusDownloading},
+			":zero":   &types.AttributeValueMemberN{Value: "0"},
+			":one":    &types.AttributeValueMemberN{Value: "1"},
+		},
+	})
 
-	// Use pagination to download the entire log file
-	for {
-		resp, err := client.DownloadDBLogFilePortion(ctx, &rds.DownloadDBLogFilePortionInput{
-			DBInstanceIdentifier: aws.String(dbInstanceID),
-			LogFileName:          aws.String(logFileName),
-			Marker:               marker,
-		})
-		if err != nil {
-			return nil, err
-		}
+	return err
+}
 
-		// Append the log file portion to the buffer
-		if resp.LogFileData != nil {
-			logContent.WriteString(*resp.LogFileData)
-		}
+// decrementPendingCount takes a record that left PENDING off the PendingCount of its instance's summary item.
+// A summary without a positive count, e.g. one written before the record was counted, is left alone.
+func decrementPendingCount(ctx context.Context, client DynamoUpdater, tableName, dbInstanceID string, logger *log.Logger) error {
+	logger.Printf("Decrementing the pending count of instance %s\n", dbInstanceID)
 
-		// Check if there are more pages
-		if resp.AdditionalDataPending == nil || !*resp.AdditionalDataPending {
-			break
-		}
-		marker = resp.Marker
-	}
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"DBInstanceIdentifier": &types.AttributeValueMemberS{Value: dbInstanceID},
+			"LogFileName":          &types.AttributeValueMemberS{Value: store.SummarySortKey},
+		},
+		UpdateExpression:    aws.String("ADD PendingCount :minusOne"),
+		ConditionExpression: aws.String("PendingCount > :zero"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":minusOne": &types.AttributeValueMemberN{Value: "-1"},
+			":zero":     &types.AttributeValueMemberN{Value: "0"},
+		},
+	})
 
-	logger.Printf("Downloaded %d bytes from log file %s\n", logContent.Len(), logFileName)
-	return logContent.Bytes(), nil
+	var conditionalCheckFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionalCheckFailed) {
+		return nil
+	}
+	return err
 }
 
-// uploadToS3 uploads a log file to S3
-func uploadToS3(ctx context.Context, client *s3.Client, bucketName, key string, content []byte, logger *log.Logger) error {
-	logger.Printf("Uploading log file to S3: s3://%s/%s\n", bucketName, key)
+// markWaiting sets the record's status to WAITING, leaving the log file for a later stream event
+func markWaiting(ctx context.Context, client DynamoUpdater, tableName, dbInstanceID, logFileName string, logger *log.Logger) error {
+	logger.Printf("Marking log file %s as %s\n", logFileName, StatusWaiting)
 
-	_, err := client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:      aws.String(bucketName),
-		Key:         aws.String(key),
-		Body:        bytes.NewReader(content),
-		ContentType: aws.String("text/plain"),
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"DBInstanceIdentifier": &types.AttributeValueMemberS{Value: dbInstanceID},
+			"LogFileName":          &types.AttributeValueMemberS{Value: logFileName},
+		},
+		UpdateExpression: aws.String("SET #status = :status"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "Status", // STATUS is a DynamoDB reserved word
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status": &types.AttributeValueMemberS{Value: StatusWaiting},
+		},
 	})
 
 	return err
 }
 
-// updateLastBackup updates the LastBackup timestamp in DynamoDB
-func updateLastBackup(ctx context.Context, client *dynamodb.Client, tableName, dbInstanceID, logFileName string, logger *log.Logger) error {
-	logger.Printf("Updating LastBackup timestamp for log file %s\n", logFileName)
-
-	now := time.Now().Unix()
+// markFailed sets the record's status to FAILED with the error that ended the download.
+// A failure to record the status is only logged, since the download error is what gets reported.
+func markFailed(ctx context.Context, client DynamoUpdater, tableName, dbInstanceID, logFileName string, downloadErr error, logger *log.Logger) {
+	logger.Printf("Marking log file %s as %s\n", logFileName, StatusFailed)
 
 	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
 		TableName: aws.String(tableName),
@@ -325,15 +2000,111 @@ func updateLastBackup(ctx context.Context, client *dynamodb.Client, tableName, d
 			"DBInstanceIdentifier": &types.AttributeValueMemberS{Value: dbInstanceID},
 			"LogFileName":          &types.AttributeValueMemberS{Value: logFileName},
 		},
-		UpdateExpression: aws.String("SET LastBackup = :lastBackup"),
+		UpdateExpression: aws.String("SET #status = :status, ErrorMessage = :error, LastError = :error"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "Status",
+		},
 		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":lastBackup": &types.AttributeValueMemberN{Value: strconv.FormatInt(now, 10)},
+			":status": &types.AttributeValueMemberS{Value: StatusFailed},
+			":error":  &types.AttributeValueMemberS{Value: downloadErr.Error()},
+		},
+	})
+	if err != nil {
+		logger.Printf("Error updating status: %v\n", err)
+	}
+}
+
+// updateLastBackup updates the LastBackup timestamp, S3 key, checksum, sizes and the marker reached in DynamoDB,
+// marks the record DOWNLOADED and clears the download checkpoint, error and attempt count.
+// A delta download is recorded as the next part of the last backup, whose S3 key is kept.
+func updateLastBackup(ctx context.Context, client DynamoUpdater, tableName, bucketName string, record LogFileRecord, result downloadResult, logger *log.Logger) error {
+	logger.Printf("Updating LastBackup timestamp for log file %s\n", record.LogFileName)
+
+	now := timeutil.EpochMillis(time.Now())
+
+	// A partial backup is continued from LastMarker by the next download
+	status := StatusDownloaded
+	if result.Partial {
+		status = StatusPartial
+	}
+
+	// The parts appended to a backup are kept until a new object replaces it
+	s3Key, markerBytes, partCount := result.S3Key, result.RawBytes, record.LastPartCount
+	switch {
+	case result.Delta:
+		s3Key, markerBytes = record.LastS3Key, record.LastMarkerBytes+result.RawBytes
+		if !result.Skipped {
+			partCount++
+		}
+	case !result.Skipped:
+		partCount = 0
+	}
+
+	values := map[string]types.AttributeValue{
+		":lastBackup":  &types.AttributeValueMemberN{Value: strconv.FormatInt(now, 10)},
+		":s3Key":       &types.AttributeValueMemberS{Value: s3Key},
+		":checksum":    &types.AttributeValueMemberS{Value: result.Checksum},
+		":algorithm":   &types.AttributeValueMemberS{Value: checksum.Normalize(result.ChecksumAlgorithm)},
+		":rawSize":     &types.AttributeValueMemberN{Value: strconv.FormatInt(result.RawBytes, 10)},
+		":objectSize":  &types.AttributeValueMemberN{Value: strconv.FormatInt(result.Bytes, 10)},
+		":marker":      &types.AttributeValueMemberS{Value: result.Marker},
+		":markerBytes": &types.AttributeValueMemberN{Value: strconv.FormatInt(markerBytes, 10)},
+		":hashState":   &types.AttributeValueMemberS{Value: result.HashState},
+		":partCount":   &types.AttributeValueMemberN{Value: strconv.FormatInt(partCount, 10)},
+		":status":      &types.AttributeValueMemberS{Value: status},
+		":bucket":      &types.AttributeValueMemberS{Value: bucketName},
+		":durationMs":  &types.AttributeValueMemberN{Value: strconv.FormatInt(result.Duration.Milliseconds(), 10)},
+	}
+	set := "LastBackup = :lastBackup, LastS3Key = :s3Key, LastChecksum = :checksum, LastChecksumAlgorithm = :algorithm, LastRawSize = :rawSize, LastObjectSize = :objectSize, LastMarker = :marker, LastMarkerBytes = :markerBytes, LastHashState = :hashState, LastPartCount = :partCount, #status = :status, LastS3Bucket = :bucket, LastBackupDurationMs = :durationMs"
+	remove := "DownloadMarker, DownloadedBytes, DownloadRawBytes, DownloadUploadId, DownloadHashState, DownloadFileSize, DownloadLastWritten, DownloadS3Key, DownloadResumeRequestedAt, ErrorMessage, AttemptCount"
+
+	if result.Partial {
+		set += ", LastBackupPartial = :partial"
+		values[":partial"] = &types.AttributeValueMemberBOOL{Value: true}
+	} else {
+		remove += ", LastBackupPartial"
+	}
+
+	// A skipped upload leaves the version of the object that was already backed up
+	switch {
+	case result.Skipped:
+	case result.VersionID != "":
+		set += ", LastS3VersionId = :versionId"
+		values[":versionId"] = &types.AttributeValueMemberS{Value: result.VersionID}
+	default:
+		remove += ", LastS3VersionId"
+	}
+
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"DBInstanceIdentifier": &types.AttributeValueMemberS{Value: record.DBInstanceIdentifier},
+			"LogFileName":          &types.AttributeValueMemberS{Value: record.LogFileName},
+		},
+		UpdateExpression: aws.String("SET " + set + " REMOVE " + remove),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "Status",
 		},
+		ExpressionAttributeValues: values,
 	})
 
 	return err
 }
 
 func main() {
-	lambda.Start(Handler)
+	// Fail the cold start instead of every invocation when the configuration is incomplete or invalid
+	if err := validateConfig(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	if _, err := loadDownloaderConfig(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+
+	// Load AWS configuration once per cold start
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Error loading AWS config: %v\n", err)
+	}
+
+	lambda.Start(NewHandler(NewHandlerDeps(cfg)))
 }
@@ -0,0 +1,1853 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"maps"
+	"math/rand/v2"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/checksum"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/timeutil"
+)
+
+var discardLogger = log.New(io.Discard, "", 0)
+
+func TestPortionLinesObserve(t *testing.T) {
+	nearCap := portionSizeCap * 9 / 10
+
+	tests := []struct {
+		name  string
+		lines int32
+		sizes []int
+		want  int32
+	}{
+		{name: "small portions keep the line count", lines: 10000, sizes: []int{1000, 2000, 3000}, want: 10000},
+		{name: "a single portion near the cap keeps the line count", lines: 10000, sizes: []int{nearCap}, want: 10000},
+		{name: "consecutive portions near the cap halve the line count", lines: 10000, sizes: []int{nearCap, portionSizeCap}, want: 5000},
+		{name: "a small portion resets the count", lines: 10000, sizes: []int{nearCap, nearCap - 1, nearCap}, want: 10000},
+		{name: "repeated halving", lines: 10000, sizes: []int{nearCap, nearCap, nearCap, nearCap}, want: 2500},
+		{name: "never below one line", lines: 1, sizes: []int{nearCap, nearCap, nearCap}, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &portionLines{lines: tt.lines}
+			for _, size := range tt.sizes {
+				p.observe(size, "audit/server_audit.log", discardLogger)
+			}
+			if p.lines != tt.want {
+				t.Errorf("lines = %d, want %d", p.lines, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackupDue(t *testing.T) {
+	now := time.UnixMilli(1_750_000_000_000)
+
+	tests := []struct {
+		name       string
+		lastBackup int64
+		want       bool
+	}{
+		{name: "never backed up", lastBackup: 0, want: true},
+		{name: "recent, milliseconds", lastBackup: now.Add(-time.Hour).UnixMilli(), want: false},
+		{name: "stale, milliseconds", lastBackup: now.Add(-25 * time.Hour).UnixMilli(), want: true},
+		{name: "recent, seconds", lastBackup: now.Add(-time.Hour).Unix(), want: false},
+		{name: "stale, seconds", lastBackup: now.Add(-25 * time.Hour).Unix(), want: true},
+		{name: "in the future", lastBackup: now.Add(time.Hour).UnixMilli(), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := backupDue(tt.lastBackup, now); got != tt.want {
+				t.Errorf("backupDue(%d) = %v, want %v", tt.lastBackup, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWrittenWithin(t *testing.T) {
+	now := time.UnixMilli(1_750_000_000_000)
+
+	tests := []struct {
+		name        string
+		lastWritten int64
+		window      time.Duration
+		want        bool
+	}{
+		{name: "written within the window", lastWritten: now.Add(-time.Minute).UnixMilli(), window: 5 * time.Minute, want: true},
+		{name: "settled", lastWritten: now.Add(-10 * time.Minute).UnixMilli(), window: 5 * time.Minute, want: false},
+		{name: "written within the window, seconds", lastWritten: now.Add(-time.Minute).Unix(), window: 5 * time.Minute, want: true},
+		{name: "no window", lastWritten: now.UnixMilli(), window: 0, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := writtenWithin(tt.lastWritten, tt.window, now); got != tt.want {
+				t.Errorf("writtenWithin(%d, %s) = %v, want %v", tt.lastWritten, tt.window, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShouldDownload(t *testing.T) {
+	recentBackup := events.NewNumberAttribute(strconv.FormatInt(time.Now().UnixMilli(), 10))
+	staleBackup := events.NewNumberAttribute(strconv.FormatInt(time.Now().Add(-25*time.Hour).UnixMilli(), 10))
+	// Written in epoch seconds by earlier versions of the Log Downloader
+	recentBackupSeconds := events.NewNumberAttribute(strconv.FormatInt(time.Now().Unix(), 10))
+	staleBackupSeconds := events.NewNumberAttribute(strconv.FormatInt(time.Now().Add(-25*time.Hour).Unix(), 10))
+
+	image := func(attributes map[string]events.DynamoDBAttributeValue) map[string]events.DynamoDBAttributeValue {
+		result := map[string]events.DynamoDBAttributeValue{
+			"DBInstanceIdentifier": events.NewStringAttribute("db-1"),
+			"LogFileName":          events.NewStringAttribute("audit/server_audit.log"),
+		}
+		for k, v := range attributes {
+			result[k] = v
+		}
+		return result
+	}
+
+	tests := []struct {
+		name     string
+		oldImage map[string]events.DynamoDBAttributeValue
+		newImage map[string]events.DynamoDBAttributeValue
+		want     bool
+	}{
+		{
+			name:     "unchanged with a recent backup",
+			oldImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LastWritten": events.NewNumberAttribute("1000"), "LastBackup": recentBackup}),
+			newImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LastWritten": events.NewNumberAttribute("1000"), "LastBackup": recentBackup, "ExpiresAt": events.NewNumberAttribute("1")}),
+			want:     false,
+		},
+		{
+			name:     "unchanged with a stale backup",
+			oldImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LastWritten": events.NewNumberAttribute("1000"), "LastBackup": staleBackup}),
+			newImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LastWritten": events.NewNumberAttribute("1000"), "LastBackup": staleBackup, "ExpiresAt": events.NewNumberAttribute("1")}),
+			want:     true,
+		},
+		{
+			name:     "unchanged with a recent backup in seconds",
+			oldImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LastWritten": events.NewNumberAttribute("1000"), "LastBackup": recentBackupSeconds}),
+			newImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LastWritten": events.NewNumberAttribute("1000"), "LastBackup": recentBackupSeconds, "ExpiresAt": events.NewNumberAttribute("1")}),
+			want:     false,
+		},
+		{
+			name:     "unchanged with a stale backup in seconds",
+			oldImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LastWritten": events.NewNumberAttribute("1000"), "LastBackup": staleBackupSeconds}),
+			newImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LastWritten": events.NewNumberAttribute("1000"), "LastBackup": staleBackupSeconds, "ExpiresAt": events.NewNumberAttribute("1")}),
+			want:     true,
+		},
+		{
+			name:     "size changed",
+			oldImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LastWritten": events.NewNumberAttribute("1000"), "LastBackup": recentBackup}),
+			newImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("20"), "LastWritten": events.NewNumberAttribute("1000"), "LastBackup": recentBackup}),
+			want:     true,
+		},
+		{
+			name:     "old image without Size",
+			oldImage: image(map[string]events.DynamoDBAttributeValue{"LastWritten": events.NewNumberAttribute("1000"), "LastBackup": recentBackup}),
+			newImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LastWritten": events.NewNumberAttribute("1000"), "LastBackup": recentBackup}),
+			want:     true,
+		},
+		{
+			name:     "old image without LastWritten",
+			oldImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LastBackup": recentBackup}),
+			newImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LastWritten": events.NewNumberAttribute("1000"), "LastBackup": recentBackup}),
+			want:     true,
+		},
+		{
+			name:     "both images without Size and LastWritten",
+			oldImage: image(map[string]events.DynamoDBAttributeValue{"LastBackup": recentBackup}),
+			newImage: image(map[string]events.DynamoDBAttributeValue{"LastBackup": recentBackup, "ExpiresAt": events.NewNumberAttribute("1")}),
+			want:     false,
+		},
+		{
+			name:     "only the checkpoint changed",
+			oldImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10")}),
+			newImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "DownloadedBytes": events.NewNumberAttribute("5")}),
+			want:     false,
+		},
+		{
+			name:     "backup recorded",
+			oldImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LastWritten": events.NewNumberAttribute("1000"), "LastBackup": staleBackup, "Status": events.NewStringAttribute(StatusDownloading), "DownloadResumeRequestedAt": events.NewNumberAttribute("1")}),
+			newImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LastWritten": events.NewNumberAttribute("1000"), "LastBackup": staleBackupSeconds, "LastChecksum": events.NewStringAttribute("abc"), "Status": events.NewStringAttribute(StatusDownloaded)}),
+			want:     false,
+		},
+		{
+			name:     "only LastBackup changed",
+			oldImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LastWritten": events.NewNumberAttribute("1000"), "LastBackup": staleBackupSeconds}),
+			newImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LastWritten": events.NewNumberAttribute("1000"), "LastBackup": staleBackup}),
+			want:     false,
+		},
+		{
+			name:     "backup verified",
+			oldImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LastWritten": events.NewNumberAttribute("1000"), "LastBackup": staleBackup, "LastS3VersionId": events.NewStringAttribute("v1")}),
+			newImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LastWritten": events.NewNumberAttribute("1000"), "LastBackup": staleBackup, "LastS3Bucket": events.NewStringAttribute("bucket"), "LastBackupDurationMs": events.NewNumberAttribute("120")}),
+			want:     false,
+		},
+		{
+			name:     "backup recorded as the log file grew",
+			oldImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LastWritten": events.NewNumberAttribute("1000"), "LastBackup": staleBackup}),
+			newImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("20"), "LastWritten": events.NewNumberAttribute("2000"), "LastBackup": recentBackup}),
+			want:     true,
+		},
+		{
+			name:     "released after waiting",
+			oldImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LastWritten": events.NewNumberAttribute("1000"), "LastBackup": recentBackup, "Status": events.NewStringAttribute(StatusWaiting)}),
+			newImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LastWritten": events.NewNumberAttribute("1000"), "LastBackup": recentBackup, "Status": events.NewStringAttribute(StatusPending)}),
+			want:     true,
+		},
+		{
+			name:     "deleted",
+			oldImage: image(map[string]events.DynamoDBAttributeValue{"LastWritten": events.NewNumberAttribute("1000")}),
+			newImage: image(map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LastWritten": events.NewNumberAttribute("1000"), "Deleted": events.NewBooleanAttribute(true)}),
+			want:     false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shouldDownload(tt.oldImage, tt.newImage, discardLogger); got != tt.want {
+				t.Errorf("shouldDownload() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string
+	}{
+		{name: "all set", env: map[string]string{"DYNAMODB_TABLE_NAME": "table", "S3_BUCKET_NAME": "bucket"}},
+		{name: "S3_PREFIX is optional", env: map[string]string{"DYNAMODB_TABLE_NAME": "table", "S3_BUCKET_NAME": "bucket", "S3_PREFIX": ""}},
+		{name: "bucket missing", env: map[string]string{"DYNAMODB_TABLE_NAME": "table"}, wantErr: "required environment variables not set: S3_BUCKET_NAME"},
+		{name: "all missing", env: map[string]string{}, wantErr: "required environment variables not set: DYNAMODB_TABLE_NAME, S3_BUCKET_NAME"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"DYNAMODB_TABLE_NAME", "S3_BUCKET_NAME", "S3_PREFIX"} {
+				t.Setenv(name, tt.env[name])
+			}
+
+			err := validateConfig()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validateConfig() error = %v, want nil", err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("validateConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHandlerFailsWithoutRequiredConfig(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "")
+
+	if _, err := Handler(context.Background(), events.DynamoDBEvent{}); err == nil {
+		t.Error("Handler() error = nil, want an error")
+	}
+}
+
+// fakePortion is the response of fakeLogFile to a DownloadDBLogFilePortion call
+type fakePortion struct {
+	data    string
+	marker  string
+	pending bool
+}
+
+// fakeLogFile serves the portions of one log file, keyed by the marker they are requested with
+// ("" for the first portion), and records the markers requested
+type fakeLogFile struct {
+	portions map[string]fakePortion
+	markers  []string
+}
+
+func (f *fakeLogFile) DescribeDBLogFiles(ctx context.Context, params *rds.DescribeDBLogFilesInput, optFns ...func(*rds.Options)) (*rds.DescribeDBLogFilesOutput, error) {
+	return &rds.DescribeDBLogFilesOutput{}, nil
+}
+
+func (f *fakeLogFile) DownloadDBLogFilePortion(ctx context.Context, params *rds.DownloadDBLogFilePortionInput, optFns ...func(*rds.Options)) (*rds.DownloadDBLogFilePortionOutput, error) {
+	marker := aws.ToString(params.Marker)
+	f.markers = append(f.markers, marker)
+
+	portion, ok := f.portions[marker]
+	if !ok {
+		return nil, fmt.Errorf("unexpected marker %q", marker)
+	}
+	output := &rds.DownloadDBLogFilePortionOutput{
+		Marker:                aws.String(portion.marker),
+		AdditionalDataPending: aws.Bool(portion.pending),
+	}
+	if portion.data != "" {
+		output.LogFileData = aws.String(portion.data)
+	}
+	return output, nil
+}
+
+// portionChain returns portions served one after the other, with markers m1, m2, ..., and
+// AdditionalDataPending set on all but the last. An empty string is a portion without data.
+func portionChain(data ...string) map[string]fakePortion {
+	portions := make(map[string]fakePortion)
+	for i, d := range data {
+		marker := ""
+		if i > 0 {
+			marker = "m" + strconv.Itoa(i)
+		}
+		portions[marker] = fakePortion{data: d, marker: "m" + strconv.Itoa(i+1), pending: i < len(data)-1}
+	}
+	return portions
+}
+
+// fakeS3 keeps the objects written by PutObject and by completed multipart uploads
+type fakeS3 struct {
+	objects          map[string][]byte
+	contentTypes     map[string]string   // Content-Type each object was written with, by key
+	contentEncodings map[string]string   // Content-Encoding of the objects written with one, by key
+	uploads          map[string][][]byte // Parts of the multipart uploads in progress, by upload ID
+	copied           []string            // Keys whose metadata was replaced
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string][]byte), contentTypes: make(map[string]string), contentEncodings: make(map[string]string), uploads: make(map[string][][]byte)}
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	body, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.objects[aws.ToString(params.Key)] = body
+	f.contentTypes[aws.ToString(params.Key)] = aws.ToString(params.ContentType)
+	if params.ContentEncoding != nil {
+		f.contentEncodings[aws.ToString(params.Key)] = *params.ContentEncoding
+	}
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	uploadID := "upload-" + strconv.Itoa(len(f.uploads)+1)
+	f.uploads[uploadID] = nil
+	f.contentTypes[aws.ToString(params.Key)] = aws.ToString(params.ContentType)
+	if params.ContentEncoding != nil {
+		f.contentEncodings[aws.ToString(params.Key)] = *params.ContentEncoding
+	}
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(uploadID)}, nil
+}
+
+func (f *fakeS3) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	uploadID := aws.ToString(params.UploadId)
+	parts, ok := f.uploads[uploadID]
+	if !ok {
+		return nil, &s3types.NoSuchUpload{}
+	}
+	body, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	partNumber := int(aws.ToInt32(params.PartNumber))
+	for len(parts) < partNumber {
+		parts = append(parts, nil)
+	}
+	parts[partNumber-1] = body
+	f.uploads[uploadID] = parts
+	return &s3.UploadPartOutput{ETag: aws.String("etag-" + strconv.Itoa(partNumber))}, nil
+}
+
+func (f *fakeS3) ListParts(ctx context.Context, params *s3.ListPartsInput, optFns ...func(*s3.Options)) (*s3.ListPartsOutput, error) {
+	parts, ok := f.uploads[aws.ToString(params.UploadId)]
+	if !ok {
+		return nil, &s3types.NoSuchUpload{}
+	}
+	output := &s3.ListPartsOutput{IsTruncated: aws.Bool(false)}
+	for i, part := range parts {
+		output.Parts = append(output.Parts, s3types.Part{
+			ETag:       aws.String("etag-" + strconv.Itoa(i+1)),
+			PartNumber: aws.Int32(int32(i + 1)),
+			Size:       aws.Int64(int64(len(part))),
+		})
+	}
+	return output, nil
+}
+
+func (f *fakeS3) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	uploadID := aws.ToString(params.UploadId)
+	parts, ok := f.uploads[uploadID]
+	if !ok {
+		return nil, &s3types.NoSuchUpload{}
+	}
+	var object []byte
+	for _, part := range params.MultipartUpload.Parts {
+		object = append(object, parts[aws.ToInt32(part.PartNumber)-1]...)
+	}
+	f.objects[aws.ToString(params.Key)] = object
+	delete(f.uploads, uploadID)
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	delete(f.uploads, aws.ToString(params.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	f.copied = append(f.copied, aws.ToString(params.Key))
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (f *fakeS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	body, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, &s3types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(body)))}, nil
+}
+
+// fakeRecords returns item from GetItem and records from Query, and records every UpdateItem call
+type fakeRecords struct {
+	item    map[string]types.AttributeValue
+	records []map[string]types.AttributeValue
+	updates []*dynamodb.UpdateItemInput
+}
+
+func (f *fakeRecords) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	return &dynamodb.QueryOutput{Items: f.records}, nil
+}
+
+func (f *fakeRecords) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: f.item}, nil
+}
+
+func (f *fakeRecords) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	f.updates = append(f.updates, params)
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+// checkpointMarkers returns the DownloadMarker of every checkpoint saved
+func (f *fakeRecords) checkpointMarkers() []string {
+	var markers []string
+	for _, update := range f.updates {
+		if marker, ok := update.ExpressionAttributeValues[":marker"].(*types.AttributeValueMemberS); ok {
+			markers = append(markers, marker.Value)
+		}
+	}
+	return markers
+}
+
+func TestDownloadLogFilePaginates(t *testing.T) {
+	part := strings.Repeat("x", 2*1024*1024)
+
+	tests := []struct {
+		name            string
+		portions        map[string]fakePortion
+		wantContent     string
+		wantMarkers     []string
+		wantCheckpoints []string
+	}{
+		{
+			name:        "single portion",
+			portions:    portionChain("line 1\n"),
+			wantContent: "line 1\n",
+			wantMarkers: []string{""},
+		},
+		{
+			name:        "several portions",
+			portions:    portionChain("line 1\n", "line 2\n", "line 3\n"),
+			wantContent: "line 1\nline 2\nline 3\n",
+			wantMarkers: []string{"", "m1", "m2"},
+		},
+		{
+			name:        "empty portions in between",
+			portions:    portionChain("line 1\n", "", "", "line 2\n"),
+			wantContent: "line 1\nline 2\n",
+			wantMarkers: []string{"", "m1", "m2", "m3"},
+		},
+		{
+			name:        "empty file",
+			portions:    portionChain(""),
+			wantContent: "",
+			wantMarkers: []string{""},
+		},
+		{
+			name:            "multipart upload",
+			portions:        portionChain(part, part, part, part),
+			wantContent:     part + part + part + part,
+			wantMarkers:     []string{"", "m1", "m2", "m3"},
+			wantCheckpoints: []string{"m3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rdsClient := &fakeLogFile{portions: tt.portions}
+			s3Client := newFakeS3()
+			dynamoClient := &fakeRecords{}
+			record := LogFileRecord{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log", Size: int64(len(tt.wantContent))}
+			opts := downloadOptions{PortionLines: defaultPortionLines}
+
+			result, err := downloadLogFile(context.Background(), rdsClient, s3Client, dynamoClient, "table", "bucket", "key", "text/plain", nil, opts, record, discardLogger)
+			if err != nil {
+				t.Fatalf("downloadLogFile() error = %v", err)
+			}
+
+			if !reflect.DeepEqual(rdsClient.markers, tt.wantMarkers) {
+				t.Errorf("requested markers %q, want %q", rdsClient.markers, tt.wantMarkers)
+			}
+			if got, ok := s3Client.objects["key"]; !ok || string(got) != tt.wantContent {
+				t.Errorf("uploaded %d bytes (present %v), want %d", len(got), ok, len(tt.wantContent))
+			}
+			if len(s3Client.uploads) != 0 {
+				t.Errorf("%d multipart uploads left in progress", len(s3Client.uploads))
+			}
+			if got := dynamoClient.checkpointMarkers(); !reflect.DeepEqual(got, tt.wantCheckpoints) {
+				t.Errorf("checkpoint markers %q, want %q", got, tt.wantCheckpoints)
+			}
+
+			sum := md5.Sum([]byte(tt.wantContent))
+			if result.Bytes != int64(len(tt.wantContent)) || result.Checksum != hex.EncodeToString(sum[:]) {
+				t.Errorf("result = %d bytes, checksum %s, want %d bytes, checksum %x", result.Bytes, result.Checksum, len(tt.wantContent), sum)
+			}
+		})
+	}
+}
+
+// syntheticLogFile serves count portions of the same data without keeping what it served
+type syntheticLogFile struct {
+	portion string
+	count   int
+}
+
+func (f *syntheticLogFile) DescribeDBLogFiles(ctx context.Context, params *rds.DescribeDBLogFilesInput, optFns ...func(*rds.Options)) (*rds.DescribeDBLogFilesOutput, error) {
+	return &rds.DescribeDBLogFilesOutput{}, nil
+}
+
+func (f *syntheticLogFile) DownloadDBLogFilePortion(ctx context.Context, params *rds.DownloadDBLogFilePortionInput, optFns ...func(*rds.Options)) (*rds.DownloadDBLogFilePortionOutput, error) {
+	i := 0
+	if marker := aws.ToString(params.Marker); marker != "" {
+		i, _ = strconv.Atoi(marker)
+	}
+	return &rds.DownloadDBLogFilePortionOutput{
+		LogFileData:           aws.String(f.portion),
+		Marker:                aws.String(strconv.Itoa(i + 1)),
+		AdditionalDataPending: aws.Bool(i+1 < f.count),
+	}, nil
+}
+
+// streamingS3 hashes the uploaded parts instead of keeping them, and records the heap in use
+// while the parts are uploaded
+type streamingS3 struct {
+	*fakeS3
+	checksum  hash.Hash
+	bytes     int64
+	peakHeap  uint64
+	partSizes []int
+}
+
+func (f *streamingS3) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	n, err := io.Copy(f.checksum, params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.bytes += n
+	f.partSizes = append(f.partSizes, int(n))
+
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	f.peakHeap = max(f.peakHeap, stats.HeapInuse)
+
+	params.Body = bytes.NewReader(nil)
+	return f.fakeS3.UploadPart(ctx, params, optFns...)
+}
+
+func TestDownloadLogFileStreamsInConstantMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streams 100 MB")
+	}
+
+	// 100 portions of 1 MiB
+	line := strings.Repeat("x", 1023) + "\n"
+	rdsClient := &syntheticLogFile{portion: strings.Repeat(line, 1024), count: 100}
+	s3Client := &streamingS3{fakeS3: newFakeS3(), checksum: md5.New()}
+	record := LogFileRecord{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log", Size: 100 << 20}
+	opts := downloadOptions{PortionLines: defaultPortionLines, PartSize: 8 << 20}
+
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	baseline := stats.HeapInuse
+
+	result, err := downloadLogFile(context.Background(), rdsClient, s3Client, &fakeRecords{}, "table", "bucket", "key", "text/plain", nil, opts, record, discardLogger)
+	if err != nil {
+		t.Fatalf("downloadLogFile() error = %v", err)
+	}
+
+	want := md5.New()
+	for range rdsClient.count {
+		io.WriteString(want, rdsClient.portion)
+	}
+	if result.Bytes != 100<<20 || s3Client.bytes != 100<<20 {
+		t.Errorf("downloaded %d bytes, uploaded %d, want %d", result.Bytes, s3Client.bytes, 100<<20)
+	}
+	if sum := hex.EncodeToString(want.Sum(nil)); result.Checksum != sum || hex.EncodeToString(s3Client.checksum.Sum(nil)) != sum {
+		t.Errorf("checksum = %s, uploaded %x, want %s", result.Checksum, s3Client.checksum.Sum(nil), sum)
+	}
+	if len(s3Client.partSizes) != 13 {
+		t.Fatalf("uploaded %d parts, want 13", len(s3Client.partSizes))
+	}
+	for i, size := range s3Client.partSizes[:len(s3Client.partSizes)-1] {
+		if size != 8<<20 {
+			t.Errorf("part %d is %d bytes, want %d", i+1, size, 8<<20)
+		}
+	}
+
+	// Only about a part is buffered at a time, however large the log file
+	if grown := int64(s3Client.peakHeap) - int64(baseline); grown > 40<<20 {
+		t.Errorf("heap grew by %d MiB while streaming 100 MiB", grown>>20)
+	}
+}
+
+func TestHandleBacksUpInsertedRecords(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+
+	rdsClient := &fakeLogFile{portions: portionChain("line 1\n", "line 2\n")}
+	s3Client := newFakeS3()
+	dynamoClient := &fakeRecords{}
+
+	event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{
+		{
+			EventName: "INSERT",
+			Change: events.DynamoDBStreamRecord{NewImage: map[string]events.DynamoDBAttributeValue{
+				"DBInstanceIdentifier": events.NewStringAttribute("db-1"),
+				"LogFileName":          events.NewStringAttribute("audit/server_audit.log"),
+				"Size":                 events.NewNumberAttribute("14"),
+				"LastWritten":          events.NewNumberAttribute("1700000000000"),
+				"Status":               events.NewStringAttribute(StatusPending),
+			}},
+		},
+		{
+			// Bookkeeping items are never downloaded
+			EventName: "INSERT",
+			Change: events.DynamoDBStreamRecord{NewImage: map[string]events.DynamoDBAttributeValue{
+				"DBInstanceIdentifier": events.NewStringAttribute("db-1"),
+				"LogFileName":          events.NewStringAttribute("#CHECKPOINT"),
+			}},
+		},
+		{
+			EventName: "MODIFY",
+			Change: events.DynamoDBStreamRecord{NewImage: map[string]events.DynamoDBAttributeValue{
+				"DBInstanceIdentifier": events.NewStringAttribute("db-1"),
+				"LogFileName":          events.NewStringAttribute("#SUMMARY"),
+				"PendingCount":         events.NewNumberAttribute("1"),
+			}},
+		},
+	}}
+
+	_, err := NewHandler(HandlerDeps{RDS: rdsClient, S3: s3Client, DynamoDB: dynamoClient})(context.Background(), event)
+	if err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+
+	if got := string(s3Client.objects["logs/db-1/2023/11/14/audit/server_audit.log.1700000000000"]); got != "line 1\nline 2\n" {
+		t.Errorf("uploaded %q, want both portions", got)
+	}
+	if len(s3Client.objects) != 2 {
+		t.Errorf("uploaded %d objects, want the log file and the manifest", len(s3Client.objects))
+	}
+	if got := s3Client.contentTypes["logs/db-1/2023/11/14/audit/server_audit.log.1700000000000"]; got != "text/plain" {
+		t.Errorf("ContentType = %q, want text/plain", got)
+	}
+
+	var statuses []string
+	for _, update := range dynamoClient.updates {
+		if status, ok := update.ExpressionAttributeValues[":status"].(*types.AttributeValueMemberS); ok {
+			statuses = append(statuses, status.Value)
+		}
+	}
+	if want := []string{StatusDownloading, StatusDownloaded}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("statuses = %v, want %v", statuses, want)
+	}
+
+	// The PENDING record is taken off the instance's pending count
+	var summaryUpdates []string
+	for _, update := range dynamoClient.updates {
+		if update.Key["LogFileName"].(*types.AttributeValueMemberS).Value == "#SUMMARY" {
+			summaryUpdates = append(summaryUpdates, aws.ToString(update.UpdateExpression))
+		}
+	}
+	if want := []string{"ADD PendingCount :minusOne"}; !reflect.DeepEqual(summaryUpdates, want) {
+		t.Errorf("summary updates = %q, want %q", summaryUpdates, want)
+	}
+}
+
+// insertRecord returns the stream record of a new log file record of db-1
+func insertRecord(logFileName, logFileType string) events.DynamoDBEventRecord {
+	image := map[string]events.DynamoDBAttributeValue{
+		"DBInstanceIdentifier": events.NewStringAttribute("db-1"),
+		"LogFileName":          events.NewStringAttribute(logFileName),
+		"Size":                 events.NewNumberAttribute("7"),
+		"LastWritten":          events.NewNumberAttribute("1700000000000"),
+	}
+	if logFileType != "" {
+		image["LogFileType"] = events.NewStringAttribute(logFileType)
+	}
+	return events.DynamoDBEventRecord{EventName: "INSERT", Change: events.DynamoDBStreamRecord{NewImage: image}}
+}
+
+func TestHandleBacksUpEnabledLogTypes(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+	t.Setenv("LOG_TYPES", "audit,error")
+
+	event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{
+		insertRecord("audit/server_audit.log", ""), // Recorded before classification
+		insertRecord("error/mysql-error-running.log", "error"),
+		insertRecord("slowquery/mysql-slowquery.log", "slowquery"),
+	}}
+
+	s3Client := newFakeS3()
+	deps := HandlerDeps{RDS: &fakeLogFile{portions: portionChain("line 1\n")}, S3: s3Client, DynamoDB: &fakeRecords{}}
+	if _, err := NewHandler(deps)(context.Background(), event); err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+
+	want := map[string]string{
+		"logs/audit/db-1/2023/11/14/audit/server_audit.log.1700000000000":        "text/plain",
+		"logs/error/db-1/2023/11/14/error/mysql-error-running.log.1700000000000": "text/plain; charset=utf-8",
+		"logs/db-1/_manifest.json": "application/json",
+	}
+	if !reflect.DeepEqual(s3Client.contentTypes, want) {
+		t.Errorf("uploaded objects = %v, want %v", s3Client.contentTypes, want)
+	}
+}
+
+func TestDiffImages(t *testing.T) {
+	tests := []struct {
+		name     string
+		oldImage map[string]events.DynamoDBAttributeValue
+		newImage map[string]events.DynamoDBAttributeValue
+		want     []string
+	}{
+		{name: "no images"},
+		{
+			name:     "identical",
+			oldImage: map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LogFileName": events.NewStringAttribute("audit/server_audit.log")},
+			newImage: map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LogFileName": events.NewStringAttribute("audit/server_audit.log")},
+		},
+		{
+			name:     "added",
+			oldImage: map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10")},
+			newImage: map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LastBackup": events.NewNumberAttribute("1")},
+			want:     []string{"LastBackup"},
+		},
+		{
+			name:     "removed",
+			oldImage: map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "DownloadMarker": events.NewStringAttribute("0:100")},
+			newImage: map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10")},
+			want:     []string{"DownloadMarker"},
+		},
+		{
+			name:     "changed",
+			oldImage: map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "Status": events.NewStringAttribute(StatusDownloading)},
+			newImage: map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("20"), "Status": events.NewStringAttribute(StatusDownloaded)},
+			want:     []string{"Size", "Status"},
+		},
+		{
+			name:     "changed type",
+			oldImage: map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10")},
+			newImage: map[string]events.DynamoDBAttributeValue{"Size": events.NewStringAttribute("10")},
+			want:     []string{"Size"},
+		},
+		{
+			name:     "new record",
+			newImage: map[string]events.DynamoDBAttributeValue{"Size": events.NewNumberAttribute("10"), "LastWritten": events.NewNumberAttribute("1000")},
+			want:     []string{"LastWritten", "Size"},
+		},
+		{
+			name:     "nested values",
+			oldImage: map[string]events.DynamoDBAttributeValue{"Tags": events.NewMapAttribute(map[string]events.DynamoDBAttributeValue{"a": events.NewStringAttribute("1")}), "Parts": events.NewListAttribute([]events.DynamoDBAttributeValue{events.NewNumberAttribute("1")})},
+			newImage: map[string]events.DynamoDBAttributeValue{"Tags": events.NewMapAttribute(map[string]events.DynamoDBAttributeValue{"a": events.NewStringAttribute("1")}), "Parts": events.NewListAttribute([]events.DynamoDBAttributeValue{events.NewNumberAttribute("2")})},
+			want:     []string{"Parts"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffImages(tt.oldImage, tt.newImage); !slices.Equal(got, tt.want) {
+				t.Errorf("diffImages() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleIgnoresOwnBackupWrites(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+
+	// The MODIFY event of a backup recorded a day ago, e.g. read from a stream that fell behind,
+	// which the 24-hour check alone would take for a stale backup
+	recorded := insertRecord("audit/server_audit.log", "")
+	recorded.EventName = "MODIFY"
+	recorded.Change.OldImage = maps.Clone(recorded.Change.NewImage)
+	recorded.Change.OldImage["Status"] = events.NewStringAttribute(StatusDownloading)
+	recorded.Change.NewImage["Status"] = events.NewStringAttribute(StatusDownloaded)
+	recorded.Change.NewImage["LastBackup"] = events.NewNumberAttribute(strconv.FormatInt(time.Now().Add(-25*time.Hour).UnixMilli(), 10))
+	recorded.Change.NewImage["LastS3Key"] = events.NewStringAttribute("logs/db-1/2023/11/14/audit/server_audit.log.1700000000000")
+	recorded.Change.NewImage["LastChecksum"] = events.NewStringAttribute("abc")
+
+	rdsClient := &fakeLogFile{portions: portionChain("line 1\n")}
+	dynamoClient := &fakeRecords{}
+	deps := HandlerDeps{RDS: rdsClient, S3: newFakeS3(), DynamoDB: dynamoClient}
+	event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{recorded}}
+	if _, err := NewHandler(deps)(context.Background(), event); err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+
+	if len(rdsClient.markers) != 0 || len(dynamoClient.updates) != 0 {
+		t.Errorf("downloaded markers %q and made %d updates, want the record skipped", rdsClient.markers, len(dynamoClient.updates))
+	}
+}
+
+// checksumS3 records the SHA-256 checksums sent with the uploads, empty for an upload without one
+type checksumS3 struct {
+	*fakeS3
+	algorithms      []s3types.ChecksumAlgorithm // Of the multipart uploads created
+	objectChecksums []string                    // Of PutObject
+	partChecksums   []string                    // Of UploadPart
+	partData        []string                    // SHA-256 of the data of UploadPart
+	completed       []string                    // Of the parts listed by CompleteMultipartUpload
+}
+
+func (f *checksumS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	f.objectChecksums = append(f.objectChecksums, aws.ToString(params.ChecksumSHA256))
+	return f.fakeS3.PutObject(ctx, params, optFns...)
+}
+
+func (f *checksumS3) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	f.algorithms = append(f.algorithms, params.ChecksumAlgorithm)
+	return f.fakeS3.CreateMultipartUpload(ctx, params, optFns...)
+}
+
+func (f *checksumS3) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.partChecksums = append(f.partChecksums, aws.ToString(params.ChecksumSHA256))
+	f.partData = append(f.partData, aws.ToString(objectChecksum(data)))
+	params.Body = bytes.NewReader(data)
+	return f.fakeS3.UploadPart(ctx, params, optFns...)
+}
+
+func (f *checksumS3) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	for _, part := range params.MultipartUpload.Parts {
+		f.completed = append(f.completed, aws.ToString(part.ChecksumSHA256))
+	}
+	return f.fakeS3.CompleteMultipartUpload(ctx, params, optFns...)
+}
+
+func TestDownloadLogFileSendsS3Checksums(t *testing.T) {
+	record := LogFileRecord{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log", LastWritten: 1700000000000}
+	opts := downloadOptions{PortionLines: defaultPortionLines, PartSize: 8 * 1024, ChecksumAlgorithm: checksum.SHA256}
+	sha256Base64 := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+
+	// A small file is a single object
+	s3Client := &checksumS3{fakeS3: newFakeS3()}
+	result, err := downloadLogFile(context.Background(), &fakeLogFile{portions: portionChain("line 1\n")}, s3Client, &fakeRecords{}, "table", "bucket", "key", "text/plain", nil, opts, record, discardLogger)
+	if err != nil {
+		t.Fatalf("downloadLogFile() error = %v", err)
+	}
+	sum := sha256.Sum256([]byte("line 1\n"))
+	if result.Checksum != hex.EncodeToString(sum[:]) || result.ChecksumAlgorithm != checksum.SHA256 {
+		t.Errorf("checksum = %s %s, want the SHA-256 %x", result.ChecksumAlgorithm, result.Checksum, sum)
+	}
+	if want := []string{sha256Base64([]byte("line 1\n"))}; !reflect.DeepEqual(s3Client.objectChecksums, want) {
+		t.Errorf("object checksums = %q, want %q", s3Client.objectChecksums, want)
+	}
+
+	// Every part of a multipart upload carries its checksum
+	portions := randomPortions(8, 8*1024)
+	s3Client = &checksumS3{fakeS3: newFakeS3()}
+	if _, err := downloadLogFile(context.Background(), &fakeLogFile{portions: portionChain(portions...)}, s3Client, &fakeRecords{}, "table", "bucket", "key", "text/plain", nil, opts, record, discardLogger); err != nil {
+		t.Fatalf("downloadLogFile() error = %v", err)
+	}
+	if want := []s3types.ChecksumAlgorithm{s3types.ChecksumAlgorithmSha256}; !reflect.DeepEqual(s3Client.algorithms, want) {
+		t.Errorf("created uploads with %q, want %q", s3Client.algorithms, want)
+	}
+	if len(s3Client.partChecksums) < 2 || !reflect.DeepEqual(s3Client.partChecksums, s3Client.partData) {
+		t.Errorf("part checksums = %q, want those of the parts %q", s3Client.partChecksums, s3Client.partData)
+	}
+	if !reflect.DeepEqual(s3Client.completed, s3Client.partChecksums) {
+		t.Errorf("completed parts with checksums %q, want those uploaded %q", s3Client.completed, s3Client.partChecksums)
+	}
+
+	// An upload checkpointed before the checksums were requested is resumed without them
+	record.Size = int64(len(strings.Join(portions, "")))
+	base := newFakeS3()
+	interrupted := interruptDownload(t, base, "key", opts, record, portions)
+	resumed := &checksumS3{fakeS3: base}
+	if _, err := downloadLogFile(context.Background(), &fakeLogFile{portions: portionChain(portions...)}, resumed, &fakeRecords{}, "table", "bucket", "key", "text/plain", nil, opts, interrupted, discardLogger); err != nil {
+		t.Fatalf("resumed downloadLogFile() error = %v", err)
+	}
+	if len(resumed.partChecksums) == 0 || slices.ContainsFunc(resumed.partChecksums, func(sum string) bool { return sum != "" }) {
+		t.Errorf("resumed upload sent part checksums %q, want none", resumed.partChecksums)
+	}
+}
+
+func TestHandleSkipsUnchangedContent(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+	const key = "logs/db-1/2023/11/14/audit/server_audit.log.1700000000000"
+
+	sum := sha256.Sum256([]byte("line 1\n"))
+	item, err := attributevalue.MarshalMap(LogFileRecord{
+		DBInstanceIdentifier:  "db-1",
+		LogFileName:           "audit/server_audit.log",
+		LastBackup:            1,
+		LastChecksum:          hex.EncodeToString(sum[:]),
+		LastChecksumAlgorithm: checksum.SHA256,
+		LastS3Key:             key,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s3Client := newFakeS3()
+	dynamoClient := &fakeRecords{item: item}
+	deps := HandlerDeps{RDS: &fakeLogFile{portions: portionChain("line 1\n")}, S3: s3Client, DynamoDB: dynamoClient}
+	event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{insertRecord("audit/server_audit.log", "")}}
+	if _, err := NewHandler(deps)(context.Background(), event); err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+
+	if _, ok := s3Client.objects[key]; ok {
+		t.Errorf("uploaded %s again, want the unchanged content skipped", key)
+	}
+	recorded := slices.ContainsFunc(dynamoClient.updates, func(update *dynamodb.UpdateItemInput) bool {
+		_, ok := update.ExpressionAttributeValues[":lastBackup"]
+		return ok
+	})
+	if !recorded {
+		t.Error("LastBackup wasn't updated")
+	}
+}
+
+func TestHandleKeyLayouts(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{name: "default", want: "logs/db-1/2023/11/14/audit/server_audit.log.1700000000000"},
+		{name: "legacy", env: map[string]string{"LEGACY_KEYS": "true"}, want: "logs/db-1/audit/server_audit.log"},
+		{name: "partitioned", env: map[string]string{"PARTITION_BY_DATE": "true"}, want: "logs/dbinstance=db-1/dt=2023-11-14/audit/server_audit.log.1700000000000"},
+		{name: "legacy partitioned", env: map[string]string{"PARTITION_BY_DATE": "true", "LEGACY_KEYS": "true"}, want: "logs/dbinstance=db-1/dt=2023-11-14/audit/server_audit.log"},
+		{name: "template", env: map[string]string{"S3_KEY_TEMPLATE": "{prefix}/{file}", "LEGACY_KEYS": "false"}, want: "logs/audit/server_audit.log"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DYNAMODB_TABLE_NAME", "table")
+			t.Setenv("S3_BUCKET_NAME", "bucket")
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			s3Client := newFakeS3()
+			dynamoClient := &fakeRecords{}
+			deps := HandlerDeps{RDS: &fakeLogFile{portions: portionChain("line 1\n")}, S3: s3Client, DynamoDB: dynamoClient}
+			event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{insertRecord("audit/server_audit.log", "")}}
+			if _, err := NewHandler(deps)(context.Background(), event); err != nil {
+				t.Fatalf("handler error = %v", err)
+			}
+
+			if _, ok := s3Client.objects[tt.want]; !ok {
+				t.Errorf("no object uploaded to %s, objects = %v", tt.want, s3Client.contentTypes)
+			}
+
+			// The key is recorded so the object can be found from the record
+			var recorded []string
+			for _, update := range dynamoClient.updates {
+				if key, ok := update.ExpressionAttributeValues[":s3Key"].(*types.AttributeValueMemberS); ok {
+					recorded = append(recorded, key.Value)
+				}
+			}
+			if want := []string{tt.want}; !reflect.DeepEqual(recorded, want) {
+				t.Errorf("LastS3Key = %v, want %v", recorded, want)
+			}
+		})
+	}
+}
+
+func TestHandleUsesRegionalRDSClients(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+	t.Setenv("REGIONS", "us-east-1,eu-west-1")
+
+	regionalRecord := func(logFileName, region string) events.DynamoDBEventRecord {
+		record := insertRecord(logFileName, "")
+		if region != "" {
+			record.Change.NewImage["Region"] = events.NewStringAttribute(region)
+		}
+		return record
+	}
+	event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{
+		regionalRecord("audit/server_audit.log", ""),
+		regionalRecord("audit/server_audit.log.1", "eu-west-1"),
+		regionalRecord("audit/server_audit.log.2", "ap-south-1"),
+	}}
+
+	local := &fakeLogFile{portions: portionChain("line 1\n")}
+	regional := &fakeLogFile{portions: portionChain("line 1\n")}
+	dynamoClient := &fakeRecords{}
+	deps := HandlerDeps{
+		RDS:         local,
+		S3:          newFakeS3(),
+		DynamoDB:    dynamoClient,
+		Region:      "us-east-1",
+		RegionalRDS: map[string]RDSLogAPI{"eu-west-1": regional},
+	}
+	response, err := NewHandler(deps)(context.Background(), event)
+	if err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+
+	if len(local.markers) != 1 || len(regional.markers) != 1 {
+		t.Errorf("portions requested = %d local, %d regional, want 1 and 1", len(local.markers), len(regional.markers))
+	}
+
+	// The record of a region without a client fails instead of being downloaded from the wrong region
+	var failed []string
+	for _, update := range dynamoClient.updates {
+		if status, ok := update.ExpressionAttributeValues[":status"].(*types.AttributeValueMemberS); ok && status.Value == StatusFailed {
+			failed = append(failed, update.Key["LogFileName"].(*types.AttributeValueMemberS).Value)
+		}
+	}
+	if want := []string{"audit/server_audit.log.2"}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("failed = %v, want %v", failed, want)
+	}
+	if len(response.BatchItemFailures) != 1 {
+		t.Errorf("BatchItemFailures = %+v, want the record of the region without a client", response.BatchItemFailures)
+	}
+}
+
+func TestObjectContentType(t *testing.T) {
+	tests := []struct {
+		logFileType string
+		opts        downloadOptions
+		want        string
+	}{
+		{logFileType: "audit", want: "text/plain"},
+		{logFileType: "audit", opts: downloadOptions{OutputFormat: outputFormatRaw, Compression: compressionNone}, want: "text/plain"},
+		{logFileType: "slowquery", want: "text/plain"},
+		{logFileType: "error", want: "text/plain; charset=utf-8"},
+		{logFileType: "audit", opts: downloadOptions{OutputFormat: outputFormatNDJSON}, want: "application/json"},
+		{logFileType: "audit", opts: downloadOptions{OutputFormat: outputFormatJSONL}, want: "application/json"},
+		{logFileType: "error", opts: downloadOptions{OutputFormat: outputFormatNDJSON}, want: "text/plain; charset=utf-8"},
+		// Compressed objects keep the type of their content, with Content-Encoding gzip
+		{logFileType: "audit", opts: downloadOptions{Compression: compressionGzip}, want: "text/plain"},
+		{logFileType: "audit", opts: downloadOptions{OutputFormat: outputFormatNDJSON, Compression: compressionGzip}, want: "application/json"},
+	}
+
+	for _, tt := range tests {
+		if got := objectContentType(tt.logFileType, tt.opts); got != tt.want {
+			t.Errorf("objectContentType(%q, %+v) = %q, want %q", tt.logFileType, tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestParseLogTypes(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]bool
+		wantErr bool
+	}{
+		{value: "", want: map[string]bool{"audit": true}},
+		{value: " error , slowquery", want: map[string]bool{"error": true, "slowquery": true}},
+		{value: "audit,binlog", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseLogTypes(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("parseLogTypes(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseLogTypes(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadLogFileRejectsStuckMarker(t *testing.T) {
+	// The second portion is empty and returns the marker it was requested with
+	rdsClient := &fakeLogFile{portions: map[string]fakePortion{
+		"":   {data: "line 1\n", marker: "m1", pending: true},
+		"m1": {marker: "m1", pending: true},
+	}}
+	record := LogFileRecord{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log"}
+	opts := downloadOptions{PortionLines: defaultPortionLines}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := downloadLogFile(context.Background(), rdsClient, newFakeS3(), &fakeRecords{}, "table", "bucket", "key", "text/plain", nil, opts, record, discardLogger)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, errMarkerLoop) {
+			t.Fatalf("downloadLogFile() error = %v, want %v", err, errMarkerLoop)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("downloadLogFile() did not return")
+	}
+	if want := []string{"", "m1", "m1", "m1"}; !reflect.DeepEqual(rdsClient.markers, want) {
+		t.Errorf("requested markers %q, want %q", rdsClient.markers, want)
+	}
+}
+
+// endlessLogFile returns empty portions with a new marker and AdditionalDataPending every time
+type endlessLogFile struct {
+	calls int
+}
+
+func (f *endlessLogFile) DescribeDBLogFiles(ctx context.Context, params *rds.DescribeDBLogFilesInput, optFns ...func(*rds.Options)) (*rds.DescribeDBLogFilesOutput, error) {
+	return &rds.DescribeDBLogFilesOutput{}, nil
+}
+
+func (f *endlessLogFile) DownloadDBLogFilePortion(ctx context.Context, params *rds.DownloadDBLogFilePortionInput, optFns ...func(*rds.Options)) (*rds.DownloadDBLogFilePortionOutput, error) {
+	f.calls++
+	return &rds.DownloadDBLogFilePortionOutput{Marker: aws.String(strconv.Itoa(f.calls)), AdditionalDataPending: aws.Bool(true)}, nil
+}
+
+func TestDownloadLogFileBoundsPortions(t *testing.T) {
+	rdsClient := &endlessLogFile{}
+	record := LogFileRecord{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log"}
+	opts := downloadOptions{PortionLines: defaultPortionLines}
+
+	_, err := downloadLogFile(context.Background(), rdsClient, newFakeS3(), &fakeRecords{}, "table", "bucket", "key", "text/plain", nil, opts, record, discardLogger)
+	if err == nil {
+		t.Fatal("downloadLogFile() error = nil, want an error")
+	}
+	if rdsClient.calls != maxPortions {
+		t.Errorf("requested %d portions, want %d", rdsClient.calls, maxPortions)
+	}
+}
+
+// randomPortions returns count portions of size bytes of lines that compress poorly
+func randomPortions(count, size int) []string {
+	random := rand.New(rand.NewPCG(1, 2))
+	portions := make([]string, count)
+	for i := range portions {
+		data := make([]byte, size*3/4)
+		for j := range data {
+			data[j] = byte(random.Uint32())
+		}
+		encoded := base64.StdEncoding.EncodeToString(data)
+		var portion strings.Builder
+		for len(encoded) > 0 {
+			n := min(len(encoded), 99)
+			portion.WriteString(encoded[:n] + "\n")
+			encoded = encoded[n:]
+		}
+		portions[i] = portion.String()
+	}
+	return portions
+}
+
+// gunzip decompresses every gzip member of data
+func gunzip(t *testing.T, data []byte) string {
+	t.Helper()
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("gzip.NewReader() error = %v", err)
+	}
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("decompressing: %v", err)
+	}
+	return string(content)
+}
+
+func TestDownloadLogFileCompressesParts(t *testing.T) {
+	portions := randomPortions(8, 100*1024)
+	raw := strings.Join(portions, "")
+
+	rdsClient := &fakeLogFile{portions: portionChain(portions...)}
+	s3Client := newFakeS3()
+	dynamoClient := &fakeRecords{}
+	record := LogFileRecord{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log", Size: int64(len(raw))}
+	opts := downloadOptions{PortionLines: defaultPortionLines, PartSize: 64 * 1024, Compression: compressionGzip}
+
+	result, err := downloadLogFile(context.Background(), rdsClient, s3Client, dynamoClient, "table", "bucket", "key.gz", "text/plain", nil, opts, record, discardLogger)
+	if err != nil {
+		t.Fatalf("downloadLogFile() error = %v", err)
+	}
+
+	object := s3Client.objects["key.gz"]
+	if got := gunzip(t, object); got != raw {
+		t.Errorf("decompressed %d bytes, want %d", len(got), len(raw))
+	}
+	if len(dynamoClient.checkpointMarkers()) == 0 {
+		t.Error("no checkpoint saved, want a multipart upload")
+	}
+	if encoding := s3Client.contentEncodings["key.gz"]; encoding != "gzip" {
+		t.Errorf("ContentEncoding = %q, want gzip", encoding)
+	}
+
+	// The checksum and raw size are those of the uncompressed content
+	sum := md5.Sum([]byte(raw))
+	if result.Checksum != hex.EncodeToString(sum[:]) || result.RawBytes != int64(len(raw)) || result.Bytes != int64(len(object)) {
+		t.Errorf("result = %+v, want checksum %x, %d raw bytes and %d bytes", result, sum, len(raw), len(object))
+	}
+}
+
+// interruptDownload downloads the portions until the one at marker m5, which fails, and returns the record
+// with the checkpoint the interrupted download left
+func interruptDownload(t *testing.T, s3Client *fakeS3, s3Key string, opts downloadOptions, record LogFileRecord, portions []string) LogFileRecord {
+	t.Helper()
+
+	interrupted := portionChain(portions...)
+	delete(interrupted, "m5")
+	dynamoClient := &fakeRecords{}
+	_, err := downloadLogFile(context.Background(), &fakeLogFile{portions: interrupted}, s3Client, dynamoClient, "table", "bucket", s3Key, "text/plain", nil, opts, record, discardLogger)
+	if err == nil {
+		t.Fatal("interrupted downloadLogFile() error = nil, want an error")
+	}
+	if len(dynamoClient.checkpointMarkers()) == 0 {
+		t.Fatal("interrupted download saved no checkpoint")
+	}
+
+	checkpoint := dynamoClient.updates[len(dynamoClient.updates)-1].ExpressionAttributeValues
+	number := func(name string) int64 {
+		value, _ := strconv.ParseInt(checkpoint[name].(*types.AttributeValueMemberN).Value, 10, 64)
+		return value
+	}
+	record.DownloadMarker = checkpoint[":marker"].(*types.AttributeValueMemberS).Value
+	record.DownloadedBytes = number(":downloadedBytes")
+	record.DownloadRawBytes = number(":rawBytes")
+	record.DownloadUploadId = checkpoint[":uploadId"].(*types.AttributeValueMemberS).Value
+	record.DownloadHashState = checkpoint[":hashState"].(*types.AttributeValueMemberS).Value
+	record.DownloadFileSize = number(":fileSize")
+	record.DownloadLastWritten = number(":lastWritten")
+	record.DownloadS3Key = checkpoint[":uploadKey"].(*types.AttributeValueMemberS).Value
+	return record
+}
+
+func TestLogFileRotated(t *testing.T) {
+	tests := []struct {
+		name   string
+		record LogFileRecord
+		want   bool
+	}{
+		{name: "unchanged", record: LogFileRecord{Size: 1000, DownloadFileSize: 1000, DownloadedBytes: 600}},
+		{name: "grown", record: LogFileRecord{Size: 1500, DownloadFileSize: 1000, DownloadedBytes: 600}},
+		{name: "shrunk", record: LogFileRecord{Size: 800, DownloadFileSize: 1000, DownloadedBytes: 600}, want: true},
+		// NDJSON output exceeds the file size, so only the checkpointed file size is compared
+		{name: "converted output larger than the file", record: LogFileRecord{Size: 1000, DownloadFileSize: 1000, DownloadedBytes: 2500}},
+		{name: "checkpoint without file size", record: LogFileRecord{Size: 1000, DownloadedBytes: 600}},
+		{name: "checkpoint without file size, shrunk", record: LogFileRecord{Size: 500, DownloadedBytes: 600}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := logFileRotated(tt.record); got != tt.want {
+				t.Errorf("logFileRotated() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloadLogFileCheckpointStaleness(t *testing.T) {
+	portions := randomPortions(8, 100*1024)
+	opts := downloadOptions{PortionLines: defaultPortionLines, PartSize: 64 * 1024}
+
+	tests := []struct {
+		name string
+		// stale changes the checkpointed record and the log file before the next invocation
+		stale      func(record *LogFileRecord, s3Client *fakeS3) []string
+		wantResume bool
+	}{
+		{
+			name:       "resumes an unchanged log file",
+			stale:      func(record *LogFileRecord, s3Client *fakeS3) []string { return portions },
+			wantResume: true,
+		},
+		{
+			name: "resumes a log file written since the checkpoint",
+			stale: func(record *LogFileRecord, s3Client *fakeS3) []string {
+				grown := append(slices.Clone(portions), "appended line\n")
+				record.Size += int64(len("appended line\n"))
+				record.LastWritten += 1000
+				return grown
+			},
+			wantResume: true,
+		},
+		{
+			name: "restarts a rotated log file",
+			stale: func(record *LogFileRecord, s3Client *fakeS3) []string {
+				rotated := randomPortions(2, 1024)
+				record.Size = int64(len(strings.Join(rotated, "")))
+				record.LastWritten += 1000
+				return rotated
+			},
+		},
+		{
+			name: "restarts when the multipart upload is gone",
+			stale: func(record *LogFileRecord, s3Client *fakeS3) []string {
+				delete(s3Client.uploads, record.DownloadUploadId)
+				return portions
+			},
+		},
+		{
+			name: "restarts without the checksum state",
+			stale: func(record *LogFileRecord, s3Client *fakeS3) []string {
+				record.DownloadHashState = ""
+				return portions
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s3Client := newFakeS3()
+			record := LogFileRecord{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log", Size: int64(len(strings.Join(portions, ""))), LastWritten: 1700000000000}
+			record = interruptDownload(t, s3Client, "key", opts, record, portions)
+			checkpointUploadID := record.DownloadUploadId
+
+			current := tt.stale(&record, s3Client)
+			content := strings.Join(current, "")
+			rdsClient := &fakeLogFile{portions: portionChain(current...)}
+			result, err := downloadLogFile(context.Background(), rdsClient, s3Client, &fakeRecords{}, "table", "bucket", "key", "text/plain", nil, opts, record, discardLogger)
+			if err != nil {
+				t.Fatalf("downloadLogFile() error = %v", err)
+			}
+
+			wantMarker := ""
+			if tt.wantResume {
+				wantMarker = record.DownloadMarker
+			}
+			if rdsClient.markers[0] != wantMarker {
+				t.Errorf("started at marker %q, want %q", rdsClient.markers[0], wantMarker)
+			}
+			if _, ok := s3Client.uploads[checkpointUploadID]; ok {
+				t.Errorf("multipart upload %s of the checkpoint is still in progress", checkpointUploadID)
+			}
+			if got := string(s3Client.objects["key"]); got != content {
+				t.Errorf("uploaded %d bytes, want the %d bytes of the current log file", len(got), len(content))
+			}
+			sum := md5.Sum([]byte(content))
+			if result.Checksum != hex.EncodeToString(sum[:]) {
+				t.Errorf("checksum = %s, want %x", result.Checksum, sum)
+			}
+		})
+	}
+}
+
+func TestDownloadLogFileResumesUnderCheckpointedKey(t *testing.T) {
+	portions := randomPortions(8, 100*1024)
+	opts := downloadOptions{PortionLines: defaultPortionLines, PartSize: 64 * 1024}
+	record := LogFileRecord{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log", Size: int64(len(strings.Join(portions, ""))), LastWritten: 1700000000000}
+	record = interruptDownload(t, newFakeS3(), "key.1700000000000", opts, record, portions)
+	if record.DownloadS3Key != "key.1700000000000" {
+		t.Fatalf("checkpointed key = %q, want key.1700000000000", record.DownloadS3Key)
+	}
+
+	// The key of the log file written since the checkpoint has moved on with its LastWritten time
+	tests := []struct {
+		name    string
+		restart bool
+		wantKey string
+	}{
+		{name: "resumed upload", wantKey: "key.1700000000000"},
+		{name: "restarted upload", restart: true, wantKey: "key.1700000001000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s3Client := newFakeS3()
+			record := interruptDownload(t, s3Client, "key.1700000000000", opts, record, portions)
+			if tt.restart {
+				record.DownloadHashState = ""
+			}
+
+			grown := append(slices.Clone(portions), "appended line\n")
+			record.Size += int64(len("appended line\n"))
+			record.LastWritten += 1000
+			rdsClient := &fakeLogFile{portions: portionChain(grown...)}
+			result, err := downloadLogFile(context.Background(), rdsClient, s3Client, &fakeRecords{}, "table", "bucket", "key.1700000001000", "text/plain", nil, opts, record, discardLogger)
+			if err != nil {
+				t.Fatalf("downloadLogFile() error = %v", err)
+			}
+
+			if result.S3Key != tt.wantKey {
+				t.Errorf("result S3Key = %q, want %q", result.S3Key, tt.wantKey)
+			}
+			if got := string(s3Client.objects[tt.wantKey]); got != strings.Join(grown, "") {
+				t.Errorf("uploaded %d bytes to %s, want the %d bytes of the current log file", len(got), tt.wantKey, len(strings.Join(grown, "")))
+			}
+			if len(s3Client.uploads) != 0 {
+				t.Errorf("%d multipart uploads still in progress", len(s3Client.uploads))
+			}
+		})
+	}
+}
+
+func TestDownloadLogFileResumesCompressedUpload(t *testing.T) {
+	portions := randomPortions(8, 100*1024)
+	raw := strings.Join(portions, "")
+	record := LogFileRecord{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log", Size: int64(len(raw)), LastWritten: 1700000000000}
+	opts := downloadOptions{PortionLines: defaultPortionLines, PartSize: 64 * 1024, Compression: compressionGzip}
+	s3Client := newFakeS3()
+
+	// The first invocation fails after checkpointing some parts
+	record = interruptDownload(t, s3Client, "key.gz", opts, record, portions)
+
+	// The next invocation resumes at the checkpoint with a new gzip member
+	rdsClient := &fakeLogFile{portions: portionChain(portions...)}
+	result, err := downloadLogFile(context.Background(), rdsClient, s3Client, &fakeRecords{}, "table", "bucket", "key.gz", "text/plain", nil, opts, record, discardLogger)
+	if err != nil {
+		t.Fatalf("resumed downloadLogFile() error = %v", err)
+	}
+	if rdsClient.markers[0] != record.DownloadMarker {
+		t.Errorf("resumed at marker %q, want %q", rdsClient.markers[0], record.DownloadMarker)
+	}
+	if got := gunzip(t, s3Client.objects["key.gz"]); got != raw {
+		t.Errorf("decompressed %d bytes, want %d", len(got), len(raw))
+	}
+	sum := md5.Sum([]byte(raw))
+	if result.Checksum != hex.EncodeToString(sum[:]) || result.RawBytes != int64(len(raw)) {
+		t.Errorf("result = %+v, want checksum %x and %d raw bytes", result, sum, len(raw))
+	}
+}
+
+// slowLogFile serves portions from the wrapped fakeLogFile after delay, and blocks on marker hangAt until
+// the call is cancelled
+type slowLogFile struct {
+	*fakeLogFile
+	delay  time.Duration
+	hangAt string
+}
+
+func (f *slowLogFile) DownloadDBLogFilePortion(ctx context.Context, params *rds.DownloadDBLogFilePortionInput, optFns ...func(*rds.Options)) (*rds.DownloadDBLogFilePortionOutput, error) {
+	wait := f.delay
+	if f.hangAt != "" && aws.ToString(params.Marker) == f.hangAt {
+		wait = time.Hour
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(wait):
+	}
+	return f.fakeLogFile.DownloadDBLogFilePortion(ctx, params, optFns...)
+}
+
+func TestDownloadLogFileStopsBeforeDeadline(t *testing.T) {
+	portions := randomPortions(40, 4*1024)
+	record := LogFileRecord{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log", Size: int64(len(strings.Join(portions, ""))), LastWritten: 1700000000000}
+	opts := downloadOptions{PortionLines: defaultPortionLines, PartSize: 4 * 1024, SafetyMargin: 300 * time.Millisecond}
+
+	tests := []struct {
+		name   string
+		delay  time.Duration
+		hangAt string
+	}{
+		{name: "between portions", delay: 50 * time.Millisecond},
+		{name: "portion in flight", hangAt: "m3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			dynamoClient := &fakeRecords{}
+			rdsClient := &slowLogFile{fakeLogFile: &fakeLogFile{portions: portionChain(portions...)}, delay: tt.delay, hangAt: tt.hangAt}
+			_, err := downloadLogFile(ctx, rdsClient, newFakeS3(), dynamoClient, "table", "bucket", "key", "text/plain", nil, opts, record, discardLogger)
+			if !errors.Is(err, errDeadlineReached) {
+				t.Fatalf("downloadLogFile() error = %v, want errDeadlineReached", err)
+			}
+			if ctx.Err() != nil {
+				t.Error("downloadLogFile() returned after the deadline, want within the safety margin")
+			}
+			if len(dynamoClient.checkpointMarkers()) == 0 {
+				t.Error("saved no checkpoint before the deadline")
+			}
+		})
+	}
+}
+
+func TestHandleCheckpointsBeforeDeadline(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+	t.Setenv("DEADLINE_SAFETY_MARGIN_SECONDS", "1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+
+	dynamoClient := &fakeRecords{}
+	rdsClient := &slowLogFile{fakeLogFile: &fakeLogFile{portions: portionChain("line 1\n", "line 2\n")}, hangAt: "m1"}
+	deps := HandlerDeps{RDS: rdsClient, S3: newFakeS3(), DynamoDB: dynamoClient}
+	event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{insertRecord("audit/server_audit.log", "")}}
+	response, err := NewHandler(deps)(ctx, event)
+	if err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Error("handler returned after the deadline, want within the safety margin")
+	}
+
+	if len(response.BatchItemFailures) != 1 {
+		t.Errorf("batch item failures = %v, want the record redelivered", response.BatchItemFailures)
+	}
+	resumed := false
+	for _, update := range dynamoClient.updates {
+		expression := aws.ToString(update.UpdateExpression)
+		if strings.Contains(expression, "DownloadResumeRequestedAt") {
+			resumed = true
+		}
+		if status, ok := update.ExpressionAttributeValues[":status"].(*types.AttributeValueMemberS); ok && status.Value == StatusFailed {
+			t.Errorf("marked the record %s, want it left to resume", StatusFailed)
+		}
+	}
+	if !resumed {
+		t.Error("requested no resume")
+	}
+}
+
+func TestHandleUploadsCompressedObjects(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+	t.Setenv("COMPRESSION", "gzip")
+
+	s3Client := newFakeS3()
+	dynamoClient := &fakeRecords{}
+	deps := HandlerDeps{RDS: &fakeLogFile{portions: portionChain("line 1\n")}, S3: s3Client, DynamoDB: dynamoClient}
+	event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{insertRecord("audit/server_audit.log", "audit")}}
+	if _, err := NewHandler(deps)(context.Background(), event); err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+
+	key := "logs/db-1/2023/11/14/audit/server_audit.log.1700000000000.gz"
+	object, ok := s3Client.objects[key]
+	if !ok {
+		t.Fatalf("no object uploaded to %s, objects = %v", key, s3Client.contentTypes)
+	}
+	if got := gunzip(t, object); got != "line 1\n" {
+		t.Errorf("decompressed %q, want %q", got, "line 1\n")
+	}
+	if s3Client.contentTypes[key] != "text/plain" || s3Client.contentEncodings[key] != "gzip" {
+		t.Errorf("ContentType = %q, ContentEncoding = %q, want text/plain and gzip", s3Client.contentTypes[key], s3Client.contentEncodings[key])
+	}
+
+	// Both sizes are recorded with the backup
+	backup := dynamoClient.updates[len(dynamoClient.updates)-1].ExpressionAttributeValues
+	rawSize, _ := backup[":rawSize"].(*types.AttributeValueMemberN)
+	objectSize, _ := backup[":objectSize"].(*types.AttributeValueMemberN)
+	if rawSize == nil || rawSize.Value != "7" || objectSize == nil || objectSize.Value != strconv.Itoa(len(object)) {
+		t.Errorf("recorded sizes %v and %v, want 7 and %d", rawSize, objectSize, len(object))
+	}
+}
+
+// failingLogFile fails the download of one log file and serves the others from fakeLogFile
+type failingLogFile struct {
+	*fakeLogFile
+	failName string
+}
+
+func (f *failingLogFile) DownloadDBLogFilePortion(ctx context.Context, params *rds.DownloadDBLogFilePortionInput, optFns ...func(*rds.Options)) (*rds.DownloadDBLogFilePortionOutput, error) {
+	if aws.ToString(params.LogFileName) == f.failName {
+		return nil, errors.New("throttled")
+	}
+	return f.fakeLogFile.DownloadDBLogFilePortion(ctx, params, optFns...)
+}
+
+func TestHandleWaitsForLogFilesToSettle(t *testing.T) {
+	lastWritten := time.UnixMilli(1700000000000) // LastWritten of insertRecord
+
+	tests := []struct {
+		name         string
+		window       string
+		now          time.Time
+		wantDownload bool
+	}{
+		{name: "written within the window", window: "300", now: lastWritten.Add(time.Minute)},
+		{name: "settled", window: "300", now: lastWritten.Add(10 * time.Minute), wantDownload: true},
+		{name: "no window", window: "0", now: lastWritten.Add(time.Second), wantDownload: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DYNAMODB_TABLE_NAME", "table")
+			t.Setenv("S3_BUCKET_NAME", "bucket")
+			t.Setenv("STABILITY_WINDOW_SECONDS", tt.window)
+
+			record := insertRecord("audit/server_audit.log", "")
+			record.Change.SequenceNumber = "100"
+			record.Change.NewImage["Status"] = events.NewStringAttribute(StatusPending)
+			rdsClient := &fakeLogFile{portions: portionChain("line 1\n")}
+			dynamoClient := &fakeRecords{}
+			deps := HandlerDeps{RDS: rdsClient, S3: newFakeS3(), DynamoDB: dynamoClient, Now: func() time.Time { return tt.now }}
+			response, err := NewHandler(deps)(context.Background(), events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{record}})
+			if err != nil {
+				t.Fatalf("handler error = %v", err)
+			}
+
+			if downloaded := len(rdsClient.markers) > 0; downloaded != tt.wantDownload {
+				t.Errorf("downloaded = %v, want %v", downloaded, tt.wantDownload)
+			}
+			var statuses []string
+			for _, update := range dynamoClient.updates {
+				if status, ok := update.ExpressionAttributeValues[":status"].(*types.AttributeValueMemberS); ok {
+					statuses = append(statuses, status.Value)
+				}
+			}
+			// A waiting record isn't a failure, so it doesn't hold back the rest of the shard
+			if len(response.BatchItemFailures) != 0 {
+				t.Errorf("BatchItemFailures = %+v, want none", response.BatchItemFailures)
+			}
+			if tt.wantDownload {
+				return
+			}
+
+			// The record waits for the detector to set it back to PENDING
+			if want := []string{StatusWaiting}; !reflect.DeepEqual(statuses, want) {
+				t.Errorf("statuses = %v, want %v", statuses, want)
+			}
+		})
+	}
+}
+
+// failingUpdates fails every UpdateItem and serves reads from fakeRecords
+type failingUpdates struct {
+	*fakeRecords
+}
+
+func (f failingUpdates) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	return nil, errors.New("throttled")
+}
+
+func TestHandleRetriesRecordsThatCantWait(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+	t.Setenv("STABILITY_WINDOW_SECONDS", "300")
+
+	record := insertRecord("audit/server_audit.log", "")
+	record.Change.SequenceNumber = "100"
+	now := time.UnixMilli(1700000000000).Add(time.Minute) // Within the window of insertRecord's LastWritten
+	deps := HandlerDeps{RDS: &fakeLogFile{}, S3: newFakeS3(), DynamoDB: failingUpdates{&fakeRecords{}}, Now: func() time.Time { return now }}
+	response, err := NewHandler(deps)(context.Background(), events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{record}})
+	if err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+
+	// The record couldn't be marked WAITING, so only the stream can retry it
+	if want := []events.DynamoDBBatchItemFailure{{ItemIdentifier: "100"}}; !reflect.DeepEqual(response.BatchItemFailures, want) {
+		t.Errorf("BatchItemFailures = %+v, want %+v", response.BatchItemFailures, want)
+	}
+}
+
+func TestHandleReportsFailedRecords(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+
+	sequenced := func(logFileName, sequenceNumber string) events.DynamoDBEventRecord {
+		record := insertRecord(logFileName, "")
+		record.Change.SequenceNumber = sequenceNumber
+		return record
+	}
+	event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{
+		sequenced("audit/server_audit.log", "100"),
+		sequenced("audit/server_audit.log.1", "200"),
+		sequenced("audit/server_audit.log.2", "300"),
+	}}
+
+	rdsClient := &failingLogFile{fakeLogFile: &fakeLogFile{portions: portionChain("line 1\n")}, failName: "audit/server_audit.log.1"}
+	s3Client := newFakeS3()
+	response, err := NewHandler(HandlerDeps{RDS: rdsClient, S3: s3Client, DynamoDB: &fakeRecords{}})(context.Background(), event)
+	if err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+
+	want := []events.DynamoDBBatchItemFailure{{ItemIdentifier: "200"}}
+	if !reflect.DeepEqual(response.BatchItemFailures, want) {
+		t.Errorf("BatchItemFailures = %+v, want %+v", response.BatchItemFailures, want)
+	}
+	for _, key := range []string{"logs/db-1/2023/11/14/audit/server_audit.log.1700000000000", "logs/db-1/2023/11/14/audit/server_audit.log.2.1700000000000"} {
+		if _, ok := s3Client.objects[key]; !ok {
+			t.Errorf("%s wasn't uploaded", key)
+		}
+	}
+}
+
+func TestHandleSkipsRecordsBackedUpSinceTheChange(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+
+	changedAt := time.Unix(1_700_000_100, 0)
+	tests := []struct {
+		name         string
+		status       string
+		lastBackup   time.Time
+		wantDownload bool
+	}{
+		{name: "backed up after the change", status: StatusDownloaded, lastBackup: changedAt.Add(time.Minute), wantDownload: false},
+		{name: "backed up within the second of the change", status: StatusDownloaded, lastBackup: changedAt.Add(500 * time.Millisecond), wantDownload: true},
+		{name: "backed up before the change", status: StatusDownloaded, lastBackup: changedAt.Add(-time.Minute), wantDownload: true},
+		{name: "failed after the change", status: StatusFailed, lastBackup: changedAt.Add(time.Minute), wantDownload: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := insertRecord("audit/server_audit.log", "")
+			record.EventName = "MODIFY"
+			record.Change.ApproximateCreationDateTime = events.SecondsEpochTime{Time: changedAt}
+
+			current, err := attributevalue.MarshalMap(LogFileRecord{
+				DBInstanceIdentifier: "db-1",
+				LogFileName:          "audit/server_audit.log",
+				Status:               tt.status,
+				LastBackup:           timeutil.EpochMillis(tt.lastBackup),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rdsClient := &fakeLogFile{portions: portionChain("line 1\n")}
+			deps := HandlerDeps{RDS: rdsClient, S3: newFakeS3(), DynamoDB: &fakeRecords{item: current}}
+			if _, err := NewHandler(deps)(context.Background(), events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{record}}); err != nil {
+				t.Fatalf("handler error = %v", err)
+			}
+			if downloaded := len(rdsClient.markers) > 0; downloaded != tt.wantDownload {
+				t.Errorf("downloaded = %v, want %v", downloaded, tt.wantDownload)
+			}
+		})
+	}
+}
+
+func TestNewHandlerDepsDynamoDBRetryer(t *testing.T) {
+	t.Setenv("DYNAMODB_MAX_ATTEMPTS", "4")
+
+	deps := NewHandlerDeps(aws.Config{Region: "us-east-1"})
+	client, ok := deps.DynamoDB.(*dynamodb.Client)
+	if !ok {
+		t.Fatalf("DynamoDB = %T, want *dynamodb.Client", deps.DynamoDB)
+	}
+	if got := client.Options().Retryer.MaxAttempts(); got != 4 {
+		t.Errorf("retryer MaxAttempts() = %d, want DYNAMODB_MAX_ATTEMPTS", got)
+	}
+}
+
+func TestHandleFailsWithInvalidConfig(t *testing.T) {
+	for name, value := range map[string]string{"DYNAMODB_MAX_ATTEMPTS": "0", "FORCE_UPLOAD": "yes please", "OUTPUT_FORMAT": "xml"} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("DYNAMODB_TABLE_NAME", "table")
+			t.Setenv("S3_BUCKET_NAME", "bucket")
+			t.Setenv(name, value)
+
+			// An invocation error retries the stream batch instead of acknowledging it without a backup
+			s3Client := newFakeS3()
+			deps := HandlerDeps{RDS: &fakeLogFile{portions: portionChain("line 1\n")}, S3: s3Client, DynamoDB: &fakeRecords{}}
+			event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{insertRecord("audit/server_audit.log", "")}}
+			if _, err := NewHandler(deps)(context.Background(), event); err == nil || !strings.Contains(err.Error(), name) {
+				t.Fatalf("handler error = %v, want one naming %s", err, name)
+			}
+			if len(s3Client.objects) != 0 {
+				t.Errorf("uploaded %v, want nothing with an invalid %s", s3Client.objects, name)
+			}
+		})
+	}
+}
+
+func TestLoadDownloaderConfig(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+
+	cfg, err := loadDownloaderConfig()
+	if err != nil {
+		t.Fatalf("loadDownloaderConfig() error = %v", err)
+	}
+	if cfg.S3Prefix != "logs" || cfg.S3KeyTemplate != defaultS3KeyTemplate || !cfg.LogTypes[logFileTypeAudit] {
+		t.Errorf("loadDownloaderConfig() = %+v, want the default prefix, key template and log types", cfg)
+	}
+	opts := cfg.Options
+	if opts.ChecksumAlgorithm != checksum.Default || opts.SafetyMargin != defaultSafetyMargin || opts.PortionLines != defaultPortionLines || opts.PartSize != multipartPartSize || opts.OutputFormat != outputFormatRaw || opts.Compression != compressionNone {
+		t.Errorf("loadDownloaderConfig() options = %+v, want the defaults", opts)
+	}
+
+	t.Setenv("PARTITION_BY_DATE", "true")
+	t.Setenv("LEGACY_KEYS", "true")
+	if cfg, err := loadDownloaderConfig(); err != nil || cfg.S3KeyTemplate != legacyPartitionedS3KeyTemplate {
+		t.Errorf("loadDownloaderConfig() key template = %q, %v, want the legacy partitioned template", cfg.S3KeyTemplate, err)
+	}
+}
+
+func TestLoadDownloaderConfigRejectsInvalidValues(t *testing.T) {
+	tests := map[string]string{
+		"PARTITION_BY_DATE":              "sometimes",
+		"FORCE_UPLOAD":                   "yes please",
+		"CHECKSUM_ALGO":                  "crc32",
+		"DEADLINE_SAFETY_MARGIN_SECONDS": "-1",
+		"STABILITY_WINDOW_SECONDS":       "soon",
+		"PORTION_LINES":                  "0",
+		"MAX_FILE_BYTES":                 "-1",
+		"PORTION_MAX_ATTEMPTS":           "0",
+		"MULTIPART_PART_SIZE_MB":         "1",
+		"REGIONS":                        "mars-1",
+		"RDS_API_RPS":                    "-1",
+		"DYNAMODB_MAX_ATTEMPTS":          "0",
+		"DRY_RUN":                        "maybe",
+		"OUTPUT_FORMAT":                  "xml",
+		"COMPRESSION":                    "zstd",
+		"LOG_TYPES":                      "audit,binlog",
+		"METRICS_BY_INSTANCE":            "2",
+	}
+
+	for name, value := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("DYNAMODB_TABLE_NAME", "table")
+			t.Setenv("S3_BUCKET_NAME", "bucket")
+			t.Setenv(name, value)
+
+			_, err := loadDownloaderConfig()
+			if err == nil || !strings.Contains(err.Error(), name) {
+				t.Errorf("loadDownloaderConfig() error = %v, want one naming %s", err, name)
+			}
+		})
+	}
+}
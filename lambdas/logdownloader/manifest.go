@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/checksum"
+)
+
+// manifestName is the name of the per-instance manifest object, under {prefix}/{instance}/
+const manifestName = "_manifest.json"
+
+// manifest lists the backed-up log files of a DB instance
+type manifest struct {
+	DBInstanceIdentifier string          `json:"DBInstanceIdentifier"`
+	GeneratedAt          int64           `json:"GeneratedAt"` // Epoch milliseconds
+	Files                []manifestEntry `json:"Files"`
+}
+
+// manifestEntry is a backed-up log file, as last recorded by updateLastBackup
+type manifestEntry struct {
+	LogFileName       string `json:"LogFileName"`
+	Size              int64  `json:"Size"`
+	LastWritten       int64  `json:"LastWritten"`       // Epoch milliseconds
+	LastBackup        int64  `json:"LastBackup"`        // Epoch milliseconds
+	Checksum          string `json:"Checksum"`          // Hex checksum of the downloaded content
+	ChecksumAlgorithm string `json:"ChecksumAlgorithm"` // md5 or sha256
+	S3Key             string `json:"S3Key"`
+	Parts             int64  `json:"Parts,omitempty"` // Parts appended by delta downloads, at the S3Key's .partN keys
+}
+
+// manifestKey returns the S3 key of the manifest of a DB instance
+func manifestKey(s3Prefix, dbInstanceID string) string {
+	return s3Prefix + "/" + dbInstanceID + "/" + manifestName
+}
+
+// buildManifest lists the records that have been backed up, by log file name.
+// Bookkeeping items and records that were never backed up are left out.
+func buildManifest(dbInstanceID string, records []LogFileRecord, generatedAt int64) manifest {
+	m := manifest{DBInstanceIdentifier: dbInstanceID, GeneratedAt: generatedAt, Files: []manifestEntry{}}
+	for _, record := range records {
+		if strings.HasPrefix(record.LogFileName, "#") || record.LastBackup == 0 {
+			continue
+		}
+		m.Files = append(m.Files, manifestEntry{
+			LogFileName:       record.LogFileName,
+			Size:              record.Size,
+			LastWritten:       record.LastWritten,
+			LastBackup:        record.LastBackup,
+			Checksum:          record.LastChecksum,
+			ChecksumAlgorithm: checksum.Normalize(record.LastChecksumAlgorithm),
+			S3Key:             record.LastS3Key,
+			Parts:             record.LastPartCount,
+		})
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].LogFileName < m.Files[j].LogFileName })
+	return m
+}
+
+// queryInstanceRecords returns every item of a DB instance with a strongly consistent query,
+// so a record updated by this invocation is included
+func queryInstanceRecords(ctx context.Context, client DynamoUpdater, tableName, dbInstanceID string) ([]LogFileRecord, error) {
+	var records []LogFileRecord
+	var exclusiveStartKey map[string]types.AttributeValue
+
+	for {
+		resp, err := client.Query(ctx, &dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			KeyConditionExpression: aws.String("DBInstanceIdentifier = :id"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":id": &types.AttributeValueMemberS{Value: dbInstanceID},
+			},
+			ConsistentRead:    aws.Bool(true),
+			ExclusiveStartKey: exclusiveStartKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var page []LogFileRecord
+		if err := attributevalue.UnmarshalListOfMaps(resp.Items, &page); err != nil {
+			return nil, err
+		}
+		records = append(records, page...)
+
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		exclusiveStartKey = resp.LastEvaluatedKey
+	}
+
+	return records, nil
+}
+
+// writeManifest rebuilds the manifest of a DB instance from the table and uploads it.
+// Every rebuild lists the whole table, so concurrent invocations can't drop each other's entries: a manifest
+// overwritten by an older rebuild is repaired by the next backup of the instance. The pinned S3 client has no
+// conditional PutObject (If-Match), so the upload itself is unconditional.
+func writeManifest(ctx context.Context, dynamoClient DynamoUpdater, s3Client S3Putter, tableName, bucketName, s3Prefix, dbInstanceID string, generatedAt int64, encryption objectEncryption, logger *log.Logger) error {
+	records, err := queryInstanceRecords(ctx, dynamoClient, tableName, dbInstanceID)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.MarshalIndent(buildManifest(dbInstanceID, records, generatedAt), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	key := manifestKey(s3Prefix, dbInstanceID)
+	logger.Printf("Writing manifest s3://%s/%s\n", bucketName, key)
+	_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:               aws.String(bucketName),
+		Key:                  aws.String(key),
+		Body:                 bytes.NewReader(body),
+		ContentType:          aws.String("application/json"),
+		ServerSideEncryption: encryption.SSE,
+		SSEKMSKeyId:          encryption.kmsKeyID(),
+	})
+	return err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/checksum"
+)
+
+func TestBuildManifest(t *testing.T) {
+	records := []LogFileRecord{
+		{LogFileName: "audit/server_audit.log.2", Size: 20, LastWritten: 2000, LastBackup: 2500, LastChecksum: "b", LastChecksumAlgorithm: checksum.SHA256, LastS3Key: "logs/db-1/audit/server_audit.log.2"},
+		{LogFileName: "#SUMMARY"},
+		{LogFileName: "audit/server_audit.log", Size: 30, LastWritten: 3000, Status: StatusPending}, // Never backed up
+		{LogFileName: "audit/server_audit.log.1", Size: 10, LastWritten: 1000, LastBackup: 1500, LastChecksum: "a", LastS3Key: "logs/db-1/audit/server_audit.log.1", LastPartCount: 2},
+	}
+
+	got := buildManifest("db-1", records, 4000)
+	want := manifest{
+		DBInstanceIdentifier: "db-1",
+		GeneratedAt:          4000,
+		Files: []manifestEntry{
+			{LogFileName: "audit/server_audit.log.1", Size: 10, LastWritten: 1000, LastBackup: 1500, Checksum: "a", ChecksumAlgorithm: checksum.MD5, S3Key: "logs/db-1/audit/server_audit.log.1", Parts: 2},
+			{LogFileName: "audit/server_audit.log.2", Size: 20, LastWritten: 2000, LastBackup: 2500, Checksum: "b", ChecksumAlgorithm: checksum.SHA256, S3Key: "logs/db-1/audit/server_audit.log.2"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("buildManifest() = %+v, want %+v", got, want)
+	}
+}
+
+func TestHandleWritesManifest(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+
+	// The table as read back after the backup, including a file backed up by an earlier invocation
+	var items []map[string]types.AttributeValue
+	for _, record := range []LogFileRecord{
+		{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log", Size: 7, LastWritten: 1700000000000, LastBackup: 1700000001000, LastChecksum: "new", LastS3Key: "logs/db-1/audit/server_audit.log"},
+		{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log.1", Size: 5, LastWritten: 1699999000000, LastBackup: 1699999001000, LastChecksum: "old", LastS3Key: "logs/db-1/audit/server_audit.log.1"},
+	} {
+		item, err := attributevalue.MarshalMap(record)
+		if err != nil {
+			t.Fatalf("MarshalMap() error = %v", err)
+		}
+		items = append(items, item)
+	}
+
+	s3Client := newFakeS3()
+	deps := HandlerDeps{RDS: &fakeLogFile{portions: portionChain("line 1\n")}, S3: s3Client, DynamoDB: &fakeRecords{records: items}}
+	event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{insertRecord("audit/server_audit.log", "audit")}}
+	if _, err := NewHandler(deps)(context.Background(), event); err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+
+	body, ok := s3Client.objects["logs/db-1/_manifest.json"]
+	if !ok {
+		t.Fatalf("no manifest uploaded, objects = %v", s3Client.contentTypes)
+	}
+	var got manifest
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("manifest is not JSON: %v", err)
+	}
+	var names []string
+	for _, entry := range got.Files {
+		names = append(names, entry.LogFileName)
+	}
+	if want := []string{"audit/server_audit.log", "audit/server_audit.log.1"}; got.DBInstanceIdentifier != "db-1" || !reflect.DeepEqual(names, want) {
+		t.Errorf("manifest of %s lists %v, want db-1 listing %v", got.DBInstanceIdentifier, names, want)
+	}
+}
+
+func TestHandleDryRunWritesNoManifest(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+	t.Setenv("DRY_RUN", "true")
+
+	s3Client := newFakeS3()
+	deps := HandlerDeps{RDS: &fakeLogFile{portions: portionChain("line 1\n")}, S3: s3Client, DynamoDB: &fakeRecords{}}
+	event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{insertRecord("audit/server_audit.log", "audit")}}
+	if _, err := NewHandler(deps)(context.Background(), event); err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+	if len(s3Client.objects) != 0 {
+		t.Errorf("dry run uploaded %v", s3Client.contentTypes)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/emf"
+)
+
+// Outcomes of the backup of a log file, each counted in a metric of its own
+const (
+	outcomeSuccess = "success"
+	outcomeFailed  = "failed"  // The record was marked FAILED, or the download stopped at the Lambda deadline
+	outcomeSkipped = "skipped" // The content matched LastChecksum, so nothing was uploaded
+	outcomePartial = "partial" // Only the first MAX_FILE_BYTES were backed up
+)
+
+// outcomeMetrics names the metric counting the log files of each outcome
+var outcomeMetrics = map[string]string{
+	outcomeSuccess: "FilesSucceeded",
+	outcomeFailed:  "FilesFailed",
+	outcomeSkipped: "FilesSkipped",
+	outcomePartial: "FilesPartial",
+}
+
+// fileTransfer measures the download of a log file from RDS and its upload to S3
+type fileTransfer struct {
+	Portions         int   // DownloadDBLogFilePortion calls that returned data
+	BytesDownloaded  int64 // Bytes of log file data returned by RDS
+	BytesUploaded    int64 // Bytes of the objects and parts written to S3
+	DownloadDuration time.Duration
+	UploadDuration   time.Duration
+}
+
+// add adds the measures of another transfer
+func (t *fileTransfer) add(other fileTransfer) {
+	t.Portions += other.Portions
+	t.BytesDownloaded += other.BytesDownloaded
+	t.BytesUploaded += other.BytesUploaded
+	t.DownloadDuration += other.DownloadDuration
+	t.UploadDuration += other.UploadDuration
+}
+
+// measuredRDS measures the log file portions downloaded through the client
+type measuredRDS struct {
+	client   RDSLogAPI
+	transfer *fileTransfer
+}
+
+// rds wraps the client so the portions it downloads are measured by the transfer
+func (t *fileTransfer) rds(client RDSLogAPI) RDSLogAPI {
+	return &measuredRDS{client: client, transfer: t}
+}
+
+func (c *measuredRDS) DescribeDBLogFiles(ctx context.Context, params *rds.DescribeDBLogFilesInput, optFns ...func(*rds.Options)) (*rds.DescribeDBLogFilesOutput, error) {
+	return c.client.DescribeDBLogFiles(ctx, params, optFns...)
+}
+
+func (c *measuredRDS) DownloadDBLogFilePortion(ctx context.Context, params *rds.DownloadDBLogFilePortionInput, optFns ...func(*rds.Options)) (*rds.DownloadDBLogFilePortionOutput, error) {
+	start := time.Now()
+	out, err := c.client.DownloadDBLogFilePortion(ctx, params, optFns...)
+	c.transfer.DownloadDuration += time.Since(start)
+	if err != nil {
+		return out, err
+	}
+	c.transfer.Portions++
+	if out.LogFileData != nil {
+		c.transfer.BytesDownloaded += int64(len(*out.LogFileData))
+	}
+	return out, nil
+}
+
+// measuredS3 measures the writes of the backup objects through the client. The other calls aren't measured.
+type measuredS3 struct {
+	S3Putter
+	transfer *fileTransfer
+}
+
+// s3 wraps the client so the objects and parts it writes are measured by the transfer
+func (t *fileTransfer) s3(client S3Putter) S3Putter {
+	return &measuredS3{S3Putter: client, transfer: t}
+}
+
+// timed adds the duration of an upload call to the transfer
+func (c *measuredS3) timed(start time.Time) {
+	c.transfer.UploadDuration += time.Since(start)
+}
+
+func (c *measuredS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	defer c.timed(time.Now())
+	// The body is read by the call, so its size is taken before
+	var size int64
+	if body, ok := params.Body.(interface{ Size() int64 }); ok {
+		size = body.Size()
+	}
+	out, err := c.S3Putter.PutObject(ctx, params, optFns...)
+	if err == nil {
+		c.transfer.BytesUploaded += size
+	}
+	return out, err
+}
+
+func (c *measuredS3) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	defer c.timed(time.Now())
+	return c.S3Putter.CreateMultipartUpload(ctx, params, optFns...)
+}
+
+func (c *measuredS3) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	defer c.timed(time.Now())
+	out, err := c.S3Putter.UploadPart(ctx, params, optFns...)
+	if err == nil && params.ContentLength != nil {
+		c.transfer.BytesUploaded += *params.ContentLength
+	}
+	return out, err
+}
+
+func (c *measuredS3) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	defer c.timed(time.Now())
+	return c.S3Putter.CompleteMultipartUpload(ctx, params, optFns...)
+}
+
+func (c *measuredS3) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	defer c.timed(time.Now())
+	return c.S3Putter.CopyObject(ctx, params, optFns...)
+}
+
+// transferTotals aggregates the log files backed up by an invocation
+type transferTotals struct {
+	fileTransfer
+	Outcomes map[string]int
+}
+
+// observe adds the transfer of a log file with its outcome
+func (t *transferTotals) observe(transfer fileTransfer, outcome string) {
+	t.add(transfer)
+	if t.Outcomes == nil {
+		t.Outcomes = make(map[string]int)
+	}
+	t.Outcomes[outcome]++
+}
+
+// transferMetrics returns the metrics of a transfer, prefixed with prefix
+func transferMetrics(prefix string, transfer fileTransfer) []emf.Metric {
+	return []emf.Metric{
+		{Name: prefix + "BytesDownloaded", Value: float64(transfer.BytesDownloaded), Unit: emf.Bytes},
+		{Name: prefix + "BytesUploaded", Value: float64(transfer.BytesUploaded), Unit: emf.Bytes},
+		{Name: prefix + "Portions", Value: float64(transfer.Portions), Unit: emf.Count},
+		{Name: prefix + "DownloadDurationMs", Value: float64(transfer.DownloadDuration.Milliseconds()), Unit: emf.Milliseconds},
+		{Name: prefix + "UploadDurationMs", Value: float64(transfer.UploadDuration.Milliseconds()), Unit: emf.Milliseconds},
+	}
+}
+
+// emitFileMetrics publishes the transfer and outcome of a log file's backup in CloudWatch embedded metric format.
+// With byInstance the metrics are also dimensioned by the DB instance, which creates a set of metrics per instance.
+func (deps HandlerDeps) emitFileMetrics(record LogFileRecord, transfer fileTransfer, outcome string, byInstance bool, logger *log.Logger) {
+	logger.Printf("Backup of log file %s %s: %d portions, %d bytes downloaded in %s, %d bytes uploaded in %s\n", record.LogFileName, outcome, transfer.Portions, transfer.BytesDownloaded, transfer.DownloadDuration, transfer.BytesUploaded, transfer.UploadDuration)
+
+	w := deps.Metrics
+	if w == nil {
+		w = os.Stdout
+	}
+	dimensions := map[string]string{"FunctionName": os.Getenv("AWS_LAMBDA_FUNCTION_NAME")}
+	if byInstance {
+		dimensions["DBInstanceIdentifier"] = record.DBInstanceIdentifier
+	}
+	metrics := append(transferMetrics("", transfer), emf.Metric{Name: outcomeMetrics[outcome], Value: 1, Unit: emf.Count})
+	if err := emf.New(w, emf.Namespace).Emit(dimensions, metrics); err != nil {
+		logger.Printf("Error emitting metrics: %v\n", err)
+	}
+}
+
+// emitInvocationMetrics publishes the totals of the log files backed up by the invocation in CloudWatch embedded
+// metric format. Their names start with Invocation, so they aren't summed with the metrics of the log files.
+func (deps HandlerDeps) emitInvocationMetrics(totals transferTotals, logger *log.Logger) {
+	w := deps.Metrics
+	if w == nil {
+		w = os.Stdout
+	}
+	dimensions := map[string]string{"FunctionName": os.Getenv("AWS_LAMBDA_FUNCTION_NAME")}
+	metrics := transferMetrics("Invocation", totals.fileTransfer)
+	for _, outcome := range []string{outcomeSuccess, outcomeFailed, outcomeSkipped, outcomePartial} {
+		metrics = append(metrics, emf.Metric{Name: "Invocation" + outcomeMetrics[outcome], Value: float64(totals.Outcomes[outcome]), Unit: emf.Count})
+	}
+	if err := emf.New(w, emf.Namespace).Emit(dimensions, metrics); err != nil {
+		logger.Printf("Error emitting metrics: %v\n", err)
+	}
+}
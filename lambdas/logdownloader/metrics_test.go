@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/checksum"
+)
+
+// metricRecord returns the EMF record of the output that has the named metric
+func metricRecord(t *testing.T, output, name string) map[string]any {
+	t.Helper()
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("metrics %q are not JSON: %v", line, err)
+		}
+		if _, ok := record[name]; ok {
+			return record
+		}
+	}
+	t.Fatalf("metrics %q have no %s", output, name)
+	return nil
+}
+
+func TestHandleEmitsFileMetrics(t *testing.T) {
+	const key = "logs/db-1/2023/11/14/audit/server_audit.log.1700000000000"
+
+	// The current record of a log file backed up with the content of the first portion
+	sum := sha256.Sum256([]byte("line 1\n"))
+	backedUp, err := attributevalue.MarshalMap(LogFileRecord{
+		DBInstanceIdentifier:  "db-1",
+		LogFileName:           "audit/server_audit.log",
+		LastBackup:            1,
+		LastChecksum:          hex.EncodeToString(sum[:]),
+		LastChecksumAlgorithm: checksum.SHA256,
+		LastS3Key:             key,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		env          map[string]string
+		portions     []string
+		rdsErr       error
+		item         map[string]types.AttributeValue
+		wantOutcome  string
+		wantPortions float64
+		wantDown     float64
+		wantUp       float64
+		wantInstance bool
+	}{
+		{name: "success", portions: []string{"line 1\n", "line 2\n"}, wantOutcome: "FilesSucceeded", wantPortions: 2, wantDown: 14, wantUp: 14},
+		{name: "failed", rdsErr: errors.New("throttled"), wantOutcome: "FilesFailed"},
+		{name: "skipped", portions: []string{"line 1\n"}, item: backedUp, wantOutcome: "FilesSkipped", wantPortions: 1, wantDown: 7},
+		{name: "partial", env: map[string]string{"MAX_FILE_BYTES": "7"}, portions: []string{"line 1\n", "line 2\n"}, wantOutcome: "FilesPartial", wantPortions: 1, wantDown: 7, wantUp: 7},
+		{name: "by instance", env: map[string]string{"METRICS_BY_INSTANCE": "true"}, portions: []string{"line 1\n", "line 2\n"}, wantOutcome: "FilesSucceeded", wantPortions: 2, wantDown: 14, wantUp: 14, wantInstance: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DYNAMODB_TABLE_NAME", "table")
+			t.Setenv("S3_BUCKET_NAME", "bucket")
+			t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "log-downloader")
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			record := insertRecord("audit/server_audit.log", "")
+			record.Change.NewImage["Size"] = events.NewNumberAttribute("14")
+			var rdsClient RDSLogAPI = &fakeLogFile{portions: portionChain(tt.portions...)}
+			if tt.rdsErr != nil {
+				rdsClient = &goneLogFile{fakeLogFile: &fakeLogFile{}, err: tt.rdsErr}
+			}
+			var output strings.Builder
+			deps := HandlerDeps{RDS: rdsClient, S3: newFakeS3(), DynamoDB: &fakeRecords{item: tt.item}, Metrics: &output}
+			if _, err := NewHandler(deps)(context.Background(), events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{record}}); err != nil {
+				t.Fatalf("handler error = %v", err)
+			}
+
+			file := metricRecord(t, output.String(), tt.wantOutcome)
+			if file[tt.wantOutcome] != 1.0 || file["Portions"] != tt.wantPortions || file["BytesDownloaded"] != tt.wantDown || file["BytesUploaded"] != tt.wantUp {
+				t.Errorf("file metrics = %v, want %s with %v portions, %v bytes downloaded and %v uploaded", file, tt.wantOutcome, tt.wantPortions, tt.wantDown, tt.wantUp)
+			}
+			for _, name := range []string{"DownloadDurationMs", "UploadDurationMs"} {
+				if _, ok := file[name]; !ok {
+					t.Errorf("file metrics = %v, want %s", file, name)
+				}
+			}
+			if instance, ok := file["DBInstanceIdentifier"]; ok != tt.wantInstance || (ok && instance != "db-1") {
+				t.Errorf("file metrics dimensioned by instance %v, want %t", instance, tt.wantInstance)
+			}
+			if file["FunctionName"] != "log-downloader" {
+				t.Errorf("file metrics = %v, want them dimensioned by log-downloader", file)
+			}
+
+			// The invocation totals are only dimensioned by function
+			invocation := metricRecord(t, output.String(), "Invocation"+tt.wantOutcome)
+			if invocation["Invocation"+tt.wantOutcome] != 1.0 || invocation["InvocationBytesDownloaded"] != tt.wantDown || invocation["InvocationPortions"] != tt.wantPortions {
+				t.Errorf("invocation metrics = %v, want the totals of the file", invocation)
+			}
+			if _, ok := invocation["DBInstanceIdentifier"]; ok {
+				t.Errorf("invocation metrics = %v, want no instance dimension", invocation)
+			}
+		})
+	}
+}
+
+func TestHandleDryRunEmitsNoFileMetrics(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+	t.Setenv("DRY_RUN", "true")
+
+	var output strings.Builder
+	deps := HandlerDeps{RDS: &fakeLogFile{portions: portionChain("line 1\n")}, S3: newFakeS3(), DynamoDB: &fakeRecords{}, Metrics: &output}
+	event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{insertRecord("audit/server_audit.log", "")}}
+	if _, err := NewHandler(deps)(context.Background(), event); err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+	if output.Len() != 0 {
+		t.Errorf("emitted %q, want no metrics for a dry run", output.String())
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// multipartPartSize is the default amount of downloaded data buffered before it is uploaded as one part,
+// and the smallest allowed: S3 requires every part except the last to be at least 5 MiB.
+const multipartPartSize = 5 * 1024 * 1024
+
+// maxMultipartPartSize is the largest part S3 accepts
+const maxMultipartPartSize = 5 * 1024 * 1024 * 1024
+
+// multipartUpload tracks an S3 multipart upload and the parts uploaded so far
+type multipartUpload struct {
+	client   S3Putter
+	bucket   string
+	key      string
+	uploadID string
+	parts    []s3types.CompletedPart
+	// The upload was created with the SHA-256 checksum algorithm, so every part carries its checksum.
+	// Uploads checkpointed before the checksums were requested are resumed without them.
+	checksummed bool
+}
+
+// objectChecksum returns the base64 SHA-256 of an object or part, which S3 checks the uploaded data against
+func objectChecksum(data []byte) *string {
+	sum := sha256.Sum256(data)
+	return aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// createMultipartUpload starts a new multipart upload
+func createMultipartUpload(ctx context.Context, client S3Putter, bucketName, key, contentType, contentEncoding string, metadata map[string]string, encryption objectEncryption, logger *log.Logger) (*multipartUpload, error) {
+	logger.Printf("Starting multipart upload to S3: s3://%s/%s\n", bucketName, key)
+
+	// The parts are encrypted as the upload was requested, so they need no encryption headers of their own
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(bucketName),
+		Key:                  aws.String(key),
+		ContentType:          aws.String(contentType),
+		Metadata:             metadata,
+		ServerSideEncryption: encryption.SSE,
+		SSEKMSKeyId:          encryption.kmsKeyID(),
+		ChecksumAlgorithm:    s3types.ChecksumAlgorithmSha256,
+	}
+	if contentEncoding != "" {
+		input.ContentEncoding = aws.String(contentEncoding)
+	}
+	resp, err := client.CreateMultipartUpload(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	return &multipartUpload{
+		client:      client,
+		bucket:      bucketName,
+		key:         key,
+		uploadID:    aws.ToString(resp.UploadId),
+		checksummed: true,
+	}, nil
+}
+
+// resumeMultipartUpload reattaches to an existing multipart upload.
+// Only the parts covered by the checkpointed byte count are kept; a part uploaded after
+// the last checkpoint is overwritten when the download reaches it again.
+func resumeMultipartUpload(ctx context.Context, client S3Putter, bucketName, key, uploadID string, checkpointBytes int64, logger *log.Logger) (*multipartUpload, error) {
+	logger.Printf("Resuming multipart upload %s to S3: s3://%s/%s\n", uploadID, bucketName, key)
+
+	upload := &multipartUpload{
+		client:   client,
+		bucket:   bucketName,
+		key:      key,
+		uploadID: uploadID,
+	}
+
+	var uploadedBytes int64
+	var partNumberMarker *string
+
+	// Use pagination to list all uploaded parts
+	for {
+		resp, err := client.ListParts(ctx, &s3.ListPartsInput{
+			Bucket:           aws.String(bucketName),
+			Key:              aws.String(key),
+			UploadId:         aws.String(uploadID),
+			PartNumberMarker: partNumberMarker,
+		})
+		if err != nil {
+			return nil, err
+		}
+		upload.checksummed = resp.ChecksumAlgorithm == s3types.ChecksumAlgorithmSha256
+
+		for _, part := range resp.Parts {
+			if uploadedBytes >= checkpointBytes {
+				break
+			}
+			upload.parts = append(upload.parts, s3types.CompletedPart{
+				ETag:           part.ETag,
+				PartNumber:     part.PartNumber,
+				ChecksumSHA256: part.ChecksumSHA256,
+			})
+			uploadedBytes += aws.ToInt64(part.Size)
+		}
+
+		// Check if there are more pages
+		if resp.IsTruncated == nil || !*resp.IsTruncated || uploadedBytes >= checkpointBytes {
+			break
+		}
+		partNumberMarker = resp.NextPartNumberMarker
+	}
+
+	logger.Printf("Found %d uploaded parts (%d bytes) for multipart upload %s\n", len(upload.parts), uploadedBytes, uploadID)
+	return upload, nil
+}
+
+// uploadPart uploads the next part of the multipart upload
+func (u *multipartUpload) uploadPart(ctx context.Context, data []byte, logger *log.Logger) error {
+	partNumber := int32(len(u.parts) + 1)
+	logger.Printf("Uploading part %d (%d bytes) of s3://%s/%s\n", partNumber, len(data), u.bucket, u.key)
+
+	input := &s3.UploadPartInput{
+		Bucket:        aws.String(u.bucket),
+		Key:           aws.String(u.key),
+		UploadId:      aws.String(u.uploadID),
+		PartNumber:    aws.Int32(partNumber),
+		Body:          bytes.NewReader(data),
+		ContentLength: aws.Int64(int64(len(data))),
+	}
+	if u.checksummed {
+		input.ChecksumSHA256 = objectChecksum(data)
+	}
+	resp, err := u.client.UploadPart(ctx, input)
+	if err != nil {
+		return err
+	}
+
+	u.parts = append(u.parts, s3types.CompletedPart{
+		ETag:           resp.ETag,
+		PartNumber:     aws.Int32(partNumber),
+		ChecksumSHA256: input.ChecksumSHA256,
+	})
+
+	return nil
+}
+
+// complete assembles the uploaded parts into the final object. Unless overwrite is set, an object already at
+// the key is only replaced when it doesn't hold the content of sum and size; otherwise the upload is
+// aborted and false is returned.
+func (u *multipartUpload) complete(ctx context.Context, overwrite bool, sum contentChecksum, size int64, logger *log.Logger) (bool, error) {
+	logger.Printf("Completing multipart upload of s3://%s/%s with %d parts\n", u.bucket, u.key, len(u.parts))
+
+	input := &s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(u.bucket),
+		Key:      aws.String(u.key),
+		UploadId: aws.String(u.uploadID),
+		MultipartUpload: &s3types.CompletedMultipartUpload{
+			Parts: u.parts,
+		},
+	}
+	if !overwrite {
+		_, err := u.client.CompleteMultipartUpload(ctx, input, ifAbsent)
+		if !objectExists(err) {
+			return err == nil, err
+		}
+		same, err := holdsContent(ctx, u.client, u.bucket, u.key, sum, size, logger)
+		if err != nil {
+			return false, err
+		}
+		if same {
+			return false, u.abort(ctx, logger)
+		}
+	}
+	_, err := u.client.CompleteMultipartUpload(ctx, input)
+
+	return err == nil, err
+}
+
+// abort discards the multipart upload and the parts uploaded so far
+func (u *multipartUpload) abort(ctx context.Context, logger *log.Logger) error {
+	logger.Printf("Aborting multipart upload of s3://%s/%s\n", u.bucket, u.key)
+
+	_, err := u.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(u.bucket),
+		Key:      aws.String(u.key),
+		UploadId: aws.String(u.uploadID),
+	})
+
+	return err
+}
+
+// replaceMetadata rewrites the metadata of the completed object by copying it onto itself
+func (u *multipartUpload) replaceMetadata(ctx context.Context, contentType, contentEncoding string, metadata map[string]string, encryption objectEncryption, logger *log.Logger) error {
+	logger.Printf("Replacing metadata of s3://%s/%s\n", u.bucket, u.key)
+
+	// The copy source is URL-encoded, one path segment at a time
+	segments := strings.Split(u.key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	// Replacing the metadata also replaces the headers, so the Content-Encoding is set again.
+	// The copy is encrypted anew, with the bucket's default encryption unless it is requested.
+	input := &s3.CopyObjectInput{
+		Bucket:               aws.String(u.bucket),
+		Key:                  aws.String(u.key),
+		CopySource:           aws.String(u.bucket + "/" + strings.Join(segments, "/")),
+		ContentType:          aws.String(contentType),
+		Metadata:             metadata,
+		MetadataDirective:    s3types.MetadataDirectiveReplace,
+		ServerSideEncryption: encryption.SSE,
+		SSEKMSKeyId:          encryption.kmsKeyID(),
+	}
+	if contentEncoding != "" {
+		input.ContentEncoding = aws.String(contentEncoding)
+	}
+	_, err := u.client.CopyObject(ctx, input)
+
+	return err
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestHandleUploadsAuditLogsAsNDJSON(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+	t.Setenv("OUTPUT_FORMAT", "ndjson")
+	t.Setenv("LOG_TYPES", "audit,error")
+
+	s3Client := newFakeS3()
+	rdsClient := &fakeLogFile{portions: portionChain("1700000000000001,host,app,10.0.0.5,1,2,CONNECT,,,0\n", "oops\n")}
+	event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{
+		insertRecord("audit/server_audit.log", "audit"),
+		insertRecord("error/mysql-error-running.log", "error"),
+	}}
+	if _, err := NewHandler(HandlerDeps{RDS: rdsClient, S3: s3Client, DynamoDB: &fakeRecords{}})(context.Background(), event); err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+
+	want := map[string]string{
+		"logs/audit/db-1/2023/11/14/audit/server_audit.log.1700000000000.ndjson": `{"timestamp":"1700000000000001","serverhost":"host","username":"app","host":"10.0.0.5","connectionid":1,"queryid":2,"operation":"CONNECT","database":"","object":"","retcode":0}` + "\n" + `{"_raw":"oops"}` + "\n",
+		// Only audit logs are converted
+		"logs/error/db-1/2023/11/14/error/mysql-error-running.log.1700000000000": "1700000000000001,host,app,10.0.0.5,1,2,CONNECT,,,0\noops\n",
+	}
+	got := make(map[string]string)
+	for key, object := range s3Client.objects {
+		got[key] = string(object)
+	}
+	delete(got, manifestKey("logs", "db-1"))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("uploaded objects = %q, want %q", got, want)
+	}
+	if contentType := s3Client.contentTypes["logs/audit/db-1/2023/11/14/audit/server_audit.log.1700000000000.ndjson"]; contentType != "application/json" {
+		t.Errorf("ContentType = %q, want application/json", contentType)
+	}
+}
+
+func TestHandleUploadsAuditLogsAsJSONL(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+	t.Setenv("OUTPUT_FORMAT", "jsonl")
+	t.Setenv("COMPRESSION", "gzip")
+
+	// The query continues on the lines of the next portions
+	s3Client := newFakeS3()
+	rdsClient := &fakeLogFile{portions: portionChain("1700000000000001,host,app,10.0.0.5,1,2,QUERY,shop,'SELECT a,\n", "  b FROM t',0\n", "oops\n")}
+	event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{insertRecord("audit/server_audit.log", "")}}
+	if _, err := NewHandler(HandlerDeps{RDS: rdsClient, S3: s3Client, DynamoDB: &fakeRecords{}})(context.Background(), event); err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+
+	const key = "logs/db-1/2023/11/14/audit/server_audit.log.1700000000000.jsonl.gz"
+	object, ok := s3Client.objects[key]
+	if !ok {
+		t.Fatalf("uploaded %v, want %s", slices.Collect(maps.Keys(s3Client.objects)), key)
+	}
+	want := `{"timestamp":"1700000000000001","serverhost":"host","username":"app","host":"10.0.0.5","connectionid":1,"queryid":2,"operation":"QUERY","database":"shop","object":"SELECT a,\n  b FROM t","retcode":0}` + "\n" + `{"raw":"oops"}` + "\n"
+	if got := gunzip(t, object); got != want {
+		t.Errorf("uploaded %q, want %q", got, want)
+	}
+	if contentType := s3Client.contentTypes[key]; contentType != "application/json" {
+		t.Errorf("ContentType = %q, want application/json", contentType)
+	}
+}
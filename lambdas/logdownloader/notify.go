@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/smithy-go"
+)
+
+// Error types of the notifications that aren't a kind of failure named by errorKind
+const (
+	notificationChecksumMismatch = "ChecksumMismatch" // S3 or verifyUpload found other data than was uploaded
+	notificationPartial          = "Partial"          // Only the first MAX_FILE_BYTES of the log file were backed up
+)
+
+// SNSPublisher is the subset of the SNS client used to publish notifications to SNS_TOPIC_ARN
+type SNSPublisher interface {
+	Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error)
+}
+
+// notification is the JSON message published to SNS_TOPIC_ARN about a log file whose backup needs attention:
+//
+//	{"dbInstanceIdentifier": "db-1", "logFileName": "audit/server_audit.log", "errorType": "DownloadFailed", "details": "..."}
+type notification struct {
+	DBInstanceIdentifier string `json:"dbInstanceIdentifier"`
+	LogFileName          string `json:"logFileName"`
+	// ErrorType is the errorKind of a failure, notificationChecksumMismatch or notificationPartial
+	ErrorType string `json:"errorType"`
+	Details   string `json:"details"`
+	// S3Key is the object the backup was written to, when it got that far
+	S3Key  string `json:"s3Key,omitempty"`
+	Region string `json:"region,omitempty"`
+}
+
+// failureNotification returns the notification of a backup that failed with err, a typed error of the handler
+func failureNotification(record LogFileRecord, err error, s3Key string) notification {
+	errorType := errorKind(err)
+	if isChecksumMismatch(err) {
+		errorType = notificationChecksumMismatch
+	}
+	return notification{
+		DBInstanceIdentifier: record.DBInstanceIdentifier,
+		LogFileName:          record.LogFileName,
+		ErrorType:            errorType,
+		Details:              err.Error(),
+		S3Key:                s3Key,
+		Region:               record.Region,
+	}
+}
+
+// partialNotification returns the notification of a log file backed up only up to MAX_FILE_BYTES
+func partialNotification(record LogFileRecord, result downloadResult) notification {
+	return notification{
+		DBInstanceIdentifier: record.DBInstanceIdentifier,
+		LogFileName:          record.LogFileName,
+		ErrorType:            notificationPartial,
+		Details:              fmt.Sprintf("backed up %d bytes of the log file, the rest is backed up by its next download", result.RawBytes),
+		S3Key:                result.S3Key,
+		Region:               record.Region,
+	}
+}
+
+// isChecksumMismatch reports whether an upload failed because S3 rejected data that didn't match its checksum,
+// or because the uploaded object didn't match when it was read back
+func isChecksumMismatch(err error) bool {
+	if errors.Is(err, errUploadMismatch) {
+		return true
+	}
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "BadDigest", "InvalidDigest", "XAmzContentChecksumMismatch", "XAmzContentSHA256Mismatch":
+		return true
+	}
+	return false
+}
+
+// notify publishes the notification to SNS_TOPIC_ARN, with its error type as the errorType message attribute so
+// subscriptions can filter on it. Nothing is published when topicARN is empty. A notification that can't be
+// published is only logged, as it doesn't change the outcome of the backup.
+func (deps HandlerDeps) notify(ctx context.Context, topicARN string, n notification, logger *log.Logger) {
+	if topicARN == "" {
+		return
+	}
+
+	message, err := json.Marshal(n)
+	if err != nil {
+		logger.Printf("Error encoding notification: %v\n", err)
+		return
+	}
+	_, err = deps.SNS.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(topicARN),
+		Subject:  aws.String("Aurora log backup: " + n.ErrorType),
+		Message:  aws.String(string(message)),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{
+			"errorType": {DataType: aws.String("String"), StringValue: aws.String(n.ErrorType)},
+		},
+	})
+	if err != nil {
+		logger.Printf("Error publishing %s notification of log file %s to %s: %v\n", n.ErrorType, n.LogFileName, topicARN, err)
+		return
+	}
+	logger.Printf("Published %s notification of log file %s\n", n.ErrorType, n.LogFileName)
+}
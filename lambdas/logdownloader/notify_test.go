@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/smithy-go"
+)
+
+// fakeSNS records the notifications published, or fails every publish with err
+type fakeSNS struct {
+	published []notification
+	err       error
+}
+
+func (f *fakeSNS) Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	var n notification
+	if err := json.Unmarshal([]byte(aws.ToString(params.Message)), &n); err != nil {
+		return nil, err
+	}
+	if got := aws.ToString(params.MessageAttributes["errorType"].StringValue); got != n.ErrorType {
+		return nil, fmt.Errorf("errorType attribute %q doesn't match the message's %q", got, n.ErrorType)
+	}
+	f.published = append(f.published, n)
+	return &sns.PublishOutput{}, nil
+}
+
+func TestFailureNotification(t *testing.T) {
+	record := LogFileRecord{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log", Region: "eu-west-1"}
+	badDigest := &smithy.GenericAPIError{Code: "BadDigest", Message: "The Content-MD5 you specified did not match what we received."}
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "download", err: recordError(ErrDownloadFailed, record, errors.New("throttled")), want: "DownloadFailed"},
+		{name: "record update", err: recordError(ErrRecordUpdate, record, errors.New("throttled")), want: "RecordUpdate"},
+		{name: "verification", err: recordError(ErrUploadFailed, record, fmt.Errorf("verifying upload: %w", errUploadMismatch)), want: notificationChecksumMismatch},
+		{name: "checksum rejected by S3", err: recordError(ErrDownloadFailed, record, uploadError(badDigest)), want: notificationChecksumMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := failureNotification(record, tt.err, "key")
+			if n.ErrorType != tt.want {
+				t.Errorf("ErrorType = %s, want %s", n.ErrorType, tt.want)
+			}
+			if n.DBInstanceIdentifier != "db-1" || n.LogFileName != "audit/server_audit.log" || n.Region != "eu-west-1" || n.S3Key != "key" || n.Details != tt.err.Error() {
+				t.Errorf("notification = %+v, want the record, key and error", n)
+			}
+		})
+	}
+}
+
+func TestHandleNotifies(t *testing.T) {
+	const key = "logs/db-1/2023/11/14/audit/server_audit.log.1700000000000"
+
+	tests := []struct {
+		name         string
+		topicARN     string
+		maxFileBytes string
+		rdsErr       error
+		snsErr       error
+		wantTypes    []string
+		wantS3Key    string
+		wantFailures int
+	}{
+		{name: "backed up", topicARN: "arn:aws:sns:us-east-1:123456789012:backups"},
+		{name: "download failed", topicARN: "arn:aws:sns:us-east-1:123456789012:backups", rdsErr: errors.New("throttled"), wantTypes: []string{"DownloadFailed"}, wantFailures: 1},
+		{name: "partial backup", topicARN: "arn:aws:sns:us-east-1:123456789012:backups", maxFileBytes: "7", wantTypes: []string{notificationPartial}, wantS3Key: key},
+		{name: "publish failed", topicARN: "arn:aws:sns:us-east-1:123456789012:backups", rdsErr: errors.New("throttled"), snsErr: errors.New("access denied"), wantFailures: 1},
+		{name: "no topic", rdsErr: errors.New("throttled"), wantFailures: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DYNAMODB_TABLE_NAME", "table")
+			t.Setenv("S3_BUCKET_NAME", "bucket")
+			t.Setenv("SNS_TOPIC_ARN", tt.topicARN)
+			t.Setenv("MAX_FILE_BYTES", tt.maxFileBytes)
+
+			record := insertRecord("audit/server_audit.log", "")
+			record.Change.NewImage["Size"] = events.NewNumberAttribute("14")
+			var rdsClient RDSLogAPI = &fakeLogFile{portions: portionChain("line 1\n", "line 2\n")}
+			if tt.rdsErr != nil {
+				rdsClient = &goneLogFile{fakeLogFile: &fakeLogFile{}, err: tt.rdsErr}
+			}
+			snsClient := &fakeSNS{err: tt.snsErr}
+			deps := HandlerDeps{RDS: rdsClient, S3: newFakeS3(), DynamoDB: &fakeRecords{}, SNS: snsClient}
+
+			response, err := NewHandler(deps)(context.Background(), events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{record}})
+			if err != nil {
+				t.Fatalf("handler error = %v", err)
+			}
+
+			// A notification that can't be published doesn't change the outcome of the record
+			if len(response.BatchItemFailures) != tt.wantFailures {
+				t.Errorf("batch item failures = %v, want %d", response.BatchItemFailures, tt.wantFailures)
+			}
+			if len(snsClient.published) != len(tt.wantTypes) {
+				t.Fatalf("published %+v, want types %v", snsClient.published, tt.wantTypes)
+			}
+			for i, n := range snsClient.published {
+				if n.ErrorType != tt.wantTypes[i] || n.S3Key != tt.wantS3Key || n.DBInstanceIdentifier != "db-1" || n.LogFileName != "audit/server_audit.log" {
+					t.Errorf("published %+v, want type %s with key %q", n, tt.wantTypes[i], tt.wantS3Key)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/emf"
+)
+
+// emitPartialBackup publishes a log file backed up only up to MAX_FILE_BYTES in CloudWatch embedded metric
+// format, so operators know a log file exceeded the budget
+func (deps HandlerDeps) emitPartialBackup(logger *log.Logger) {
+	w := deps.Metrics
+	if w == nil {
+		w = os.Stdout
+	}
+	dimensions := map[string]string{"FunctionName": os.Getenv("AWS_LAMBDA_FUNCTION_NAME")}
+	metrics := []emf.Metric{{Name: "PartialBackups", Value: 1, Unit: emf.Count}}
+	if err := emf.New(w, emf.Namespace).Emit(dimensions, metrics); err != nil {
+		logger.Printf("Error emitting metrics: %v\n", err)
+	}
+}
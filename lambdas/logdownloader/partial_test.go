@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/s3key"
+)
+
+func TestDownloadLogFileStopsAtMaxBytes(t *testing.T) {
+	record := LogFileRecord{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log", LastWritten: 1700000000000}
+	portions := portionChain("line 1\n", "line 2\n", "line 3\n", "line 4\n")
+
+	tests := []struct {
+		name        string
+		maxBytes    int64
+		wantContent string
+		wantPartial bool
+	}{
+		{name: "no limit", wantContent: "line 1\nline 2\nline 3\nline 4\n"},
+		{name: "over the limit", maxBytes: 14, wantContent: "line 1\nline 2\n", wantPartial: true},
+		{name: "limit reached by the last portion", maxBytes: 28, wantContent: "line 1\nline 2\nline 3\nline 4\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &conditionalS3{fakeS3: newFakeS3(), metadata: map[string]map[string]string{}}
+			opts := downloadOptions{PortionLines: defaultPortionLines, MaxBytes: tt.maxBytes}
+			result, err := downloadLogFile(context.Background(), &fakeLogFile{portions: portions}, client, &fakeRecords{}, "table", "bucket", "key", "text/plain", objectMetadata(record), opts, record, discardLogger)
+			if err != nil {
+				t.Fatalf("downloadLogFile() error = %v", err)
+			}
+
+			if got := string(client.objects["key"]); got != tt.wantContent {
+				t.Errorf("uploaded %q, want %q", got, tt.wantContent)
+			}
+			if result.Partial != tt.wantPartial || (client.metadata["key"]["partial"] == "true") != tt.wantPartial {
+				t.Errorf("Partial = %v with metadata %v, want partial %v", result.Partial, client.metadata["key"], tt.wantPartial)
+			}
+			if tt.wantPartial && result.Marker != "m2" {
+				t.Errorf("Marker = %q, want the marker to continue from", result.Marker)
+			}
+		})
+	}
+}
+
+func TestHandleContinuesPartialBackup(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+	t.Setenv("MAX_FILE_BYTES", "14")
+	const key = "logs/db-1/2023/11/14/audit/server_audit.log.1700000000000"
+
+	record := insertRecord("audit/server_audit.log", "")
+	record.Change.NewImage["Size"] = events.NewNumberAttribute("28")
+	event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{record}}
+	s3Client := newFakeS3()
+
+	// The first download stops at MAX_FILE_BYTES and records where it stopped
+	var metrics bytes.Buffer
+	dynamoClient := &fakeRecords{}
+	deps := HandlerDeps{RDS: &fakeLogFile{portions: portionChain("line 1\n", "line 2\n", "line 3\n", "line 4\n")}, S3: s3Client, DynamoDB: dynamoClient, Metrics: &metrics}
+	if _, err := NewHandler(deps)(context.Background(), event); err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+	if got := string(s3Client.objects[key]); got != "line 1\nline 2\n" {
+		t.Fatalf("uploaded %q, want the first 14 bytes", got)
+	}
+	if !strings.Contains(metrics.String(), "PartialBackups") {
+		t.Errorf("metrics = %q, want PartialBackups", metrics.String())
+	}
+	backup := dynamoClient.updates[len(dynamoClient.updates)-1].ExpressionAttributeValues
+	if status := backup[":status"].(*types.AttributeValueMemberS).Value; status != StatusPartial {
+		t.Fatalf("status = %s, want %s", status, StatusPartial)
+	}
+	if _, ok := backup[":partial"]; !ok {
+		t.Fatal("LastBackupPartial isn't set")
+	}
+
+	// The next download continues from there, as the next part of the backup
+	dynamoClient = &fakeRecords{item: map[string]types.AttributeValue{
+		"DBInstanceIdentifier":  &types.AttributeValueMemberS{Value: "db-1"},
+		"LogFileName":           &types.AttributeValueMemberS{Value: "audit/server_audit.log"},
+		"Status":                &types.AttributeValueMemberS{Value: StatusPartial},
+		"LastS3Key":             backup[":s3Key"],
+		"LastChecksum":          backup[":checksum"],
+		"LastChecksumAlgorithm": backup[":algorithm"],
+		"LastMarker":            backup[":marker"],
+		"LastMarkerBytes":       backup[":markerBytes"],
+		"LastHashState":         backup[":hashState"],
+		"LastBackupPartial":     backup[":partial"],
+	}}
+	deps.DynamoDB = dynamoClient
+	deps.RDS = &fakeLogFile{portions: portionChain("line 1\n", "line 2\n", "line 3\n", "line 4\n")}
+	if _, err := NewHandler(deps)(context.Background(), event); err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+	if got := string(s3Client.objects[s3key.PartKey(key, 1)]); got != "line 3\nline 4\n" {
+		t.Errorf("uploaded part %q, want the rest of the log file", got)
+	}
+	backup = dynamoClient.updates[len(dynamoClient.updates)-1].ExpressionAttributeValues
+	if status := backup[":status"].(*types.AttributeValueMemberS).Value; status != StatusDownloaded {
+		t.Errorf("status = %s, want %s", status, StatusDownloaded)
+	}
+	if _, ok := backup[":partial"]; ok {
+		t.Error("LastBackupPartial is still set")
+	}
+}
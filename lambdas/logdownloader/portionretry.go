@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/emf"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/retry"
+)
+
+// defaultPortionMaxAttempts is the default for PORTION_MAX_ATTEMPTS
+const defaultPortionMaxAttempts = 5
+
+// maxRepeatedMarkers is the number of portions in a row that may return the marker they were requested with,
+// and more data pending, before the download is aborted with errMarkerLoop. RDS has been seen to do so
+// during engine failovers.
+const maxRepeatedMarkers = 3
+
+// repeatedMarkerDelay is the wait before a marker that didn't advance is requested again, multiplied by
+// the number of times it was returned
+const repeatedMarkerDelay = 200 * time.Millisecond
+
+// errMarkerLoop is returned by downloadLogFile when RDS keeps returning the marker it was requested with
+var errMarkerLoop = errors.New("marker did not advance")
+
+// portionRetryPolicy is the backoff between attempts of a DownloadDBLogFilePortion call. The attempts share
+// the call's portionTimeout.
+var portionRetryPolicy = retry.Policy{
+	InitialInterval: 200 * time.Millisecond,
+	MaxInterval:     5 * time.Second,
+	MaxElapsedTime:  portionTimeout,
+}
+
+// portionRetries counts the DownloadDBLogFilePortion calls of an invocation that were retried,
+// and the downloads aborted by errMarkerLoop
+type portionRetries struct {
+	Retries     int
+	MarkerLoops int
+}
+
+// retryingRDS retries the DownloadDBLogFilePortion calls of the wrapped client that were throttled
+// or failed with a server error, and counts the retries
+type retryingRDS struct {
+	client  RDSLogAPI
+	policy  retry.Policy
+	retries *portionRetries
+}
+
+// withPortionRetries wraps the client so its throttled portion calls are retried with backoff, up to
+// maxAttempts attempts per call. With a single attempt the client is returned as is.
+func withPortionRetries(client RDSLogAPI, maxAttempts int, retries *portionRetries) RDSLogAPI {
+	if maxAttempts <= 1 {
+		return client
+	}
+	policy := portionRetryPolicy
+	policy.MaxAttempts = maxAttempts
+	return &retryingRDS{client: client, policy: policy, retries: retries}
+}
+
+func (c *retryingRDS) DescribeDBLogFiles(ctx context.Context, params *rds.DescribeDBLogFilesInput, optFns ...func(*rds.Options)) (*rds.DescribeDBLogFilesOutput, error) {
+	return c.client.DescribeDBLogFiles(ctx, params, optFns...)
+}
+
+func (c *retryingRDS) DownloadDBLogFilePortion(ctx context.Context, params *rds.DownloadDBLogFilePortionInput, optFns ...func(*rds.Options)) (out *rds.DownloadDBLogFilePortionOutput, err error) {
+	retries, err := retry.Do(ctx, c.policy, func() error {
+		out, err = c.client.DownloadDBLogFilePortion(ctx, params, optFns...)
+		return err
+	})
+	c.retries.Retries += retries
+	return out, err
+}
+
+// emitPortionRetryMetrics publishes the invocation's portion retries and marker loop aborts in CloudWatch
+// embedded metric format
+func (deps HandlerDeps) emitPortionRetryMetrics(retries portionRetries, logger *log.Logger) {
+	logger.Printf("Retried %d log file portions, %d downloads stopped by a marker that didn't advance\n", retries.Retries, retries.MarkerLoops)
+
+	w := deps.Metrics
+	if w == nil {
+		w = os.Stdout
+	}
+	dimensions := map[string]string{"FunctionName": os.Getenv("AWS_LAMBDA_FUNCTION_NAME")}
+	metrics := []emf.Metric{
+		{Name: "PortionRetries", Value: float64(retries.Retries), Unit: emf.Count},
+		{Name: "MarkerLoopAborts", Value: float64(retries.MarkerLoops), Unit: emf.Count},
+	}
+	if err := emf.New(w, emf.Namespace).Emit(dimensions, metrics); err != nil {
+		logger.Printf("Error emitting metrics: %v\n", err)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/aws/smithy-go"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/retry"
+)
+
+// throttledLogFile fails portion calls with errs before serving them from the wrapped fakeLogFile
+type throttledLogFile struct {
+	*fakeLogFile
+	errs  []error
+	calls int
+}
+
+func (f *throttledLogFile) DownloadDBLogFilePortion(ctx context.Context, params *rds.DownloadDBLogFilePortionInput, optFns ...func(*rds.Options)) (*rds.DownloadDBLogFilePortionOutput, error) {
+	f.calls++
+	if f.calls <= len(f.errs) {
+		return nil, f.errs[f.calls-1]
+	}
+	return f.fakeLogFile.DownloadDBLogFilePortion(ctx, params, optFns...)
+}
+
+// repeatingLogFile returns the marker it was requested with, and more data pending, for the first repeats
+// requests of marker
+type repeatingLogFile struct {
+	*fakeLogFile
+	marker  string
+	repeats int
+}
+
+func (f *repeatingLogFile) DownloadDBLogFilePortion(ctx context.Context, params *rds.DownloadDBLogFilePortionInput, optFns ...func(*rds.Options)) (*rds.DownloadDBLogFilePortionOutput, error) {
+	if aws.ToString(params.Marker) == f.marker && f.repeats > 0 {
+		f.repeats--
+		f.markers = append(f.markers, f.marker)
+		return &rds.DownloadDBLogFilePortionOutput{Marker: params.Marker, AdditionalDataPending: aws.Bool(true), LogFileData: aws.String("duplicate\n")}, nil
+	}
+	return f.fakeLogFile.DownloadDBLogFilePortion(ctx, params, optFns...)
+}
+
+func TestRetryingRDS(t *testing.T) {
+	throttled := &smithy.GenericAPIError{Code: "Throttling"}
+	denied := &smithy.GenericAPIError{Code: "AccessDenied"}
+	policy := retry.Policy{InitialInterval: time.Millisecond, MaxInterval: time.Millisecond, MaxElapsedTime: time.Second, MaxAttempts: 3}
+
+	tests := []struct {
+		name        string
+		errs        []error
+		wantErr     error
+		wantRetries int
+	}{
+		{name: "succeeds"},
+		{name: "throttled", errs: []error{throttled, throttled}, wantRetries: 2},
+		{name: "out of attempts", errs: []error{throttled, throttled, throttled}, wantErr: throttled, wantRetries: 2},
+		{name: "not retryable", errs: []error{denied}, wantErr: denied},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var retries portionRetries
+			client := &retryingRDS{client: &throttledLogFile{fakeLogFile: &fakeLogFile{portions: portionChain("line 1\n")}, errs: tt.errs}, policy: policy, retries: &retries}
+
+			resp, err := client.DownloadDBLogFilePortion(context.Background(), &rds.DownloadDBLogFilePortionInput{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("DownloadDBLogFilePortion() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && aws.ToString(resp.LogFileData) != "line 1\n" {
+				t.Errorf("LogFileData = %q, want the portion", aws.ToString(resp.LogFileData))
+			}
+			if retries.Retries != tt.wantRetries {
+				t.Errorf("retries = %d, want %d", retries.Retries, tt.wantRetries)
+			}
+		})
+	}
+
+	// A single attempt leaves the client as is
+	client := &fakeLogFile{}
+	if got := withPortionRetries(client, 1, &portionRetries{}); got != RDSLogAPI(client) {
+		t.Errorf("withPortionRetries() = %T, want the client itself", got)
+	}
+}
+
+func TestDownloadLogFileRequestsRepeatedMarkerAgain(t *testing.T) {
+	rdsClient := &repeatingLogFile{fakeLogFile: &fakeLogFile{portions: portionChain("line 1\n", "line 2\n")}, marker: "m1", repeats: maxRepeatedMarkers - 1}
+	record := LogFileRecord{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log"}
+	s3Client := newFakeS3()
+	opts := downloadOptions{PortionLines: defaultPortionLines}
+
+	if _, err := downloadLogFile(context.Background(), rdsClient, s3Client, &fakeRecords{}, "table", "bucket", "key", "text/plain", nil, opts, record, discardLogger); err != nil {
+		t.Fatalf("downloadLogFile() error = %v", err)
+	}
+	if want := []string{"", "m1", "m1", "m1"}; !reflect.DeepEqual(rdsClient.markers, want) {
+		t.Errorf("requested markers %q, want %q", rdsClient.markers, want)
+	}
+	if got := string(s3Client.objects["key"]); got != "line 1\nline 2\n" {
+		t.Errorf("uploaded %q, want the data of the repeated marker left out", got)
+	}
+}
+
+func TestHandleRetriesThrottledPortions(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "log-downloader")
+	t.Setenv("PORTION_MAX_ATTEMPTS", "3")
+
+	var output bytes.Buffer
+	s3Client := newFakeS3()
+	rdsClient := &throttledLogFile{fakeLogFile: &fakeLogFile{portions: portionChain("line 1\n", "line 2\n")}, errs: []error{&smithy.GenericAPIError{Code: "Throttling"}}}
+	deps := HandlerDeps{RDS: rdsClient, S3: s3Client, DynamoDB: &fakeRecords{}, Metrics: &output}
+	event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{insertRecord("audit/server_audit.log", "")}}
+	if _, err := NewHandler(deps)(context.Background(), event); err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+
+	if got := string(s3Client.objects["logs/db-1/2023/11/14/audit/server_audit.log.1700000000000"]); got != "line 1\nline 2\n" {
+		t.Errorf("uploaded %q, want both portions", got)
+	}
+	record := metricRecord(t, output.String(), "PortionRetries")
+	if record["FunctionName"] != "log-downloader" || record["PortionRetries"] != 1.0 || record["MarkerLoopAborts"] != 0.0 {
+		t.Errorf("metrics = %v, want 1 PortionRetries of log-downloader", record)
+	}
+
+	// Without retries the throttled portion fails the download
+	t.Setenv("PORTION_MAX_ATTEMPTS", "1")
+	output.Reset()
+	rdsClient.calls = 0
+	dynamoClient := &fakeRecords{}
+	deps.DynamoDB = dynamoClient
+	resp, err := NewHandler(deps)(context.Background(), event)
+	if err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+	if len(resp.BatchItemFailures) != 1 || strings.Contains(output.String(), "PortionRetries") {
+		t.Errorf("failures = %v, metrics %q, want the record failed and no retry metrics", resp.BatchItemFailures, output.String())
+	}
+}
+
+func TestHandleCountsMarkerLoops(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+
+	var output bytes.Buffer
+	rdsClient := &fakeLogFile{portions: map[string]fakePortion{
+		"":   {data: "line 1\n", marker: "m1", pending: true},
+		"m1": {marker: "m1", pending: true},
+	}}
+	deps := HandlerDeps{RDS: rdsClient, S3: newFakeS3(), DynamoDB: &fakeRecords{}, Metrics: &output}
+	event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{insertRecord("audit/server_audit.log", "")}}
+	resp, err := NewHandler(deps)(context.Background(), event)
+	if err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+	if len(resp.BatchItemFailures) != 1 {
+		t.Errorf("failures = %v, want the record failed", resp.BatchItemFailures)
+	}
+
+	record := metricRecord(t, output.String(), "MarkerLoopAborts")
+	if record["MarkerLoopAborts"] != 1.0 {
+		t.Errorf("metrics = %v, want 1 MarkerLoopAborts", record)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/emf"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/ratelimit"
+)
+
+// rateLimitWaits counts the RDS calls of an invocation delayed by RDS_API_RPS
+type rateLimitWaits struct {
+	Waits int
+	Delay time.Duration
+}
+
+// rateLimitedRDS waits for the RDS rate limiter before every call and counts the calls it delayed
+type rateLimitedRDS struct {
+	client  RDSLogAPI
+	limiter *ratelimit.Limiter
+	waits   *rateLimitWaits
+}
+
+// withRateLimit wraps the client so its calls are spaced out by the limiter.
+// Without a limiter the client is returned as is.
+func withRateLimit(client RDSLogAPI, limiter *ratelimit.Limiter, waits *rateLimitWaits) RDSLogAPI {
+	if limiter == nil {
+		return client
+	}
+	return &rateLimitedRDS{client: client, limiter: limiter, waits: waits}
+}
+
+// wait waits for the limiter and counts the delay
+func (c *rateLimitedRDS) wait(ctx context.Context) error {
+	delay, err := c.limiter.Wait(ctx)
+	if delay > 0 {
+		c.waits.Waits++
+		c.waits.Delay += delay
+	}
+	return err
+}
+
+func (c *rateLimitedRDS) DescribeDBLogFiles(ctx context.Context, params *rds.DescribeDBLogFilesInput, optFns ...func(*rds.Options)) (*rds.DescribeDBLogFilesOutput, error) {
+	if err := c.wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.client.DescribeDBLogFiles(ctx, params, optFns...)
+}
+
+func (c *rateLimitedRDS) DownloadDBLogFilePortion(ctx context.Context, params *rds.DownloadDBLogFilePortionInput, optFns ...func(*rds.Options)) (*rds.DownloadDBLogFilePortionOutput, error) {
+	if err := c.wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.client.DownloadDBLogFilePortion(ctx, params, optFns...)
+}
+
+// emitRateLimitMetrics publishes the invocation's rate limit waits in CloudWatch embedded metric format
+func (deps HandlerDeps) emitRateLimitMetrics(waits rateLimitWaits, logger *log.Logger) {
+	logger.Printf("%d RDS calls waited %s for the rate limit\n", waits.Waits, waits.Delay)
+
+	w := deps.Metrics
+	if w == nil {
+		w = os.Stdout
+	}
+	dimensions := map[string]string{"FunctionName": os.Getenv("AWS_LAMBDA_FUNCTION_NAME")}
+	metrics := []emf.Metric{
+		{Name: "RDSRateLimitWaits", Value: float64(waits.Waits), Unit: emf.Count},
+		{Name: "RDSRateLimitDelaySeconds", Value: waits.Delay.Seconds(), Unit: emf.Seconds},
+	}
+	if err := emf.New(w, emf.Namespace).Emit(dimensions, metrics); err != nil {
+		logger.Printf("Error emitting metrics: %v\n", err)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/ratelimit"
+)
+
+func TestHandleCountsRateLimitWaits(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "log-downloader")
+
+	// Use up the burst, so every portion waits 10ms for its token
+	limiter := ratelimit.New(100)
+	for range 100 {
+		if _, err := limiter.Wait(context.Background()); err != nil {
+			t.Fatalf("Wait() error = %v", err)
+		}
+	}
+
+	var output bytes.Buffer
+	s3Client := newFakeS3()
+	deps := HandlerDeps{
+		RDS:        &fakeLogFile{portions: portionChain("line 1\n", "line 2\n")},
+		S3:         s3Client,
+		DynamoDB:   &fakeRecords{},
+		RDSLimiter: limiter,
+		Metrics:    &output,
+	}
+	event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{insertRecord("audit/server_audit.log", "")}}
+	if _, err := NewHandler(deps)(context.Background(), event); err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+
+	if got := string(s3Client.objects["logs/db-1/2023/11/14/audit/server_audit.log.1700000000000"]); got != "line 1\nline 2\n" {
+		t.Errorf("uploaded %q, want both portions", got)
+	}
+
+	record := metricRecord(t, output.String(), "RDSRateLimitWaits")
+	if record["FunctionName"] != "log-downloader" || record["RDSRateLimitWaits"] != 2.0 {
+		t.Errorf("metrics = %v, want 2 RDSRateLimitWaits of log-downloader", record)
+	}
+}
+
+func TestHandleWithoutRateLimitEmitsNoMetrics(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+
+	var output bytes.Buffer
+	deps := HandlerDeps{RDS: &fakeLogFile{portions: portionChain("line 1\n")}, S3: newFakeS3(), DynamoDB: &fakeRecords{}, Metrics: &output}
+	event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{insertRecord("audit/server_audit.log", "")}}
+	if _, err := NewHandler(deps)(context.Background(), event); err != nil {
+		t.Fatalf("handler error = %v", err)
+	}
+	if strings.Contains(output.String(), "RDSRateLimit") {
+		t.Errorf("emitted %q, want no rate limit metrics without RDS_API_RPS", output.String())
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	rdstypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/emf"
+)
+
+// recordRemovals counts the log file records of an invocation removed from the table, and the final backups
+// REMOVE_FINAL_BACKUP made of them
+type recordRemovals struct {
+	TTL                int // Removed by the table's TTL
+	Manual             int // Deleted by anything else, e.g. an operator or a cleanup script
+	FinalBackups       int // Log files downloaded because their removed record wasn't backed up
+	FinalBackupsMissed int // Log files no longer in RDS when their removed record wasn't backed up
+}
+
+// observe counts and logs a REMOVE stream record. TTL removals are told from deletes by the stream record's
+// userIdentity, which DynamoDB only sets on its own TTL deletes.
+func (r *recordRemovals) observe(record events.DynamoDBEventRecord, logger *log.Logger) {
+	if isTTLExpiry(record) {
+		r.TTL++
+		logger.Printf("Record %s removed by TTL expiry\n", removedKey(record))
+		return
+	}
+	r.Manual++
+	logger.Printf("Record %s deleted\n", removedKey(record))
+}
+
+// removedKey returns the instance and log file of a REMOVE stream record's keys
+func removedKey(record events.DynamoDBEventRecord) string {
+	key := func(name string) string {
+		if value, ok := record.Change.Keys[name]; ok && value.DataType() == events.DataTypeString {
+			return value.String()
+		}
+		return ""
+	}
+	return fmt.Sprintf("%s/%s", key("DBInstanceIdentifier"), key("LogFileName"))
+}
+
+// needsFinalBackup reports whether the log file of a removed record, as of its old image, was never backed up
+// since it last changed
+func needsFinalBackup(record LogFileRecord, logTypes map[string]bool) bool {
+	if record.LogFileName == "" || strings.HasPrefix(record.LogFileName, "#") {
+		return false
+	}
+	return record.Status != StatusDownloaded && logTypes[recordLogType(record)]
+}
+
+// logFileGone reports whether a download failed because the log file or its instance no longer exists
+func logFileGone(err error) bool {
+	var logFileNotFound *rdstypes.DBLogFileNotFoundFault
+	var instanceNotFound *rdstypes.DBInstanceNotFoundFault
+	return errors.As(err, &logFileNotFound) || errors.As(err, &instanceNotFound)
+}
+
+// emitRemovalMetrics publishes the invocation's removed records and final backups in CloudWatch embedded
+// metric format
+func (deps HandlerDeps) emitRemovalMetrics(removals recordRemovals, logger *log.Logger) {
+	logger.Printf("%d records removed by TTL expiry, %d deleted, %d final backups, %d log files gone before their final backup\n", removals.TTL, removals.Manual, removals.FinalBackups, removals.FinalBackupsMissed)
+
+	w := deps.Metrics
+	if w == nil {
+		w = os.Stdout
+	}
+	dimensions := map[string]string{"FunctionName": os.Getenv("AWS_LAMBDA_FUNCTION_NAME")}
+	metrics := []emf.Metric{
+		{Name: "TTLRemovals", Value: float64(removals.TTL), Unit: emf.Count},
+		{Name: "ManualRemovals", Value: float64(removals.Manual), Unit: emf.Count},
+		{Name: "FinalBackups", Value: float64(removals.FinalBackups), Unit: emf.Count},
+		{Name: "FinalBackupsMissed", Value: float64(removals.FinalBackupsMissed), Unit: emf.Count},
+	}
+	if err := emf.New(w, emf.Namespace).Emit(dimensions, metrics); err != nil {
+		logger.Printf("Error emitting metrics: %v\n", err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	rdstypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
+)
+
+// goneLogFile fails every portion call with err, as RDS does for a log file or instance that no longer exists
+type goneLogFile struct {
+	*fakeLogFile
+	err error
+}
+
+func (f *goneLogFile) DownloadDBLogFilePortion(ctx context.Context, params *rds.DownloadDBLogFilePortionInput, optFns ...func(*rds.Options)) (*rds.DownloadDBLogFilePortionOutput, error) {
+	return nil, f.err
+}
+
+// removeRecord returns a REMOVE stream record of a log file record with the given status, expired by the
+// table's TTL or deleted by a user
+func removeRecord(logFileName, status string, ttl bool) events.DynamoDBEventRecord {
+	record := insertRecord(logFileName, "")
+	record.EventName = "REMOVE"
+	record.Change.SequenceNumber = "100"
+	record.Change.OldImage, record.Change.NewImage = record.Change.NewImage, nil
+	if status != "" {
+		record.Change.OldImage["Status"] = events.NewStringAttribute(status)
+	}
+	record.Change.Keys = map[string]events.DynamoDBAttributeValue{
+		"DBInstanceIdentifier": record.Change.OldImage["DBInstanceIdentifier"],
+		"LogFileName":          record.Change.OldImage["LogFileName"],
+	}
+	if ttl {
+		record.UserIdentity = &events.DynamoDBUserIdentity{Type: "Service", PrincipalID: "dynamodb.amazonaws.com"}
+	}
+	return record
+}
+
+func TestRemovedKey(t *testing.T) {
+	if got, want := removedKey(removeRecord("audit/server_audit.log", "", false)), "db-1/audit/server_audit.log"; got != want {
+		t.Errorf("removedKey() = %q, want %q", got, want)
+	}
+	if got, want := removedKey(events.DynamoDBEventRecord{}), "/"; got != want {
+		t.Errorf("removedKey() of a record without keys = %q, want %q", got, want)
+	}
+}
+
+func TestHandleRemovedRecords(t *testing.T) {
+	const key = "logs/db-1/2023/11/14/audit/server_audit.log.1700000000000"
+	notFound := &rdstypes.DBLogFileNotFoundFault{}
+
+	tests := []struct {
+		name         string
+		finalBackup  string
+		status       string
+		ttl          bool
+		rdsErr       error
+		wantUploaded bool
+		wantFailed   bool
+		wantMetrics  map[string]float64
+	}{
+		{name: "TTL expiry", status: StatusPending, ttl: true, wantMetrics: map[string]float64{"TTLRemovals": 1, "ManualRemovals": 0}},
+		{name: "delete", status: StatusPending, wantMetrics: map[string]float64{"TTLRemovals": 0, "ManualRemovals": 1}},
+		{name: "final backup", finalBackup: "true", status: StatusPending, wantUploaded: true, wantMetrics: map[string]float64{"ManualRemovals": 1, "FinalBackups": 1}},
+		{name: "final backup of a TTL expiry", finalBackup: "true", status: StatusFailed, ttl: true, wantUploaded: true, wantMetrics: map[string]float64{"TTLRemovals": 1, "FinalBackups": 1}},
+		{name: "already backed up", finalBackup: "true", status: StatusDownloaded, wantMetrics: map[string]float64{"ManualRemovals": 1, "FinalBackups": 0}},
+		{name: "log file gone", finalBackup: "true", status: StatusPending, rdsErr: notFound, wantMetrics: map[string]float64{"FinalBackups": 0, "FinalBackupsMissed": 1}},
+		{name: "final backup fails", finalBackup: "true", status: StatusPending, rdsErr: errors.New("throttled"), wantFailed: true, wantMetrics: map[string]float64{"ManualRemovals": 1, "FinalBackups": 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DYNAMODB_TABLE_NAME", "table")
+			t.Setenv("S3_BUCKET_NAME", "bucket")
+			t.Setenv("REMOVE_FINAL_BACKUP", tt.finalBackup)
+
+			var metrics bytes.Buffer
+			var rdsClient RDSLogAPI = &fakeLogFile{portions: portionChain("line 1\n")}
+			if tt.rdsErr != nil {
+				rdsClient = &goneLogFile{fakeLogFile: &fakeLogFile{}, err: tt.rdsErr}
+			}
+			s3Client := newFakeS3()
+			dynamoClient := &fakeRecords{}
+			deps := HandlerDeps{RDS: rdsClient, S3: s3Client, DynamoDB: dynamoClient, Metrics: &metrics}
+			event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{removeRecord("audit/server_audit.log", tt.status, tt.ttl)}}
+			response, err := NewHandler(deps)(context.Background(), event)
+			if err != nil {
+				t.Fatalf("handler error = %v", err)
+			}
+
+			if _, uploaded := s3Client.objects[key]; uploaded != tt.wantUploaded {
+				t.Errorf("uploaded %s = %v, want %v", key, uploaded, tt.wantUploaded)
+			}
+			if got := len(response.BatchItemFailures) == 1; got != tt.wantFailed {
+				t.Errorf("batch item failures = %v, want failed %v", response.BatchItemFailures, tt.wantFailed)
+			}
+			// Writing to the table would recreate the removed record
+			if len(dynamoClient.updates) != 0 {
+				t.Errorf("updated the removed record %d times, want never", len(dynamoClient.updates))
+			}
+
+			var record map[string]any
+			if err := json.Unmarshal(metrics.Bytes(), &record); err != nil {
+				t.Fatalf("metrics %q are not JSON: %v", metrics.String(), err)
+			}
+			for name, want := range tt.wantMetrics {
+				if record[name] != want {
+					t.Errorf("%s = %v, want %v", name, record[name], want)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadLogFileWithoutCheckpoints(t *testing.T) {
+	part := strings.Repeat("x", 2*1024*1024)
+	record := LogFileRecord{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log"}
+	rdsClient := &fakeLogFile{portions: portionChain(part, part, part, part)}
+	s3Client := newFakeS3()
+	dynamoClient := &fakeRecords{}
+	opts := downloadOptions{PortionLines: defaultPortionLines, NoCheckpoints: true}
+
+	if _, err := downloadLogFile(context.Background(), rdsClient, s3Client, dynamoClient, "table", "bucket", "key", "text/plain", nil, opts, record, discardLogger); err != nil {
+		t.Fatalf("downloadLogFile() error = %v", err)
+	}
+	if got := len(s3Client.objects["key"]); got != 4*len(part) {
+		t.Errorf("uploaded %d bytes, want %d", got, 4*len(part))
+	}
+	if len(dynamoClient.updates) != 0 {
+		t.Errorf("saved %d checkpoints, want none", len(dynamoClient.updates))
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+)
+
+// defaultMemoryWarningFraction is the fraction of the function's memory a log file may reach before it is reported
+const defaultMemoryWarningFraction = 0.5
+
+// invocationSizing tracks the log files an invocation downloaded, as a hint for sizing the function's
+// memory and timeout
+type invocationSizing struct {
+	start       time.Time
+	warnBytes   int64 // Log files larger than this are reported as an out-of-memory risk (0 reports none)
+	files       int
+	maxFileSize int64
+	maxFileName string
+}
+
+// parseMemoryWarningFraction parses MEMORY_WARNING_FRACTION, a fraction of the function's memory between 0 and 1.
+// 0 reports no log file.
+func parseMemoryWarningFraction(value string) (float64, error) {
+	if value == "" {
+		return defaultMemoryWarningFraction, nil
+	}
+	fraction, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(fraction) || fraction < 0 || fraction > 1 {
+		return 0, fmt.Errorf("memory warning fraction must be between 0 and 1")
+	}
+	return fraction, nil
+}
+
+// memoryWarningBytes returns the log file size above which a download is reported, the fraction of the function's
+// memory in AWS_LAMBDA_FUNCTION_MEMORY_SIZE megabytes. An unknown memory size reports no log file.
+func memoryWarningBytes(memorySizeMB string, fraction float64) int64 {
+	megabytes, err := strconv.ParseInt(memorySizeMB, 10, 64)
+	if err != nil || megabytes <= 0 {
+		return 0
+	}
+	return int64(float64(megabytes*1024*1024) * fraction)
+}
+
+// observe records a log file about to be downloaded and warns when it is large for the function's memory
+func (s *invocationSizing) observe(record LogFileRecord, logger *log.Logger) {
+	s.files++
+	if record.Size > s.maxFileSize {
+		s.maxFileSize = record.Size
+		s.maxFileName = record.LogFileName
+	}
+	if s.warnBytes > 0 && record.Size > s.warnBytes {
+		logger.Printf("Warning: log file %s of instance %s is %d bytes, more than %d bytes of the function's memory, consider raising it\n",
+			record.LogFileName, record.DBInstanceIdentifier, record.Size, s.warnBytes)
+	}
+}
+
+// log reports the largest log file downloaded and how long the invocation took
+func (s *invocationSizing) log(logger *log.Logger) {
+	duration := time.Since(s.start).Round(time.Millisecond)
+	if s.files == 0 {
+		logger.Printf("Downloaded no log files in %s\n", duration)
+		return
+	}
+	logger.Printf("Downloaded %d log files in %s, the largest %s at %d bytes\n", s.files, duration, s.maxFileName, s.maxFileSize)
+}
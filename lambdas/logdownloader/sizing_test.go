@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMemoryWarningFraction(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    float64
+		wantErr bool
+	}{
+		{value: "", want: defaultMemoryWarningFraction},
+		{value: "0", want: 0},
+		{value: "0.25", want: 0.25},
+		{value: "1", want: 1},
+		{value: "1.5", wantErr: true},
+		{value: "-0.5", wantErr: true},
+		{value: "NaN", wantErr: true},
+		{value: "half", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseMemoryWarningFraction(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseMemoryWarningFraction(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseMemoryWarningFraction(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryWarningBytes(t *testing.T) {
+	tests := []struct {
+		memorySizeMB string
+		fraction     float64
+		want         int64
+	}{
+		{memorySizeMB: "512", fraction: 0.5, want: 256 * 1024 * 1024},
+		{memorySizeMB: "128", fraction: 1, want: 128 * 1024 * 1024},
+		{memorySizeMB: "512", fraction: 0},
+		{memorySizeMB: "", fraction: 0.5},
+		{memorySizeMB: "large", fraction: 0.5},
+	}
+
+	for _, tt := range tests {
+		if got := memoryWarningBytes(tt.memorySizeMB, tt.fraction); got != tt.want {
+			t.Errorf("memoryWarningBytes(%q, %v) = %d, want %d", tt.memorySizeMB, tt.fraction, got, tt.want)
+		}
+	}
+}
+
+func TestInvocationSizing(t *testing.T) {
+	var out bytes.Buffer
+	logger := log.New(&out, "", 0)
+
+	sizing := invocationSizing{start: time.Now(), warnBytes: 1000}
+	sizing.observe(LogFileRecord{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log.1", Size: 400}, logger)
+	sizing.observe(LogFileRecord{DBInstanceIdentifier: "db-1", LogFileName: "audit/server_audit.log", Size: 1500}, logger)
+	sizing.observe(LogFileRecord{DBInstanceIdentifier: "db-1", LogFileName: "error/mysql-error.log", Size: 900}, logger)
+	sizing.log(logger)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %q, want a warning and a summary", lines)
+	}
+	if !strings.HasPrefix(lines[0], "Warning: log file audit/server_audit.log of instance db-1 is 1500 bytes") {
+		t.Errorf("warning = %q, want the log file over the threshold", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "Downloaded 3 log files in ") || !strings.HasSuffix(lines[1], "the largest audit/server_audit.log at 1500 bytes") {
+		t.Errorf("summary = %q, want 3 log files with the largest one", lines[1])
+	}
+
+	// Without a memory size nothing is reported as large
+	out.Reset()
+	sizing = invocationSizing{start: time.Now()}
+	sizing.observe(LogFileRecord{LogFileName: "audit/server_audit.log", Size: 1 << 40}, logger)
+	if strings.Contains(out.String(), "Warning") {
+		t.Errorf("logged %q without a memory size", out.String())
+	}
+}
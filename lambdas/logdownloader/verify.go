@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/emf"
+)
+
+// errUploadMismatch is returned by verifyUpload when the object in S3 isn't the one that was uploaded
+var errUploadMismatch = errors.New("uploaded object doesn't match")
+
+// verifyUpload reads the uploaded object back with HeadObject and checks that it has the uploaded size,
+// returning its version ID (empty when the bucket isn't versioned). S3 already checked the SHA-256 of the data
+// it received, so this catches an object missing or replaced since, by its size.
+func verifyUpload(ctx context.Context, client S3Putter, bucketName, key string, size int64, logger *log.Logger) (string, error) {
+	logger.Printf("Verifying upload s3://%s/%s\n", bucketName, key)
+
+	resp, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var notFound *s3types.NotFound
+		if errors.As(err, &notFound) {
+			return "", fmt.Errorf("%w: s3://%s/%s not found", errUploadMismatch, bucketName, key)
+		}
+		return "", fmt.Errorf("failed to read uploaded object: %w", err)
+	}
+	if got := aws.ToInt64(resp.ContentLength); got != size {
+		return "", fmt.Errorf("%w: s3://%s/%s is %d bytes, uploaded %d", errUploadMismatch, bucketName, key, got, size)
+	}
+	return aws.ToString(resp.VersionId), nil
+}
+
+// emitVerificationFailure publishes an upload that failed verification in CloudWatch embedded metric format,
+// so it can be alarmed on
+func (deps HandlerDeps) emitVerificationFailure(logger *log.Logger) {
+	w := deps.Metrics
+	if w == nil {
+		w = os.Stdout
+	}
+	dimensions := map[string]string{"FunctionName": os.Getenv("AWS_LAMBDA_FUNCTION_NAME")}
+	metrics := []emf.Metric{{Name: "UploadVerificationFailures", Value: 1, Unit: emf.Count}}
+	if err := emf.New(w, emf.Namespace).Emit(dimensions, metrics); err != nil {
+		logger.Printf("Error emitting metrics: %v\n", err)
+	}
+}
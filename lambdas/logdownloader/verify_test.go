@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// headS3 answers HeadObject with the objects of fakeS3, as versionID and shortBy bytes shorter,
+// or with err when set
+type headS3 struct {
+	*fakeS3
+	versionID string
+	shortBy   int64
+	err       error
+}
+
+func (f *headS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	resp, err := f.fakeS3.HeadObject(ctx, params, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	resp.ContentLength = aws.Int64(aws.ToInt64(resp.ContentLength) - f.shortBy)
+	if f.versionID != "" {
+		resp.VersionId = aws.String(f.versionID)
+	}
+	return resp, nil
+}
+
+func TestVerifyUpload(t *testing.T) {
+	tests := []struct {
+		name         string
+		client       *headS3
+		key          string
+		want         string
+		wantErr      bool
+		wantMismatch bool
+	}{
+		{name: "unversioned", client: &headS3{}, key: "key"},
+		{name: "versioned", client: &headS3{versionID: "v1"}, key: "key", want: "v1"},
+		{name: "size differs", client: &headS3{shortBy: 1}, key: "key", wantErr: true, wantMismatch: true},
+		{name: "not found", client: &headS3{}, key: "other", wantErr: true, wantMismatch: true},
+		{name: "unreadable", client: &headS3{err: errors.New("access denied")}, key: "key", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		tt.client.fakeS3 = newFakeS3()
+		tt.client.objects["key"] = []byte("line 1\n")
+
+		got, err := verifyUpload(context.Background(), tt.client, "bucket", tt.key, 7, discardLogger)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: verifyUpload() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if errors.Is(err, errUploadMismatch) != tt.wantMismatch {
+			t.Errorf("%s: verifyUpload() error = %v, want mismatch %v", tt.name, err, tt.wantMismatch)
+		}
+		if got != tt.want {
+			t.Errorf("%s: verifyUpload() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHandleVerifiesUploads(t *testing.T) {
+	t.Setenv("DYNAMODB_TABLE_NAME", "table")
+	t.Setenv("S3_BUCKET_NAME", "bucket")
+
+	tests := []struct {
+		name        string
+		shortBy     int64
+		wantFailed  bool
+		wantMetric  bool
+		wantVersion string
+	}{
+		{name: "verified", wantVersion: "v1"},
+		{name: "size differs", shortBy: 1, wantFailed: true, wantMetric: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var metrics bytes.Buffer
+			dynamoClient := &fakeRecords{}
+			s3Client := &headS3{fakeS3: newFakeS3(), versionID: "v1", shortBy: tt.shortBy}
+			deps := HandlerDeps{RDS: &fakeLogFile{portions: portionChain("line 1\n")}, S3: s3Client, DynamoDB: dynamoClient, Metrics: &metrics}
+			event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{insertRecord("audit/server_audit.log", "")}}
+			response, err := NewHandler(deps)(context.Background(), event)
+			if err != nil {
+				t.Fatalf("handler error = %v", err)
+			}
+
+			if got := len(response.BatchItemFailures) == 1; got != tt.wantFailed {
+				t.Errorf("batch item failures = %v, want failed %v", response.BatchItemFailures, tt.wantFailed)
+			}
+			if got := strings.Contains(metrics.String(), "UploadVerificationFailures"); got != tt.wantMetric {
+				t.Errorf("metrics = %q, want UploadVerificationFailures %v", metrics.String(), tt.wantMetric)
+			}
+
+			var backup, failed map[string]types.AttributeValue
+			for _, update := range dynamoClient.updates {
+				if _, ok := update.ExpressionAttributeValues[":lastBackup"]; ok {
+					backup = update.ExpressionAttributeValues
+				}
+				if status, ok := update.ExpressionAttributeValues[":status"].(*types.AttributeValueMemberS); ok && status.Value == StatusFailed {
+					failed = update.ExpressionAttributeValues
+				}
+			}
+			if (failed != nil) != tt.wantFailed {
+				t.Errorf("marked %s = %v, want %v", StatusFailed, failed != nil, tt.wantFailed)
+			}
+			if tt.wantFailed {
+				if backup != nil {
+					t.Error("recorded the backup of an upload that failed verification")
+				}
+				return
+			}
+
+			if backup == nil {
+				t.Fatal("backup wasn't recorded")
+			}
+			if got := backup[":bucket"].(*types.AttributeValueMemberS).Value; got != "bucket" {
+				t.Errorf("LastS3Bucket = %q, want bucket", got)
+			}
+			if got := backup[":versionId"].(*types.AttributeValueMemberS).Value; got != tt.wantVersion {
+				t.Errorf("LastS3VersionId = %q, want %q", got, tt.wantVersion)
+			}
+			if _, ok := backup[":durationMs"].(*types.AttributeValueMemberN); !ok {
+				t.Error("LastBackupDurationMs wasn't recorded")
+			}
+		})
+	}
+}
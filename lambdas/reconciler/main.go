@@ -0,0 +1,552 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	rdstypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/aurora"
+)
+
+// Event represents the input event for the Lambda function
+type Event struct {
+	// Empty for EventBridge scheduled events
+}
+
+// Response represents the output of the Lambda function
+type Response struct {
+	InstancesChecked int      `json:"instancesChecked"`
+	RecordsCreated   int      `json:"recordsCreated"`
+	FailedInstances  []string `json:"failedInstances,omitempty"`
+	Message          string   `json:"message"`
+}
+
+// LogFileRecord represents a record in the DynamoDB table
+type LogFileRecord struct {
+	DBInstanceIdentifier string      `dynamodbav:"DBInstanceIdentifier"`
+	LogFileName          string      `dynamodbav:"LogFileName"`
+	LogFileType          LogFileType `dynamodbav:"LogFileType,omitempty"`
+	Size                 int64       `dynamodbav:"Size"`
+	LastWritten          int64       `dynamodbav:"LastWritten"`
+	Status               string      `dynamodbav:"Status,omitempty"`
+	ClusterIdentifier    string      `dynamodbav:"ClusterIdentifier,omitempty"` // DB cluster of the instance, if any
+	ExpiresAt            int64       `dynamodbav:"ExpiresAt,omitempty"`         // TTL in epoch seconds
+}
+
+// StatusPending marks a record whose log file hasn't been backed up yet
+const StatusPending = "PENDING"
+
+// defaultRetentionDays is how long a record is kept after its log file was last written
+const defaultRetentionDays = 14
+
+// LogFileType classifies a log file by the name pattern it matched
+type LogFileType = aurora.LogFileType
+
+// Supported log file types
+const (
+	LogFileTypeAudit     = aurora.LogFileTypeAudit
+	LogFileTypeError     = aurora.LogFileTypeError
+	LogFileTypeSlowQuery = aurora.LogFileTypeSlowQuery
+	LogFileTypeGeneral   = aurora.LogFileTypeGeneral
+)
+
+// The log name patterns are compiled once per cold start and must match the Log Detector's,
+// so the reconciler only creates records the detector would have created
+var logNamePatterns, logNamePatternsErr = aurora.ParseLogNamePatterns(os.Getenv("LOG_NAME_PATTERNS"))
+
+// DBInstancesAPI is the subset of the RDS client used by the reconciler
+type DBInstancesAPI interface {
+	DescribeDBInstances(ctx context.Context, params *rds.DescribeDBInstancesInput, optFns ...func(*rds.Options)) (*rds.DescribeDBInstancesOutput, error)
+	DescribeDBLogFiles(ctx context.Context, params *rds.DescribeDBLogFilesInput, optFns ...func(*rds.Options)) (*rds.DescribeDBLogFilesOutput, error)
+	aurora.DescribeDBClustersAPI
+}
+
+// RecordStoreAPI is the subset of the DynamoDB client used to read and create log file records
+type RecordStoreAPI interface {
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+}
+
+// HandlerDeps holds the AWS clients used by the handler
+type HandlerDeps struct {
+	RDS      DBInstancesAPI
+	DynamoDB RecordStoreAPI
+	Now      func() time.Time // Defaults to time.Now
+}
+
+// reconcilerConfig holds the settings read from the environment
+type reconcilerConfig struct {
+	TableName     string
+	RetentionDays int
+	// LogTypes are the log file types reconciled, as recorded by the detector
+	LogTypes map[LogFileType]bool
+	// Thresholds are the detector's; log files below them aren't recorded yet
+	Thresholds aurora.Thresholds
+	// ExcludePattern matches the identifiers of the instances the DB Scanner never enqueues (nil excludes none)
+	ExcludePattern *regexp.Regexp
+	// ClusterID is the DB cluster of the instance being reconciled, stored on its records; set per cluster
+	ClusterID string
+	// ClusterLogFiles are the log file names already listed for an earlier member of the cluster being reconciled,
+	// which aren't recorded again for a later member; nil outside a cluster
+	ClusterLogFiles map[string]bool
+}
+
+// requiredEnvVars are the environment variables the reconciler can't run without
+var requiredEnvVars = []string{"DYNAMODB_TABLE_NAME"}
+
+// validateConfig returns an error naming every required environment variable that is not set
+func validateConfig() error {
+	var missing []string
+	for _, name := range requiredEnvVars {
+		if os.Getenv(name) == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("required environment variables not set: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// loadReconcilerConfig reads the reconciler settings from the environment. An invalid value is an error,
+// which fails the invocation.
+func loadReconcilerConfig() (reconcilerConfig, error) {
+	// Get the record retention from environment variable
+	retentionDays := defaultRetentionDays
+	if retentionDaysStr := os.Getenv("RETENTION_DAYS"); retentionDaysStr != "" {
+		val, err := strconv.Atoi(retentionDaysStr)
+		if err != nil || val <= 0 {
+			return reconcilerConfig{}, fmt.Errorf("invalid RETENTION_DAYS value %q", retentionDaysStr)
+		}
+		retentionDays = val
+	}
+
+	// Only the log file types the detector records are reconciled
+	logTypes, err := aurora.ParseLogTypes(os.Getenv("LOG_TYPES"))
+	if err != nil {
+		return reconcilerConfig{}, fmt.Errorf("invalid LOG_TYPES value %q: %w", os.Getenv("LOG_TYPES"), err)
+	}
+
+	// Log files the detector holds back until they reach a minimum size and age aren't missing
+	thresholds, err := aurora.ParseThresholds(os.Getenv("MIN_FILE_SIZE_BYTES"), os.Getenv("MIN_FILE_AGE_SECONDS"))
+	if err != nil {
+		return reconcilerConfig{}, err
+	}
+
+	// The instances the DB Scanner excludes are never backed up, so their log files aren't missing either
+	excludePattern, err := aurora.ParseExcludePattern(os.Getenv("EXCLUDE_PATTERN"))
+	if err != nil {
+		return reconcilerConfig{}, err
+	}
+
+	return reconcilerConfig{
+		TableName:      os.Getenv("DYNAMODB_TABLE_NAME"),
+		RetentionDays:  retentionDays,
+		LogTypes:       logTypes,
+		Thresholds:     thresholds,
+		ExcludePattern: excludePattern,
+	}, nil
+}
+
+// NewHandlerDeps creates the AWS clients from the given configuration
+func NewHandlerDeps(cfg aws.Config) HandlerDeps {
+	return HandlerDeps{
+		RDS:      rds.NewFromConfig(rdsConfig(cfg)),
+		DynamoDB: dynamodb.NewFromConfig(cfg),
+	}
+}
+
+// rdsConfig returns the configuration for the RDS client. When ASSUME_ROLE_ARN is set, the RDS client
+// assumes that role to reach instances in another account; the other clients stay in the local account.
+func rdsConfig(cfg aws.Config) aws.Config {
+	roleARN := os.Getenv("ASSUME_ROLE_ARN")
+	if roleARN == "" {
+		return cfg
+	}
+
+	rdsCfg := cfg.Copy()
+	rdsCfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), roleARN))
+	return rdsCfg
+}
+
+// NewHandler returns a Lambda function handler using the given clients
+func NewHandler(deps HandlerDeps) func(ctx context.Context, event Event) (Response, error) {
+	return deps.handle
+}
+
+// Handler is the Lambda function handler.
+// It creates the AWS clients on every invocation; main uses NewHandler to create them once per cold start.
+func Handler(ctx context.Context, event Event) (Response, error) {
+	// Load AWS configuration
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		log.Printf("Error loading AWS config: %v\n", err)
+		return Response{}, err
+	}
+
+	return NewHandler(NewHandlerDeps(cfg))(ctx, event)
+}
+
+// handle creates the missing records of log files on all Aurora MySQL instances
+func (deps HandlerDeps) handle(ctx context.Context, event Event) (Response, error) {
+	// Initialize logger
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	logger.Println("Starting Log File Reconciler Lambda")
+
+	// Fail the invocation when required settings are missing, so it is retried and alarmed on
+	if err := validateConfig(); err != nil {
+		logger.Printf("Error: %v\n", err)
+		return Response{}, err
+	}
+
+	cfg, err := loadReconcilerConfig()
+	if err != nil {
+		logger.Printf("Error: %v\n", err)
+		return Response{}, err
+	}
+
+	// Fail the invocation when the log name patterns can't be compiled
+	if logNamePatternsErr != nil {
+		logger.Printf("Error: invalid LOG_NAME_PATTERNS: %v\n", logNamePatternsErr)
+		return Response{}, logNamePatternsErr
+	}
+
+	now := deps.Now
+	if now == nil {
+		now = time.Now
+	}
+
+	// Get all DB instances
+	instances, err := getDBInstances(ctx, deps.RDS, logger)
+	if err != nil {
+		logger.Printf("Error getting DB instances: %v\n", err)
+		return Response{}, err
+	}
+
+	// Filter for Aurora MySQL instances
+	auroraInstances, excluded := aurora.MySQLInstances(instances, cfg.ExcludePattern)
+	if cfg.ExcludePattern != nil {
+		logger.Printf("Excluded %d Aurora MySQL instances matching EXCLUDE_PATTERN %q\n", excluded, cfg.ExcludePattern)
+	}
+	logger.Printf("Found %d Aurora MySQL instances\n", len(auroraInstances))
+
+	response := Response{InstancesChecked: len(auroraInstances)}
+
+	// Reconcile the members of a DB cluster together, the writer first, so a log file listed by both the writer
+	// and a reader is only recorded for the writer, as the detector does
+	for _, group := range groupByCluster(auroraInstances) {
+		groupCfg := cfg
+		instanceIDs := group.instanceIDs
+		if group.clusterID != "" {
+			members, err := aurora.ClusterMembers(ctx, deps.RDS, group.clusterID)
+			if err != nil {
+				logger.Printf("Error describing DB cluster %s: %v\n", group.clusterID, err)
+				// Continue with other clusters even if one fails
+				response.FailedInstances = append(response.FailedInstances, instanceIDs...)
+				continue
+			}
+			instanceIDs = writerFirst(instanceIDs, members)
+			groupCfg.ClusterID = group.clusterID
+			groupCfg.ClusterLogFiles = make(map[string]bool)
+		}
+
+		for _, dbInstanceID := range instanceIDs {
+			created, err := reconcileDBInstance(ctx, deps.RDS, deps.DynamoDB, groupCfg, dbInstanceID, now(), logger)
+			response.RecordsCreated += created
+			if err != nil {
+				logger.Printf("Error reconciling instance %s: %v\n", dbInstanceID, err)
+				// Continue with other instances even if one fails
+				response.FailedInstances = append(response.FailedInstances, dbInstanceID)
+			}
+		}
+	}
+
+	logger.Printf("Created %d missing records for %d instances\n", response.RecordsCreated, len(auroraInstances))
+	response.Message = "Successfully reconciled log file records"
+	return response, nil
+}
+
+// instanceGroup is a DB cluster and its member instances to reconcile, or a single instance outside a cluster
+type instanceGroup struct {
+	clusterID   string
+	instanceIDs []string
+}
+
+// groupByCluster groups the instances by their DB cluster, in the order the clusters are first listed
+func groupByCluster(instances []rdstypes.DBInstance) []instanceGroup {
+	var groups []instanceGroup
+	clusterGroup := make(map[string]int)
+	for _, instance := range instances {
+		dbInstanceID := aws.ToString(instance.DBInstanceIdentifier)
+		clusterID := aws.ToString(instance.DBClusterIdentifier)
+		if clusterID == "" {
+			groups = append(groups, instanceGroup{instanceIDs: []string{dbInstanceID}})
+			continue
+		}
+		if i, ok := clusterGroup[clusterID]; ok {
+			groups[i].instanceIDs = append(groups[i].instanceIDs, dbInstanceID)
+			continue
+		}
+		clusterGroup[clusterID] = len(groups)
+		groups = append(groups, instanceGroup{clusterID: clusterID, instanceIDs: []string{dbInstanceID}})
+	}
+	return groups
+}
+
+// writerFirst orders the instance IDs as the cluster members, which list the writer first. Instances that
+// aren't members (yet) keep their order after the members.
+func writerFirst(instanceIDs []string, members []string) []string {
+	position := func(dbInstanceID string) int {
+		if i := slices.Index(members, dbInstanceID); i >= 0 {
+			return i
+		}
+		return len(members)
+	}
+
+	ordered := slices.Clone(instanceIDs)
+	slices.SortStableFunc(ordered, func(a, b string) int {
+		return position(a) - position(b)
+	})
+	return ordered
+}
+
+// reconcileDBInstance creates a record for every tracked log file of the instance that has none,
+// and returns the number of records created
+func reconcileDBInstance(ctx context.Context, rdsClient DBInstancesAPI, dynamoClient RecordStoreAPI, cfg reconcilerConfig, dbInstanceID string, now time.Time, logger *log.Logger) (int, error) {
+	logger.Printf("Reconciling DB instance: %s\n", dbInstanceID)
+
+	// Get log files for the DB instance
+	logFiles, err := getDBLogFiles(ctx, rdsClient, dbInstanceID, logger)
+	if err != nil {
+		return 0, fmt.Errorf("getting log files: %w", err)
+	}
+
+	// Get the log files already recorded in DynamoDB
+	recorded, err := getRecordedLogFiles(ctx, dynamoClient, cfg.TableName, dbInstanceID, logger)
+	if err != nil {
+		return 0, fmt.Errorf("querying records: %w", err)
+	}
+
+	created := 0
+	for _, record := range findMissingRecords(logNamePatterns, cfg, dbInstanceID, logFiles, recorded, now) {
+		record.ExpiresAt = expiresAt(record.LastWritten, cfg.RetentionDays)
+
+		logger.Printf("Log file %s of instance %s has no record\n", record.LogFileName, dbInstanceID)
+		err := createLogFileRecord(ctx, dynamoClient, cfg.TableName, record, logger)
+		if isConditionalCheckFailed(err) {
+			// The detector created the record in the meantime
+			continue
+		}
+		if err != nil {
+			return created, err
+		}
+		created++
+	}
+
+	return created, nil
+}
+
+// findMissingRecords returns a record for each log file matching the patterns that isn't recorded yet,
+// skipping the log file types not in cfg.LogTypes, the log files the detector holds back until they
+// reach cfg.Thresholds, and the log files already listed for an earlier member of the cluster
+func findMissingRecords(patterns []aurora.LogNamePattern, cfg reconcilerConfig, dbInstanceID string, logFiles []rdstypes.DescribeDBLogFilesDetails, recorded map[string]bool, now time.Time) []LogFileRecord {
+	var missing []LogFileRecord
+	for _, logFile := range logFiles {
+		logFileName := aws.ToString(logFile.LogFileName)
+		if logFileName == "" {
+			continue
+		}
+
+		logFileType, ok := aurora.ClassifyLogFile(patterns, logFileName)
+		if !ok || !cfg.LogTypes[logFileType] {
+			continue
+		}
+
+		// A log file name already listed for an earlier member of the cluster is only recorded for that member
+		if cfg.ClusterLogFiles != nil {
+			if cfg.ClusterLogFiles[logFileName] {
+				continue
+			}
+			cfg.ClusterLogFiles[logFileName] = true
+		}
+
+		if recorded[logFileName] {
+			continue
+		}
+		if cfg.Thresholds.Below(aws.ToInt64(logFile.Size), aws.ToInt64(logFile.LastWritten), now) {
+			continue
+		}
+
+		missing = append(missing, LogFileRecord{
+			DBInstanceIdentifier: dbInstanceID,
+			LogFileName:          logFileName,
+			LogFileType:          logFileType,
+			Size:                 aws.ToInt64(logFile.Size),
+			LastWritten:          aws.ToInt64(logFile.LastWritten),
+			Status:               StatusPending,
+			ClusterIdentifier:    cfg.ClusterID,
+		})
+	}
+
+	return missing
+}
+
+// getDBInstances gets all DB instances in the current region
+func getDBInstances(ctx context.Context, client DBInstancesAPI, logger *log.Logger) ([]rdstypes.DBInstance, error) {
+	logger.Println("Getting all DB instances")
+
+	var instances []rdstypes.DBInstance
+	var marker *string
+
+	// Use pagination to get all instances
+	for {
+		resp, err := client.DescribeDBInstances(ctx, &rds.DescribeDBInstancesInput{
+			Marker: marker,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		instances = append(instances, resp.DBInstances...)
+
+		// Check if there are more pages
+		if resp.Marker == nil {
+			break
+		}
+		marker = resp.Marker
+	}
+
+	logger.Printf("Found %d DB instances total\n", len(instances))
+	return instances, nil
+}
+
+// getDBLogFiles gets all log files for a DB instance
+func getDBLogFiles(ctx context.Context, client DBInstancesAPI, dbInstanceID string, logger *log.Logger) ([]rdstypes.DescribeDBLogFilesDetails, error) {
+	logger.Printf("Getting log files for DB instance %s\n", dbInstanceID)
+
+	var logFiles []rdstypes.DescribeDBLogFilesDetails
+	var marker *string
+
+	// Use pagination to get all log files
+	for {
+		resp, err := client.DescribeDBLogFiles(ctx, &rds.DescribeDBLogFilesInput{
+			DBInstanceIdentifier: aws.String(dbInstanceID),
+			Marker:               marker,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		logFiles = append(logFiles, resp.DescribeDBLogFiles...)
+
+		// Check if there are more pages
+		if resp.Marker == nil {
+			break
+		}
+		marker = resp.Marker
+	}
+
+	return logFiles, nil
+}
+
+// getRecordedLogFiles gets the names of the log files recorded for a DB instance
+func getRecordedLogFiles(ctx context.Context, client RecordStoreAPI, tableName string, dbInstanceID string, logger *log.Logger) (map[string]bool, error) {
+	logger.Printf("Querying records for DB instance %s\n", dbInstanceID)
+
+	recorded := make(map[string]bool)
+	var exclusiveStartKey map[string]types.AttributeValue
+
+	// Use pagination to get all records
+	for {
+		resp, err := client.Query(ctx, &dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			KeyConditionExpression: aws.String("DBInstanceIdentifier = :dbInstanceID"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":dbInstanceID": &types.AttributeValueMemberS{Value: dbInstanceID},
+			},
+			ProjectionExpression: aws.String("LogFileName"),
+			ConsistentRead:       aws.Bool(true),
+			ExclusiveStartKey:    exclusiveStartKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range resp.Items {
+			if name, ok := item["LogFileName"].(*types.AttributeValueMemberS); ok {
+				recorded[name.Value] = true
+			}
+		}
+
+		// Check if there are more pages
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		exclusiveStartKey = resp.LastEvaluatedKey
+	}
+
+	return recorded, nil
+}
+
+// createLogFileRecord creates a new log file record in DynamoDB.
+// The write is rejected with a ConditionalCheckFailedException if the record already exists.
+func createLogFileRecord(ctx context.Context, client RecordStoreAPI, tableName string, record LogFileRecord, logger *log.Logger) error {
+	logger.Printf("Creating new record for log file %s\n", record.LogFileName)
+
+	item, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(DBInstanceIdentifier)"),
+	})
+
+	return err
+}
+
+// expiresAt returns the TTL for a log file last written at lastWritten (epoch milliseconds),
+// in the epoch seconds DynamoDB expects
+func expiresAt(lastWritten int64, retentionDays int) int64 {
+	return lastWritten/1000 + int64(retentionDays)*24*60*60
+}
+
+// isConditionalCheckFailed reports whether a write was rejected by its condition expression
+func isConditionalCheckFailed(err error) bool {
+	var conditionalCheckFailed *types.ConditionalCheckFailedException
+	return errors.As(err, &conditionalCheckFailed)
+}
+
+func main() {
+	// Fail the cold start instead of every invocation when the configuration is incomplete
+	if err := validateConfig(); err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+
+	// Load AWS configuration once per cold start
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Error loading AWS config: %v\n", err)
+	}
+
+	lambda.Start(NewHandler(NewHandlerDeps(cfg)))
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	rdstypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
+	"github.com/zhang1980s/aurora-audit-log-backup-lab/lambdas/internal/aurora"
+)
+
+var discardLogger = log.New(io.Discard, "", 0)
+
+// fakeRDS returns the configured instances and log files, and fails DescribeDBLogFiles for the configured instances
+type fakeRDS struct {
+	instances []rdstypes.DBInstance
+	logFiles  map[string][]string
+	fail      map[string]bool
+	clusters  map[string][]rdstypes.DBClusterMember
+}
+
+func (f *fakeRDS) DescribeDBClusters(ctx context.Context, params *rds.DescribeDBClustersInput, optFns ...func(*rds.Options)) (*rds.DescribeDBClustersOutput, error) {
+	members, ok := f.clusters[aws.ToString(params.DBClusterIdentifier)]
+	if !ok {
+		return nil, &rdstypes.DBClusterNotFoundFault{}
+	}
+	return &rds.DescribeDBClustersOutput{DBClusters: []rdstypes.DBCluster{{DBClusterMembers: members}}}, nil
+}
+
+func (f *fakeRDS) DescribeDBInstances(ctx context.Context, params *rds.DescribeDBInstancesInput, optFns ...func(*rds.Options)) (*rds.DescribeDBInstancesOutput, error) {
+	return &rds.DescribeDBInstancesOutput{DBInstances: f.instances}, nil
+}
+
+func (f *fakeRDS) DescribeDBLogFiles(ctx context.Context, params *rds.DescribeDBLogFilesInput, optFns ...func(*rds.Options)) (*rds.DescribeDBLogFilesOutput, error) {
+	dbInstanceID := aws.ToString(params.DBInstanceIdentifier)
+	if f.fail[dbInstanceID] {
+		return nil, &rdstypes.DBInstanceNotFoundFault{}
+	}
+
+	resp := &rds.DescribeDBLogFilesOutput{}
+	for _, name := range f.logFiles[dbInstanceID] {
+		resp.DescribeDBLogFiles = append(resp.DescribeDBLogFiles, rdstypes.DescribeDBLogFilesDetails{
+			LogFileName: aws.String(name),
+			Size:        aws.Int64(100),
+			LastWritten: aws.Int64(1000),
+		})
+	}
+	return resp, nil
+}
+
+// fakeRecordStore serves the recorded log file names per instance from Query, one item per page,
+// and records the created log file names. Puts of the names in raced fail their condition.
+type fakeRecordStore struct {
+	recorded map[string][]string
+	raced    map[string]bool
+	created  []string
+}
+
+func (f *fakeRecordStore) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	dbInstanceID := params.ExpressionAttributeValues[":dbInstanceID"].(*types.AttributeValueMemberS).Value
+	names := f.recorded[dbInstanceID]
+
+	start := 0
+	if params.ExclusiveStartKey != nil {
+		last := params.ExclusiveStartKey["LogFileName"].(*types.AttributeValueMemberS).Value
+		for i, name := range names {
+			if name == last {
+				start = i + 1
+			}
+		}
+	}
+	if start >= len(names) {
+		return &dynamodb.QueryOutput{}, nil
+	}
+
+	item := map[string]types.AttributeValue{
+		"LogFileName": &types.AttributeValueMemberS{Value: names[start]},
+	}
+	resp := &dynamodb.QueryOutput{Items: []map[string]types.AttributeValue{item}}
+	if start < len(names)-1 {
+		resp.LastEvaluatedKey = item
+	}
+	return resp, nil
+}
+
+func (f *fakeRecordStore) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	name := params.Item["LogFileName"].(*types.AttributeValueMemberS).Value
+	if f.raced[name] {
+		return nil, &types.ConditionalCheckFailedException{}
+	}
+	f.created = append(f.created, params.Item["DBInstanceIdentifier"].(*types.AttributeValueMemberS).Value+"/"+name)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func auroraInstance(id, engine string) rdstypes.DBInstance {
+	return rdstypes.DBInstance{DBInstanceIdentifier: aws.String(id), Engine: aws.String(engine)}
+}
+
+// clusterInstance returns an Aurora MySQL instance of a DB cluster
+func clusterInstance(id, clusterID string) rdstypes.DBInstance {
+	instance := auroraInstance(id, "aurora-mysql")
+	instance.DBClusterIdentifier = aws.String(clusterID)
+	return instance
+}
+
+// clusterMember returns a member instance of a DB cluster
+func clusterMember(dbInstanceID string, writer bool) rdstypes.DBClusterMember {
+	return rdstypes.DBClusterMember{DBInstanceIdentifier: aws.String(dbInstanceID), IsClusterWriter: aws.Bool(writer)}
+}
+
+func TestFindMissingRecords(t *testing.T) {
+	patterns, err := aurora.ParseLogNamePatterns("")
+	if err != nil {
+		t.Fatalf("ParseLogNamePatterns() error = %v", err)
+	}
+
+	logFiles := []rdstypes.DescribeDBLogFilesDetails{
+		{LogFileName: aws.String("audit/server_audit.log"), Size: aws.Int64(10), LastWritten: aws.Int64(2000)},
+		{LogFileName: aws.String("audit/server_audit.log.1"), Size: aws.Int64(20), LastWritten: aws.Int64(1000)},
+		{LogFileName: aws.String("error/mysql-error.log"), Size: aws.Int64(30), LastWritten: aws.Int64(1000)},
+		{LogFileName: nil},
+	}
+	recorded := map[string]bool{"audit/server_audit.log": true}
+
+	auditRecord := LogFileRecord{
+		DBInstanceIdentifier: "db-1",
+		LogFileName:          "audit/server_audit.log.1",
+		LogFileType:          LogFileTypeAudit,
+		Size:                 20,
+		LastWritten:          1000,
+		Status:               StatusPending,
+	}
+	errorRecord := LogFileRecord{
+		DBInstanceIdentifier: "db-1",
+		LogFileName:          "error/mysql-error.log",
+		LogFileType:          LogFileTypeError,
+		Size:                 30,
+		LastWritten:          1000,
+		Status:               StatusPending,
+	}
+
+	// One minute after the files were last written
+	now := time.UnixMilli(61_000)
+
+	tests := []struct {
+		logTypes   string
+		thresholds aurora.Thresholds
+		want       []LogFileRecord
+	}{
+		{logTypes: "", want: []LogFileRecord{auditRecord}},
+		{logTypes: "audit,error", want: []LogFileRecord{auditRecord, errorRecord}},
+		{logTypes: "error", want: []LogFileRecord{errorRecord}},
+		{logTypes: "audit,error", thresholds: aurora.Thresholds{MinFileSize: 21}, want: []LogFileRecord{errorRecord}},
+		{logTypes: "audit,error", thresholds: aurora.Thresholds{MinFileAge: time.Minute}, want: []LogFileRecord{auditRecord, errorRecord}},
+		{logTypes: "audit,error", thresholds: aurora.Thresholds{MinFileAge: time.Minute + time.Millisecond}},
+	}
+
+	for _, tt := range tests {
+		logTypes, err := aurora.ParseLogTypes(tt.logTypes)
+		if err != nil {
+			t.Fatalf("ParseLogTypes(%q) error = %v", tt.logTypes, err)
+		}
+		cfg := reconcilerConfig{LogTypes: logTypes, Thresholds: tt.thresholds}
+		got := findMissingRecords(patterns, cfg, "db-1", logFiles, recorded, now)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("findMissingRecords() with LOG_TYPES %q and %+v = %+v, want %+v", tt.logTypes, tt.thresholds, got, tt.want)
+		}
+	}
+}
+
+func TestWriterFirst(t *testing.T) {
+	members := []string{"writer-1", "reader-1", "reader-2"}
+	got := writerFirst([]string{"new-1", "reader-2", "writer-1", "new-2", "reader-1"}, members)
+	if want := []string{"writer-1", "reader-1", "reader-2", "new-1", "new-2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("writerFirst() = %v, want %v", got, want)
+	}
+}
+
+func TestGetRecordedLogFilesPaginates(t *testing.T) {
+	store := &fakeRecordStore{recorded: map[string][]string{"db-1": {"a", "b", "c"}}}
+
+	got, err := getRecordedLogFiles(context.Background(), store, "table", "db-1", discardLogger)
+	if err != nil {
+		t.Fatalf("getRecordedLogFiles() error = %v", err)
+	}
+	if want := map[string]bool{"a": true, "b": true, "c": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("getRecordedLogFiles() = %v, want %v", got, want)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		rds         *fakeRDS
+		store       *fakeRecordStore
+		want        Response
+		wantCreated []string
+	}{
+		{
+			name: "creates missing audit records only",
+			rds: &fakeRDS{
+				instances: []rdstypes.DBInstance{auroraInstance("db-1", "aurora-mysql"), auroraInstance("pg-1", "postgres")},
+				logFiles: map[string][]string{
+					"db-1": {"audit/server_audit.log", "audit/server_audit.log.1", "audit/server_audit.log.2", "error/mysql-error.log"},
+					"pg-1": {"audit/server_audit.log"},
+				},
+			},
+			store:       &fakeRecordStore{recorded: map[string][]string{"db-1": {"#CHECKPOINT", "audit/server_audit.log"}}},
+			want:        Response{InstancesChecked: 1, RecordsCreated: 2},
+			wantCreated: []string{"db-1/audit/server_audit.log.1", "db-1/audit/server_audit.log.2"},
+		},
+		{
+			name: "records created concurrently by the detector are skipped",
+			rds: &fakeRDS{
+				instances: []rdstypes.DBInstance{auroraInstance("db-1", "aurora-mysql")},
+				logFiles:  map[string][]string{"db-1": {"audit/server_audit.log", "audit/server_audit.log.1"}},
+			},
+			store:       &fakeRecordStore{raced: map[string]bool{"audit/server_audit.log": true}},
+			want:        Response{InstancesChecked: 1, RecordsCreated: 1},
+			wantCreated: []string{"db-1/audit/server_audit.log.1"},
+		},
+		{
+			name: "excluded instances are skipped",
+			env:  map[string]string{"EXCLUDE_PATTERN": "-clone-"},
+			rds: &fakeRDS{
+				instances: []rdstypes.DBInstance{auroraInstance("db-1", "aurora-mysql"), auroraInstance("db-1-clone-7", "aurora-mysql")},
+				logFiles: map[string][]string{
+					"db-1":         {"audit/server_audit.log"},
+					"db-1-clone-7": {"audit/server_audit.log"},
+				},
+			},
+			store:       &fakeRecordStore{},
+			want:        Response{InstancesChecked: 1, RecordsCreated: 1},
+			wantCreated: []string{"db-1/audit/server_audit.log"},
+		},
+		{
+			name: "log files listed by the writer and a reader are created for the writer only",
+			rds: &fakeRDS{
+				instances: []rdstypes.DBInstance{clusterInstance("reader-1", "cluster-1"), clusterInstance("writer-1", "cluster-1"), auroraInstance("db-3", "aurora-mysql")},
+				logFiles: map[string][]string{
+					"reader-1": {"audit/server_audit.log", "audit/server_audit.log.1"},
+					"writer-1": {"audit/server_audit.log"},
+					"db-3":     {"audit/server_audit.log"},
+				},
+				clusters: map[string][]rdstypes.DBClusterMember{"cluster-1": {clusterMember("reader-1", false), clusterMember("writer-1", true)}},
+			},
+			store:       &fakeRecordStore{},
+			want:        Response{InstancesChecked: 3, RecordsCreated: 3},
+			wantCreated: []string{"db-3/audit/server_audit.log", "reader-1/audit/server_audit.log.1", "writer-1/audit/server_audit.log"},
+		},
+		{
+			name: "log files recorded for the writer aren't created for a reader",
+			rds: &fakeRDS{
+				instances: []rdstypes.DBInstance{clusterInstance("writer-1", "cluster-1"), clusterInstance("reader-1", "cluster-1")},
+				logFiles: map[string][]string{
+					"reader-1": {"audit/server_audit.log"},
+					"writer-1": {"audit/server_audit.log"},
+				},
+				clusters: map[string][]rdstypes.DBClusterMember{"cluster-1": {clusterMember("writer-1", true), clusterMember("reader-1", false)}},
+			},
+			store: &fakeRecordStore{recorded: map[string][]string{"writer-1": {"audit/server_audit.log"}}},
+			want:  Response{InstancesChecked: 2},
+		},
+		{
+			name: "cluster that can't be described fails its members only",
+			rds: &fakeRDS{
+				instances: []rdstypes.DBInstance{clusterInstance("writer-1", "cluster-1"), clusterInstance("reader-1", "cluster-1"), auroraInstance("db-3", "aurora-mysql")},
+				logFiles:  map[string][]string{"db-3": {"audit/server_audit.log"}},
+			},
+			store:       &fakeRecordStore{},
+			want:        Response{InstancesChecked: 3, RecordsCreated: 1, FailedInstances: []string{"writer-1", "reader-1"}},
+			wantCreated: []string{"db-3/audit/server_audit.log"},
+		},
+		{
+			name: "failing instance doesn't stop the others",
+			rds: &fakeRDS{
+				instances: []rdstypes.DBInstance{auroraInstance("db-1", "aurora-mysql"), auroraInstance("db-2", "aurora")},
+				logFiles:  map[string][]string{"db-2": {"audit/server_audit.log"}},
+				fail:      map[string]bool{"db-1": true},
+			},
+			store:       &fakeRecordStore{},
+			want:        Response{InstancesChecked: 2, RecordsCreated: 1, FailedInstances: []string{"db-1"}},
+			wantCreated: []string{"db-2/audit/server_audit.log"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DYNAMODB_TABLE_NAME", "table")
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			got, err := NewHandler(HandlerDeps{RDS: tt.rds, DynamoDB: tt.store})(context.Background(), Event{})
+			if err != nil {
+				t.Fatalf("handler error = %v", err)
+			}
+
+			got.Message = ""
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("response = %+v, want %+v", got, tt.want)
+			}
+
+			sort.Strings(tt.store.created)
+			if !reflect.DeepEqual(tt.store.created, tt.wantCreated) {
+				t.Errorf("created = %v, want %v", tt.store.created, tt.wantCreated)
+			}
+		})
+	}
+}
+
+func TestHandleSkipsFilesBelowThresholds(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		now         time.Time
+		wantCreated []string
+	}{
+		{name: "file at the minimum size is created", env: map[string]string{"MIN_FILE_SIZE_BYTES": "100"}, wantCreated: []string{"db-1/audit/server_audit.log"}},
+		{name: "file below the minimum size is skipped", env: map[string]string{"MIN_FILE_SIZE_BYTES": "101"}},
+		{name: "file at the minimum age is created", env: map[string]string{"MIN_FILE_AGE_SECONDS": "60"}, now: time.UnixMilli(61_000), wantCreated: []string{"db-1/audit/server_audit.log"}},
+		{name: "file below the minimum age is skipped", env: map[string]string{"MIN_FILE_AGE_SECONDS": "60"}, now: time.UnixMilli(60_999)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DYNAMODB_TABLE_NAME", "table")
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			rdsClient := &fakeRDS{
+				instances: []rdstypes.DBInstance{auroraInstance("db-1", "aurora-mysql")},
+				logFiles:  map[string][]string{"db-1": {"audit/server_audit.log"}},
+			}
+			store := &fakeRecordStore{}
+			deps := HandlerDeps{RDS: rdsClient, DynamoDB: store, Now: func() time.Time { return tt.now }}
+			if _, err := NewHandler(deps)(context.Background(), Event{}); err != nil {
+				t.Fatalf("handler error = %v", err)
+			}
+			if !reflect.DeepEqual(store.created, tt.wantCreated) {
+				t.Errorf("created = %v, want %v", store.created, tt.wantCreated)
+			}
+		})
+	}
+}
+
+func TestHandleEnvErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{name: "missing table name fails the invocation", env: map[string]string{"DYNAMODB_TABLE_NAME": ""}, wantErr: true},
+		{name: "invalid retention fails the invocation", env: map[string]string{"DYNAMODB_TABLE_NAME": "table", "RETENTION_DAYS": "0"}, wantErr: true},
+		{name: "invalid log types fail the invocation", env: map[string]string{"DYNAMODB_TABLE_NAME": "table", "LOG_TYPES": "audit,binlog"}, wantErr: true},
+		{name: "invalid minimum file size fails the invocation", env: map[string]string{"DYNAMODB_TABLE_NAME": "table", "MIN_FILE_SIZE_BYTES": "1KB"}, wantErr: true},
+		{name: "invalid exclude pattern fails the invocation", env: map[string]string{"DYNAMODB_TABLE_NAME": "table", "EXCLUDE_PATTERN": "(clone"}, wantErr: true},
+		{name: "invalid minimum file age fails the invocation", env: map[string]string{"DYNAMODB_TABLE_NAME": "table", "MIN_FILE_AGE_SECONDS": "-1"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			rdsClient := &fakeRDS{instances: []rdstypes.DBInstance{auroraInstance("db-1", "aurora-mysql")}}
+			got, err := NewHandler(HandlerDeps{RDS: rdsClient, DynamoDB: &fakeRecordStore{}})(context.Background(), Event{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handler error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got.InstancesChecked != 0 {
+				t.Errorf("InstancesChecked = %d, want 0", got.InstancesChecked)
+			}
+		})
+	}
+}
+
+func TestIsConditionalCheckFailed(t *testing.T) {
+	if !isConditionalCheckFailed(&types.ConditionalCheckFailedException{}) {
+		t.Error("isConditionalCheckFailed(ConditionalCheckFailedException) = false, want true")
+	}
+	if isConditionalCheckFailed(errors.New("other")) {
+		t.Error("isConditionalCheckFailed(other) = true, want false")
+	}
+}
+
+func TestRDSConfigAssumesRole(t *testing.T) {
+	cfg := aws.Config{Region: "us-east-1", Credentials: aws.AnonymousCredentials{}}
+
+	t.Setenv("ASSUME_ROLE_ARN", "")
+	if got := rdsConfig(cfg); got.Credentials != cfg.Credentials {
+		t.Errorf("rdsConfig() credentials = %T, want the local credentials", got.Credentials)
+	}
+
+	t.Setenv("ASSUME_ROLE_ARN", "arn:aws:iam::123456789012:role/audit-log-backup")
+	got := rdsConfig(cfg)
+	cache, ok := got.Credentials.(*aws.CredentialsCache)
+	if !ok || !cache.IsCredentialsProvider(&stscreds.AssumeRoleProvider{}) {
+		t.Errorf("rdsConfig() credentials = %T, want an assume role provider", got.Credentials)
+	}
+	if cfg.Credentials != (aws.AnonymousCredentials{}) {
+		t.Errorf("rdsConfig() changed the local credentials to %T", cfg.Credentials)
+	}
+}